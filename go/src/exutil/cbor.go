@@ -0,0 +1,475 @@
+/**
+ * @brief CBOR (RFC 8949) encoding of JSON data model values
+ *
+ * @file cbor.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package exutil
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+/*
+
+Values are the same as for MessagePack (see msgpack.go). Decoder supports
+definite and indefinite lengths, tags are skipped (tagged value is decoded),
+byte strings are decoded as Base64 strings.
+
+*/
+
+//CBOR major types
+const (
+	cborUint   = 0
+	cborNegint = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+//Write item header
+//@param b output buffer
+//@param major major type
+//@param arg argument (value or length)
+func cborHdr(b *bytes.Buffer, major byte, arg uint64) {
+
+	var tmp [8]byte
+
+	major <<= 5
+
+	switch {
+	case arg < 24:
+		b.WriteByte(major | byte(arg))
+	case arg <= math.MaxUint8:
+		b.WriteByte(major | 24)
+		b.WriteByte(byte(arg))
+	case arg <= math.MaxUint16:
+		b.WriteByte(major | 25)
+		binary.BigEndian.PutUint16(tmp[:], uint16(arg))
+		b.Write(tmp[0:2])
+	case arg <= math.MaxUint32:
+		b.WriteByte(major | 26)
+		binary.BigEndian.PutUint32(tmp[:], uint32(arg))
+		b.Write(tmp[0:4])
+	default:
+		b.WriteByte(major | 27)
+		binary.BigEndian.PutUint64(tmp[:], arg)
+		b.Write(tmp[0:8])
+	}
+}
+
+//Write integer
+//@param b output buffer
+//@param i value
+func cborInt(b *bytes.Buffer, i int64) {
+
+	if i >= 0 {
+		cborHdr(b, cborUint, uint64(i))
+	} else {
+		cborHdr(b, cborNegint, uint64(-1-i))
+	}
+}
+
+//Write float64
+//@param b output buffer
+//@param f value
+func cborFloat(b *bytes.Buffer, f float64) {
+
+	var tmp [8]byte
+
+	b.WriteByte(cborSimple<<5 | 27)
+	binary.BigEndian.PutUint64(tmp[:], math.Float64bits(f))
+	b.Write(tmp[:])
+}
+
+//Write CBOR value
+//@param b output buffer
+//@param v value
+//@return error
+func cborEncode(b *bytes.Buffer, v interface{}) error {
+
+	switch t := v.(type) {
+	case nil:
+		b.WriteByte(0xf6)
+	case bool:
+		if t {
+			b.WriteByte(0xf5)
+		} else {
+			b.WriteByte(0xf4)
+		}
+	case json.Number:
+
+		if i, err := strconv.ParseInt(string(t), 10, 64); nil == err {
+			cborInt(b, i)
+		} else if f, err := strconv.ParseFloat(string(t), 64); nil == err {
+			cborFloat(b, f)
+		} else {
+			return fmt.Errorf("Invalid number [%s]", string(t))
+		}
+	case int64:
+		cborInt(b, t)
+	case int:
+		cborInt(b, int64(t))
+	case float64:
+		cborFloat(b, t)
+	case string:
+		cborHdr(b, cborText, uint64(len(t)))
+		b.WriteString(t)
+	case []interface{}:
+
+		cborHdr(b, cborArray, uint64(len(t)))
+
+		for _, e := range t {
+			if err := cborEncode(b, e); nil != err {
+				return err
+			}
+		}
+	case map[string]interface{}:
+
+		keys := make([]string, 0, len(t))
+
+		for k := range t {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		cborHdr(b, cborMap, uint64(len(t)))
+
+		for _, k := range keys {
+
+			cborHdr(b, cborText, uint64(len(k)))
+			b.WriteString(k)
+
+			if err := cborEncode(b, t[k]); nil != err {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Unsupported type %T", v)
+	}
+
+	return nil
+}
+
+//Encode value to CBOR
+//@param v value (JSON data model)
+//@return CBOR data, error
+func CborMarshal(v interface{}) ([]byte, error) {
+
+	var b bytes.Buffer
+
+	if err := cborEncode(&b, v); nil != err {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+/**
+ * CBOR decoder state
+ */
+type cborDecoder struct {
+	msgpackDecoder
+}
+
+//Marker of indefinite length
+const cborIndefinite = math.MaxUint64
+
+//"break" stop code of indefinite length items
+var errCborBreak = errors.New("Unexpected CBOR break")
+
+//Read item header
+//@return major type, additional info, argument, error
+func (d *cborDecoder) hdr() (byte, byte, uint64, error) {
+
+	c, err := d.uint(1)
+
+	if nil != err {
+		return 0, 0, 0, err
+	}
+
+	major := byte(c >> 5)
+	info := byte(c & 0x1f)
+
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		arg, err := d.uint(1 << (info - 24))
+		return major, info, arg, err
+	case 31 == info:
+		return major, info, cborIndefinite, nil
+	}
+
+	return 0, 0, 0, fmt.Errorf("Invalid CBOR additional info %d", info)
+}
+
+//Decode byte or text string
+//@param major major type
+//@param arg length or indefinite
+//@return string data, error
+func (d *cborDecoder) bytes(major byte, arg uint64) ([]byte, error) {
+
+	if cborIndefinite != arg {
+
+		if arg > uint64(len(d.data)-d.pos) {
+			return nil, errMsgpackShort
+		}
+
+		return d.read(int(arg))
+	}
+
+	//Chunks of definite strings of the same type
+	var ret []byte
+
+	for {
+		m, _, n, err := d.hdr()
+
+		if nil != err {
+			return nil, err
+		}
+
+		if cborSimple == m && cborIndefinite == n {
+			return ret, nil
+		}
+
+		if m != major || cborIndefinite == n {
+			return nil, errors.New("Invalid CBOR string chunk")
+		}
+
+		chunk, err := d.bytes(major, n)
+
+		if nil != err {
+			return nil, err
+		}
+
+		ret = append(ret, chunk...)
+	}
+}
+
+//Decode next value
+//@return value, error
+func (d *cborDecoder) decode() (interface{}, error) {
+
+	major, info, arg, err := d.hdr()
+
+	if nil != err {
+		return nil, err
+	}
+
+	if 31 == info && (major < cborBytes || cborTag == major) {
+		return nil, errors.New("Invalid CBOR indefinite length item")
+	}
+
+	switch major {
+	case cborUint:
+
+		if arg > math.MaxInt64 {
+			return arg, nil
+		}
+
+		return int64(arg), nil
+	case cborNegint:
+
+		if arg > math.MaxInt64 {
+			return nil, errors.New("CBOR negative integer out of range")
+		}
+
+		return -1 - int64(arg), nil
+	case cborBytes:
+
+		b, err := d.bytes(major, arg)
+
+		if nil != err {
+			return nil, err
+		}
+
+		return base64.StdEncoding.EncodeToString(b), nil
+	case cborText:
+
+		b, err := d.bytes(major, arg)
+
+		return string(b), err
+	case cborArray, cborMap, cborTag:
+
+		if err := d.enter(); nil != err {
+			return nil, err
+		}
+
+		defer func() { d.depth-- }()
+
+		if cborTag == major {
+			return d.decode()
+		} else if cborArray == major {
+			return d.array(arg)
+		}
+
+		return d.obj(arg)
+	}
+
+	//Simple values and floats
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 25:
+		return cborHalf(uint16(arg)), nil
+	case 26:
+		return float64(math.Float32frombits(uint32(arg))), nil
+	case 27:
+		return math.Float64frombits(arg), nil
+	case 31:
+		return nil, errCborBreak
+	}
+
+	return nil, fmt.Errorf("Unsupported CBOR simple value %d", arg)
+}
+
+//Decode array
+//@param n number of elements or indefinite
+//@return array, error
+func (d *cborDecoder) array(n uint64) (interface{}, error) {
+
+	ret := []interface{}{}
+
+	for i := uint64(0); cborIndefinite == n || i < n; i++ {
+
+		v, err := d.decode()
+
+		if errCborBreak == err && cborIndefinite == n {
+			break
+		} else if nil != err {
+			return nil, err
+		}
+
+		ret = append(ret, v)
+	}
+
+	return ret, nil
+}
+
+//Decode map
+//@param n number of pairs or indefinite
+//@return map, error
+func (d *cborDecoder) obj(n uint64) (interface{}, error) {
+
+	ret := make(map[string]interface{})
+
+	for i := uint64(0); cborIndefinite == n || i < n; i++ {
+
+		k, err := d.decode()
+
+		if errCborBreak == err && cborIndefinite == n {
+			break
+		} else if nil != err {
+			return nil, err
+		}
+
+		v, err := d.decode()
+
+		if nil != err {
+			return nil, err
+		}
+
+		if s, ok := k.(string); ok {
+			ret[s] = v
+		} else {
+			ret[fmt.Sprintf("%v", k)] = v
+		}
+	}
+
+	return ret, nil
+}
+
+//Convert half precision float
+//@param h IEEE 754 half precision bits
+//@return value
+func cborHalf(h uint16) float64 {
+
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+
+	var val float64
+
+	switch exp {
+	case 0:
+		val = math.Ldexp(mant, -24)
+	case 31:
+		if 0 == mant {
+			val = math.Inf(1)
+		} else {
+			val = math.NaN()
+		}
+	default:
+		val = math.Ldexp(mant+1024, exp-25)
+	}
+
+	if 0 != h&0x8000 {
+		val = -val
+	}
+
+	return val
+}
+
+//Decode CBOR data
+//@param data CBOR data
+//@return value (JSON data model), error
+func CborUnmarshal(data []byte) (interface{}, error) {
+
+	d := cborDecoder{msgpackDecoder: msgpackDecoder{data: data}}
+
+	v, err := d.decode()
+
+	if nil != err {
+		return nil, err
+	}
+
+	if d.pos != len(data) {
+		return nil, errors.New("Extra data after CBOR value")
+	}
+
+	return v, nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,145 @@
+/**
+ * @brief CBOR codec tests
+ *
+ * @file cbor_test.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package exutil
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCborRoundTrip(t *testing.T) {
+
+	for _, js := range append(codecTestMsgs, codecTestLong()) {
+
+		data, err := CborMarshal(codecTestDecode(t, js))
+
+		if nil != err {
+			t.Fatalf("Failed to encode [%.200s]: %s", js, err.Error())
+		}
+
+		v, err := CborUnmarshal(data)
+
+		if nil != err {
+			t.Fatalf("Failed to decode [%.200s]: %s", js, err.Error())
+		}
+
+		codecTestSame(t, js, v)
+	}
+}
+
+func TestCborVectors(t *testing.T) {
+
+	vectors := []struct {
+		data []byte
+		js   string
+	}{
+		//Half float 1.0, byte string, indefinite array and text
+		{[]byte{0xf9, 0x3c, 0x00}, `1`},
+		{[]byte{0x42, 0x01, 0x02}, `"AQI="`},
+		{[]byte{0x9f, 0x01, 0x02, 0xff}, `[1,2]`},
+		{[]byte{0x7f, 0x61, 'a', 0x61, 'b', 0xff}, `"ab"`},
+		{[]byte{0xbf, 0x61, 'k', 0xf6, 0xff}, `{"k":null}`},
+		//Tag is skipped
+		{[]byte{0xc1, 0x1a, 0x00, 0x00, 0x00, 0x01}, `1`},
+	}
+
+	for _, vec := range vectors {
+
+		v, err := CborUnmarshal(vec.data)
+
+		if nil != err {
+			t.Errorf("Failed to decode %x: %s", vec.data, err.Error())
+			continue
+		}
+
+		codecTestSame(t, vec.js, v)
+	}
+}
+
+func TestCborTruncated(t *testing.T) {
+
+	for _, js := range codecTestMsgs {
+
+		data, _ := CborMarshal(codecTestDecode(t, js))
+
+		for i := 0; i < len(data); i++ {
+			if _, err := CborUnmarshal(data[:i]); nil == err {
+				t.Errorf("Truncated [%s] at %d of %d decoded", js, i, len(data))
+			}
+		}
+
+		if _, err := CborUnmarshal(append(data, 0xf6)); nil == err {
+			t.Errorf("Extra data after [%s] accepted", js)
+		}
+	}
+
+	//Lengths over the data, unterminated indefinite items, stray break
+	for _, data := range [][]byte{{0x5a, 0xff, 0xff, 0xff, 0xff},
+		{0x7b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		{0x9f, 0x01}, {0x7f, 0x61, 'a'}, {0xff}, {0x81, 0xff}} {
+
+		if _, err := CborUnmarshal(data); nil == err {
+			t.Errorf("Invalid data %x accepted", data)
+		}
+	}
+}
+
+func TestCborNesting(t *testing.T) {
+
+	deep := append(bytes.Repeat([]byte{0x81}, decodeMaxDepth+1), 0xf6)
+
+	if _, err := CborUnmarshal(deep); nil == err {
+		t.Errorf("Nesting of %d accepted", decodeMaxDepth+1)
+	}
+
+	deep = append(bytes.Repeat([]byte{0x9f}, decodeMaxDepth+1), 0xf6)
+
+	if _, err := CborUnmarshal(deep); nil == err {
+		t.Errorf("Indefinite nesting of %d accepted", decodeMaxDepth+1)
+	}
+
+	deep = append(bytes.Repeat([]byte{0xc1}, decodeMaxDepth+1), 0xf6)
+
+	if _, err := CborUnmarshal(deep); nil == err {
+		t.Errorf("Tag nesting of %d accepted", decodeMaxDepth+1)
+	}
+
+	ok := append(bytes.Repeat([]byte{0x81}, 100), 0xf6)
+
+	if _, err := CborUnmarshal(ok); nil != err {
+		t.Errorf("Nesting of 100 failed: %s", err.Error())
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,486 @@
+/**
+ * @brief JSON key <-> XATMI field name mapping profiles
+ *
+ * @file jsonmap.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package exutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+/*
+
+Mapping profile is JSON file:
+
+{
+	"unknown":"drop",
+	"fields":{
+		"accountId":{"name":"T_ACCT_ID", "type":"string"},
+		"amount":{"name":"T_AMOUNT", "type":"number", "xatmi_type":"string"},
+		"customer.name":{"name":"T_CUST_NAME"}
+	}
+}
+
+- keys are API (JSON) names, dot separated key is path in nested objects, which
+  is flattened to single field on the way in, and unflattened on the way out
+- "type" is coercion of the value sent to the API client, "xatmi_type" is
+  coercion of the value before loading to XATMI buffer
+- "unknown" is policy for keys not in the profile: "pass" (default), "drop"
+  or "reject". Kept fields (error code and message) are always passed in
+  responses
+
+*/
+
+//Unknown key policies
+const (
+	JSONMAP_PASS   = "pass"
+	JSONMAP_DROP   = "drop"
+	JSONMAP_REJECT = "reject"
+)
+
+//Value coercion types
+const (
+	JSONMAP_STRING  = "string"
+	JSONMAP_NUMBER  = "number"
+	JSONMAP_INTEGER = "integer"
+	JSONMAP_BOOLEAN = "boolean"
+)
+
+/**
+ * Profile field
+ */
+type JSONMapField struct {
+	Name      string `json:"name"`       //XATMI field name
+	Type      string `json:"type"`       //Coercion for API side
+	XatmiType string `json:"xatmi_type"` //Coercion for XATMI side
+	path      string //API path
+}
+
+/**
+ * Mapping profile
+ */
+type JSONMapProfile struct {
+	Unknown string                   `json:"unknown"`
+	View    string                   `json:"view"` //Wrap object in VIEW
+	Fields  map[string]*JSONMapField `json:"fields"`
+	File    string                   `json:"-"`
+
+	byName   map[string]*JSONMapField //By XATMI name
+	prefixes map[string]bool          //Nested object paths
+	keep     map[string]bool          //Unknown fields passed in responses
+}
+
+//Load mapping profile from file
+//@param file profile file name
+//@return profile, error
+func JSONMapLoad(file string) (*JSONMapProfile, error) {
+
+	var p JSONMapProfile
+
+	data, err := ioutil.ReadFile(file)
+
+	if nil != err {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, &p); nil != err {
+		return nil, fmt.Errorf("Failed to parse mapping profile [%s]: %s",
+			file, err.Error())
+	}
+
+	p.File = file
+	p.byName = make(map[string]*JSONMapField)
+	p.prefixes = make(map[string]bool)
+	p.keep = make(map[string]bool)
+
+	switch p.Unknown {
+	case "":
+		p.Unknown = JSONMAP_PASS
+	case JSONMAP_PASS, JSONMAP_DROP, JSONMAP_REJECT:
+	default:
+		return nil, fmt.Errorf("Mapping profile [%s]: invalid 'unknown' [%s]",
+			file, p.Unknown)
+	}
+
+	for path, f := range p.Fields {
+
+		if nil == f || "" == f.Name {
+			return nil, fmt.Errorf("Mapping profile [%s]: missing 'name' for [%s]",
+				file, path)
+		}
+
+		for _, t := range []string{f.Type, f.XatmiType} {
+			switch t {
+			case "", JSONMAP_STRING, JSONMAP_NUMBER, JSONMAP_INTEGER, JSONMAP_BOOLEAN:
+			default:
+				return nil, fmt.Errorf("Mapping profile [%s]: invalid type [%s] "+
+					"for [%s]", file, t, path)
+			}
+		}
+
+		if _, ok := p.byName[f.Name]; ok {
+			return nil, fmt.Errorf("Mapping profile [%s]: field [%s] mapped "+
+				"more than once", file, f.Name)
+		}
+
+		f.path = path
+		p.byName[f.Name] = f
+
+		parts := strings.Split(path, ".")
+
+		for i := 1; i < len(parts); i++ {
+			p.prefixes[strings.Join(parts[0:i], ".")] = true
+		}
+	}
+
+	return &p, nil
+}
+
+//XATMI fields passed to API client even if not in profile and unknown keys
+//are dropped or rejected (e.g. error code and message)
+//@param flds XATMI field names
+func (p *JSONMapProfile) Keep(flds ...string) {
+
+	for _, f := range flds {
+		p.keep[f] = true
+	}
+}
+
+//Coerce value to given type
+//@param val decoded JSON value (decoded with UseNumber)
+//@param typ coercion type, empty - keep as is
+//@return converted value, error
+func jsonMapCoerce(val interface{}, typ string) (interface{}, error) {
+
+	if "" == typ || nil == val {
+		return val, nil
+	}
+
+	if arr, ok := val.([]interface{}); ok {
+
+		for i := range arr {
+
+			v, err := jsonMapCoerce(arr[i], typ)
+
+			if nil != err {
+				return nil, err
+			}
+
+			arr[i] = v
+		}
+
+		return arr, nil
+	}
+
+	var str string
+
+	switch v := val.(type) {
+	case json.Number:
+		str = v.String()
+	case string:
+		str = v
+	case bool:
+		if JSONMAP_BOOLEAN == typ {
+			return v, nil
+		} else if v {
+			str = "1"
+		} else {
+			str = "0"
+		}
+	default:
+		return nil, fmt.Errorf("Cannot convert %T to %s", val, typ)
+	}
+
+	switch typ {
+	case JSONMAP_STRING:
+		return str, nil
+	case JSONMAP_NUMBER:
+
+		if _, err := strconv.ParseFloat(str, 64); nil != err {
+			return nil, fmt.Errorf("Value [%s] is not a number", str)
+		}
+
+		return json.Number(str), nil
+	case JSONMAP_INTEGER:
+
+		if _, err := strconv.ParseInt(str, 10, 64); nil == err {
+			return json.Number(str), nil
+		}
+
+		f, err := strconv.ParseFloat(str, 64)
+
+		if nil != err {
+			return nil, fmt.Errorf("Value [%s] is not an integer", str)
+		}
+
+		return json.Number(strconv.FormatInt(int64(f), 10)), nil
+	case JSONMAP_BOOLEAN:
+
+		if b, err := strconv.ParseBool(str); nil == err {
+			return b, nil
+		}
+
+		if f, err := strconv.ParseFloat(str, 64); nil == err {
+			return 0 != f, nil
+		}
+
+		return nil, fmt.Errorf("Value [%s] is not a boolean", str)
+	}
+
+	return val, nil
+}
+
+//Decode JSON object
+//@param js JSON message
+//@return object, error
+func jsonMapDecode(js []byte) (map[string]interface{}, error) {
+
+	var obj map[string]interface{}
+
+	d := json.NewDecoder(bytes.NewReader(js))
+	d.UseNumber()
+
+	if err := d.Decode(&obj); nil != err {
+		return nil, err
+	}
+
+	if nil == obj {
+		return nil, fmt.Errorf("JSON message is not an object")
+	}
+
+	return obj, nil
+}
+
+//Map API object to XATMI names, flatten nested paths
+//@param obj API object (or nested object)
+//@param prefix path of the object
+//@param out output object
+//@return error
+func (p *JSONMapProfile) toXATMI(obj map[string]interface{}, prefix string,
+	out map[string]interface{}) error {
+
+	for k, v := range obj {
+
+		path := prefix + k
+
+		if f, ok := p.Fields[path]; ok {
+
+			val, err := jsonMapCoerce(v, f.XatmiType)
+
+			if nil != err {
+				return fmt.Errorf("Key [%s]: %s", path, err.Error())
+			}
+
+			out[f.Name] = val
+			continue
+		}
+
+		if sub, ok := v.(map[string]interface{}); ok && p.prefixes[path] {
+
+			if err := p.toXATMI(sub, path+".", out); nil != err {
+				return err
+			}
+
+			continue
+		}
+
+		switch p.Unknown {
+		case JSONMAP_REJECT:
+			return fmt.Errorf("Unknown key [%s]", path)
+		case JSONMAP_PASS:
+			//Only top level keys can be passed as is
+			if "" == prefix {
+				out[k] = v
+			}
+		}
+	}
+
+	return nil
+}
+
+//Set value at path, nested objects are created
+//@param out output object
+//@param path dot separated path
+//@param val value to set
+func jsonMapSet(out map[string]interface{}, path string, val interface{}) {
+
+	parts := strings.Split(path, ".")
+
+	for _, p := range parts[0 : len(parts)-1] {
+
+		sub, ok := out[p].(map[string]interface{})
+
+		if !ok {
+			sub = make(map[string]interface{})
+			out[p] = sub
+		}
+
+		out = sub
+	}
+
+	out[parts[len(parts)-1]] = val
+}
+
+//Map XATMI object to API names, unflatten nested paths
+//@param obj XATMI object
+//@return API object, error
+func (p *JSONMapProfile) fromXATMI(obj map[string]interface{}) (map[string]interface{}, error) {
+
+	out := make(map[string]interface{})
+
+	for k, v := range obj {
+
+		if f, ok := p.byName[k]; ok {
+
+			val, err := jsonMapCoerce(v, f.Type)
+
+			if nil != err {
+				return nil, fmt.Errorf("Field [%s]: %s", k, err.Error())
+			}
+
+			jsonMapSet(out, f.path, val)
+			continue
+		}
+
+		if p.keep[k] {
+			out[k] = v
+			continue
+		}
+
+		switch p.Unknown {
+		case JSONMAP_REJECT:
+			return nil, fmt.Errorf("Unknown field [%s]", k)
+		case JSONMAP_PASS:
+			if _, ok := out[k]; !ok {
+				out[k] = v
+			}
+		}
+	}
+
+	return out, nil
+}
+
+//Get object of the single key (VIEW name) from JSON message
+//@param obj JSON message
+//@return VIEW name, object, error
+func jsonMapUnwrap(obj map[string]interface{}) (string, map[string]interface{}, error) {
+
+	for k, v := range obj {
+
+		sub, ok := v.(map[string]interface{})
+
+		if !ok || len(obj) != 1 {
+			break
+		}
+
+		return k, sub, nil
+	}
+
+	return "", nil, fmt.Errorf("VIEW object expected")
+}
+
+//Map API message to XATMI field names
+//@param js API JSON message
+//@param view message is VIEW, if profile has no view name, then
+//	content of VIEW object is mapped, otherwise result is wrapped in profile view
+//@return JSON message for XATMI conversion, error
+func (p *JSONMapProfile) ToXATMI(js []byte, view bool) ([]byte, error) {
+
+	var vname string
+
+	obj, err := jsonMapDecode(js)
+
+	if nil != err {
+		return nil, err
+	}
+
+	if view {
+
+		if "" != p.View {
+			vname = p.View
+		} else if vname, obj, err = jsonMapUnwrap(obj); nil != err {
+			return nil, err
+		}
+	}
+
+	out := make(map[string]interface{})
+
+	if err = p.toXATMI(obj, "", out); nil != err {
+		return nil, err
+	}
+
+	if view {
+		return json.Marshal(map[string]interface{}{vname: out})
+	}
+
+	return json.Marshal(out)
+}
+
+//Map XATMI message to API names
+//@param js JSON message of XATMI buffer
+//@param view message is VIEW, if profile has view name, then view object is
+//	unwrapped, otherwise content of VIEW object is mapped
+//@return API JSON message, error
+func (p *JSONMapProfile) FromXATMI(js []byte, view bool) ([]byte, error) {
+
+	var vname string
+
+	obj, err := jsonMapDecode(js)
+
+	if nil != err {
+		return nil, err
+	}
+
+	if view {
+		if vname, obj, err = jsonMapUnwrap(obj); nil != err {
+			return nil, err
+		}
+	}
+
+	out, err := p.fromXATMI(obj)
+
+	if nil != err {
+		return nil, err
+	}
+
+	if view && "" == p.View {
+		return json.Marshal(map[string]interface{}{vname: out})
+	}
+
+	return json.Marshal(out)
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
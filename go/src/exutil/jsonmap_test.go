@@ -0,0 +1,330 @@
+/**
+ * @brief JSON field mapping profile tests
+ *
+ * @file jsonmap_test.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package exutil
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+//Test profile, nested paths and coercions
+const jsonMapTestProfile = `{
+	"fields":{
+		"accountId":{"name":"T_ACCT_ID", "type":"string", "xatmi_type":"string"},
+		"amount":{"name":"T_AMOUNT", "type":"number", "xatmi_type":"string"},
+		"count":{"name":"T_COUNT", "type":"integer"},
+		"active":{"name":"T_ACTIVE", "type":"boolean", "xatmi_type":"integer"},
+		"customer.name":{"name":"T_CUST_NAME"},
+		"customer.address.city":{"name":"T_CITY"},
+		"tags":{"name":"T_TAG", "xatmi_type":"string"}
+	}
+}`
+
+//Load profile from temporary file
+//@param t test
+//@param profile profile JSON
+//@param unknown unknown key policy, empty - not set
+//@return loaded profile
+func jsonMapTestLoad(t *testing.T, profile string, unknown string) *JSONMapProfile {
+
+	if "" != unknown {
+		profile = strings.Replace(profile, "{", `{"unknown":"`+unknown+`",`, 1)
+	}
+
+	f, err := ioutil.TempFile("", "jsonmap")
+
+	if nil != err {
+		t.Fatalf("Failed to create profile file: %s", err.Error())
+	}
+
+	defer os.Remove(f.Name())
+
+	f.WriteString(profile)
+	f.Close()
+
+	p, err := JSONMapLoad(f.Name())
+
+	if nil != err {
+		t.Fatalf("Failed to load profile: %s", err.Error())
+	}
+
+	return p
+}
+
+func TestJSONMapLoadErrors(t *testing.T) {
+
+	tests := []string{
+		`{"unknown":"ignore", "fields":{}}`,
+		`{"fields":{"a":{"type":"string"}}}`,
+		`{"fields":{"a":{"name":"T_A", "type":"float"}}}`,
+		`{"fields":{"a":{"name":"T_A", "xatmi_type":"date"}}}`,
+		`{"fields":{"a":{"name":"T_A"}, "b":{"name":"T_A"}}}`,
+		`{"fields":`,
+	}
+
+	for _, profile := range tests {
+
+		f, err := ioutil.TempFile("", "jsonmap")
+
+		if nil != err {
+			t.Fatalf("Failed to create profile file: %s", err.Error())
+		}
+
+		f.WriteString(profile)
+		f.Close()
+
+		if _, err = JSONMapLoad(f.Name()); nil == err {
+			t.Errorf("Expected error for profile [%s]", profile)
+		}
+
+		os.Remove(f.Name())
+	}
+
+	if _, err := JSONMapLoad("/nonexistent/jsonmap.json"); nil == err {
+		t.Errorf("Expected error for missing profile file")
+	}
+}
+
+func TestJSONMapToXATMI(t *testing.T) {
+
+	p := jsonMapTestLoad(t, jsonMapTestProfile, "")
+
+	tests := []struct {
+		in  string
+		exp string
+	}{
+		//Flat fields with coercion, no xatmi_type - value as is
+		{`{"accountId":12345,"amount":10.5,"count":"7","active":true}`,
+			`{"T_ACCT_ID":"12345","T_ACTIVE":1,"T_AMOUNT":"10.5","T_COUNT":"7"}`},
+		//Nested paths are flattened
+		{`{"customer":{"name":"John","address":{"city":"Riga"}}}`,
+			`{"T_CITY":"Riga","T_CUST_NAME":"John"}`},
+		//Arrays are occurrences, coerced by element
+		{`{"tags":[1,"b",true]}`, `{"T_TAG":["1","b","1"]}`},
+		//Missing fields are not added, null is kept
+		{`{"accountId":null}`, `{"T_ACCT_ID":null}`},
+		{`{}`, `{}`},
+		//Unknown top level keys are passed, unknown nested keys are not
+		{`{"other":1,"customer":{"name":"A","phone":"123"}}`,
+			`{"T_CUST_NAME":"A","other":1}`},
+	}
+
+	for _, tc := range tests {
+
+		out, err := p.ToXATMI([]byte(tc.in), false)
+
+		if nil != err {
+			t.Errorf("ToXATMI [%s] failed: %s", tc.in, err.Error())
+		} else if tc.exp != string(out) {
+			t.Errorf("ToXATMI [%s]: got [%s], expected [%s]", tc.in, out, tc.exp)
+		}
+	}
+}
+
+func TestJSONMapFromXATMI(t *testing.T) {
+
+	p := jsonMapTestLoad(t, jsonMapTestProfile, "")
+
+	tests := []struct {
+		in  string
+		exp string
+	}{
+		{`{"T_ACCT_ID":12345,"T_AMOUNT":"10.50","T_COUNT":"7.9","T_ACTIVE":"0"}`,
+			`{"accountId":"12345","active":false,"amount":10.50,"count":7}`},
+		//Nested paths are unflattened
+		{`{"T_CUST_NAME":"John","T_CITY":"Riga"}`,
+			`{"customer":{"address":{"city":"Riga"},"name":"John"}}`},
+		{`{"T_TAG":["a","b"]}`, `{"tags":["a","b"]}`},
+		{`{"T_COUNT":[1.5,"2"]}`, `{"count":[1,2]}`},
+		//Missing fields are not added
+		{`{}`, `{}`},
+		{`{"error_code":0,"T_OTHER":"x"}`, `{"T_OTHER":"x","error_code":0}`},
+	}
+
+	for _, tc := range tests {
+
+		out, err := p.FromXATMI([]byte(tc.in), false)
+
+		if nil != err {
+			t.Errorf("FromXATMI [%s] failed: %s", tc.in, err.Error())
+		} else if tc.exp != string(out) {
+			t.Errorf("FromXATMI [%s]: got [%s], expected [%s]", tc.in, out, tc.exp)
+		}
+	}
+}
+
+//Mapping there and back gives the original message
+func TestJSONMapRoundTrip(t *testing.T) {
+
+	p := jsonMapTestLoad(t, jsonMapTestProfile, JSONMAP_REJECT)
+
+	in := `{"accountId":"A1","active":true,"amount":1.25,"count":3,` +
+		`"customer":{"address":{"city":"Riga"},"name":"John"},"tags":["x","y"]}`
+
+	xatmi, err := p.ToXATMI([]byte(in), false)
+
+	if nil != err {
+		t.Fatalf("ToXATMI failed: %s", err.Error())
+	}
+
+	out, err := p.FromXATMI(xatmi, false)
+
+	if nil != err {
+		t.Fatalf("FromXATMI failed: %s", err.Error())
+	}
+
+	if in != string(out) {
+		t.Errorf("Round trip: got [%s], expected [%s]", out, in)
+	}
+}
+
+func TestJSONMapUnknown(t *testing.T) {
+
+	drop := jsonMapTestLoad(t, jsonMapTestProfile, JSONMAP_DROP)
+	drop.Keep("error_code", "error_message")
+
+	out, err := drop.ToXATMI([]byte(`{"accountId":"A","other":1}`), false)
+
+	if nil != err || `{"T_ACCT_ID":"A"}` != string(out) {
+		t.Errorf("drop ToXATMI: got [%s] err %v", out, err)
+	}
+
+	out, err = drop.FromXATMI([]byte(`{"T_ACCT_ID":"A","T_OTHER":1,`+
+		`"error_code":0,"error_message":"SUCCEED"}`), false)
+
+	if nil != err || `{"accountId":"A","error_code":0,"error_message":"SUCCEED"}` !=
+		string(out) {
+		t.Errorf("drop FromXATMI: got [%s] err %v", out, err)
+	}
+
+	reject := jsonMapTestLoad(t, jsonMapTestProfile, JSONMAP_REJECT)
+	reject.Keep("error_code")
+
+	if _, err = reject.ToXATMI([]byte(`{"other":1}`), false); nil == err {
+		t.Errorf("reject ToXATMI: expected error for unknown key")
+	}
+
+	if _, err = reject.ToXATMI([]byte(`{"customer":{"phone":"1"}}`), false); nil == err {
+		t.Errorf("reject ToXATMI: expected error for unknown nested key")
+	}
+
+	if _, err = reject.FromXATMI([]byte(`{"T_OTHER":1}`), false); nil == err {
+		t.Errorf("reject FromXATMI: expected error for unknown field")
+	}
+
+	if out, err = reject.FromXATMI([]byte(`{"error_code":0}`), false); nil != err ||
+		`{"error_code":0}` != string(out) {
+		t.Errorf("reject FromXATMI: kept field got [%s] err %v", out, err)
+	}
+}
+
+func TestJSONMapCoerceErrors(t *testing.T) {
+
+	p := jsonMapTestLoad(t, jsonMapTestProfile, "")
+
+	for _, in := range []string{`{"accountId":{"a":1}}`, `{"active":"maybe"}`,
+		`{"active":[1,"x"]}`, `{"tags":[1,{}]}`, `[1]`, `not json`} {
+
+		if out, err := p.ToXATMI([]byte(in), false); nil == err {
+			t.Errorf("ToXATMI [%s]: expected error, got [%s]", in, out)
+		}
+	}
+
+	for _, in := range []string{`{"T_COUNT":"x"}`, `{"T_AMOUNT":"1,5"}`} {
+
+		if out, err := p.FromXATMI([]byte(in), false); nil == err {
+			t.Errorf("FromXATMI [%s]: expected error, got [%s]", in, out)
+		}
+	}
+}
+
+func TestJSONMapView(t *testing.T) {
+
+	p := jsonMapTestLoad(t, jsonMapTestProfile, "")
+
+	//VIEW name comes from message
+	out, err := p.ToXATMI([]byte(`{"V1":{"accountId":"A","customer":{"name":"B"}}}`), true)
+
+	if nil != err || `{"V1":{"T_ACCT_ID":"A","T_CUST_NAME":"B"}}` != string(out) {
+		t.Errorf("ToXATMI view: got [%s] err %v", out, err)
+	}
+
+	out, err = p.FromXATMI([]byte(`{"V1":{"T_ACCT_ID":"A","T_CUST_NAME":"B"}}`), true)
+
+	if nil != err || `{"V1":{"accountId":"A","customer":{"name":"B"}}}` != string(out) {
+		t.Errorf("FromXATMI view: got [%s] err %v", out, err)
+	}
+
+	for _, in := range []string{`{"accountId":"A"}`, `{"V1":{},"V2":{}}`} {
+		if _, err = p.ToXATMI([]byte(in), true); nil == err {
+			t.Errorf("ToXATMI view [%s]: expected error", in)
+		}
+	}
+
+	//VIEW name from profile, API message is not wrapped
+	p.View = "V2"
+
+	out, err = p.ToXATMI([]byte(`{"accountId":"A"}`), true)
+
+	if nil != err || `{"V2":{"T_ACCT_ID":"A"}}` != string(out) {
+		t.Errorf("ToXATMI profile view: got [%s] err %v", out, err)
+	}
+
+	out, err = p.FromXATMI([]byte(`{"V2":{"T_ACCT_ID":"A"}}`), true)
+
+	if nil != err || `{"accountId":"A"}` != string(out) {
+		t.Errorf("FromXATMI profile view: got [%s] err %v", out, err)
+	}
+}
+
+func TestJSONMapSet(t *testing.T) {
+
+	out := map[string]interface{}{"a": "scalar"}
+
+	jsonMapSet(out, "b.c.d", 1)
+	jsonMapSet(out, "b.c.e", 2)
+	jsonMapSet(out, "b.f", 3)
+	//Scalar on the path is replaced by object
+	jsonMapSet(out, "a.x", 4)
+
+	js, _ := json.Marshal(out)
+
+	if exp := `{"a":{"x":4},"b":{"c":{"d":1,"e":2},"f":3}}`; exp != string(js) {
+		t.Errorf("jsonMapSet: got [%s], expected [%s]", js, exp)
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
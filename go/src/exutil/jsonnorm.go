@@ -0,0 +1,250 @@
+/**
+ * @brief Array/scalar normalization of UBF JSON messages
+ *
+ * @file jsonnorm.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package exutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+/*
+
+Enduro/X UBF to JSON conversion gives single occurrence as scalar and several
+occurrences as array. Normalization fixes the form of the fields:
+
+- array fields are always sent as arrays
+- scalar fields are always sent as scalars (occurrence 0)
+- empty/zero values can be omitted from responses (except kept fields, such
+  as error code and message)
+- declared fields absent in message are sent as null
+
+Field lists are comma separated UBF field names, "*" means all fields.
+
+*/
+
+/**
+ * Normalization settings
+ */
+type JSONNorm struct {
+	allArrays  bool
+	allScalars bool
+	arrays     map[string]bool
+	scalars    map[string]bool
+	omitEmpty  bool
+	keep       map[string]bool
+	nulls      []string
+}
+
+//Parse comma separated field list
+//@param list field list
+//@return all fields flag, field set
+func jsonNormList(list string) (bool, map[string]bool) {
+
+	ret := make(map[string]bool)
+
+	for _, f := range strings.Split(list, ",") {
+
+		f = strings.TrimSpace(f)
+
+		if "*" == f {
+			return true, ret
+		} else if "" != f {
+			ret[f] = true
+		}
+	}
+
+	return false, ret
+}
+
+//Create normalization settings
+//@param arrays fields always sent as arrays
+//@param scalars fields always sent as scalars
+//@param omitEmpty omit empty or zero values
+//@param nulls fields sent as null if absent
+//@return settings (nil if nothing to do), error
+func NewJSONNorm(arrays string, scalars string, omitEmpty bool,
+	nulls string) (*JSONNorm, error) {
+
+	var n JSONNorm
+
+	n.allArrays, n.arrays = jsonNormList(arrays)
+	n.allScalars, n.scalars = jsonNormList(scalars)
+	n.omitEmpty = omitEmpty
+	n.keep = make(map[string]bool)
+
+	_, nullset := jsonNormList(nulls)
+
+	for f := range nullset {
+		n.nulls = append(n.nulls, f)
+	}
+
+	if n.allArrays && n.allScalars {
+		return nil, fmt.Errorf("All fields cannot be both arrays and scalars")
+	}
+
+	for f := range n.arrays {
+		if n.scalars[f] {
+			return nil, fmt.Errorf("Field [%s] cannot be both array and scalar", f)
+		}
+	}
+
+	if !n.allArrays && !n.allScalars && 0 == len(n.arrays) &&
+		0 == len(n.scalars) && !n.omitEmpty && 0 == len(n.nulls) {
+		return nil, nil
+	}
+
+	return &n, nil
+}
+
+//Fields which are never omitted as empty (e.g. error code and message)
+//@param flds field names
+func (n *JSONNorm) Keep(flds ...string) {
+
+	for _, f := range flds {
+		n.keep[f] = true
+	}
+}
+
+//Check the form of the field
+//@param fld field name
+//@return true if field is always array
+func (n *JSONNorm) isArray(fld string) bool {
+	return n.arrays[fld] || (n.allArrays && !n.scalars[fld])
+}
+
+//Check the form of the field
+//@param fld field name
+//@return true if field is always scalar
+func (n *JSONNorm) isScalar(fld string) bool {
+	return n.scalars[fld] || (n.allScalars && !n.arrays[fld])
+}
+
+//Check if value is empty or zero
+//@param val decoded JSON value
+//@return true if empty
+func jsonNormEmpty(val interface{}) bool {
+
+	switch v := val.(type) {
+	case nil:
+		return true
+	case string:
+		return "" == v
+	case bool:
+		return !v
+	case json.Number:
+		f, err := v.Float64()
+		return nil == err && 0 == f
+	case []interface{}:
+		return 0 == len(v)
+	case map[string]interface{}:
+		return 0 == len(v)
+	}
+
+	return false
+}
+
+//Normalize message received from API client for loading to UBF
+//Nulls are removed, scalar fields given as arrays use first element. Empty
+//values are passed as is, omitempty applies to responses only
+//@param js JSON message
+//@return normalized message, error
+func (n *JSONNorm) ToXATMI(js []byte) ([]byte, error) {
+
+	obj, err := jsonMapDecode(js)
+
+	if nil != err {
+		return nil, err
+	}
+
+	for k, v := range obj {
+
+		if arr, ok := v.([]interface{}); ok && n.isScalar(k) {
+			if len(arr) > 0 {
+				v = arr[0]
+			} else {
+				v = nil
+			}
+
+			obj[k] = v
+		}
+
+		if nil == v {
+			delete(obj, k)
+		}
+	}
+
+	return json.Marshal(obj)
+}
+
+//Normalize JSON message of UBF buffer for sending to API client
+//@param js JSON message
+//@return normalized message, error
+func (n *JSONNorm) FromXATMI(js []byte) ([]byte, error) {
+
+	obj, err := jsonMapDecode(js)
+
+	if nil != err {
+		return nil, err
+	}
+
+	for k, v := range obj {
+
+		if n.omitEmpty && !n.keep[k] && jsonNormEmpty(v) {
+			delete(obj, k)
+			continue
+		}
+
+		arr, isarr := v.([]interface{})
+
+		if isarr && n.isScalar(k) {
+			if len(arr) > 0 {
+				obj[k] = arr[0]
+			} else {
+				obj[k] = nil
+			}
+		} else if !isarr && n.isArray(k) {
+			obj[k] = []interface{}{v}
+		}
+	}
+
+	for _, f := range n.nulls {
+		if _, ok := obj[f]; !ok {
+			obj[f] = nil
+		}
+	}
+
+	return json.Marshal(obj)
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,216 @@
+/**
+ * @brief JSON normalization tests
+ *
+ * @file jsonnorm_test.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package exutil
+
+import (
+	"testing"
+)
+
+func TestJSONNormNew(t *testing.T) {
+
+	if n, err := NewJSONNorm("", " , ", false, ""); nil != n || nil != err {
+		t.Errorf("Expected no normalization, got %v err %v", n, err)
+	}
+
+	for _, tc := range [][2]string{{"*", "*"}, {"A,B", "C, B"}} {
+		if _, err := NewJSONNorm(tc[0], tc[1], false, ""); nil == err {
+			t.Errorf("Expected error for arrays [%s] scalars [%s]", tc[0], tc[1])
+		}
+	}
+
+	for _, tc := range [][2]string{{"*", "B"}, {"A", "*"}, {"A", ""}} {
+		if n, err := NewJSONNorm(tc[0], tc[1], false, ""); nil == n || nil != err {
+			t.Errorf("arrays [%s] scalars [%s]: got %v err %v", tc[0], tc[1], n, err)
+		}
+	}
+}
+
+func TestJSONNormEmpty(t *testing.T) {
+
+	tests := []struct {
+		js    string
+		empty bool
+	}{
+		{`null`, true},
+		{`""`, true},
+		{`false`, true},
+		{`0`, true},
+		{`0.0`, true},
+		{`-0e3`, true},
+		{`[]`, true},
+		{`{}`, true},
+		{`" "`, false},
+		{`"0"`, false},
+		{`true`, false},
+		{`0.001`, false},
+		{`-1`, false},
+		{`[0]`, false},
+		{`{"a":null}`, false},
+	}
+
+	for _, tc := range tests {
+		if got := jsonNormEmpty(codecTestDecode(t, tc.js)); got != tc.empty {
+			t.Errorf("jsonNormEmpty(%s): got %t, expected %t", tc.js, got, tc.empty)
+		}
+	}
+}
+
+func TestJSONNormFromXATMI(t *testing.T) {
+
+	tests := []struct {
+		arrays    string
+		scalars   string
+		omitEmpty bool
+		nulls     string
+		in        string
+		exp       string
+	}{
+		//Single occurrence as array
+		{"A", "", false, "", `{"A":1,"B":2}`, `{"A":[1],"B":2}`},
+		{"*", "B", false, "", `{"A":"x","B":[1,2],"C":true}`,
+			`{"A":["x"],"B":1,"C":[true]}`},
+		//Occurrences as scalar
+		{"", "A", false, "", `{"A":[1,2],"B":[3,4]}`, `{"A":1,"B":[3,4]}`},
+		{"", "*", false, "", `{"A":[],"B":["s"],"C":null}`,
+			`{"A":null,"B":"s","C":null}`},
+		{"B", "*", false, "", `{"A":[1.5,2],"B":false}`, `{"A":1.5,"B":[false]}`},
+		//Number, bool and null values are kept as is
+		{"A", "", false, "", `{"A":null,"B":1e3,"C":-0.5}`,
+			`{"A":[null],"B":1e3,"C":-0.5}`},
+		//Empty values are omitted, except kept fields
+		{"", "", true, "", `{"A":"","B":0,"C":false,"D":null,"E":[],` +
+			`"F":"x","error_code":0,"error_message":""}`,
+			`{"F":"x","error_code":0,"error_message":""}`},
+		{"A", "B", true, "", `{"A":0,"B":[0,1],"C":[0]}`, `{"B":0,"C":[0]}`},
+		//Absent fields as null
+		{"", "", false, "A, B", `{"B":1}`, `{"A":null,"B":1}`},
+		{"", "", true, "A", `{"A":""}`, `{"A":null}`},
+	}
+
+	for _, tc := range tests {
+
+		n, err := NewJSONNorm(tc.arrays, tc.scalars, tc.omitEmpty, tc.nulls)
+
+		if nil != err {
+			t.Fatalf("NewJSONNorm failed: %s", err.Error())
+		}
+
+		n.Keep("error_code", "error_message")
+
+		out, err := n.FromXATMI([]byte(tc.in))
+
+		if nil != err {
+			t.Errorf("FromXATMI [%s] failed: %s", tc.in, err.Error())
+		} else if tc.exp != string(out) {
+			t.Errorf("FromXATMI [%s] arrays [%s] scalars [%s]: got [%s], expected [%s]",
+				tc.in, tc.arrays, tc.scalars, out, tc.exp)
+		}
+	}
+}
+
+func TestJSONNormToXATMI(t *testing.T) {
+
+	tests := []struct {
+		arrays  string
+		scalars string
+		in      string
+		exp     string
+	}{
+		//Nulls are removed
+		{"A", "", `{"A":null,"B":null,"C":1}`, `{"C":1}`},
+		//Scalar fields given as arrays use first element
+		{"", "A,B,C", `{"A":[1,2],"B":[],"C":[null,1],"D":[3,4]}`, `{"A":1,"D":[3,4]}`},
+		{"", "*", `{"A":[true],"B":["x","y"]}`, `{"A":true,"B":"x"}`},
+		{"", "A", `{"A":["1"]}`, `{"A":"1"}`},
+		//Arrays and empty values are passed as is
+		{"*", "", `{"A":1,"B":"","C":0,"D":false,"E":[]}`,
+			`{"A":1,"B":"","C":0,"D":false,"E":[]}`},
+	}
+
+	for _, tc := range tests {
+
+		n, err := NewJSONNorm(tc.arrays, tc.scalars, true, "")
+
+		if nil != err {
+			t.Fatalf("NewJSONNorm failed: %s", err.Error())
+		}
+
+		out, err := n.ToXATMI([]byte(tc.in))
+
+		if nil != err {
+			t.Errorf("ToXATMI [%s] failed: %s", tc.in, err.Error())
+		} else if tc.exp != string(out) {
+			t.Errorf("ToXATMI [%s]: got [%s], expected [%s]", tc.in, out, tc.exp)
+		}
+	}
+}
+
+func TestJSONNormInvalid(t *testing.T) {
+
+	n, _ := NewJSONNorm("*", "", false, "")
+
+	for _, in := range []string{`[1]`, `null`, `"s"`, `{"A":`} {
+
+		if _, err := n.ToXATMI([]byte(in)); nil == err {
+			t.Errorf("ToXATMI [%s]: expected error", in)
+		}
+
+		if _, err := n.FromXATMI([]byte(in)); nil == err {
+			t.Errorf("FromXATMI [%s]: expected error", in)
+		}
+	}
+}
+
+//Normalized response is stable, normalizing again changes nothing
+func TestJSONNormIdempotent(t *testing.T) {
+
+	n, _ := NewJSONNorm("A", "B", false, "C")
+
+	out, err := n.FromXATMI([]byte(`{"A":1,"B":[2,3]}`))
+
+	if nil != err {
+		t.Fatalf("FromXATMI failed: %s", err.Error())
+	}
+
+	again, err := n.FromXATMI(out)
+
+	if nil != err {
+		t.Fatalf("FromXATMI failed: %s", err.Error())
+	}
+
+	if string(out) != string(again) {
+		t.Errorf("Not stable: [%s] vs [%s]", out, again)
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
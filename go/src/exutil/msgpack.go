@@ -0,0 +1,491 @@
+/**
+ * @brief MessagePack encoding of JSON data model values
+ *
+ * @file msgpack.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package exutil
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+/*
+
+Values are in the form produced by encoding/json decoding (with UseNumber):
+nil, bool, string, json.Number, float64, []interface{} and
+map[string]interface{}. Decoded values are suitable for json.Marshal(), binary
+data is decoded as Base64 string (as used for BFLD_CARRAY in JSON).
+
+*/
+
+//Write MessagePack value
+//@param b output buffer
+//@param v value
+//@return error
+func msgpackEncode(b *bytes.Buffer, v interface{}) error {
+
+	switch t := v.(type) {
+	case nil:
+		b.WriteByte(0xc0)
+	case bool:
+		if t {
+			b.WriteByte(0xc3)
+		} else {
+			b.WriteByte(0xc2)
+		}
+	case json.Number:
+
+		if i, err := strconv.ParseInt(string(t), 10, 64); nil == err {
+			msgpackInt(b, i)
+		} else if f, err := strconv.ParseFloat(string(t), 64); nil == err {
+			msgpackFloat(b, f)
+		} else {
+			return fmt.Errorf("Invalid number [%s]", string(t))
+		}
+	case int64:
+		msgpackInt(b, t)
+	case int:
+		msgpackInt(b, int64(t))
+	case float64:
+		msgpackFloat(b, t)
+	case string:
+		msgpackHdr(b, len(t), 0xa0, 32, 0xd9)
+		b.WriteString(t)
+	case []interface{}:
+
+		msgpackHdr(b, len(t), 0x90, 16, 0xdc)
+
+		for _, e := range t {
+			if err := msgpackEncode(b, e); nil != err {
+				return err
+			}
+		}
+	case map[string]interface{}:
+
+		keys := make([]string, 0, len(t))
+
+		for k := range t {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		msgpackHdr(b, len(t), 0x80, 16, 0xde)
+
+		for _, k := range keys {
+
+			msgpackHdr(b, len(k), 0xa0, 32, 0xd9)
+			b.WriteString(k)
+
+			if err := msgpackEncode(b, t[k]); nil != err {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Unsupported type %T", v)
+	}
+
+	return nil
+}
+
+//Write length header
+//@param b output buffer
+//@param n length
+//@param fix fix format prefix
+//@param fixmax max length of fix format
+//@param first first of the 8/16/32 bit formats (str8/array16/map16)
+func msgpackHdr(b *bytes.Buffer, n int, fix byte, fixmax int, first byte) {
+
+	var tmp [4]byte
+
+	switch {
+	case n < fixmax:
+		b.WriteByte(fix | byte(n))
+	case 0xd9 == first && n <= math.MaxUint8:
+		//Only strings have 8 bit length
+		b.WriteByte(first)
+		b.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		if 0xd9 == first {
+			first++
+		}
+		b.WriteByte(first)
+		binary.BigEndian.PutUint16(tmp[:], uint16(n))
+		b.Write(tmp[0:2])
+	default:
+		if 0xd9 == first {
+			first++
+		}
+		b.WriteByte(first + 1)
+		binary.BigEndian.PutUint32(tmp[:], uint32(n))
+		b.Write(tmp[0:4])
+	}
+}
+
+//Write integer in shortest form
+//@param b output buffer
+//@param i value
+func msgpackInt(b *bytes.Buffer, i int64) {
+
+	var tmp [8]byte
+
+	switch {
+	case i >= 0 && i <= 127:
+		b.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		b.WriteByte(byte(0xe0 | (i + 32)))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		b.WriteByte(0xd0)
+		b.WriteByte(byte(i))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		b.WriteByte(0xd1)
+		binary.BigEndian.PutUint16(tmp[:], uint16(i))
+		b.Write(tmp[0:2])
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		b.WriteByte(0xd2)
+		binary.BigEndian.PutUint32(tmp[:], uint32(i))
+		b.Write(tmp[0:4])
+	default:
+		b.WriteByte(0xd3)
+		binary.BigEndian.PutUint64(tmp[:], uint64(i))
+		b.Write(tmp[0:8])
+	}
+}
+
+//Write float64
+//@param b output buffer
+//@param f value
+func msgpackFloat(b *bytes.Buffer, f float64) {
+
+	var tmp [8]byte
+
+	b.WriteByte(0xcb)
+	binary.BigEndian.PutUint64(tmp[:], math.Float64bits(f))
+	b.Write(tmp[:])
+}
+
+//Encode value to MessagePack
+//@param v value (JSON data model)
+//@return MessagePack data, error
+func MsgpackMarshal(v interface{}) ([]byte, error) {
+
+	var b bytes.Buffer
+
+	if err := msgpackEncode(&b, v); nil != err {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+/**
+ * MessagePack decoder state
+ */
+type msgpackDecoder struct {
+	data  []byte
+	pos   int
+	depth int //Nesting of arrays/maps
+}
+
+//Max nesting of arrays/maps
+const decodeMaxDepth = 512
+
+var errMsgpackShort = errors.New("Unexpected end of MessagePack data")
+
+//Enter nested array/map
+//@return error if nesting is too deep
+func (d *msgpackDecoder) enter() error {
+
+	if d.depth++; d.depth > decodeMaxDepth {
+		return errors.New("Nesting too deep")
+	}
+
+	return nil
+}
+
+//Read n bytes
+//@param n number of bytes
+//@return data, error
+func (d *msgpackDecoder) read(n int) ([]byte, error) {
+
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, errMsgpackShort
+	}
+
+	ret := d.data[d.pos : d.pos+n]
+	d.pos += n
+
+	return ret, nil
+}
+
+//Read big endian unsigned of n bytes
+//@param n number of bytes (1, 2, 4, 8)
+//@return value, error
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+
+	b, err := d.read(n)
+
+	if nil != err {
+		return 0, err
+	}
+
+	var ret uint64
+
+	for _, c := range b {
+		ret = ret<<8 | uint64(c)
+	}
+
+	return ret, nil
+}
+
+//Decode string of given length
+//@param n length
+//@return string, error
+func (d *msgpackDecoder) str(n int) (string, error) {
+
+	b, err := d.read(n)
+
+	return string(b), err
+}
+
+//Decode array of given length
+//@param n number of elements
+//@return array, error
+func (d *msgpackDecoder) array(n int) (interface{}, error) {
+
+	//Each element takes at least one byte
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+
+	if err := d.enter(); nil != err {
+		return nil, err
+	}
+
+	defer func() { d.depth-- }()
+
+	ret := make([]interface{}, 0, n)
+
+	for i := 0; i < n; i++ {
+
+		v, err := d.decode()
+
+		if nil != err {
+			return nil, err
+		}
+
+		ret = append(ret, v)
+	}
+
+	return ret, nil
+}
+
+//Decode map of given length
+//@param n number of pairs
+//@return map, error
+func (d *msgpackDecoder) obj(n int) (interface{}, error) {
+
+	if err := d.enter(); nil != err {
+		return nil, err
+	}
+
+	defer func() { d.depth-- }()
+
+	ret := make(map[string]interface{})
+
+	for i := 0; i < n; i++ {
+
+		k, err := d.decode()
+
+		if nil != err {
+			return nil, err
+		}
+
+		v, err := d.decode()
+
+		if nil != err {
+			return nil, err
+		}
+
+		if s, ok := k.(string); ok {
+			ret[s] = v
+		} else {
+			ret[fmt.Sprintf("%v", k)] = v
+		}
+	}
+
+	return ret, nil
+}
+
+//Decode next value
+//@return value, error
+func (d *msgpackDecoder) decode() (interface{}, error) {
+
+	c, err := d.uint(1)
+
+	if nil != err {
+		return nil, err
+	}
+
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.obj(int(c & 0x0f))
+	case c&0xf0 == 0x90:
+		return d.array(int(c & 0x0f))
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+
+		n, err := d.uint(1 << (c - 0xc4))
+
+		if nil != err {
+			return nil, err
+		}
+
+		b, err := d.read(int(n))
+
+		if nil != err {
+			return nil, err
+		}
+
+		return base64.StdEncoding.EncodeToString(b), nil
+	case 0xca:
+
+		n, err := d.uint(4)
+
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+
+		n, err := d.uint(8)
+
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+
+		n, err := d.uint(1 << (c - 0xcc))
+
+		if nil == err && n > math.MaxInt64 {
+			return n, nil
+		}
+
+		return int64(n), err
+	case 0xd0:
+
+		n, err := d.uint(1)
+
+		return int64(int8(n)), err
+	case 0xd1:
+
+		n, err := d.uint(2)
+
+		return int64(int16(n)), err
+	case 0xd2:
+
+		n, err := d.uint(4)
+
+		return int64(int32(n)), err
+	case 0xd3:
+
+		n, err := d.uint(8)
+
+		return int64(n), err
+	case 0xd9, 0xda, 0xdb:
+
+		n, err := d.uint(1 << (c - 0xd9))
+
+		if nil != err {
+			return nil, err
+		}
+
+		return d.str(int(n))
+	case 0xdc, 0xdd:
+
+		n, err := d.uint(2 << (c - 0xdc))
+
+		if nil != err {
+			return nil, err
+		}
+
+		return d.array(int(n))
+	case 0xde, 0xdf:
+
+		n, err := d.uint(2 << (c - 0xde))
+
+		if nil != err {
+			return nil, err
+		}
+
+		return d.obj(int(n))
+	}
+
+	return nil, fmt.Errorf("Unsupported MessagePack type 0x%02x", c)
+}
+
+//Decode MessagePack data
+//@param data MessagePack data
+//@return value (JSON data model), error
+func MsgpackUnmarshal(data []byte) (interface{}, error) {
+
+	d := msgpackDecoder{data: data}
+
+	v, err := d.decode()
+
+	if nil != err {
+		return nil, err
+	}
+
+	if d.pos != len(data) {
+		return nil, errors.New("Extra data after MessagePack value")
+	}
+
+	return v, nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
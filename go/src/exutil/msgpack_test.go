@@ -0,0 +1,185 @@
+/**
+ * @brief MessagePack codec tests
+ *
+ * @file msgpack_test.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package exutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+//Test messages in JSON data model
+var codecTestMsgs = []string{
+	`null`,
+	`true`,
+	`{"T_STRING_FLD":"A","T_LONG_FLD":5,"T_DOUBLE_FLD":1.5,"T_BOOL":false}`,
+	`{"neg":[-1,-32,-33,-128,-129,-32768,-32769,-2147483648,-2147483649,-9223372036854775808]}`,
+	`{"pos":[0,127,128,255,256,65535,65536,4294967295,4294967296,9223372036854775807]}`,
+	`{"arr":[[1,[2,[3,{"a":[]}]]],{},"",0.25,-1234.125]}`,
+	`{"nested":{"obj":{"deeper":{"key":"value"}}}}`,
+}
+
+//Build test message with long strings and arrays (all length formats)
+//@return JSON message
+func codecTestLong() string {
+
+	var arr []string
+
+	for i := 0; i < 70000; i++ {
+		arr = append(arr, "1")
+	}
+
+	return `{"s31":"` + strings.Repeat("x", 31) + `","s255":"` +
+		strings.Repeat("y", 255) + `","s70000":"` + strings.Repeat("z", 70000) +
+		`","a15":[` + strings.Join(arr[:15], ",") + `],"a16":[` +
+		strings.Join(arr[:16], ",") + `],"a70000":[` + strings.Join(arr, ",") + `]}`
+}
+
+//Decode JSON as the bridge does
+//@param t test
+//@param js JSON message
+//@return value
+func codecTestDecode(t *testing.T, js string) interface{} {
+
+	var v interface{}
+
+	d := json.NewDecoder(bytes.NewReader([]byte(js)))
+	d.UseNumber()
+
+	if err := d.Decode(&v); nil != err {
+		t.Fatalf("Invalid test JSON [%s]: %s", js, err.Error())
+	}
+
+	return v
+}
+
+//Check that value gives the same JSON as original message
+//@param t test
+//@param js original JSON message
+//@param v decoded value
+func codecTestSame(t *testing.T, js string, v interface{}) {
+
+	exp, _ := json.Marshal(codecTestDecode(t, js))
+	got, err := json.Marshal(v)
+
+	if nil != err {
+		t.Fatalf("Failed to marshal decoded value: %s", err.Error())
+	}
+
+	if !bytes.Equal(exp, got) {
+		t.Errorf("Round trip mismatch, expected [%.200s], got [%.200s]", exp, got)
+	}
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+
+	for _, js := range append(codecTestMsgs, codecTestLong()) {
+
+		data, err := MsgpackMarshal(codecTestDecode(t, js))
+
+		if nil != err {
+			t.Fatalf("Failed to encode [%.200s]: %s", js, err.Error())
+		}
+
+		v, err := MsgpackUnmarshal(data)
+
+		if nil != err {
+			t.Fatalf("Failed to decode [%.200s]: %s", js, err.Error())
+		}
+
+		codecTestSame(t, js, v)
+	}
+}
+
+func TestMsgpackBinary(t *testing.T) {
+
+	v, err := MsgpackUnmarshal([]byte{0x81, 0xa1, 'b', 0xc4, 0x02, 0x01, 0x02})
+
+	if nil != err {
+		t.Fatalf("Failed to decode bin: %s", err.Error())
+	}
+
+	codecTestSame(t, `{"b":"AQI="}`, v)
+}
+
+func TestMsgpackTruncated(t *testing.T) {
+
+	for _, js := range codecTestMsgs {
+
+		data, _ := MsgpackMarshal(codecTestDecode(t, js))
+
+		for i := 0; i < len(data); i++ {
+			if _, err := MsgpackUnmarshal(data[:i]); nil == err {
+				t.Errorf("Truncated [%s] at %d of %d decoded", js, i, len(data))
+			}
+		}
+
+		if _, err := MsgpackUnmarshal(append(data, 0xc0)); nil == err {
+			t.Errorf("Extra data after [%s] accepted", js)
+		}
+	}
+
+	//Lengths over the data
+	for _, data := range [][]byte{{0xdd, 0xff, 0xff, 0xff, 0xff},
+		{0xdf, 0xff, 0xff, 0xff, 0xff}, {0xdb, 0xff, 0xff, 0xff, 0xff},
+		{0xc6, 0xff, 0xff, 0xff, 0xff}} {
+
+		if _, err := MsgpackUnmarshal(data); nil == err {
+			t.Errorf("Invalid length %x accepted", data)
+		}
+	}
+}
+
+func TestMsgpackNesting(t *testing.T) {
+
+	ok := append(bytes.Repeat([]byte{0x91}, decodeMaxDepth), 0xc0)
+
+	if _, err := MsgpackUnmarshal(ok); nil != err {
+		t.Errorf("Nesting of %d failed: %s", decodeMaxDepth, err.Error())
+	}
+
+	deep := append(bytes.Repeat([]byte{0x91}, decodeMaxDepth+1), 0xc0)
+
+	if _, err := MsgpackUnmarshal(deep); nil == err {
+		t.Errorf("Nesting of %d accepted", decodeMaxDepth+1)
+	}
+
+	deep = append(bytes.Repeat([]byte{0x81, 0xa1, 'k'}, decodeMaxDepth+1), 0xc0)
+
+	if _, err := MsgpackUnmarshal(deep); nil == err {
+		t.Errorf("Map nesting of %d accepted", decodeMaxDepth+1)
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
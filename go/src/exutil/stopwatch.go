@@ -49,11 +49,13 @@ func GetEpochMillis() int64 {
 //About incoming & outgoing messages:
 type StopWatch struct {
 	start int64 //Timestamp messag sent
+	nanos int64 //Start timestamp in nanoseconds, for fine measurements
 }
 
 //Reset the stopwatch
 func (s *StopWatch) Reset() {
 	s.start = GetEpochMillis()
+	s.nanos = time.Now().UnixNano()
 }
 
 //Get delta milliseconds
@@ -62,6 +64,12 @@ func (s *StopWatch) GetDeltaMillis() int64 {
 	return GetEpochMillis() - s.start
 }
 
+//Get delta microseconds
+//@return time spent in microseconds
+func (s *StopWatch) GetDeltaMicros() int64 {
+	return (time.Now().UnixNano() - s.nanos) / 1000
+}
+
 //Get delta seconds of the stopwatch
 //@return return seconds spent
 func (s *StopWatch) GetDetlaSec() int64 {
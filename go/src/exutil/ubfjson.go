@@ -0,0 +1,338 @@
+/**
+ * @brief UBF <-> JSON conversion with embedded UBF and VIEW fields
+ *
+ * @file ubfjson.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package exutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+/*
+
+Nested JSON objects are mapped to embedded buffer fields:
+
+- object value of BFLD_UBF field is embedded UBF buffer (converted recursively)
+- object value of BFLD_VIEW field is VIEW in Enduro/X JSON form,
+  i.e. {"VIEW_NAME":{"field":value,...}}
+- array of objects are occurrences of the field
+
+Flat part of the message is converted by Enduro/X JSON<->UBF conversion.
+
+*/
+
+//Check if JSON value is object or array containing objects
+//@param val JSON value
+//@return list of objects (occurrences), true if value is nested
+func jsonObjects(val json.RawMessage) ([]json.RawMessage, bool) {
+
+	val = bytes.TrimSpace(val)
+
+	if len(val) == 0 {
+		return nil, false
+	}
+
+	switch val[0] {
+	case '{':
+		return []json.RawMessage{val}, true
+	case '[':
+		var arr []json.RawMessage
+
+		if err := json.Unmarshal(val, &arr); nil != err {
+			return nil, false
+		}
+
+		for _, v := range arr {
+			if v = bytes.TrimSpace(v); len(v) > 0 && '{' == v[0] {
+				return arr, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+//Load occurrences of embedded field
+//@param ac ATMI context
+//@param bufu UBF buffer
+//@param name field name
+//@param occs occurrences (JSON objects)
+//@return ATMI error
+func ubfSetEmbedded(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, name string,
+	occs []json.RawMessage) atmi.ATMIError {
+
+	fldid, errU := ac.BFldId(name)
+
+	if nil != errU {
+		return atmi.NewCustomATMIError(atmi.TPEINVAL,
+			fmt.Sprintf("Unknown field [%s]: %s", name, errU.Message()))
+	}
+
+	typ := ac.BFldType(fldid)
+
+	for occ, val := range occs {
+
+		if val = bytes.TrimSpace(val); len(val) == 0 || '{' != val[0] {
+			return atmi.NewCustomATMIError(atmi.TPEINVAL,
+				fmt.Sprintf("Field [%s] occ %d: object expected", name, occ))
+		}
+
+		switch typ {
+		case atmi.BFLD_UBF:
+
+			sub, err := ac.NewUBF(atmi.ATMIMsgSizeMax())
+
+			if nil != err {
+				return err
+			}
+
+			if err = JSONToUBF(ac, sub, val); nil != err {
+				ac.TpFree(sub.GetBuf())
+				return err
+			}
+
+			errU = bufu.BChg(fldid, occ, sub)
+			ac.TpFree(sub.GetBuf())
+		case atmi.BFLD_VIEW:
+
+			sub, err := ac.TpJSONToVIEW(string(val))
+
+			if nil != err {
+				return err
+			}
+
+			errU = bufu.BChg(fldid, occ, sub)
+			ac.TpFree(sub.GetBuf())
+		default:
+			return atmi.NewCustomATMIError(atmi.TPEINVAL,
+				fmt.Sprintf("Field [%s] is not UBF or VIEW, but object given",
+					name))
+		}
+
+		if nil != errU {
+			return atmi.NewCustomATMIError(atmi.TPESYSTEM,
+				fmt.Sprintf("Failed to set field [%s] occ %d: %s", name, occ,
+					errU.Message()))
+		}
+	}
+
+	return nil
+}
+
+//Convert JSON message to UBF, nested objects are loaded to
+//embedded UBF/VIEW fields
+//@param ac ATMI context
+//@param bufu UBF buffer to load
+//@param js JSON message
+//@return ATMI error
+func JSONToUBF(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, js []byte) atmi.ATMIError {
+
+	var obj map[string]json.RawMessage
+	var nested []string
+
+	if err := json.Unmarshal(js, &obj); nil != err {
+		//Let Enduro/X report the error
+		return bufu.TpJSONToUBF(string(js))
+	}
+
+	for k, v := range obj {
+		if _, ok := jsonObjects(v); ok {
+			nested = append(nested, k)
+		}
+	}
+
+	if len(nested) == 0 {
+		return bufu.TpJSONToUBF(string(js))
+	}
+
+	sort.Strings(nested)
+
+	embedded := make(map[string][]json.RawMessage)
+
+	for _, k := range nested {
+		embedded[k], _ = jsonObjects(obj[k])
+		delete(obj, k)
+	}
+
+	flat, _ := json.Marshal(obj)
+
+	if err := bufu.TpJSONToUBF(string(flat)); nil != err {
+		return err
+	}
+
+	for _, k := range nested {
+		if err := ubfSetEmbedded(ac, bufu, k, embedded[k]); nil != err {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Convert UBF buffer to JSON, embedded UBF/VIEW fields are returned as
+//nested objects
+//@param ac ATMI context
+//@param bufu UBF buffer
+//@param viewFlags flags for VIEW to JSON conversion of embedded views
+//@return JSON message, ATMI error
+func UBFToJSON(ac *atmi.ATMICtx, bufu *atmi.TypedUBF,
+	viewFlags int64) (string, atmi.ATMIError) {
+
+	var embedded []int
+
+	seen := make(map[int]bool)
+
+	for first := true; ; first = false {
+
+		fldid, _, errU := bufu.BNext(first)
+
+		if nil != errU || fldid <= 0 {
+			break
+		}
+
+		if seen[fldid] {
+			continue
+		}
+
+		if typ := ac.BFldType(fldid); atmi.BFLD_UBF == typ || atmi.BFLD_VIEW == typ {
+			seen[fldid] = true
+			embedded = append(embedded, fldid)
+		}
+	}
+
+	if len(embedded) == 0 {
+		return bufu.TpUBFToJSON()
+	}
+
+	//Convert flat part
+	size, errU := bufu.BSizeof()
+
+	if nil != errU {
+		return "", atmi.NewCustomATMIError(atmi.TPESYSTEM, errU.Message())
+	}
+
+	tmp, err := ac.NewUBF(size)
+
+	if nil != err {
+		return "", err
+	}
+
+	defer ac.TpFree(tmp.GetBuf())
+
+	if errU = ac.BCpy(tmp, bufu); nil != errU {
+		return "", atmi.NewCustomATMIError(atmi.TPESYSTEM, errU.Message())
+	}
+
+	if errU = tmp.BDelete(embedded); nil != errU {
+		return "", atmi.NewCustomATMIError(atmi.TPESYSTEM, errU.Message())
+	}
+
+	flat, err := tmp.TpUBFToJSON()
+
+	if nil != err {
+		return "", err
+	}
+
+	obj := make(map[string]json.RawMessage)
+
+	if jerr := json.Unmarshal([]byte(flat), &obj); nil != jerr {
+		return "", atmi.NewCustomATMIError(atmi.TPESYSTEM, jerr.Error())
+	}
+
+	for _, fldid := range embedded {
+
+		var occs []json.RawMessage
+
+		name, errU := ac.BFname(fldid)
+
+		if nil != errU {
+			return "", atmi.NewCustomATMIError(atmi.TPESYSTEM, errU.Message())
+		}
+
+		cnt, errU := bufu.BOccur(fldid)
+
+		if nil != errU {
+			return "", atmi.NewCustomATMIError(atmi.TPESYSTEM, errU.Message())
+		}
+
+		for occ := 0; occ < cnt; occ++ {
+
+			var js string
+
+			if atmi.BFLD_UBF == ac.BFldType(fldid) {
+
+				sub, errU := bufu.BGetUBF(fldid, occ)
+
+				if nil != errU {
+					return "", atmi.NewCustomATMIError(atmi.TPESYSTEM, errU.Message())
+				}
+
+				if js, err = UBFToJSON(ac, sub, viewFlags); nil != err {
+					return "", err
+				}
+			} else {
+
+				sub, errU := bufu.BGetView(fldid, occ)
+
+				if nil != errU {
+					return "", atmi.NewCustomATMIError(atmi.TPESYSTEM, errU.Message())
+				}
+
+				if js, err = sub.TpVIEWToJSON(viewFlags); nil != err {
+					return "", err
+				}
+			}
+
+			occs = append(occs, json.RawMessage(js))
+		}
+
+		if len(occs) == 1 {
+			obj[name] = occs[0]
+		} else {
+			obj[name], _ = json.Marshal(occs)
+		}
+	}
+
+	ret, jerr := json.Marshal(obj)
+
+	if nil != jerr {
+		return "", atmi.NewCustomATMIError(atmi.TPESYSTEM, jerr.Error())
+	}
+
+	return string(ret), nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
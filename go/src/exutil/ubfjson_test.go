@@ -0,0 +1,180 @@
+/**
+ * @brief Nested JSON <-> UBF conversion tests
+ *
+ * @file ubfjson_test.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package exutil
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+func TestJSONObjects(t *testing.T) {
+
+	tests := []struct {
+		js     string
+		nested bool
+		occs   int
+	}{
+		{`{"a":1}`, true, 1},
+		{` {} `, true, 1},
+		{`[{"a":1},{"b":2}]`, true, 2},
+		{`[1, {"a":1}]`, true, 2},
+		{`[ {"a":1}]`, true, 1},
+		{`[1,2]`, false, 0},
+		{`[]`, false, 0},
+		{`["{"]`, false, 0},
+		{`"{}"`, false, 0},
+		{`1`, false, 0},
+		{`null`, false, 0},
+		{`[{"a":1}`, false, 0},
+		{``, false, 0},
+	}
+
+	for _, tc := range tests {
+
+		occs, nested := jsonObjects(json.RawMessage(tc.js))
+
+		if nested != tc.nested || len(occs) != tc.occs {
+			t.Errorf("jsonObjects [%s]: got %t/%d, expected %t/%d",
+				tc.js, nested, len(occs), tc.nested, tc.occs)
+		}
+	}
+}
+
+//ATMI context with test field tables (T_UBF_FLD), otherwise test is skipped
+//@param t test
+//@return ATMI context
+func ubfJSONTestCtx(t *testing.T) *atmi.ATMICtx {
+
+	ac, err := atmi.NewATMICtx()
+
+	if nil != err {
+		t.Skipf("No ATMI context: %s", err.Error())
+	}
+
+	if id, errU := ac.BFldId("T_UBF_FLD"); nil != errU || id <= 0 {
+		ac.FreeATMICtx()
+		t.Skip("Test field tables are not loaded")
+	}
+
+	return ac
+}
+
+//Check that JSON messages are equal
+//@param t test
+//@param exp expected message
+//@param got converted message
+func ubfJSONTestSame(t *testing.T, exp string, got string) {
+
+	var v1, v2 interface{}
+
+	if err := json.Unmarshal([]byte(exp), &v1); nil != err {
+		t.Fatalf("Invalid test JSON [%s]: %s", exp, err.Error())
+	}
+
+	if err := json.Unmarshal([]byte(got), &v2); nil != err ||
+		!reflect.DeepEqual(v1, v2) {
+		t.Errorf("Round trip mismatch, expected [%s], got [%s]", exp, got)
+	}
+}
+
+func TestUBFJSONRoundTrip(t *testing.T) {
+
+	ac := ubfJSONTestCtx(t)
+	defer ac.FreeATMICtx()
+
+	tests := []string{
+		//Flat message
+		`{"T_STRING_FLD":"A","T_LONG_FLD":[1,2]}`,
+		//Escaping
+		`{"T_STRING_FLD":["Say \"hi\" \\ & <ok>","line\n\ttab"]}`,
+		//Embedded buffer, occurrences and deeper nesting
+		`{"T_STRING_FLD":"ORDER1","T_UBF_FLD":{"T_LONG_FLD":2}}`,
+		`{"T_STRING_FLD":"ORDER1","T_UBF_FLD":[{"T_STRING_FLD":"ITEM1","T_LONG_FLD":2},` +
+			`{"T_STRING_FLD":"ITEM2","T_UBF_FLD":{"T_LONG_FLD":[3,4]}}]}`,
+	}
+
+	for _, js := range tests {
+
+		bufu, err := ac.NewUBF(atmi.ATMIMsgSizeMax())
+
+		if nil != err {
+			t.Fatalf("Failed to allocate UBF: %s", err.Message())
+		}
+
+		if err = JSONToUBF(ac, bufu, []byte(js)); nil != err {
+			t.Errorf("JSONToUBF [%s] failed: %s", js, err.Message())
+		} else if out, err := UBFToJSON(ac, bufu, 0); nil != err {
+			t.Errorf("UBFToJSON [%s] failed: %s", js, err.Message())
+		} else {
+			ubfJSONTestSame(t, js, out)
+		}
+
+		ac.TpFree(bufu.GetBuf())
+	}
+}
+
+func TestUBFJSONInvalid(t *testing.T) {
+
+	ac := ubfJSONTestCtx(t)
+	defer ac.FreeATMICtx()
+
+	tests := []string{
+		//Object for non embedded field
+		`{"T_STRING_FLD":{"T_LONG_FLD":1}}`,
+		//Unknown field
+		`{"NO_SUCH_FLD":{"T_LONG_FLD":1}}`,
+		//Mixed occurrences
+		`{"T_UBF_FLD":[{"T_LONG_FLD":1},2]}`,
+		`{"T_UBF_FLD":{"NO_SUCH_FLD":1}}`,
+	}
+
+	for _, js := range tests {
+
+		bufu, err := ac.NewUBF(atmi.ATMIMsgSizeMax())
+
+		if nil != err {
+			t.Fatalf("Failed to allocate UBF: %s", err.Message())
+		}
+
+		if err = JSONToUBF(ac, bufu, []byte(js)); nil == err {
+			t.Errorf("JSONToUBF [%s]: expected error", js)
+		}
+
+		ac.TpFree(bufu.GetBuf())
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
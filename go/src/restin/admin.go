@@ -0,0 +1,584 @@
+/**
+ * @brief Admin HTTP API - routes, workers, statistics and maintenance
+ *
+ * @file admin.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+/*
+
+Admin API is served by separate listener (admin_ip:admin_port), thus it is not
+reachable from the public port. If 'admin_token' is set, requests must carry
+"Authorization: Bearer <token>" header.
+
+- GET  /routes       - effective routes with resolved settings
+- GET  /workers      - worker pool state
+- GET  /stats        - per route counters
+- GET  /maintenance  - routes in maintenance
+- PUT  /maintenance  - toggle route maintenance, {"url":..., "enabled":true|false}
+- POST /reload       - reload the routes
+
+Maintenance is kept by route URL, thus it survives the reload.
+
+*/
+
+const (
+	ADMIN_IP_DEFAULT    = "127.0.0.1"
+	MAINT_BODY_DEFAULT  = "Service temporary unavailable"
+	MAINT_CTYPE_DEFAULT = "text/plain"
+)
+
+//Worker (pooled ATMI context) state
+type WorkerState struct {
+	Nr        int       `json:"nr"`
+	Busy      bool      `json:"busy"`
+	Url       string    `json:"url,omitempty"`
+	Method    string    `json:"method,omitempty"`
+	Since     time.Time `json:"since,omitempty"`
+	ElapsedMs int64     `json:"elapsed_ms,omitempty"`
+}
+
+//Per route counters
+type RouteStats struct {
+	Requests  int64 `json:"requests"`
+	Status2xx int64 `json:"status_2xx"`
+	Status3xx int64 `json:"status_3xx"`
+	Status4xx int64 `json:"status_4xx"`
+	Status5xx int64 `json:"status_5xx"`
+	Maint     int64 `json:"maintenance"` //Rejected by maintenance
+	TimeMs    int64 `json:"time_ms"`     //Total processing time
+	MaxMs     int64 `json:"max_ms"`      //Longest request
+}
+
+//Route maintenance
+type Maint struct {
+	Url        string    `json:"url"`
+	Enabled    bool      `json:"enabled"`
+	Body       string    `json:"body,omitempty"`         //Response body, route setting if empty
+	Ctype      string    `json:"content_type,omitempty"` //Response content type
+	RetryAfter int       `json:"retry_after,omitempty"`  //Retry-After header, sec
+	Since      time.Time `json:"since"`
+}
+
+//Route description
+type AdminRoute struct {
+	Url         string                 `json:"url"`
+	Regexp      bool                   `json:"regexp"`
+	Published   bool                   `json:"published"`
+	Owner       string                 `json:"owner,omitempty"`
+	Expires     *time.Time             `json:"expires,omitempty"`
+	Maintenance bool                   `json:"maintenance"`
+	Settings    map[string]interface{} `json:"settings"`
+}
+
+var m_adminip string = ADMIN_IP_DEFAULT //Admin listener address
+var m_adminport int                     //Admin listener port, 0 - disabled
+var m_admintoken string                 //Bearer token, empty - not required
+
+var m_adminmutex sync.Mutex                //Protects maps and worker states bellow
+var m_workstate []WorkerState              //Pooled context states
+var m_stats = make(map[string]*RouteStats) //Counters by route
+var m_maint = make(map[string]*Maint)      //Maintenance by route
+
+//Response writer keeping the status code
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+//Record and send the status code
+//@param status http status
+func (s *statusWriter) WriteHeader(status int) {
+
+	if 0 == s.status {
+		s.status = status
+	}
+
+	s.ResponseWriter.WriteHeader(status)
+}
+
+//Send the body data
+//@param b data to write
+func (s *statusWriter) Write(b []byte) (int, error) {
+
+	if 0 == s.status {
+		s.status = http.StatusOK
+	}
+
+	return s.ResponseWriter.Write(b)
+}
+
+//Flush the data to the client, if supported
+func (s *statusWriter) Flush() {
+
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+//Status sent
+//@return http status
+func (s *statusWriter) Status() int {
+
+	if 0 == s.status {
+		return http.StatusOK
+	}
+
+	return s.status
+}
+
+//Mark the worker busy
+//@param nr worker number
+//@param url URL served
+//@param method HTTP method
+func workerBusy(nr int, url string, method string) {
+
+	m_adminmutex.Lock()
+
+	if nr < len(m_workstate) {
+		m_workstate[nr] = WorkerState{Nr: nr, Busy: true, Url: url,
+			Method: method, Since: time.Now()}
+	}
+
+	m_adminmutex.Unlock()
+}
+
+//Mark the worker free
+//@param nr worker number
+func workerFree(nr int) {
+
+	m_adminmutex.Lock()
+
+	if nr < len(m_workstate) {
+		m_workstate[nr] = WorkerState{Nr: nr}
+	}
+
+	m_adminmutex.Unlock()
+}
+
+//Count the request of the route
+//@param url route
+//@param status http status returned
+//@param start processing start
+func statsAdd(url string, status int, start time.Time) {
+
+	ms := int64(time.Since(start) / time.Millisecond)
+
+	m_adminmutex.Lock()
+
+	st, ok := m_stats[url]
+
+	if !ok {
+		st = &RouteStats{}
+		m_stats[url] = st
+	}
+
+	st.Requests++
+	st.TimeMs += ms
+
+	if ms > st.MaxMs {
+		st.MaxMs = ms
+	}
+
+	switch {
+	case status >= 500:
+		st.Status5xx++
+	case status >= 400:
+		st.Status4xx++
+	case status >= 300:
+		st.Status3xx++
+	default:
+		st.Status2xx++
+	}
+
+	m_adminmutex.Unlock()
+}
+
+//Reject the request, if route is in maintenance
+//@param w response writer
+//@param svc route
+//@return true if request was rejected
+func maintServe(w http.ResponseWriter, svc *ServiceMap) bool {
+
+	m_adminmutex.Lock()
+
+	m, ok := m_maint[svc.Url]
+
+	if !ok {
+		m_adminmutex.Unlock()
+		return false
+	}
+
+	body := m.Body
+	ctype := m.Ctype
+	retry := m.RetryAfter
+
+	if st, ok := m_stats[svc.Url]; ok {
+		st.Maint++
+	} else {
+		m_stats[svc.Url] = &RouteStats{Maint: 1}
+	}
+
+	m_adminmutex.Unlock()
+
+	if "" == body {
+		body = svc.MaintBody
+		ctype = svc.MaintCtype
+	}
+
+	if "" == body {
+		body = MAINT_BODY_DEFAULT
+	}
+
+	if "" == ctype {
+		ctype = MAINT_CTYPE_DEFAULT
+	}
+
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+
+	if retry > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+	}
+
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(body))
+
+	return true
+}
+
+//Resolved route settings, i.e. configuration fields (with json tags)
+//@param svc route
+//@return settings by config key
+func routeSettings(svc *ServiceMap) map[string]interface{} {
+
+	ret := make(map[string]interface{})
+	v := reflect.ValueOf(svc).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+
+		tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+
+		if "" == tag || "-" == tag {
+			continue
+		}
+
+		switch t.Field(i).Type.Kind() {
+		case reflect.Func, reflect.Chan, reflect.Interface, reflect.Ptr:
+			continue
+		}
+
+		ret[tag] = v.Field(i).Interface()
+	}
+
+	return ret
+}
+
+//Write JSON response
+//@param w response writer
+//@param status http status
+//@param v object to send
+func adminRsp(w http.ResponseWriter, status int, v interface{}) {
+
+	body, err := json.Marshal(v)
+
+	if nil != err {
+		status = http.StatusInternalServerError
+		body = []byte(fmt.Sprintf("{\"message\":%q}", err.Error()))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+//List the routes
+func adminRoutes(w http.ResponseWriter, req *http.Request) {
+
+	h := m_handler.Load().(*RegexpHandler)
+
+	m_routesmutex.Lock()
+
+	dyn := make(map[string]dynRoute)
+
+	for url, r := range m_dynroutes {
+		dyn[url] = *r
+	}
+
+	m_routesmutex.Unlock()
+
+	m_adminmutex.Lock()
+
+	maint := make(map[string]bool)
+
+	for url := range m_maint {
+		maint[url] = true
+	}
+
+	m_adminmutex.Unlock()
+
+	routes := make([]AdminRoute, 0, len(h.urlMap)+len(h.regexpRoutes))
+
+	add := func(svc *ServiceMap, rex bool) {
+
+		r := AdminRoute{Url: svc.Url, Regexp: rex, Maintenance: maint[svc.Url],
+			Settings: routeSettings(svc)}
+
+		if d, ok := dyn[svc.Url]; ok {
+			r.Published = true
+			r.Owner = d.owner
+			r.Expires = &d.expires
+		}
+
+		routes = append(routes, r)
+	}
+
+	for _, svc := range h.urlMap {
+		svc := svc
+		add(&svc, false)
+	}
+
+	for _, r := range h.regexpRoutes {
+		add(&r.svc, true)
+	}
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].Url < routes[j].Url
+	})
+
+	adminRsp(w, http.StatusOK, routes)
+}
+
+//Worker pool state
+func adminWorkers(w http.ResponseWriter, req *http.Request) {
+
+	now := time.Now()
+	busy := 0
+
+	m_adminmutex.Lock()
+
+	workers := make([]WorkerState, len(m_workstate))
+	copy(workers, m_workstate)
+
+	m_adminmutex.Unlock()
+
+	for i := range workers {
+
+		workers[i].Nr = i
+
+		if workers[i].Busy {
+			busy++
+			workers[i].ElapsedMs = int64(now.Sub(workers[i].Since) / time.Millisecond)
+		}
+	}
+
+	adminRsp(w, http.StatusOK, map[string]interface{}{
+		"workers": len(workers),
+		"busy":    busy,
+		"free":    len(workers) - busy,
+		"list":    workers})
+}
+
+//Route statistics
+func adminStats(w http.ResponseWriter, req *http.Request) {
+
+	m_adminmutex.Lock()
+
+	stats := make(map[string]RouteStats)
+
+	for url, st := range m_stats {
+		stats[url] = *st
+	}
+
+	m_adminmutex.Unlock()
+
+	adminRsp(w, http.StatusOK, stats)
+}
+
+//List or toggle the maintenance
+func adminMaint(w http.ResponseWriter, req *http.Request) {
+
+	switch req.Method {
+	case http.MethodGet:
+
+		m_adminmutex.Lock()
+
+		list := make([]Maint, 0, len(m_maint))
+
+		for _, m := range m_maint {
+			list = append(list, *m)
+		}
+
+		m_adminmutex.Unlock()
+
+		sort.Slice(list, func(i, j int) bool { return list[i].Url < list[j].Url })
+
+		adminRsp(w, http.StatusOK, list)
+
+	case http.MethodPut, http.MethodPost:
+
+		var m Maint
+
+		if err := json.NewDecoder(req.Body).Decode(&m); nil != err || "" == m.Url {
+			adminRsp(w, http.StatusBadRequest,
+				map[string]string{"message": "Invalid maintenance request"})
+			return
+		}
+
+		//Typo in URL would leave the route in service. Routes removed by
+		//reload may still be taken out of maintenance.
+		if m.Enabled {
+			if _, ok := m_handler.Load().(*RegexpHandler).getRoute(m.Url); !ok {
+				adminRsp(w, http.StatusNotFound,
+					map[string]string{"message": "Route not found"})
+				return
+			}
+		}
+
+		m_adminmutex.Lock()
+
+		if m.Enabled {
+			m.Since = time.Now()
+			m_maint[m.Url] = &m
+		} else {
+			delete(m_maint, m.Url)
+		}
+
+		m_adminmutex.Unlock()
+
+		m_ac.TpLogWarn("Route [%s] maintenance: %t", m.Url, m.Enabled)
+
+		adminRsp(w, http.StatusOK, &m)
+
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+//Check the admin token of the request, respond with 401 if not valid
+//@param w response writer
+//@param req request
+//@return true if token is valid or not required
+func adminTokenOk(w http.ResponseWriter, req *http.Request) bool {
+
+	if "" != m_admintoken {
+		given := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+
+		if 1 != subtle.ConstantTimeCompare([]byte(given), []byte(m_admintoken)) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return false
+		}
+	}
+
+	return true
+}
+
+//Check the admin token
+//@param next handler to protect
+//@return handler
+func adminAuth(next http.HandlerFunc) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, req *http.Request) {
+
+		if !adminTokenOk(w, req) {
+			return
+		}
+
+		next(w, req)
+	}
+}
+
+//Allow only GET method
+//@param next handler
+//@return handler
+func adminGet(next http.HandlerFunc) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, req *http.Request) {
+
+		if http.MethodGet != req.Method {
+			w.Header().Set("Allow", http.MethodGet)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		next(w, req)
+	}
+}
+
+//Start the admin listener, if configured
+//@param ac ATMI context
+func adminStart(ac *atmi.ATMICtx) {
+
+	if 0 == m_adminport {
+		return
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/routes", adminAuth(adminGet(adminRoutes)))
+	mux.HandleFunc("/workers", adminAuth(adminGet(adminWorkers)))
+	mux.HandleFunc("/stats", adminAuth(adminGet(adminStats)))
+	mux.HandleFunc("/maintenance", adminAuth(adminMaint))
+	mux.HandleFunc("/reload", adminAuth(func(w http.ResponseWriter, req *http.Request) {
+		reloadHandler(w, req, nil)
+	}))
+
+	listenOn := fmt.Sprintf("%s:%d", m_adminip, m_adminport)
+
+	ac.TpLogInfo("Admin API listening on %s", listenOn)
+
+	go func() {
+		if err := http.ListenAndServe(listenOn, mux); nil != err {
+			ac.TpLogError("Admin ListenAndServe() failed: %s", err)
+			ac.UserLog("restincl: admin listener on %s failed: %s",
+				listenOn, err.Error())
+		}
+	}()
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
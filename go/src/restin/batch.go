@@ -0,0 +1,481 @@
+/**
+ * @brief Batch calls - multiple service invocations per HTTP request
+ *
+ * @file batch.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"encoding/json"
+	"exutil"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+/**
+ * Batch request item
+ */
+type BatchItem struct {
+	Service string          `json:"service"`
+	Conv    string          `json:"conv"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+/**
+ * Batch response item
+ */
+type BatchResult struct {
+	Service      string          `json:"service"`
+	ErrorCode    int             `json:"error_code"`
+	ErrorMessage string          `json:"error_message"`
+	Tpurcode     int64           `json:"tpurcode"`
+	Payload      json.RawMessage `json:"payload,omitempty"`
+}
+
+/**
+ * Batch response
+ */
+type BatchRsp struct {
+	ErrorCode    int           `json:"error_code"`
+	ErrorMessage string        `json:"error_message"`
+	Results      []BatchResult `json:"results"`
+}
+
+//Validate batch route settings
+//@param ac ATMI context
+//@param svc service map
+//@return error or nil
+func validateBatchService(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if !svc.Batch {
+		return nil
+	}
+
+	svc.BatchSvcs = strings.TrimSpace(svc.BatchSvcs)
+
+	if "" == svc.BatchSvcs {
+		return fmt.Errorf("Route [%s]: 'batch_svcs' must be set for batch route",
+			svc.Url)
+	}
+
+	if svc.BatchMax <= 0 {
+		return fmt.Errorf("Route [%s]: invalid 'batch_max' %d", svc.Url, svc.BatchMax)
+	}
+
+	//Global transaction cannot be resumed by several contexts at the same time
+	if svc.BatchParallel && svc.BatchTran {
+		return fmt.Errorf("Route [%s]: 'batch_parallel' cannot be used with "+
+			"'batch_tran'", svc.Url)
+	}
+
+	svc.BatchSvcs_map = make(map[string]bool)
+
+	for _, s := range strings.Split(svc.BatchSvcs, ",") {
+		svc.BatchSvcs_map[strings.TrimSpace(s)] = true
+	}
+
+	ac.TpLogInfo("Batch route [%s]: svcs [%s] max %d parallel %t tran %t "+
+		"trantout %d", svc.Url, svc.BatchSvcs, svc.BatchMax, svc.BatchParallel,
+		svc.BatchTran, svc.BatchTrantout)
+
+	return nil
+}
+
+//Prepare XATMI buffer for batch item
+//@param ac ATMI context
+//@param item batch item
+//@return typed buffer or ATMI error
+func batchPrepBuf(ac *atmi.ATMICtx, item *BatchItem) (atmi.TypedBuffer, atmi.ATMIError) {
+
+	conv := item.Conv
+
+	if "" == conv {
+		conv = CONV_DEFAULT
+	}
+
+	switch m_convs[conv] {
+	case CONV_JSON2UBF:
+
+		bufu, err := ac.NewUBF(atmi.ATMIMsgSizeMax())
+
+		if nil != err {
+			return nil, err
+		}
+
+		if len(item.Payload) > 0 {
+			if err = exutil.JSONToUBF(ac, bufu, item.Payload); nil != err {
+				return nil, err
+			}
+		}
+
+		return bufu, nil
+	case CONV_JSON2VIEW:
+
+		return ac.TpJSONToVIEW(string(item.Payload))
+	case CONV_JSON:
+
+		payload := []byte(item.Payload)
+
+		if 0 == len(payload) {
+			payload = []byte("{}")
+		}
+
+		return ac.NewJSON(payload)
+	case CONV_TEXT:
+
+		var str string
+
+		if len(item.Payload) > 0 {
+			if errJ := json.Unmarshal(item.Payload, &str); nil != errJ {
+				return nil, atmi.NewCustomATMIError(atmi.TPEINVAL,
+					fmt.Sprintf("text payload must be JSON string: %s", errJ.Error()))
+			}
+		}
+
+		return ac.NewString(str)
+	case CONV_RAW:
+
+		var data []byte
+
+		if len(item.Payload) > 0 {
+			if errJ := json.Unmarshal(item.Payload, &data); nil != errJ {
+				return nil, atmi.NewCustomATMIError(atmi.TPEINVAL,
+					fmt.Sprintf("raw payload must be base64 string: %s", errJ.Error()))
+			}
+		}
+
+		return ac.NewCarray(data)
+	}
+
+	return nil, atmi.NewCustomATMIError(atmi.TPEINVAL,
+		fmt.Sprintf("Unsupported batch item conv [%s]", conv))
+}
+
+//Convert the service response buffer to JSON payload
+//@param ac ATMI context
+//@param buf response buffer
+//@return JSON payload or ATMI error
+func batchRspPayload(ac *atmi.ATMICtx, buf atmi.TypedBuffer) (json.RawMessage, atmi.ATMIError) {
+
+	switch b := buf.(type) {
+	case *atmi.TypedUBF:
+
+		ret, err := exutil.UBFToJSON(ac, b, 0)
+
+		if nil != err {
+			return nil, err
+		}
+
+		return json.RawMessage(ret), nil
+	case *atmi.TypedVIEW:
+
+		ret, err := b.TpVIEWToJSON(0)
+
+		if nil != err {
+			return nil, err
+		}
+
+		return json.RawMessage(ret), nil
+	case *atmi.TypedJSON:
+
+		ret := b.GetJSON()
+
+		if 0 == len(ret) {
+			return nil, nil
+		}
+
+		return json.RawMessage(ret), nil
+	case *atmi.TypedString:
+
+		ret, _ := json.Marshal(b.GetString())
+		return json.RawMessage(ret), nil
+	case *atmi.TypedCarray:
+
+		ret, _ := json.Marshal(b.GetBytes())
+		return json.RawMessage(ret), nil
+	}
+
+	return nil, atmi.NewCustomATMIError(atmi.TPEOTYPE, "Unsupported response buffer")
+}
+
+//Execute single batch item
+//@param ac ATMI context
+//@param svc batch route
+//@param item batch item to execute
+//@param tid global transaction id, if running in transaction
+//@param res result to fill
+func batchCall(ac *atmi.ATMICtx, svc *ServiceMap, item *BatchItem, tid string,
+	res *BatchResult) {
+
+	var err atmi.ATMIError
+	var flags int64
+
+	res.Service = item.Service
+
+	defer func() {
+		if nil != err {
+			res.ErrorCode = err.Code()
+			res.ErrorMessage = err.Message()
+		} else {
+			res.ErrorMessage = "SUCCEED"
+		}
+	}()
+
+	if !svc.BatchSvcs_map["*"] && !svc.BatchSvcs_map[item.Service] {
+		ac.TpLogError("Service [%s] not permitted for batch route [%s]",
+			item.Service, svc.Url)
+		err = atmi.NewCustomATMIError(atmi.TPENOENT,
+			fmt.Sprintf("Service [%s] not permitted", item.Service))
+		return
+	}
+
+	buf, err := batchPrepBuf(ac, item)
+
+	if nil != err {
+		ac.TpLogError("Failed to prepare batch buffer for [%s]: %s",
+			item.Service, err.Message())
+		return
+	}
+
+	defer ac.TpFree(buf.GetBuf())
+
+	if svc.Notime {
+		flags |= atmi.TPNOTIME
+	}
+
+	_, _, err = txSvcCall(ac, item.Service, buf, svc, tid, flags)
+
+	if nil == err || atmi.TPESVCFAIL == err.Code() {
+		res.Tpurcode, _ = ac.TpURCode()
+
+		payload, errP := batchRspPayload(ac, buf)
+
+		if nil != errP {
+			ac.TpLogError("Failed to convert [%s] response: %s",
+				item.Service, errP.Message())
+
+			if nil == err {
+				err = errP
+			}
+		} else {
+			res.Payload = payload
+		}
+	}
+}
+
+//Run the batch items
+//@param ac ATMI context of the request
+//@param svc batch route
+//@param items items to execute
+//@param tid global transaction id if any
+//@return results
+func batchRun(ac *atmi.ATMICtx, svc *ServiceMap, items []BatchItem,
+	tid string) []BatchResult {
+
+	results := make([]BatchResult, len(items))
+	var failed int32
+	var wg sync.WaitGroup
+
+	next := make(chan int, len(items))
+
+	for i := range items {
+		next <- i
+	}
+
+	close(next)
+
+	//Process the queued items. In transaction mode, after first failure
+	//rest of the items are not executed, as transaction will be aborted anyway
+	worker := func(wac *atmi.ATMICtx) {
+		for i := range next {
+
+			if "" != tid && atomic.LoadInt32(&failed) > 0 {
+				results[i].Service = items[i].Service
+				results[i].ErrorCode = atmi.TPEABORT
+				results[i].ErrorMessage = "Not executed, batch is aborted"
+				continue
+			}
+
+			batchCall(wac, svc, &items[i], tid, &results[i])
+
+			if 0 != results[i].ErrorCode {
+				atomic.StoreInt32(&failed, 1)
+			}
+		}
+	}
+
+	if svc.BatchParallel {
+
+		//Borrow free workers, if none available, items are processed by
+		//current context
+		var extra []int
+	borrow:
+		for len(extra) < len(items)-1 {
+			select {
+			case nr := <-m_freechan:
+				extra = append(extra, nr)
+			default:
+				break borrow
+			}
+		}
+
+		ac.TpLogInfo("Batch: borrowed %d extra workers", len(extra))
+
+		for _, nr := range extra {
+			wg.Add(1)
+			go func(nr int) {
+				defer wg.Done()
+				workerBusy(nr, svc.Url, "")
+				worker(m_ctxs[nr])
+				workerFree(nr)
+				m_freechan <- nr
+			}(nr)
+		}
+	}
+
+	worker(ac)
+	wg.Wait()
+
+	return results
+}
+
+//Handle batch request
+//@param ac ATMI context
+//@param svc batch route
+//@param w response writer
+//@param req request
+//@return atmi.SUCCEED or atmi.FAIL
+func batchHandler(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
+	req *http.Request) (ret int) {
+
+	var items []BatchItem
+	var rsp BatchRsp
+	var err atmi.ATMIError
+
+	ret = atmi.SUCCEED
+
+	defer func() {
+
+		http_status := http.StatusOK
+
+		if nil != err {
+			rsp.ErrorCode = err.Code()
+			rsp.ErrorMessage = err.Message()
+			ret = atmi.FAIL
+
+			if err.Code() == atmi.TPEINVAL || err.Code() == atmi.TPEPROTO {
+				http_status = http.StatusBadRequest
+			} else {
+				http_status = http.StatusInternalServerError
+			}
+		} else {
+			rsp.ErrorMessage = "SUCCEED"
+		}
+
+		if nil == rsp.Results {
+			rsp.Results = []BatchResult{}
+		}
+
+		body, errJ := json.Marshal(&rsp)
+
+		if nil != errJ {
+			ac.TpLogError("Failed to marshal batch response: %s", errJ.Error())
+			http_status = http.StatusInternalServerError
+			body = []byte(fmt.Sprintf("{\"error_code\":%d,\"error_message\":\"%s\"}",
+				atmi.TPESYSTEM, "Failed to build response"))
+		}
+
+		ac.TpLogDebug("Batch response: [%s]", string(body))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http_status)
+		w.Write(body)
+	}()
+
+	body, errR := ioutil.ReadAll(req.Body)
+
+	if nil != errR {
+		err = atmi.NewCustomATMIError(atmi.TPEINVAL,
+			fmt.Sprintf("Failed to read request: %s", errR.Error()))
+		return
+	}
+
+	ac.TpLogDebug("Batch request: [%s]", string(body))
+
+	if errJ := json.Unmarshal(body, &items); nil != errJ {
+		err = atmi.NewCustomATMIError(atmi.TPEINVAL,
+			fmt.Sprintf("Failed to parse JSON request: %s", errJ.Error()))
+		return
+	}
+
+	if 0 == len(items) || len(items) > svc.BatchMax {
+		err = atmi.NewCustomATMIError(atmi.TPEINVAL,
+			fmt.Sprintf("Invalid number of batch items %d (max %d)",
+				len(items), svc.BatchMax))
+		return
+	}
+
+	tid := ""
+
+	if svc.BatchTran {
+		if tid, err = txBegin(ac, svc.BatchTrantout, 0); nil != err {
+			return
+		}
+	}
+
+	rsp.Results = batchRun(ac, svc, items, tid)
+
+	if svc.BatchTran {
+
+		commit := true
+
+		for i := range rsp.Results {
+			if 0 != rsp.Results[i].ErrorCode {
+				commit = false
+				break
+			}
+		}
+
+		if _, err = txEnd(ac, tid, commit); nil == err && !commit {
+			err = atmi.NewCustomATMIError(atmi.TPEABORT,
+				"Batch item failed, transaction aborted")
+		}
+	}
+
+	return
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
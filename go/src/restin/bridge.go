@@ -0,0 +1,251 @@
+/**
+ * @brief Public API of the HTTP to XATMI bridge
+ *
+ * @file bridge.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"container/list"
+	"errors"
+	"net/http"
+	"sync"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+/*
+
+The bridge converts HTTP requests to XATMI calls by routes, the same way as
+restincl process does. It may be used in two ways:
+
+1. Standalone process, configured from common-config (restincl binary):
+
+	restin.Init(ac)
+	restin.Serve(ac)
+	restin.UnInit(ac)
+
+2. Embedded in other Go program (e.g. XATMI server) which serves its own HTTP
+endpoints. Routes are given by the program, requests are processed by the
+given XATMI contexts:
+
+	h, err := restin.NewHandler(ac, &restin.Config{
+		Defaults: `{"conv":"json2ubf", "errors":"json"}`,
+		Routes: []restin.RouteConfig{
+			{Url: "/api/acct", Route: `{"svc":"ACCTGET"}`},
+		}}, ctxs)
+
+	http.Handle("/api/", h)
+
+Bridge state (routes, worker contexts, metrics) is kept per process, thus only
+one bridge may be running in the process. After Close() requests are answered
+with 503 and new bridge may be started by NewHandler().
+
+*/
+
+//Route of embedded bridge
+type RouteConfig struct {
+	Url   string //Route URL or regexp (with "format":"r")
+	Route string //Route settings, JSON, the same as in ini
+}
+
+//Embedded bridge configuration
+type Config struct {
+	Defaults string        //Default route settings, JSON, may be empty
+	Routes   []RouteConfig //Routes, regexp routes are matched in given order
+}
+
+//Init the standalone bridge: read the configuration from common-config
+//(@restin section with NDRX_CCTAG), open worker contexts and background tasks
+//@param ac main ATMI context, kept by the bridge
+//@return error
+func Init(ac *atmi.ATMICtx) error {
+
+	m_ac = ac
+
+	return appinit(ac)
+}
+
+//Serve HTTP requests on configured address, until listener fails.
+//Route reload by SIGHUP and admin API are started too.
+//@param ac main ATMI context
+//@return listener error
+func Serve(ac *atmi.ATMICtx) error {
+
+	handleReload(ac)
+	adminStart(ac)
+
+	ac.TpLogWarn("REST Incoming init ok - serving...")
+
+	return apprun(ac)
+}
+
+//Terminate the standalone bridge: stop background tasks, close worker
+//contexts and the main context. Process is not terminated.
+//@param ac main ATMI context
+func UnInit(ac *atmi.ATMICtx) {
+
+	unInit(ac)
+}
+
+//Build HTTP handler for the embedded bridge
+//@param ac ATMI context for logging and background tasks, kept by the bridge
+//@param cfg routes and defaults
+//@param pool XATMI contexts processing the requests, owned by the caller.
+//	For transactional routes the contexts must be open with tpopen(3).
+//@return HTTP handler, error
+func NewHandler(ac *atmi.ATMICtx, cfg *Config, pool []*atmi.ATMICtx) (http.Handler, error) {
+
+	if nil != m_ac {
+		return nil, errors.New("Bridge is already started in this process")
+	}
+
+	if 0 == len(pool) {
+		return nil, errors.New("At least one XATMI context is required")
+	}
+
+	m_ac = ac
+
+	//Websocket state of previous bridge is gone
+	m_wsmutex.Lock()
+	m_wsdown = false
+	m_wsmutex.Unlock()
+
+	initDefaults(&m_defaults)
+
+	if "" != cfg.Defaults {
+		if err := defaultsLoad(ac, &m_defaults, []byte(cfg.Defaults)); nil != err {
+			return nil, err
+		}
+	}
+
+	if err := defaultsFinish(&m_defaults); nil != err {
+		return nil, err
+	}
+
+	h := newRegexpHandler()
+
+	for _, r := range cfg.Routes {
+
+		ac.TpLogInfo("Got route config [%s] [%s]", r.Url, r.Route)
+
+		svc, err := routeLoad(ac, &m_defaults, r.Url, r.Route)
+
+		if nil != err {
+			return nil, err
+		}
+
+		if err := h.routeAdd(ac, svc, true); nil != err {
+			return nil, err
+		}
+	}
+
+	h.defaults = m_defaults
+
+	if err := timingInit(ac); nil != err {
+		return nil, err
+	}
+
+	poolStart(pool)
+
+	m_routesmutex.Lock()
+	m_cfgroutes = h
+	m_handler.Store(h)
+	m_routesmutex.Unlock()
+
+	m_runmutex.Lock()
+	m_closed = false
+	m_runmutex.Unlock()
+
+	//Reaper needs XA session, which is configured for transactional routes
+	if !m_do_tpopen {
+		m_tx_idle_max = 0
+	}
+
+	if err := txReaperStart(ac); nil != err {
+		return nil, err
+	}
+
+	ac.TpLogInfo("Embedded bridge started: %d routes, %d workers",
+		len(cfg.Routes), m_workers)
+
+	return currentRoutes{}, nil
+}
+
+//Stop the embedded bridge. Waits for requests in progress, worker contexts
+//are not closed and are returned to the caller. Handler answers 503 after
+//this point.
+//@param ac ATMI context
+func Close(ac *atmi.ATMICtx) {
+
+	bridgeStop(ac)
+
+	for i := 0; i < m_workers; i++ {
+		<-m_freechan
+	}
+
+	bridgeReset()
+
+	ac.TpLogInfo("Embedded bridge stopped")
+}
+
+//Drop the state of stopped bridge, so that NewHandler() may be called again
+func bridgeReset() {
+
+	m_routesmutex.Lock()
+	m_cfgroutes = nil
+	m_dynroutes = make(map[string]*dynRoute)
+	m_routesmutex.Unlock()
+
+	m_cachemutex.Lock()
+	m_cache = make(map[string]*CacheEntry)
+	m_cachelru = list.New()
+	m_cachesize = 0
+	m_cachemutex.Unlock()
+
+	m_txmutex.Lock()
+	m_txs = make(map[string]*TxInfo)
+	m_txmutex.Unlock()
+
+	m_adminmutex.Lock()
+	m_stats = make(map[string]*RouteStats)
+	m_maint = make(map[string]*Maint)
+	m_workstate = nil
+	m_adminmutex.Unlock()
+
+	m_mirroronce = sync.Once{}
+	m_mockall = false
+	m_do_tpopen = false
+	m_ctxs = nil
+	m_workers = 0
+	m_ac = nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
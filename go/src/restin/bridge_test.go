@@ -0,0 +1,93 @@
+/**
+ * @brief Embedded bridge usage
+ *
+ * @file bridge_test.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin_test
+
+import (
+	"net/http"
+	"restin"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Bridge embedded in Go program, which serves own HTTP endpoints too. Needs
+//Enduro/X application domain, thus is compiled only.
+func ExampleNewHandler() {
+
+	ac, err := atmi.NewATMICtx()
+
+	if nil != err {
+		return
+	}
+
+	defer ac.FreeATMICtx()
+
+	var pool []*atmi.ATMICtx
+
+	for i := 0; i < 2; i++ {
+		ctx, err := atmi.NewATMICtx()
+
+		if nil != err {
+			return
+		}
+
+		defer ctx.FreeATMICtx()
+		pool = append(pool, ctx)
+	}
+
+	h, errH := restin.NewHandler(ac, &restin.Config{
+		Defaults: `{"conv":"json2ubf", "errors":"json"}`,
+		Routes: []restin.RouteConfig{
+			{Url: "/api/acct", Route: `{"svc":"ACCTGET"}`},
+		}}, pool)
+
+	if nil != errH {
+		ac.TpLogError("Failed to start bridge: %s", errH.Error())
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", h)
+	srv := &http.Server{Addr: ":8080", Handler: mux}
+
+	go srv.ListenAndServe()
+
+	//... program runs ...
+
+	srv.Close()
+	restin.Close(ac)
+
+	//Bridge may be started again, e.g. with new routes
+	if h, errH = restin.NewHandler(ac, &restin.Config{}, pool); nil == errH {
+		restin.Close(ac)
+	}
+}
@@ -0,0 +1,480 @@
+/**
+ * @brief Response cache for GET routes - TTL, LRU eviction and request coalescing
+ *
+ * @file cache.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Metric names
+const (
+	METRIC_CACHE_HITS      = "restincl_cache_hits_total"
+	METRIC_CACHE_MISSES    = "restincl_cache_misses_total"
+	METRIC_CACHE_COALESCED = "restincl_cache_coalesced_total"
+	METRIC_CACHE_EVICTIONS = "restincl_cache_evictions_total"
+	METRIC_CACHE_BYTES     = "restincl_cache_bytes"
+)
+
+/**
+ * Cached response
+ */
+type CacheEntry struct {
+	key     string
+	url     string //Route which cached the entry
+	status  int
+	header  http.Header
+	body    []byte
+	etag    string
+	expires time.Time
+	size    int64
+	elem    *list.Element //Position in LRU list
+}
+
+/**
+ * Request in progress, other requests for the same key wait for it
+ */
+type cacheCall struct {
+	wg  sync.WaitGroup
+	ent *CacheEntry
+}
+
+var m_cachemutex sync.Mutex
+
+//Cached entries by key
+var m_cache = make(map[string]*CacheEntry)
+
+//LRU list, most recently used at front
+var m_cachelru = list.New()
+
+//Current cache size in bytes
+var m_cachesize int64
+
+//Cache memory budget, bytes
+var m_cachemem int64 = CACHE_MEM_DEFAULT
+
+//Calls in progress by key
+var m_cacheflight = make(map[string]*cacheCall)
+
+//Validate cache settings of the route
+//@param ac ATMI context
+//@param svc service map
+//@return error or nil
+func validateCacheService(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if !svc.Cache {
+		return nil
+	}
+
+	if svc.CacheTtl < 0 {
+		return fmt.Errorf("Route [%s]: invalid 'cache_ttl' %d", svc.Url, svc.CacheTtl)
+	}
+
+	metricsGauge(METRIC_CACHE_BYTES, cacheBytes)
+
+	svc.CacheHdrs_arr = nil
+
+	for _, h := range strings.Split(svc.CacheHdrs, ",") {
+		if h = strings.TrimSpace(h); "" != h {
+			svc.CacheHdrs_arr = append(svc.CacheHdrs_arr, http.CanonicalHeaderKey(h))
+		}
+	}
+
+	ac.TpLogInfo("Route [%s] cache: ttl %d ttl_field [%s] ttl_hdr [%s] hdrs [%s]",
+		svc.Url, svc.CacheTtl, svc.CacheTtlField, svc.CacheTtlHdr, svc.CacheHdrs)
+
+	return nil
+}
+
+//Build cache key of the request. Service is part of the key, as with
+//'targets' the same URL may be served by different service versions.
+//@param svc service map
+//@param req request
+//@return key
+func cacheKey(svc *ServiceMap, req *http.Request) string {
+
+	var b strings.Builder
+
+	b.WriteString(svc.Svc)
+	b.WriteString(" ")
+	b.WriteString(req.URL.Path)
+	b.WriteString("?")
+	b.WriteString(req.URL.RawQuery)
+
+	for _, h := range svc.CacheHdrs_arr {
+		b.WriteString("\n")
+		b.WriteString(h)
+		b.WriteString(":")
+		b.WriteString(strings.Join(req.Header[h], ","))
+	}
+
+	return b.String()
+}
+
+//Check if request carries client credentials, which are not part of the
+//cache key. Such requests are not served from cache.
+//@param svc service map
+//@param req request
+//@return true if request is private
+func cachePrivate(svc *ServiceMap, req *http.Request) bool {
+
+	for _, h := range []string{"Authorization", "Cookie"} {
+
+		if _, ok := req.Header[h]; !ok {
+			continue
+		}
+
+		keyed := false
+
+		for _, k := range svc.CacheHdrs_arr {
+			if k == h {
+				keyed = true
+				break
+			}
+		}
+
+		if !keyed {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Lookup fresh entry, mark it as recently used
+//@param key cache key
+//@return entry or nil
+func cacheGet(key string) *CacheEntry {
+
+	m_cachemutex.Lock()
+	defer m_cachemutex.Unlock()
+
+	ent, ok := m_cache[key]
+
+	if !ok {
+		return nil
+	}
+
+	if time.Now().After(ent.expires) {
+		cacheRemove(ent)
+		return nil
+	}
+
+	m_cachelru.MoveToFront(ent.elem)
+
+	return ent
+}
+
+//Remove entry, cache must be locked
+//@param ent entry to remove
+func cacheRemove(ent *CacheEntry) {
+	m_cachelru.Remove(ent.elem)
+	delete(m_cache, ent.key)
+	m_cachesize -= ent.size
+}
+
+//Add entry to cache, evict least recently used entries over the budget
+//@param ac ATMI context
+//@param ent entry to add
+func cachePut(ac *atmi.ATMICtx, ent *CacheEntry) {
+
+	if ent.size > m_cachemem {
+		ac.TpLogWarn("Response of [%s] size %d exceeds cache memory %d - not cached",
+			ent.key, ent.size, m_cachemem)
+		return
+	}
+
+	m_cachemutex.Lock()
+	defer m_cachemutex.Unlock()
+
+	if old, ok := m_cache[ent.key]; ok {
+		cacheRemove(old)
+	}
+
+	ent.elem = m_cachelru.PushFront(ent)
+	m_cache[ent.key] = ent
+	m_cachesize += ent.size
+
+	for m_cachesize > m_cachemem {
+		last := m_cachelru.Back().Value.(*CacheEntry)
+		ac.TpLogDebug("Evicting cache entry [%s]", last.key)
+		cacheRemove(last)
+		metricsAdd(METRIC_CACHE_EVICTIONS, 1)
+	}
+}
+
+//Resolve the TTL of the response
+//@param ac ATMI context
+//@param svc service map
+//@param rsp buffered response
+//@return TTL in seconds
+func cacheTtl(ac *atmi.ATMICtx, svc *ServiceMap, rsp *RspBuffer) int {
+
+	ttl := svc.CacheTtl
+
+	if "" != svc.CacheTtlHdr {
+
+		if val := rsp.Header().Get(svc.CacheTtlHdr); "" != val {
+
+			if n, err := strconv.Atoi(val); nil == err {
+				ttl = n
+			} else {
+				ac.TpLogWarn("Invalid cache TTL header [%s] value [%s]",
+					svc.CacheTtlHdr, val)
+			}
+		}
+
+		//Internal header, not for the client
+		rsp.Header().Del(svc.CacheTtlHdr)
+	}
+
+	if "" != svc.CacheTtlField {
+
+		var obj map[string]interface{}
+
+		if err := json.Unmarshal(rsp.Body(), &obj); nil == err {
+			if n, ok := obj[svc.CacheTtlField].(float64); ok {
+				ttl = int(n)
+			}
+		}
+	}
+
+	return ttl
+}
+
+//Check if client has the current version
+//@param req request
+//@param etag entry ETag
+//@return true if If-None-Match matches
+func cacheNotModified(req *http.Request, etag string) bool {
+
+	inm := req.Header.Get("If-None-Match")
+
+	if "" == inm {
+		return false
+	}
+
+	for _, t := range strings.Split(inm, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+
+		if "*" == t || etag == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Send the entry to the client
+//@param w response writer
+//@param req request
+//@param ent entry
+func cacheSend(w http.ResponseWriter, req *http.Request, ent *CacheEntry) {
+
+	for k, v := range ent.header {
+		w.Header()[k] = v
+	}
+
+	if "" != ent.etag {
+
+		maxage := int64(time.Until(ent.expires) / time.Second)
+
+		if maxage < 0 {
+			maxage = 0
+		}
+
+		w.Header().Set("ETag", ent.etag)
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", maxage))
+
+		if cacheNotModified(req, ent.etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	w.WriteHeader(ent.status)
+	w.Write(ent.body)
+}
+
+//Call the service for the key, coalescing parallel requests
+//@param svc service map
+//@param req request
+//@param key cache key
+//@return response entry (cached or not)
+func cacheFetch(svc *ServiceMap, req *http.Request, key string) *CacheEntry {
+
+	m_cachemutex.Lock()
+
+	if call, ok := m_cacheflight[key]; ok {
+		m_cachemutex.Unlock()
+		metricsAdd(METRIC_CACHE_COALESCED, 1)
+		call.wg.Wait()
+
+		//Response was for that caller only
+		if nil == call.ent {
+			ent, _ := cacheSvcCall(svc, req, key)
+			return ent
+		}
+
+		return call.ent
+	}
+
+	call := &cacheCall{}
+	call.wg.Add(1)
+	m_cacheflight[key] = call
+	m_cachemutex.Unlock()
+
+	metricsAdd(METRIC_CACHE_MISSES, 1)
+
+	defer func() {
+		m_cachemutex.Lock()
+		delete(m_cacheflight, key)
+		m_cachemutex.Unlock()
+		call.wg.Done()
+	}()
+
+	ent, ttl := cacheSvcCall(svc, req, key)
+
+	//Session cookies are given to this caller only
+	if _, ok := ent.header["Set-Cookie"]; ok {
+		m_ac.TpLogInfo("Response of [%s] sets cookies - not cached", key)
+		return ent
+	}
+
+	if http.StatusOK == ent.status && ttl > 0 {
+
+		sum := sha256.Sum256(ent.body)
+		ent.etag = "\"" + hex.EncodeToString(sum[:16]) + "\""
+		ent.expires = time.Now().Add(time.Duration(ttl) * time.Second)
+		ent.size = int64(len(ent.body) + len(key))
+
+		for k, v := range ent.header {
+			ent.size += int64(len(k) + len(strings.Join(v, "")))
+		}
+
+		cachePut(m_ac, ent)
+	}
+
+	call.ent = ent
+
+	return ent
+}
+
+//Call the service by free worker, response is buffered
+//@param svc service map
+//@param req request
+//@param key cache key
+//@return response entry (not cached), TTL in seconds
+func cacheSvcCall(svc *ServiceMap, req *http.Request, key string) (*CacheEntry, int) {
+
+	rsp := NewRspBuffer()
+
+	nr := <-m_freechan
+
+	m_ac.TpLogInfo("Got free goroutine, nr %d (cache miss [%s])", nr, key)
+	workerBusy(nr, req.URL.Path, req.Method)
+
+	ac := m_ctxs[nr]
+	handleMessage(ac, svc, rsp, req, nil)
+	ttl := cacheTtl(ac, svc, rsp)
+
+	workerFree(nr)
+	m_freechan <- nr
+
+	ent := &CacheEntry{key: key, url: svc.Url, status: rsp.Status(), header: rsp.Header(),
+		body: rsp.Body()}
+
+	if 0 == ent.status {
+		ent.status = http.StatusOK
+	}
+
+	return ent, ttl
+}
+
+//Serve request from cache or by calling the service
+//@param w response writer
+//@param req request
+//@param svc service map
+func cacheDispatch(w http.ResponseWriter, req *http.Request, svc *ServiceMap) {
+
+	key := cacheKey(svc, req)
+
+	ent := cacheGet(key)
+
+	if nil != ent {
+		m_ac.TpLogDebug("Cache hit [%s]", key)
+		metricsAdd(METRIC_CACHE_HITS, 1)
+	} else {
+		ent = cacheFetch(svc, req, key)
+	}
+
+	cacheSend(w, req, ent)
+}
+
+//Drop the entries cached by the route
+//@param ac ATMI context
+//@param url route URL
+func cacheDrop(ac *atmi.ATMICtx, url string) {
+
+	m_cachemutex.Lock()
+	defer m_cachemutex.Unlock()
+
+	for _, ent := range m_cache {
+		if ent.url == url {
+			cacheRemove(ent)
+		}
+	}
+
+	ac.TpLogInfo("Cache of route [%s] dropped", url)
+}
+
+//Current cache size, for metrics
+func cacheBytes() int64 {
+
+	m_cachemutex.Lock()
+	defer m_cachemutex.Unlock()
+
+	return m_cachesize
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,346 @@
+/**
+ * @brief CSV/TSV export of multi-occurrence UBF responses
+ *
+ * @file csvexport.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Export modes
+const (
+	EXPORT_CSV = "csv"
+	EXPORT_TSV = "tsv"
+)
+
+//Export encodings
+const (
+	CSV_ENC_UTF8    = "utf-8"
+	CSV_ENC_UTF8BOM = "utf-8-bom"
+	CSV_ENC_LATIN1  = "iso-8859-1"
+)
+
+const (
+	CSV_QUERY_DEFAULT    = "format"
+	CSV_FILENAME_DEFAULT = "export"
+	CSV_FLUSH_ROWS       = 100 //Rows between flushes to client
+)
+
+//Export media types
+var m_exportmimes = map[string]string{
+	EXPORT_CSV: "text/csv",
+	EXPORT_TSV: "text/tab-separated-values",
+}
+
+//Writer converting UTF-8 to ISO-8859-1, characters out of range are
+//replaced by '?'
+type latin1Writer struct {
+	w io.Writer
+}
+
+//Convert and write data
+//@param p UTF-8 data (csv writer passes whole fields/lines)
+//@return bytes consumed, error
+func (l *latin1Writer) Write(p []byte) (int, error) {
+
+	out := make([]byte, 0, len(p))
+
+	for i := 0; i < len(p); {
+
+		r, size := utf8.DecodeRune(p[i:])
+
+		if r < 256 {
+			out = append(out, byte(r))
+		} else {
+			out = append(out, '?')
+		}
+
+		i += size
+	}
+
+	if _, err := l.w.Write(out); nil != err {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+//Validate export settings of the route
+//@param ac ATMI context
+//@param svc service map
+//@return error or nil
+func validateCsvService(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	svc.CsvFields_arr = nil
+	svc.CsvFields_ids = nil
+
+	if "" == svc.CsvFields {
+		return nil
+	}
+
+	if CONV_JSON2UBF != svc.Conv_int && CONV_EXT != svc.Conv_int {
+		return fmt.Errorf("Route [%s]: 'csv_fields' valid only for json2ubf "+
+			"or ext conv (cur %s)", svc.Url, svc.Conv)
+	}
+
+	if svc.Asynccall {
+		return fmt.Errorf("Route [%s]: 'csv_fields' not valid for async calls",
+			svc.Url)
+	}
+
+	if "" != svc.Formats || "" != svc.Template {
+		return fmt.Errorf("Route [%s]: 'csv_fields' not valid together "+
+			"with 'formats' or 'template'", svc.Url)
+	}
+
+	for _, f := range strings.Split(svc.CsvFields, ",") {
+
+		if f = strings.TrimSpace(f); "" == f {
+			continue
+		}
+
+		id, err := ac.BFldId(f)
+
+		if nil != err {
+			return fmt.Errorf("Route [%s]: invalid field [%s] in 'csv_fields': %s",
+				svc.Url, f, err.Message())
+		}
+
+		svc.CsvFields_arr = append(svc.CsvFields_arr, f)
+		svc.CsvFields_ids = append(svc.CsvFields_ids, id)
+	}
+
+	switch svc.CsvDelim {
+	case "":
+		svc.CsvDelim = ","
+	case "tab":
+		svc.CsvDelim = "\t"
+	}
+
+	if d, size := utf8.DecodeRuneInString(svc.CsvDelim); size != len(svc.CsvDelim) ||
+		'"' == d || '\r' == d || '\n' == d {
+		return fmt.Errorf("Route [%s]: invalid 'csv_delim' [%s]",
+			svc.Url, svc.CsvDelim)
+	}
+
+	switch strings.ToLower(svc.CsvEncoding) {
+	case "", CSV_ENC_UTF8:
+		svc.CsvEncoding = CSV_ENC_UTF8
+	case CSV_ENC_UTF8BOM:
+		svc.CsvEncoding = CSV_ENC_UTF8BOM
+	case CSV_ENC_LATIN1, "latin1":
+		svc.CsvEncoding = CSV_ENC_LATIN1
+	default:
+		return fmt.Errorf("Route [%s]: invalid 'csv_encoding' [%s]",
+			svc.Url, svc.CsvEncoding)
+	}
+
+	if "" == svc.CsvQuery {
+		svc.CsvQuery = CSV_QUERY_DEFAULT
+	}
+
+	if "" == svc.CsvFilename {
+		svc.CsvFilename = CSV_FILENAME_DEFAULT
+	}
+
+	//Cached responses differ by format
+	if svc.Cache {
+		svc.CacheHdrs_arr = append(svc.CacheHdrs_arr, "Accept")
+	}
+
+	ac.TpLogInfo("Route [%s] export: fields [%s] delim [%s] encoding [%s] "+
+		"query [%s] filename [%s]", svc.Url, svc.CsvFields, svc.CsvDelim,
+		svc.CsvEncoding, svc.CsvQuery, svc.CsvFilename)
+
+	return nil
+}
+
+//Select export mode of the request, by query parameter or Accept header
+//@param svc service map
+//@param req request
+//@return export mode or empty string for normal response
+func csvSelect(svc *ServiceMap, req *http.Request) string {
+
+	if nil == svc.CsvFields_ids {
+		return ""
+	}
+
+	switch strings.ToLower(req.URL.Query().Get(svc.CsvQuery)) {
+	case EXPORT_CSV:
+		return EXPORT_CSV
+	case EXPORT_TSV:
+		return EXPORT_TSV
+	}
+
+	best := ""
+	bestq := 0.0
+
+	for _, part := range strings.Split(req.Header.Get("Accept"), ",") {
+
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+
+		if nil != err {
+			continue
+		}
+
+		q := 1.0
+
+		if qs, ok := params["q"]; ok {
+			if v, err := strconv.ParseFloat(qs, 64); nil == err {
+				q = v
+			}
+		}
+
+		if q <= bestq {
+			continue
+		}
+
+		bestq = q
+
+		switch mt {
+		case m_exportmimes[EXPORT_CSV]:
+			best = EXPORT_CSV
+		case m_exportmimes[EXPORT_TSV]:
+			best = EXPORT_TSV
+		default:
+			best = ""
+		}
+	}
+
+	return best
+}
+
+//Stream the response buffer as CSV/TSV, one row per occurrence index
+//@param ac ATMI context
+//@param svc service map
+//@param w response writer
+//@param bufu response buffer
+//@param mode export mode
+func csvExport(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
+	bufu *atmi.TypedUBF, mode string) {
+
+	rows := 0
+	charset := "utf-8"
+
+	for _, id := range svc.CsvFields_ids {
+		if occs, _ := bufu.BOccur(id); occs > rows {
+			rows = occs
+		}
+	}
+
+	if CSV_ENC_LATIN1 == svc.CsvEncoding {
+		charset = CSV_ENC_LATIN1
+	}
+
+	//Response headers of ext route may be set already
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", m_exportmimes[mode]+"; charset="+charset)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": svc.CsvFilename + "." + mode}))
+	w.WriteHeader(http.StatusOK)
+
+	ac.TpLogInfo("Exporting %d rows as %s", rows, mode)
+
+	bw := bufio.NewWriter(w)
+	var out io.Writer = bw
+
+	switch svc.CsvEncoding {
+	case CSV_ENC_UTF8BOM:
+		bw.WriteString("\xef\xbb\xbf")
+	case CSV_ENC_LATIN1:
+		out = &latin1Writer{w: bw}
+	}
+
+	cw := csv.NewWriter(out)
+
+	if EXPORT_TSV == mode {
+		cw.Comma = '\t'
+	} else {
+		cw.Comma, _ = utf8.DecodeRuneInString(svc.CsvDelim)
+	}
+
+	flush := func() error {
+
+		cw.Flush()
+
+		if err := cw.Error(); nil != err {
+			return err
+		}
+
+		if err := bw.Flush(); nil != err {
+			return err
+		}
+
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+
+		return nil
+	}
+
+	cw.Write(svc.CsvFields_arr)
+
+	rec := make([]string, len(svc.CsvFields_ids))
+
+	for i := 0; i < rows; i++ {
+
+		for j, id := range svc.CsvFields_ids {
+			//Missing occurrences are empty cells
+			rec[j], _ = bufu.BGetString(id, i)
+		}
+
+		cw.Write(rec)
+
+		if 0 == (i+1)%CSV_FLUSH_ROWS {
+			if err := flush(); nil != err {
+				ac.TpLogError("Failed to send export: %s", err.Error())
+				return
+			}
+		}
+	}
+
+	if err := flush(); nil != err {
+		ac.TpLogError("Failed to send export: %s", err.Error())
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,187 @@
+/**
+ * @brief File download responses of ext services (with range requests)
+ *
+ * @file download.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Validate download settings of the route
+//@param ac ATMI context
+//@param svc service map
+//@return error or nil
+func validateDownloadService(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	svc.DownloadDirs_arr = nil
+
+	if "" == svc.DownloadDirs {
+		return nil
+	}
+
+	if CONV_EXT != svc.Conv_int {
+		return fmt.Errorf("Route [%s]: 'download_dirs' valid only for ext "+
+			"conv (cur %s)", svc.Url, svc.Conv)
+	}
+
+	for _, dir := range strings.Split(svc.DownloadDirs, ",") {
+
+		if dir = strings.TrimSpace(dir); "" == dir {
+			continue
+		}
+
+		//Resolved, so that links can be checked against it
+		rpath, err := filepath.EvalSymlinks(dir)
+
+		if nil == err {
+			rpath, err = filepath.Abs(rpath)
+		}
+
+		if nil != err {
+			return fmt.Errorf("Route [%s]: invalid download directory [%s]: %s",
+				svc.Url, dir, err.Error())
+		}
+
+		svc.DownloadDirs_arr = append(svc.DownloadDirs_arr, rpath)
+	}
+
+	ac.TpLogInfo("Route [%s] download directories: %v", svc.Url,
+		svc.DownloadDirs_arr)
+
+	return nil
+}
+
+//Check that file is in one of the download directories
+//@param svc service map
+//@param path file path returned by service
+//@return resolved path, error if not allowed
+func downloadPath(svc *ServiceMap, path string) (string, error) {
+
+	rpath, err := filepath.EvalSymlinks(path)
+
+	if nil == err {
+		rpath, err = filepath.Abs(rpath)
+	}
+
+	if nil != err {
+		return "", err
+	}
+
+	for _, dir := range svc.DownloadDirs_arr {
+		if strings.HasPrefix(rpath, dir+string(filepath.Separator)) {
+			return rpath, nil
+		}
+	}
+
+	return "", fmt.Errorf("file [%s] is not in download directories", path)
+}
+
+//Send file returned by service. Range, If-Range and conditional requests
+//are served by net/http
+//@param ac ATMI context
+//@param svc service map
+//@param w response writer
+//@param bufu response buffer with EX_IF_RSPFILEDISK
+//@param rctx request context
+func downloadSend(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
+	bufu *atmi.TypedUBF, rctx *RequestContext) {
+
+	path, _ := bufu.BGetString(ubftab.EX_IF_RSPFILEDISK, 0)
+	ctype, _ := bufu.BGetString(ubftab.EX_IF_RSPFILEMIME, 0)
+	name, _ := bufu.BGetString(ubftab.EX_IF_RSPFILENAME, 0)
+	del, _ := bufu.BGetInt16(ubftab.EX_IF_RSPFILEDEL, 0)
+
+	ac.TpLogInfo("Sending file [%s] name [%s] type [%s] delete %d",
+		path, name, ctype, del)
+
+	rpath, err := downloadPath(svc, path)
+
+	if nil != err {
+		ac.TpLogError("Download of [%s] refused: %s", path, err.Error())
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	f, err := os.Open(rpath)
+
+	if nil != err {
+		ac.TpLogError("Failed to open [%s]: %s", rpath, err.Error())
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	defer func() {
+
+		f.Close()
+
+		if 1 == del {
+			if err := os.Remove(rpath); nil != err {
+				ac.TpLogError("Failed to remove [%s]: %s", rpath, err.Error())
+			}
+		}
+	}()
+
+	fi, err := f.Stat()
+
+	if nil != err || !fi.Mode().IsRegular() {
+		ac.TpLogError("[%s] is not a regular file", rpath)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if "" == name {
+		name = filepath.Base(rpath)
+	}
+
+	if "" != ctype {
+		w.Header().Set("Content-Type", ctype)
+	} else if "" == w.Header().Get("Content-Type") {
+		if ctype = mime.TypeByExtension(filepath.Ext(name)); "" != ctype {
+			w.Header().Set("Content-Type", ctype)
+		}
+	}
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": name}))
+
+	http.ServeContent(w, rctx.req, name, fi.ModTime(), f)
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,426 @@
+/**
+ * @brief Routes published by XATMI services at runtime
+ *
+ * @file dynroute.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+/*
+
+Services may publish their REST routes by posting JSON buffer to the event
+configured by 'route_event' (e.g. @RESTIN_ROUTE):
+
+{"op":"add", "url":"/api/v1/orders", "owner":"ORDERSV", "ttl":60,
+	"route":{"svc":"ORDERS", "conv":"json2ubf", "errors":"http"}}
+
+restincl subscribes to the event with separate XATMI context (events are
+delivered as unsolicited messages) and polls it with tpchkunsol(3). The route
+settings are the same as for ini routes and are validated the same way. Route
+expires if not posted again within 'ttl' seconds. Routes from configuration
+cannot be overridden.
+
+Owner is declared by the publisher and is not verified (event has no sender
+identity), it only guards against routes of other services published by
+mistake. Anybody who may post to the event, may publish routes.
+
+*/
+
+//Route operations
+const (
+	ROUTE_OP_ADD = "add"
+	ROUTE_OP_DEL = "del"
+)
+
+const (
+	ROUTE_POLL_DEFAULT    = 1000 //Event poll interval, ms
+	ROUTE_TTL_DEFAULT     = 60   //Published route lifetime, sec
+	METRIC_ROUTES_DYNAMIC = "restincl_routes_dynamic"
+)
+
+//Route publish message
+type RouteMsg struct {
+	Op    string          `json:"op"`    //add (default) or del
+	Url   string          `json:"url"`   //Route URL (or regexp)
+	Owner string          `json:"owner"` //Publisher (not verified), only owner may change the route
+	Ttl   int             `json:"ttl"`   //Lifetime, sec
+	Route json.RawMessage `json:"route"` //Route settings, as in ini
+}
+
+//Published route
+type dynRoute struct {
+	svc     *ServiceMap //Validated route
+	owner   string      //Publisher
+	expires time.Time   //Removed after
+}
+
+var m_routeevent string                  //Event of route publishing, empty - disabled
+var m_routepoll int = ROUTE_POLL_DEFAULT //Poll interval, ms
+var m_routettl int = ROUTE_TTL_DEFAULT   //Default route lifetime, sec
+
+var m_dynroutes = make(map[string]*dynRoute) //Published routes, guarded by m_routesmutex
+
+var m_routeac *atmi.ATMICtx //Context subscribed to the event
+var m_routesub int64        //Subscription id
+var m_routestop chan bool   //Stop the poller
+var m_routedone chan bool   //Poller finished
+
+//Copy the route table
+//@return new handler with the same routes
+func (h *RegexpHandler) clone() *RegexpHandler {
+
+	c := newRegexpHandler()
+	c.defaults = h.defaults
+	c.regexpRoutes = append(c.regexpRoutes, h.regexpRoutes...)
+
+	for url, svc := range h.urlMap {
+		c.urlMap[url] = svc
+	}
+
+	for url, handler := range h.defaultHandler {
+		c.defaultHandler[url] = handler
+	}
+
+	return c
+}
+
+//Check is the route present in the table
+//@param url route URL (or regexp)
+//@return true if present
+func (h *RegexpHandler) hasRoute(url string) bool {
+
+	_, ok := h.getRoute(url)
+
+	return ok
+}
+
+//Find the route in the table
+//@param url route URL (or regexp)
+//@return route settings, true if present
+func (h *RegexpHandler) getRoute(url string) (*ServiceMap, bool) {
+
+	if svc, ok := h.urlMap[url]; ok {
+		return &svc, true
+	}
+
+	for _, r := range h.regexpRoutes {
+		if r.pattern.String() == url {
+			return &r.svc, true
+		}
+	}
+
+	return nil, false
+}
+
+//Build the route table from configured and published routes and start using it.
+//m_routesmutex must be locked.
+//@param ac ATMI context
+func routesPublish(ac *atmi.ATMICtx) {
+
+	h := m_cfgroutes.clone()
+	urls := make([]string, 0, len(m_dynroutes))
+
+	for url := range m_dynroutes {
+		urls = append(urls, url)
+	}
+
+	//Keep the order of regexp routes stable
+	sort.Strings(urls)
+
+	for _, url := range urls {
+
+		if h.hasRoute(url) {
+			ac.TpLogWarn("Published route [%s] is configured now - dropping", url)
+			delete(m_dynroutes, url)
+			continue
+		}
+
+		h.routeAdd(ac, m_dynroutes[url].svc, false)
+	}
+
+	m_handler.Store(h)
+}
+
+//Add or remove the published route
+//@param ac ATMI context
+//@param msg route message
+//@return error
+func routeApply(ac *atmi.ATMICtx, msg *RouteMsg) error {
+
+	if !strings.HasPrefix(msg.Url, "/") {
+		return fmt.Errorf("Invalid route url [%s]", msg.Url)
+	}
+
+	m_routesmutex.Lock()
+	defer m_routesmutex.Unlock()
+
+	old, exists := m_dynroutes[msg.Url]
+
+	if exists && old.owner != msg.Owner {
+		return fmt.Errorf("Route [%s] is owned by [%s]", msg.Url, old.owner)
+	}
+
+	switch msg.Op {
+	case ROUTE_OP_DEL:
+
+		if !exists {
+			return fmt.Errorf("Route [%s] is not published", msg.Url)
+		}
+
+		ac.TpLogWarn("Removing route [%s] of [%s]", msg.Url, msg.Owner)
+		delete(m_dynroutes, msg.Url)
+		routesPublish(ac)
+
+		return nil
+	case "", ROUTE_OP_ADD:
+	default:
+		return fmt.Errorf("Invalid route operation [%s]", msg.Op)
+	}
+
+	if m_cfgroutes.hasRoute(msg.Url) {
+		return fmt.Errorf("Route [%s] is configured, cannot be published", msg.Url)
+	}
+
+	cfg := "{}"
+
+	if len(msg.Route) > 0 {
+		cfg = string(msg.Route)
+	}
+
+	tpopen := m_do_tpopen
+	svc, err := routeLoad(ac, &m_cfgroutes.defaults, msg.Url, cfg)
+	changed := tpopen != m_do_tpopen
+	m_do_tpopen = tpopen
+
+	if nil != err {
+		return err
+	}
+
+	//Process internal and file system routes are configured by admin only
+	if changed || svc.TransactionHandler || nil != svc.LocalHandler ||
+		CONV_STATIC == svc.Conv_int {
+		return fmt.Errorf("Route [%s] of this kind cannot be published", msg.Url)
+	}
+
+	if svc.Format == "regexp" || svc.Format == "r" {
+		if _, err := regexp.Compile(msg.Url); nil != err {
+			return fmt.Errorf("Route [%s]: failed to compile regexp: %s",
+				msg.Url, err.Error())
+		}
+	}
+
+	ttl := msg.Ttl
+
+	if ttl <= 0 {
+		ttl = m_routettl
+	}
+
+	m_dynroutes[msg.Url] = &dynRoute{svc: svc, owner: msg.Owner,
+		expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+
+	ac.TpLogInfo("Route [%s] -> [%s] published by [%s], ttl %d",
+		msg.Url, svc.Svc, msg.Owner, ttl)
+
+	//Refresh may change the settings too
+	routesPublish(ac)
+
+	return nil
+}
+
+//Remove expired routes
+//@param ac ATMI context
+func routesExpire(ac *atmi.ATMICtx) {
+
+	m_routesmutex.Lock()
+	defer m_routesmutex.Unlock()
+
+	now := time.Now()
+	expired := false
+
+	for url, r := range m_dynroutes {
+		if now.After(r.expires) {
+			ac.TpLogWarn("Route [%s] of [%s] expired", url, r.owner)
+			delete(m_dynroutes, url)
+			expired = true
+		}
+	}
+
+	if expired {
+		routesPublish(ac)
+	}
+}
+
+//Route event received
+//@param ac ATMI context
+//@param tb event data, JSON or STRING with JSON
+func routeUnsolHandler(ac *atmi.ATMICtx, tb atmi.TypedBuffer) {
+
+	var msg RouteMsg
+	var data []byte
+
+	itype := ""
+	subtype := ""
+
+	if _, errA := ac.TpTypes(tb.GetBuf(), &itype, &subtype); nil != errA {
+		ac.TpLogError("Failed to get route message type: %s", errA.Error())
+		return
+	}
+
+	switch itype {
+	case "JSON":
+		bufj, _ := ac.CastToJSON(tb.GetBuf())
+		data = bufj.GetJSON()
+	case "STRING":
+		bufs, _ := ac.CastToString(tb.GetBuf())
+		data = []byte(bufs.GetString())
+	default:
+		ac.TpLogError("Unsupported route message type [%s] - dropping", itype)
+		return
+	}
+
+	ac.TpLogInfo("Got route message [%s]", string(data))
+
+	if err := json.Unmarshal(data, &msg); nil != err {
+		ac.TpLogError("Invalid route message - dropping: %s", err.Error())
+		return
+	}
+
+	if err := routeApply(ac, &msg); nil != err {
+		ac.TpLogError("Route message rejected: %s", err.Error())
+		ac.UserLog("restincl: route [%s] of [%s] rejected: %s",
+			msg.Url, msg.Owner, err.Error())
+	}
+}
+
+//Poll the route events and expire the routes until stopped
+func routePoller() {
+
+	ticker := time.NewTicker(time.Duration(m_routepoll) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m_routestop:
+			close(m_routedone)
+			return
+		case <-ticker.C:
+			if _, errA := m_routeac.TpChkUnsol(); nil != errA {
+				m_routeac.TpLogError("tpchkunsol failed: %s", errA.Error())
+			}
+
+			routesExpire(m_routeac)
+		}
+	}
+}
+
+//Subscribe to route events
+//@param ac ATMI context, for logging
+//@return error
+func routeSubStart(ac *atmi.ATMICtx) error {
+
+	if m_routepoll <= 0 || m_routettl <= 0 {
+		return fmt.Errorf("Invalid route_poll %d or route_ttl %d",
+			m_routepoll, m_routettl)
+	}
+
+	rac, errA := atmi.NewATMICtx()
+
+	if nil != errA {
+		return errors.New(errA.Error())
+	}
+
+	if errA = rac.TpInit(); nil != errA {
+		rac.FreeATMICtx()
+		return errors.New(errA.Error())
+	}
+
+	if errA = rac.TpSetUnsol(routeUnsolHandler); nil != errA {
+		rac.TpTerm()
+		rac.FreeATMICtx()
+		return errors.New(errA.Error())
+	}
+
+	//Events to clients are delivered as unsolicited messages
+	if m_routesub, errA = rac.TpSubscribe(m_routeevent, "", nil, 0); nil != errA {
+		rac.TpTerm()
+		rac.FreeATMICtx()
+		return fmt.Errorf("Failed to subscribe to [%s]: %s",
+			m_routeevent, errA.Error())
+	}
+
+	m_routeac = rac
+	m_routestop = make(chan bool)
+	m_routedone = make(chan bool)
+
+	metricsGauge(METRIC_ROUTES_DYNAMIC, func() int64 {
+		m_routesmutex.Lock()
+		defer m_routesmutex.Unlock()
+		return int64(len(m_dynroutes))
+	})
+
+	ac.TpLogInfo("Subscribed to route event [%s], poll %d ms, ttl %d s",
+		m_routeevent, m_routepoll, m_routettl)
+
+	go routePoller()
+
+	return nil
+}
+
+//Unsubscribe from route events
+//@param ac ATMI context, for logging
+func routeSubStop(ac *atmi.ATMICtx) {
+
+	if nil == m_routeac {
+		return
+	}
+
+	close(m_routestop)
+	<-m_routedone
+
+	ac.TpLogInfo("Unsubscribing from route event [%s]", m_routeevent)
+
+	m_routeac.TpUnsubscribe(m_routesub, 0)
+	m_routeac.TpTerm()
+	m_routeac.FreeATMICtx()
+	m_routeac = nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -30,9 +30,11 @@
  * contact@mavimax.com
  * -----------------------------------------------------------------------------
  */
-package main
+package restin
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -56,6 +58,11 @@ const (
 type RequestContext struct {
 	errSrc   string
 	fileList []string
+	instance string //Request URI, for error responses
+	export   string //CSV/TSV export of the response, empty if not requested
+	req      *http.Request
+	timing   *ServerTiming //Phase timing, may be nil
+	status   int           //HTTP status of error response set by bridge, 0 - mapped
 }
 
 //Prepare file upload (request part, download & prepare the UBF buffer)
@@ -71,6 +78,8 @@ func handleFileUploadReq(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, svc *ServiceMap,
 	var n int
 	var err error
 	var occ = 0
+	var files = 0       //Parts with file names
+	var total int64 = 0 //Total size of the upload
 	// define pointers for the multipart reader and its parts
 	var mr *multipart.Reader
 	var part *multipart.Part
@@ -91,6 +100,7 @@ func handleFileUploadReq(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, svc *ServiceMap,
 		var tempfile *os.File
 		var filesize int
 		var uploaded bool
+		var head []byte //Start of the file, for content sniffing
 
 		if part, err = mr.NextPart(); err != nil {
 			if err != io.EOF {
@@ -107,6 +117,22 @@ func handleFileUploadReq(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, svc *ServiceMap,
 		ac.TpLogDebug("Uploaded filename occ=%d: %s", occ, part.FileName())
 		ac.TpLogDebug("Uploaded mimetype occ=%d: %s", occ, part.Header)
 
+		isFile := "" != part.FileName()
+
+		if isFile {
+			files++
+
+			if svc.UploadMaxFiles > 0 && files > svc.UploadMaxFiles {
+				return uploadReject(ac, bufu, http.StatusRequestEntityTooLarge,
+					"Too many files, max %d", svc.UploadMaxFiles)
+			}
+
+			if !uploadExtAllowed(svc, part.FileName()) {
+				return uploadReject(ac, bufu, http.StatusUnsupportedMediaType,
+					"File [%s] extension not allowed", part.FileName())
+			}
+		}
+
 		//Add the file names to the buffer
 		if errU := bufu.BAdd(ubftab.EX_IF_REQFILENAME, part.FileName()); nil != errU {
 			ac.TpLogError("Failed to add EX_IF_REQFILENAME[%d]: %s", occ, errU.Error())
@@ -128,7 +154,7 @@ func handleFileUploadReq(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, svc *ServiceMap,
 
 		//Add the file name to received rctx
 
-		tempfile, err = ioutil.TempFile(svc.Tempdir, fmt.Sprintf("%s-%s", progsection, M_cctag))
+		tempfile, err = ioutil.TempFile(svc.Tempdir, fmt.Sprintf("%s-%s", progsection, m_cctag))
 		if err != nil {
 			return atmi.NewCustomATMIError(atmi.TPEOS,
 				fmt.Sprintf("Error while creating temp file: %s", err.Error()))
@@ -145,6 +171,8 @@ func handleFileUploadReq(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, svc *ServiceMap,
 
 		defer tempfile.Close()
 
+		hash := sha256.New()
+
 		// Read all parts of the file & write off to disk...
 		for !uploaded {
 			if n, err = part.Read(chunk); err != nil {
@@ -161,11 +189,57 @@ func handleFileUploadReq(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, svc *ServiceMap,
 				return atmi.NewCustomATMIError(atmi.TPEOS,
 					fmt.Sprintf("Error writing chunk [%s] to: %s", tempfile.Name(), err.Error()))
 			}
+			hash.Write(chunk[:n])
+
+			if len(head) < 512 {
+				head = append(head, chunk[:n]...)
+			}
+
 			filesize += n
+			total += int64(n)
+
+			if svc.UploadMaxSize > 0 && int64(filesize) > svc.UploadMaxSize {
+				return uploadReject(ac, bufu, http.StatusRequestEntityTooLarge,
+					"File [%s] exceeds max size %d", part.FileName(), svc.UploadMaxSize)
+			}
+
+			if svc.UploadMaxTotal > 0 && total > svc.UploadMaxTotal {
+				return uploadReject(ac, bufu, http.StatusRequestEntityTooLarge,
+					"Upload exceeds max total size %d", svc.UploadMaxTotal)
+			}
 		}
 
 		ac.TpLogInfo("Uploaded file [%s] size: %d bytes", tempfile.Name(), filesize)
 
+		sum := hex.EncodeToString(hash.Sum(nil))
+
+		if errU := bufu.BAdd(ubftab.EX_IF_REQFILESHA256, sum); nil != errU {
+			ac.TpLogError("Failed to add EX_IF_REQFILESHA256[%d]: %s", occ, errU.Error())
+			return atmi.NewCustomATMIError(atmi.TPESYSTEM,
+				fmt.Sprintf("Failed to add EX_IF_REQFILESHA256[%d]: %s", occ, errU.Error()))
+		}
+
+		if isFile {
+
+			if len(head) > 512 {
+				head = head[:512]
+			}
+
+			mtype, ok := uploadMimeAllowed(svc, head)
+
+			if !ok {
+				return uploadReject(ac, bufu, http.StatusUnsupportedMediaType,
+					"File [%s] content type [%s] not allowed", part.FileName(), mtype)
+			}
+
+			if "" != svc.UploadScanSvc {
+				if errA := uploadScan(ac, bufu, svc, occ, tempfile.Name(),
+					part.FileName(), mtype, sum); nil != errA {
+					return errA
+				}
+			}
+		}
+
 		occ++
 	}
 
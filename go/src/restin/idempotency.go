@@ -0,0 +1,721 @@
+/**
+ * @brief Idempotency-Key support - replay of stored responses for retried requests
+ *
+ * @file idempotency.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Idempotency stores
+const (
+	IDEM_NONE  = 0
+	IDEM_MEM   = 1 //Process memory
+	IDEM_SVC   = 2 //XATMI service
+	IDEM_QUEUE = 3 //Persistent queue
+)
+
+//Store operations for service store
+const (
+	IDEM_OP_LOCK   = "lock"
+	IDEM_OP_SAVE   = "save"
+	IDEM_OP_UNLOCK = "unlock"
+)
+
+//Header set on replayed responses
+const IDEM_REPLAY_HDR = "Idempotent-Replayed"
+
+//Max expired records removed from queue store by one sweep
+const IDEM_SWEEP_MAX = 100
+
+/**
+ * Stored request result
+ */
+type IdemRecord struct {
+	Key         string      `json:"key"`
+	Fingerprint string      `json:"fingerprint"`
+	Pending     bool        `json:"pending"`
+	Status      int         `json:"status"`
+	Headers     http.Header `json:"headers,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+	Expires     int64       `json:"expires"`
+}
+
+/**
+ * Service store request
+ */
+type IdemSvcReq struct {
+	Operation string      `json:"operation"`
+	Key       string      `json:"key"`
+	Record    *IdemRecord `json:"record,omitempty"`
+}
+
+/**
+ * Service store response
+ */
+type IdemSvcRsp struct {
+	Found  bool        `json:"found"`
+	Record *IdemRecord `json:"record,omitempty"`
+}
+
+//Idempotency record store
+type IdemStore interface {
+	//Lock the key for processing (store pending record). If key exists, the
+	//stored record is returned and nothing is changed.
+	Lock(ac *atmi.ATMICtx, rec *IdemRecord) (*IdemRecord, error)
+	//Save the final response
+	Save(ac *atmi.ATMICtx, rec *IdemRecord) error
+	//Remove the lock, request was not completed
+	Unlock(ac *atmi.ATMICtx, key string) error
+}
+
+/**
+ * Idempotent request in progress
+ */
+type IdemCtx struct {
+	key         string
+	fingerprint string
+	rec         *RspRecorder
+}
+
+var m_idemmutex sync.Mutex
+
+//Keys processed by this process at the moment
+var m_ideminflight = make(map[string]bool)
+
+///////////////////////////////////////////////////////////////////////////////
+// Memory store
+///////////////////////////////////////////////////////////////////////////////
+
+type idemMemStore struct {
+	mutex sync.Mutex
+	recs  map[string]*IdemRecord
+	max   int
+}
+
+//Remove expired records, if still full, remove the ones expiring first
+func (s *idemMemStore) sweep() {
+
+	now := time.Now().Unix()
+
+	for k, r := range s.recs {
+		if r.Expires <= now {
+			delete(s.recs, k)
+		}
+	}
+
+	for len(s.recs) > s.max {
+		oldk := ""
+		var oldexp int64
+
+		for k, r := range s.recs {
+			if "" == oldk || r.Expires < oldexp {
+				oldk = k
+				oldexp = r.Expires
+			}
+		}
+
+		delete(s.recs, oldk)
+	}
+}
+
+func (s *idemMemStore) Lock(ac *atmi.ATMICtx, rec *IdemRecord) (*IdemRecord, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if r, ok := s.recs[rec.Key]; ok && r.Expires > time.Now().Unix() {
+		ret := *r
+		return &ret, nil
+	}
+
+	s.recs[rec.Key] = rec
+
+	if len(s.recs) > s.max {
+		s.sweep()
+	}
+
+	return nil, nil
+}
+
+func (s *idemMemStore) Save(ac *atmi.ATMICtx, rec *IdemRecord) error {
+
+	s.mutex.Lock()
+	s.recs[rec.Key] = rec
+	s.mutex.Unlock()
+
+	return nil
+}
+
+func (s *idemMemStore) Unlock(ac *atmi.ATMICtx, key string) error {
+
+	s.mutex.Lock()
+	delete(s.recs, key)
+	s.mutex.Unlock()
+
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Service store
+///////////////////////////////////////////////////////////////////////////////
+
+type idemSvcStore struct {
+	svc string
+}
+
+//Call the store service
+//@param ac ATMI context
+//@param req request to send
+//@return service response or error
+func (s *idemSvcStore) call(ac *atmi.ATMICtx, req *IdemSvcReq) (*IdemSvcRsp, error) {
+
+	var rsp IdemSvcRsp
+
+	data, errJ := json.Marshal(req)
+
+	if nil != errJ {
+		return nil, errJ
+	}
+
+	buf, err := ac.NewJSON(data)
+
+	if nil != err {
+		return nil, err
+	}
+
+	defer ac.TpFree(buf.GetBuf())
+
+	if _, err = ac.TpCall(s.svc, buf, 0); nil != err {
+		ac.TpLogError("Idempotency store [%s] %s failed: %s",
+			s.svc, req.Operation, err.Message())
+		return nil, err
+	}
+
+	if rspdata := buf.GetJSON(); len(rspdata) > 0 {
+		if errJ = json.Unmarshal(rspdata, &rsp); nil != errJ {
+			return nil, errJ
+		}
+	}
+
+	return &rsp, nil
+}
+
+func (s *idemSvcStore) Lock(ac *atmi.ATMICtx, rec *IdemRecord) (*IdemRecord, error) {
+
+	rsp, err := s.call(ac, &IdemSvcReq{Operation: IDEM_OP_LOCK, Key: rec.Key,
+		Record: rec})
+
+	if nil != err {
+		return nil, err
+	}
+
+	if rsp.Found && nil != rsp.Record && rsp.Record.Expires > time.Now().Unix() {
+		return rsp.Record, nil
+	}
+
+	return nil, nil
+}
+
+func (s *idemSvcStore) Save(ac *atmi.ATMICtx, rec *IdemRecord) error {
+
+	_, err := s.call(ac, &IdemSvcReq{Operation: IDEM_OP_SAVE, Key: rec.Key,
+		Record: rec})
+
+	return err
+}
+
+func (s *idemSvcStore) Unlock(ac *atmi.ATMICtx, key string) error {
+
+	_, err := s.call(ac, &IdemSvcReq{Operation: IDEM_OP_UNLOCK, Key: key})
+
+	return err
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Queue store
+///////////////////////////////////////////////////////////////////////////////
+
+type idemQueueStore struct {
+	qspace    string
+	qname     string
+	mutex     sync.Mutex //Protects lastsweep
+	lastsweep int64      //Time of last expired records sweep
+}
+
+//Build queue control block for the key
+//@param key idempotency key
+//@return queue control with correlator set
+func (s *idemQueueStore) qctl(key string) *atmi.TPQCTL {
+
+	var ctl atmi.TPQCTL
+
+	corrid := sha256.Sum256([]byte(key))
+	copy(ctl.Corrid[:], corrid[:])
+
+	return &ctl
+}
+
+//Check is the dequeue error "no message"
+//@param err ATMI error
+//@param ctl queue control used
+//@return true if queue has no (more) messages
+func idemQueueEmpty(err atmi.ATMIError, ctl *atmi.TPQCTL) bool {
+	return atmi.TPEDIAGNOSTIC == err.Code() && atmi.QMENOMSG == ctl.Diagnostic
+}
+
+//Store the record in queue
+//@param ac ATMI context
+//@param rec record to store
+//@return error
+func (s *idemQueueStore) put(ac *atmi.ATMICtx, rec *IdemRecord) error {
+
+	data, errJ := json.Marshal(rec)
+
+	if nil != errJ {
+		return errJ
+	}
+
+	buf, err := ac.NewJSON(data)
+
+	if nil != err {
+		return err
+	}
+
+	defer ac.TpFree(buf.GetBuf())
+
+	ctl := s.qctl(rec.Key)
+	ctl.Flags = atmi.TPQCORRID
+
+	if err = ac.TpEnqueue(s.qspace, s.qname, ctl, buf, atmi.TPNOTRAN); nil != err {
+		ac.TpLogError("Idempotency store %s/%s save failed: %s (%d)",
+			s.qspace, s.qname, err.Message(), ctl.Diagnostic)
+		return err
+	}
+
+	return nil
+}
+
+//Remove all the records of the key
+//@param ac ATMI context
+//@param buf buffer for dequeued messages
+//@param key idempotency key
+//@return error
+func (s *idemQueueStore) remove(ac *atmi.ATMICtx, buf *atmi.TypedJSON, key string) error {
+
+	for {
+		ctl := s.qctl(key)
+		ctl.Flags = atmi.TPQGETBYCORRID
+
+		if err := ac.TpDequeue(s.qspace, s.qname, ctl, buf, atmi.TPNOTRAN); nil != err {
+
+			if idemQueueEmpty(err, ctl) {
+				return nil
+			}
+
+			ac.TpLogError("Idempotency store %s/%s remove of [%s] failed: %s (%d)",
+				s.qspace, s.qname, key, err.Message(), ctl.Diagnostic)
+
+			return err
+		}
+	}
+}
+
+//Remove expired records from the head of the queue. Records are enqueued
+//in order of expiry (the same ttl), thus sweep stops at first valid record.
+//Runs at most once per second.
+//@param ac ATMI context
+//@param buf buffer for dequeued messages
+func (s *idemQueueStore) sweep(ac *atmi.ATMICtx, buf *atmi.TypedJSON) {
+
+	now := time.Now().Unix()
+
+	s.mutex.Lock()
+
+	if s.lastsweep == now {
+		s.mutex.Unlock()
+		return
+	}
+
+	s.lastsweep = now
+	s.mutex.Unlock()
+
+	for i := 0; i < IDEM_SWEEP_MAX; i++ {
+
+		var stored IdemRecord
+
+		ctl := &atmi.TPQCTL{Flags: atmi.TPQPEEK}
+
+		if err := ac.TpDequeue(s.qspace, s.qname, ctl, buf, atmi.TPNOTRAN); nil != err {
+
+			if !idemQueueEmpty(err, ctl) {
+				ac.TpLogWarn("Idempotency store %s/%s sweep failed: %s (%d)",
+					s.qspace, s.qname, err.Message(), ctl.Diagnostic)
+			}
+
+			return
+		}
+
+		if errJ := json.Unmarshal(buf.GetJSON(), &stored); nil == errJ &&
+			stored.Expires > now {
+			return
+		}
+
+		ac.TpLogInfo("Idempotency key [%s] expired - removing", stored.Key)
+
+		ctl.Flags = atmi.TPQGETBYMSGID
+
+		if err := ac.TpDequeue(s.qspace, s.qname, ctl, buf, atmi.TPNOTRAN); nil != err &&
+			!idemQueueEmpty(err, ctl) {
+			ac.TpLogWarn("Failed to remove expired key [%s]: %s",
+				stored.Key, err.Message())
+			return
+		}
+	}
+}
+
+//Lookup the key, if not found, enqueue pending marker. Lookup and enqueue
+//is not atomic, thus the same key arriving to several instances at the same
+//moment may be processed more than once.
+func (s *idemQueueStore) Lock(ac *atmi.ATMICtx, rec *IdemRecord) (*IdemRecord, error) {
+
+	var stored IdemRecord
+
+	buf, err := ac.NewJSON([]byte("{}"))
+
+	if nil != err {
+		return nil, err
+	}
+
+	defer ac.TpFree(buf.GetBuf())
+
+	s.sweep(ac, buf)
+
+	ctl := s.qctl(rec.Key)
+	ctl.Flags = atmi.TPQGETBYCORRID | atmi.TPQPEEK
+
+	if err = ac.TpDequeue(s.qspace, s.qname, ctl, buf, atmi.TPNOTRAN); nil != err {
+
+		if !idemQueueEmpty(err, ctl) {
+			ac.TpLogError("Idempotency store %s/%s lookup failed: %s (%d)",
+				s.qspace, s.qname, err.Message(), ctl.Diagnostic)
+
+			return nil, err
+		}
+	} else {
+
+		if errJ := json.Unmarshal(buf.GetJSON(), &stored); nil != errJ {
+			return nil, errJ
+		}
+
+		if stored.Expires > time.Now().Unix() {
+			return &stored, nil
+		}
+
+		ac.TpLogInfo("Idempotency key [%s] expired - removing", rec.Key)
+
+		if errR := s.remove(ac, buf, rec.Key); nil != errR {
+			return nil, errR
+		}
+	}
+
+	//Pending marker, so that other processes see the request in progress
+	return nil, s.put(ac, rec)
+}
+
+//Replace the pending marker with the final response
+func (s *idemQueueStore) Save(ac *atmi.ATMICtx, rec *IdemRecord) error {
+
+	if err := s.Unlock(ac, rec.Key); nil != err {
+		return err
+	}
+
+	return s.put(ac, rec)
+}
+
+//Remove the pending marker
+func (s *idemQueueStore) Unlock(ac *atmi.ATMICtx, key string) error {
+
+	buf, err := ac.NewJSON([]byte("{}"))
+
+	if nil != err {
+		return err
+	}
+
+	defer ac.TpFree(buf.GetBuf())
+
+	return s.remove(ac, buf, key)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Request processing
+///////////////////////////////////////////////////////////////////////////////
+
+//Validate idempotency settings of the route and create the store
+//@param ac ATMI context
+//@param svc service map
+//@return error or nil
+func validateIdemService(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	switch svc.Idempotency {
+	case "":
+		svc.Idem_int = IDEM_NONE
+		return nil
+	case "mem":
+		svc.Idem_int = IDEM_MEM
+
+		if svc.IdemMax <= 0 {
+			return fmt.Errorf("Route [%s]: invalid 'idem_max' %d", svc.Url, svc.IdemMax)
+		}
+
+		svc.IdemStore = &idemMemStore{recs: make(map[string]*IdemRecord),
+			max: svc.IdemMax}
+	case "svc":
+		svc.Idem_int = IDEM_SVC
+
+		if "" == svc.IdemSvc {
+			return fmt.Errorf("Route [%s]: 'idem_svc' must be set for "+
+				"idempotency 'svc'", svc.Url)
+		}
+
+		svc.IdemStore = &idemSvcStore{svc: svc.IdemSvc}
+	case "queue":
+		svc.Idem_int = IDEM_QUEUE
+
+		if "" == svc.IdemQspace || "" == svc.IdemQname {
+			return fmt.Errorf("Route [%s]: 'idem_qspace' and 'idem_qname' must "+
+				"be set for idempotency 'queue'", svc.Url)
+		}
+
+		svc.IdemStore = &idemQueueStore{qspace: svc.IdemQspace, qname: svc.IdemQname}
+	default:
+		return fmt.Errorf("Route [%s]: unsupported idempotency [%s]",
+			svc.Url, svc.Idempotency)
+	}
+
+	if svc.Fileupload {
+		return fmt.Errorf("Route [%s]: idempotency cannot be used with 'fileupload'",
+			svc.Url)
+	}
+
+	if svc.IdemTtl <= 0 {
+		return fmt.Errorf("Route [%s]: invalid 'idem_ttl' %d", svc.Url, svc.IdemTtl)
+	}
+
+	if svc.IdemLockTtl < 0 {
+		return fmt.Errorf("Route [%s]: invalid 'idem_lockttl' %d",
+			svc.Url, svc.IdemLockTtl)
+	} else if 0 == svc.IdemLockTtl {
+
+		//Lock must outlive the service call, but not block the retries of
+		//crashed request for the whole idem_ttl
+		tout, errA := strconv.Atoi(os.Getenv("NDRX_TOUT"))
+
+		if nil != errA || tout <= 0 {
+			tout = IDEM_TOUT_DEFAULT
+		}
+
+		svc.IdemLockTtl = tout + IDEM_LOCK_MARGIN
+	}
+
+	ac.TpLogInfo("Route [%s] idempotency: store [%s] hdr [%s] ttl %d lockttl %d",
+		svc.Url, svc.Idempotency, svc.IdemHdr, svc.IdemTtl, svc.IdemLockTtl)
+
+	return nil
+}
+
+//Reply with idempotency error
+//@param w response writer
+//@param status http status
+//@param code ATMI error code
+//@param msg error message
+func idemReject(w http.ResponseWriter, status int, code int, msg string) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write([]byte(fmt.Sprintf("{\"error_code\":%d,\"error_message\":%q}",
+		code, msg)))
+}
+
+//Start idempotent request processing
+//@param ac ATMI context
+//@param svc service map
+//@param w response writer
+//@param req request
+//@return idempotency context (nil if request has no key), true if response
+//is already sent (replay or reject)
+func idemStart(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
+	req *http.Request) (*IdemCtx, bool) {
+
+	key := req.Header.Get(svc.IdemHdr)
+
+	if "" == key {
+		return nil, false
+	}
+
+	//Safe methods are executed as usual
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		ac.TpLogDebug("Idempotency key ignored for %s", req.Method)
+		return nil, false
+	}
+
+	//Keys are per route
+	key = svc.Url + ":" + key
+
+	body, errR := ioutil.ReadAll(req.Body)
+
+	if nil != errR {
+		ac.TpLogError("Failed to read request: %s", errR.Error())
+		idemReject(w, http.StatusBadRequest, atmi.TPEINVAL, "Failed to read request")
+		return nil, true
+	}
+
+	//Body is read by the request processing again
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	h := sha256.New()
+	h.Write([]byte(req.Method + " " + req.URL.RequestURI() + "\n"))
+	h.Write([]byte(req.Header.Get("Content-Type") + "\n"))
+	h.Write(body)
+	fingerprint := hex.EncodeToString(h.Sum(nil))
+
+	ac.TpLogInfo("Idempotency key [%s] fingerprint [%s]", key, fingerprint)
+
+	m_idemmutex.Lock()
+
+	if m_ideminflight[key] {
+		m_idemmutex.Unlock()
+		ac.TpLogWarn("Idempotency key [%s] is in progress", key)
+		idemReject(w, http.StatusConflict, atmi.TPEMATCH,
+			"Request with the same Idempotency-Key is in progress")
+		return nil, true
+	}
+
+	m_ideminflight[key] = true
+	m_idemmutex.Unlock()
+
+	//Pending lock has short lease, so that key of crashed request is freed
+	stored, err := svc.IdemStore.Lock(ac, &IdemRecord{Key: key,
+		Fingerprint: fingerprint, Pending: true,
+		Expires: time.Now().Unix() + int64(svc.IdemLockTtl)})
+
+	if nil != err || nil != stored {
+		m_idemmutex.Lock()
+		delete(m_ideminflight, key)
+		m_idemmutex.Unlock()
+	}
+
+	if nil != err {
+		ac.TpLogError("Idempotency store failed for key [%s]: %s", key, err.Error())
+		idemReject(w, http.StatusInternalServerError, atmi.TPESYSTEM,
+			"Idempotency store failed")
+		return nil, true
+	}
+
+	if nil != stored {
+
+		if stored.Fingerprint != fingerprint {
+			ac.TpLogWarn("Idempotency key [%s] fingerprint mismatch [%s] vs [%s]",
+				key, fingerprint, stored.Fingerprint)
+			idemReject(w, http.StatusUnprocessableEntity, atmi.TPEINVAL,
+				"Idempotency-Key reused with different request")
+			return nil, true
+		}
+
+		if stored.Pending {
+			ac.TpLogWarn("Idempotency key [%s] is in progress", key)
+			idemReject(w, http.StatusConflict, atmi.TPEMATCH,
+				"Request with the same Idempotency-Key is in progress")
+			return nil, true
+		}
+
+		ac.TpLogInfo("Idempotency key [%s] - replaying stored response %d",
+			key, stored.Status)
+
+		for k, v := range stored.Headers {
+			w.Header()[k] = v
+		}
+
+		w.Header().Set(IDEM_REPLAY_HDR, "true")
+		w.WriteHeader(stored.Status)
+		w.Write(stored.Body)
+
+		return nil, true
+	}
+
+	return &IdemCtx{key: key, fingerprint: fingerprint, rec: NewRspRecorder(w)}, false
+}
+
+//Finish idempotent request, store the response
+//@param ac ATMI context
+//@param svc service map
+//@param ictx idempotency context
+func idemFinish(ac *atmi.ATMICtx, svc *ServiceMap, ictx *IdemCtx) {
+
+	var err error
+
+	if 0 == ictx.rec.Status() {
+		ac.TpLogWarn("Idempotency key [%s] - no response, unlocking", ictx.key)
+		err = svc.IdemStore.Unlock(ac, ictx.key)
+	} else {
+		err = svc.IdemStore.Save(ac, &IdemRecord{Key: ictx.key,
+			Fingerprint: ictx.fingerprint, Status: ictx.rec.Status(),
+			Headers: ictx.rec.HeaderCopy(), Body: ictx.rec.Body(),
+			Expires: time.Now().Unix() + int64(svc.IdemTtl)})
+	}
+
+	if nil != err {
+		ac.TpLogError("Failed to store idempotency key [%s]: %s",
+			ictx.key, err.Error())
+		ac.UserLog("Failed to store idempotency key [%s]: %s",
+			ictx.key, err.Error())
+	}
+
+	m_idemmutex.Lock()
+	delete(m_ideminflight, ictx.key)
+	m_idemmutex.Unlock()
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,171 @@
+/**
+ * @brief JSON key mapping profiles and array/scalar normalization of the routes
+ *
+ * @file jsonmap.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"exutil"
+	"fmt"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Load mapping profile of the route
+//@param ac ATMI context
+//@param svc service map
+//@return error or nil
+func validateJsonMapService(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if "" == svc.JsonMap {
+		return nil
+	}
+
+	if base := convBase(svc.Conv_int); CONV_JSON2UBF != base && CONV_JSON2VIEW != base {
+		return fmt.Errorf("Route [%s]: 'json_map' valid only for json2ubf, "+
+			"json2view, xml2ubf or xml2view conv (cur %s)", svc.Url, svc.Conv)
+	}
+
+	prof, err := exutil.JSONMapLoad(svc.JsonMap)
+
+	if nil != err {
+		return fmt.Errorf("Route [%s]: %s", svc.Url, err.Error())
+	}
+
+	//Error code & message are part of the response, whatever the policy
+	prof.Keep("EX_IF_ECODE", "EX_IF_EMSG")
+
+	svc.JsonMap_prof = prof
+
+	ac.TpLogInfo("Route [%s] JSON mapping profile [%s]: %d fields, unknown [%s]",
+		svc.Url, svc.JsonMap, len(prof.Fields), prof.Unknown)
+
+	return nil
+}
+
+//Setup array/scalar normalization of the route
+//@param ac ATMI context
+//@param svc service map
+//@return error or nil
+func validateJsonNormService(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	norm, err := exutil.NewJSONNorm(svc.JsonArrays, svc.JsonScalars,
+		svc.JsonOmitEmpty, svc.JsonNulls)
+
+	if nil != err {
+		return fmt.Errorf("Route [%s]: %s", svc.Url, err.Error())
+	}
+
+	if nil == norm {
+		return nil
+	}
+
+	if CONV_JSON2UBF != convBase(svc.Conv_int) {
+		return fmt.Errorf("Route [%s]: 'json_arrays', 'json_scalars', "+
+			"'json_omitempty' and 'json_nulls' valid only for json2ubf or "+
+			"xml2ubf conv (cur %s)", svc.Url, svc.Conv)
+	}
+
+	//Error code & message are part of the response even if zero/empty
+	norm.Keep("EX_IF_ECODE", "EX_IF_EMSG")
+
+	svc.JsonNorm = norm
+
+	ac.TpLogInfo("Route [%s] JSON normalization: arrays [%s] scalars [%s] "+
+		"omitempty %t nulls [%s]", svc.Url, svc.JsonArrays, svc.JsonScalars,
+		svc.JsonOmitEmpty, svc.JsonNulls)
+
+	return nil
+}
+
+//Map request message to XATMI field names and normalize it
+//@param ac ATMI context
+//@param svc service map
+//@param body JSON request
+//@return mapped request, ATMI error
+func jsonMapRequest(ac *atmi.ATMICtx, svc *ServiceMap, body []byte) ([]byte, atmi.ATMIError) {
+
+	var err error
+
+	if nil != svc.JsonMap_prof {
+		if body, err = svc.JsonMap_prof.ToXATMI(body,
+			CONV_JSON2VIEW == convBase(svc.Conv_int)); nil != err {
+			ac.TpLogError("Failed to map request by [%s]: %s", svc.JsonMap,
+				err.Error())
+			return nil, atmi.NewCustomATMIError(atmi.TPEINVAL,
+				fmt.Sprintf("Invalid request: %s", err.Error()))
+		}
+	}
+
+	if nil != svc.JsonNorm {
+		if body, err = svc.JsonNorm.ToXATMI(body); nil != err {
+			ac.TpLogError("Failed to normalize request: %s", err.Error())
+			return nil, atmi.NewCustomATMIError(atmi.TPEINVAL,
+				fmt.Sprintf("Invalid request: %s", err.Error()))
+		}
+	}
+
+	ac.TpLogDebug("Mapped request: [%s]", string(body))
+
+	return body, nil
+}
+
+//Normalize response message and map it to API names
+//@param ac ATMI context
+//@param svc service map
+//@param rsp JSON response
+//@return mapped response, ATMI error
+func jsonMapResponse(ac *atmi.ATMICtx, svc *ServiceMap, rsp []byte) ([]byte, atmi.ATMIError) {
+
+	var err error
+
+	if nil != svc.JsonNorm {
+		if rsp, err = svc.JsonNorm.FromXATMI(rsp); nil != err {
+			ac.TpLogError("Failed to normalize response: %s", err.Error())
+			return nil, atmi.NewCustomATMIError(atmi.TPESYSTEM,
+				fmt.Sprintf("Failed to normalize response: %s", err.Error()))
+		}
+	}
+
+	if nil != svc.JsonMap_prof {
+		if rsp, err = svc.JsonMap_prof.FromXATMI(rsp,
+			CONV_JSON2VIEW == convBase(svc.Conv_int)); nil != err {
+			ac.TpLogError("Failed to map response by [%s]: %s", svc.JsonMap,
+				err.Error())
+			return nil, atmi.NewCustomATMIError(atmi.TPESYSTEM,
+				fmt.Sprintf("Failed to map response: %s", err.Error()))
+		}
+	}
+
+	return rsp, nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,153 @@
+/**
+ * @brief Process metrics - counters and gauges in Prometheus text format
+ *
+ * @file metrics.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//Metric names
+const (
+	METRIC_TX_STARTED   = "restincl_tx_started_total"
+	METRIC_TX_COMMITTED = "restincl_tx_committed_total"
+	METRIC_TX_ABORTED   = "restincl_tx_aborted_total"
+	METRIC_TX_REAPED    = "restincl_tx_reaped_total"
+	METRIC_TX_ACTIVE    = "restincl_tx_active"
+)
+
+var m_metricsmutex sync.Mutex
+
+//Counters, by metric name
+var m_metrics = make(map[string]int64)
+
+//Gauges, evaluated when metrics are requested
+var m_gauges = make(map[string]func() int64)
+
+//Increment the counter
+//@param name metric name
+//@param delta value to add
+func metricsAdd(name string, delta int64) {
+	m_metricsmutex.Lock()
+	m_metrics[name] += delta
+	m_metricsmutex.Unlock()
+}
+
+//Register gauge function
+//@param name metric name
+//@param f function returning current value
+func metricsGauge(name string, f func() int64) {
+	m_metricsmutex.Lock()
+	m_gauges[name] = f
+	m_metricsmutex.Unlock()
+}
+
+//Build metrics in Prometheus text exposition format
+//@return metrics text
+func metricsText() []byte {
+
+	var out bytes.Buffer
+	vals := make(map[string]int64)
+
+	m_metricsmutex.Lock()
+
+	for name, val := range m_metrics {
+		vals[name] = val
+	}
+
+	gauges := make(map[string]func() int64)
+	for name, f := range m_gauges {
+		gauges[name] = f
+	}
+
+	m_metricsmutex.Unlock()
+
+	//Gauges may take other locks, thus evaluate them unlocked
+	for name, f := range gauges {
+		vals[name] = f()
+	}
+
+	names := make([]string, 0, len(vals))
+
+	for name := range vals {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	last := ""
+
+	for _, name := range names {
+		mtype := "counter"
+
+		if _, ok := gauges[name]; ok {
+			mtype = "gauge"
+		}
+
+		//Labeled series share the type line of the base name
+		base := name
+		if i := strings.IndexByte(name, '{'); i >= 0 {
+			base = name[:i]
+		}
+
+		if base != last {
+			fmt.Fprintf(&out, "# TYPE %s %s\n", base, mtype)
+			last = base
+		}
+
+		fmt.Fprintf(&out, "%s %d\n", name, vals[name])
+	}
+
+	return out.Bytes()
+}
+
+//Serve metrics route
+//@param w response writer
+//@param req request
+//@param svc route
+func metricsHandler(w http.ResponseWriter, req *http.Request, svc *ServiceMap) {
+
+	if !adminTokenOk(w, req) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	w.Write(metricsText())
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,560 @@
+/**
+ * @brief Shadow calls of route requests to mirror service
+ *
+ * @file mirror.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+/*
+
+Route with 'mirror_svc' sends copy of the converted request buffer to the
+mirror service after the main call is completed, e.g. to test new service
+implementation against real traffic:
+
+/acct={"svc":"ACCTGET", "conv":"json2ubf", "errors":"json",
+	"mirror_svc":"ACCTGET2", "mirror_rate":0.1, "mirror_compare":true}
+
+Buffers are copied into portable form (JSON for UBF and VIEW) and mirror calls
+are made by separate workers with own XATMI contexts ('mirror_workers'),
+via bounded queue ('mirror_queue'). If the queue is full, mirror call is
+dropped. Thus mirroring never blocks or changes the main request. Without
+'mirror_compare' calls are made with TPNOREPLY, otherwise mirror response is
+compared with the main response and differences are logged. UBF response is
+kept as raw copy and is converted after the response is sent to the client.
+
+*/
+
+const (
+	MIRROR_WORKERS_DEFAULT = 2   //Default number of mirror workers
+	MIRROR_QUEUE_DEFAULT   = 100 //Default mirror queue size
+)
+
+const (
+	METRIC_MIRROR_SENT    = "restincl_mirror_sent_total"
+	METRIC_MIRROR_DROPPED = "restincl_mirror_dropped_total"
+	METRIC_MIRROR_FAILED  = "restincl_mirror_failed_total"
+	METRIC_MIRROR_DIFF    = "restincl_mirror_diff_total"
+)
+
+var m_mirrorworkers int = MIRROR_WORKERS_DEFAULT //Mirror workers
+var m_mirrorqueue int = MIRROR_QUEUE_DEFAULT     //Mirror queue size
+
+var m_mirroronce sync.Once       //Workers are started on first use
+var m_mirrorchan chan *mirrorJob //Mirror calls
+var m_mirrorstop chan bool       //Stop the workers
+var m_mirrorwg sync.WaitGroup    //Running workers
+
+//Buffer in portable form, so that it can be moved between contexts
+type mirrorBuf struct {
+	btype   string //Buffer type
+	subtype string //VIEW name
+	data    []byte //Buffer data
+}
+
+//Mirror call
+type mirrorJob struct {
+	url     string     //Route
+	svc     string     //Main service
+	mirror  string     //Mirror service
+	flags   int64      //Call flags
+	req     *mirrorBuf //Request
+	compare bool       //Compare responses
+	rsp     *mirrorBuf //Main response
+	rspCode int        //Main call error code, 0 - ok
+
+	rspUbf *atmi.TypedUBF //Raw copy of UBF main response, not converted yet
+}
+
+//Validate mirror settings
+//@param ac ATMI context
+//@param svc service map
+//@return error or nil
+func validateMirrorService(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if "" == svc.MirrorSvc {
+
+		if svc.MirrorCompare {
+			return fmt.Errorf("Route [%s]: 'mirror_compare' requires 'mirror_svc'",
+				svc.Url)
+		}
+
+		return nil
+	}
+
+	if nil != svc.LocalHandler || CONV_STATIC == svc.Conv_int ||
+		CONV_WEBSOCKET == svc.Conv_int || CONV_STREAM == svc.Conv_int ||
+		svc.Echo || svc.Asynccall || svc.Batch || svc.Fileupload ||
+		svc.TransactionHandler {
+		return fmt.Errorf("Route [%s]: 'mirror_svc' requires synchronous "+
+			"service call route", svc.Url)
+	}
+
+	if 0 == svc.MirrorRate {
+		svc.MirrorRate = 1
+	}
+
+	if svc.MirrorRate < 0 || svc.MirrorRate > 1 {
+		return fmt.Errorf("Route [%s]: invalid 'mirror_rate' %f, expected 0..1",
+			svc.Url, svc.MirrorRate)
+	}
+
+	ac.TpLogInfo("Route [%s]: mirror to [%s] rate %f compare %t",
+		svc.Url, svc.MirrorSvc, svc.MirrorRate, svc.MirrorCompare)
+
+	return nil
+}
+
+//Copy the buffer to portable form
+//@param ac ATMI context
+//@param buf buffer
+//@return portable buffer, error
+func mirrorSnap(ac *atmi.ATMICtx, buf atmi.TypedBuffer) (*mirrorBuf, error) {
+
+	var ret mirrorBuf
+
+	if _, errA := ac.TpTypes(buf.GetBuf(), &ret.btype, &ret.subtype); nil != errA {
+		return nil, errA
+	}
+
+	switch ret.btype {
+	case "UBF", "UBF32", "FML", "FML32":
+		bufu, errA := ac.CastToUBF(buf.GetBuf())
+
+		if nil != errA {
+			return nil, errA
+		}
+
+		js, errA := bufu.TpUBFToJSON()
+
+		if nil != errA {
+			return nil, errA
+		}
+
+		ret.data = []byte(js)
+	case "VIEW", "VIEW32":
+		bufv, errA := ac.CastToVIEW(buf.GetBuf())
+
+		if nil != errA {
+			return nil, errA
+		}
+
+		js, errA := bufv.TpVIEWToJSON(0)
+
+		if nil != errA {
+			return nil, errA
+		}
+
+		ret.data = []byte(js)
+	case "STRING":
+		bufs, errA := ac.CastToString(buf.GetBuf())
+
+		if nil != errA {
+			return nil, errA
+		}
+
+		ret.data = []byte(bufs.GetString())
+	case "JSON":
+		bufj, errA := ac.CastToJSON(buf.GetBuf())
+
+		if nil != errA {
+			return nil, errA
+		}
+
+		ret.data = append([]byte(nil), bufj.GetJSON()...)
+	case "CARRAY":
+		bufc, errA := ac.CastToCarray(buf.GetBuf())
+
+		if nil != errA {
+			return nil, errA
+		}
+
+		ret.data = append([]byte(nil), bufc.GetBytes()...)
+	default:
+		return nil, fmt.Errorf("Buffer type [%s] cannot be mirrored", ret.btype)
+	}
+
+	return &ret, nil
+}
+
+//Restore the buffer from portable form
+//@param ac ATMI context
+//@param m portable buffer
+//@return typed buffer, error
+func mirrorBufNew(ac *atmi.ATMICtx, m *mirrorBuf) (atmi.TypedBuffer, error) {
+
+	switch m.btype {
+	case "VIEW", "VIEW32":
+		bufv, errA := ac.TpJSONToVIEW(string(m.data))
+
+		if nil != errA {
+			return nil, errA
+		}
+
+		return bufv, nil
+	case "STRING":
+		bufs, errA := ac.NewString(string(m.data))
+
+		if nil != errA {
+			return nil, errA
+		}
+
+		return bufs, nil
+	case "JSON":
+		bufj, errA := ac.NewJSON(m.data)
+
+		if nil != errA {
+			return nil, errA
+		}
+
+		return bufj, nil
+	case "CARRAY":
+		bufc, errA := ac.NewCarray(m.data)
+
+		if nil != errA {
+			return nil, errA
+		}
+
+		return bufc, nil
+	}
+
+	bufu, errA := ac.NewUBF(atmi.ATMIMsgSizeMax())
+
+	if nil != errA {
+		return nil, errA
+	}
+
+	if errA = bufu.TpJSONToUBF(string(m.data)); nil != errA {
+		return nil, errA
+	}
+
+	return bufu, nil
+}
+
+//Copy UBF buffer as is, in the same context
+//@param ac ATMI context
+//@param buf buffer
+//@return copy or nil if buffer is not UBF, error
+func mirrorUbfCopy(ac *atmi.ATMICtx, buf atmi.TypedBuffer) (*atmi.TypedUBF, error) {
+
+	var btype, subtype string
+
+	if _, errA := ac.TpTypes(buf.GetBuf(), &btype, &subtype); nil != errA {
+		return nil, errA
+	}
+
+	switch btype {
+	case "UBF", "UBF32", "FML", "FML32":
+	default:
+		return nil, nil
+	}
+
+	bufu, errA := ac.CastToUBF(buf.GetBuf())
+
+	if nil != errA {
+		return nil, errA
+	}
+
+	size, errU := bufu.BSizeof()
+
+	if nil != errU {
+		return nil, errU
+	}
+
+	cp, errA := ac.NewUBF(size)
+
+	if nil != errA {
+		return nil, errA
+	}
+
+	if errU = ac.BCpy(cp, bufu); nil != errU {
+		ac.TpFree(cp.GetBuf())
+		return nil, errU
+	}
+
+	return cp, nil
+}
+
+//Prepare the mirror call for the sampled request. Called after main call,
+//before the response is generated (which changes the buffer).
+//@param ac ATMI context of the main call
+//@param svc route
+//@param req request snapshot, taken before the main call
+//@param buf main response buffer
+//@param err main call error
+//@param flags call flags
+//@return mirror call
+func mirrorJobNew(ac *atmi.ATMICtx, svc *ServiceMap, req *mirrorBuf,
+	buf atmi.TypedBuffer, err atmi.ATMIError, flags int64) *mirrorJob {
+
+	job := mirrorJob{url: svc.Url, svc: svc.Svc, mirror: svc.MirrorSvc,
+		flags: flags, req: req, compare: svc.MirrorCompare}
+
+	if !job.compare {
+		return &job
+	}
+
+	if nil != err {
+		job.rspCode = err.Code()
+	}
+
+	//Response buffer is not available for e.g. timeouts
+	if nil != err && atmi.TPESVCFAIL != err.Code() {
+		return &job
+	}
+
+	rspUbf, errS := mirrorUbfCopy(ac, buf)
+
+	if nil == errS && nil != rspUbf {
+		job.rspUbf = rspUbf
+	} else if nil == errS {
+		job.rsp, errS = mirrorSnap(ac, buf)
+	}
+
+	if nil != errS {
+		ac.TpLogWarn("Route [%s]: mirror response copy failed: %s",
+			svc.Url, errS.Error())
+		job.compare = false
+	}
+
+	return &job
+}
+
+//Queue the mirror call. Called after the response is generated.
+//@param ac ATMI context of the main call
+//@param w response writer, main response is flushed to the client
+//@param job mirror call
+func mirrorSubmit(ac *atmi.ATMICtx, w http.ResponseWriter, job *mirrorJob) {
+
+	if nil != job.rspUbf {
+
+		//Conversion does not delay the client
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+
+		var errS error
+
+		if job.rsp, errS = mirrorSnap(ac, job.rspUbf); nil != errS {
+			ac.TpLogWarn("Route [%s]: mirror response copy failed: %s",
+				job.url, errS.Error())
+			job.compare = false
+		}
+
+		ac.TpFree(job.rspUbf.GetBuf())
+		job.rspUbf = nil
+	}
+
+	m_mirroronce.Do(mirrorStart)
+
+	select {
+	case m_mirrorchan <- job:
+		ac.TpLogDebug("Route [%s]: mirror call to [%s] queued",
+			job.url, job.mirror)
+	default:
+		ac.TpLogWarn("Route [%s]: mirror queue full, dropping call to [%s]",
+			job.url, job.mirror)
+		metricsAdd(METRIC_MIRROR_DROPPED, 1)
+	}
+}
+
+//Take request copy for the mirror, if route is mirrored and request is sampled
+//@param ac ATMI context
+//@param svc route
+//@param buf request buffer
+//@return portable request or nil
+func mirrorSample(ac *atmi.ATMICtx, svc *ServiceMap, buf atmi.TypedBuffer) *mirrorBuf {
+
+	if "" == svc.MirrorSvc || rand.Float64() >= svc.MirrorRate {
+		return nil
+	}
+
+	ret, err := mirrorSnap(ac, buf)
+
+	if nil != err {
+		ac.TpLogWarn("Route [%s]: mirror request copy failed: %s",
+			svc.Url, err.Error())
+		return nil
+	}
+
+	return ret
+}
+
+//Perform mirror call
+//@param ac mirror worker context
+//@param job mirror call
+func mirrorCall(ac *atmi.ATMICtx, job *mirrorJob) {
+
+	buf, err := mirrorBufNew(ac, job.req)
+
+	if nil != err {
+		ac.TpLogError("Route [%s]: failed to build mirror buffer: %s",
+			job.url, err.Error())
+		metricsAdd(METRIC_MIRROR_FAILED, 1)
+		return
+	}
+
+	//Reply may reallocate the buffer
+	defer func() {
+		ac.TpFree(buf.GetBuf())
+	}()
+
+	metricsAdd(METRIC_MIRROR_SENT, 1)
+
+	if !job.compare {
+
+		if _, errA := ac.TpACall(job.mirror, buf, job.flags|atmi.TPNOREPLY); nil != errA {
+			ac.TpLogError("Route [%s]: mirror call to [%s] failed: %s",
+				job.url, job.mirror, errA.Error())
+			metricsAdd(METRIC_MIRROR_FAILED, 1)
+		}
+
+		return
+	}
+
+	code := 0
+	var rsp *mirrorBuf
+
+	if _, errA := ac.TpCall(job.mirror, buf, job.flags); nil != errA {
+		code = errA.Code()
+	}
+
+	if 0 == code || atmi.TPESVCFAIL == code {
+		rsp, err = mirrorSnap(ac, buf)
+
+		if nil != err {
+			ac.TpLogError("Route [%s]: failed to read mirror response: %s",
+				job.url, err.Error())
+			metricsAdd(METRIC_MIRROR_FAILED, 1)
+			return
+		}
+	}
+
+	same := code == job.rspCode && (nil == rsp) == (nil == job.rsp)
+
+	if same && nil != rsp {
+		same = rsp.btype == job.rsp.btype && rsp.subtype == job.rsp.subtype &&
+			bytes.Equal(rsp.data, job.rsp.data)
+	}
+
+	if same {
+		ac.TpLogDebug("Route [%s]: mirror [%s] response matches [%s]",
+			job.url, job.mirror, job.svc)
+		return
+	}
+
+	metricsAdd(METRIC_MIRROR_DIFF, 1)
+
+	ac.TpLogWarn("Route [%s]: mirror [%s] response differs from [%s]: "+
+		"error %d vs %d", job.url, job.mirror, job.svc, code, job.rspCode)
+
+	if nil != job.rsp {
+		ac.TpLogDebug("Main response [%s]: %s", job.rsp.btype, string(job.rsp.data))
+	}
+
+	if nil != rsp {
+		ac.TpLogDebug("Mirror response [%s]: %s", rsp.btype, string(rsp.data))
+	}
+}
+
+//Mirror worker
+//@param ac worker context
+func mirrorWorker(ac *atmi.ATMICtx) {
+
+	defer m_mirrorwg.Done()
+
+	for {
+		select {
+		case <-m_mirrorstop:
+			ac.TpTerm()
+			ac.FreeATMICtx()
+			return
+		case job := <-m_mirrorchan:
+			mirrorCall(ac, job)
+		}
+	}
+}
+
+//Start mirror workers, on first mirrored request
+func mirrorStart() {
+
+	m_mirrorchan = make(chan *mirrorJob, m_mirrorqueue)
+	m_mirrorstop = make(chan bool)
+
+	for i := 0; i < m_mirrorworkers; i++ {
+
+		ac, errA := atmi.NewATMICtx()
+
+		if nil != errA {
+			m_ac.TpLogError("Failed to create mirror context: %s", errA.Message())
+			break
+		}
+
+		if errA = ac.TpInit(); nil != errA {
+			m_ac.TpLogError("Failed to init mirror context: %s", errA.Message())
+			ac.FreeATMICtx()
+			break
+		}
+
+		m_mirrorwg.Add(1)
+		go mirrorWorker(ac)
+	}
+
+	m_ac.TpLogInfo("Mirror workers started, queue %d", m_mirrorqueue)
+}
+
+//Stop mirror workers, queued calls are dropped
+//@param ac ATMI context, for logging
+func mirrorStop(ac *atmi.ATMICtx) {
+
+	//Do not start workers after this point
+	started := true
+	m_mirroronce.Do(func() { started = false })
+
+	if !started {
+		return
+	}
+
+	ac.TpLogInfo("Stopping mirror workers")
+
+	close(m_mirrorstop)
+	m_mirrorwg.Wait()
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,301 @@
+/**
+ * @brief Mock responses of routes, served from fixture files
+ *
+ * @file mock.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+/*
+
+Route with 'mock' returns responses from fixture file, without calling the
+service. Fixture file is JSON array of cases, first matching case is served:
+
+[
+	{"method":"GET", "params":{"id":"1"}, "response":{"id":1, "name":"Demo"}},
+	{"method":"POST", "match":{"type":"card"}, "status":201,
+		"headers":{"Location":"/acct/2"}, "response_file":"acct2.json"},
+	{"status":404, "delay":200, "response":{"error":"not found"}}
+]
+
+Case conditions (all optional): 'method', 'params' - named groups of regexp
+route URL, 'query' - query parameters, 'match' - top level fields of JSON
+request body. Global 'mock' setting serves all service routes from fixtures.
+
+*/
+
+const (
+	MOCK_SVC = "@RINMOCK" //Service of route without back-end
+)
+
+var m_mockall bool //All service routes are served from fixtures
+
+//Fixture case
+type MockCase struct {
+	Method       string                 `json:"method"`        //HTTP method
+	Params       map[string]string      `json:"params"`        //Path parameters
+	Query        map[string]string      `json:"query"`         //Query parameters
+	Match        map[string]interface{} `json:"match"`         //JSON body fields
+	Status       int                    `json:"status"`        //HTTP status, default 200
+	Headers      map[string]string      `json:"headers"`       //Response headers
+	Delay        int                    `json:"delay"`         //Response delay, ms
+	Response     json.RawMessage        `json:"response"`      //Response, JSON or string
+	ResponseFile string                 `json:"response_file"` //Response from file
+
+	body  []byte //Response body
+	ctype string //Default content type
+}
+
+//Load and validate mock fixtures
+//@param ac ATMI context
+//@param svc service map
+//@return error or nil
+func validateMockService(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if "" == svc.Mock {
+		return nil
+	}
+
+	if nil != svc.LocalHandler || CONV_STATIC == svc.Conv_int ||
+		CONV_WEBSOCKET == svc.Conv_int {
+		return fmt.Errorf("Route [%s]: 'mock' is not supported by this route",
+			svc.Url)
+	}
+
+	src, err := ioutil.ReadFile(svc.Mock)
+
+	if nil != err {
+		return fmt.Errorf("Route [%s]: failed to read mock fixtures: %s",
+			svc.Url, err.Error())
+	}
+
+	if err = json.Unmarshal(src, &svc.Mock_cases); nil != err {
+		return fmt.Errorf("Route [%s]: invalid mock fixtures [%s]: %s",
+			svc.Url, svc.Mock, err.Error())
+	}
+
+	if 0 == len(svc.Mock_cases) {
+		return fmt.Errorf("Route [%s]: no cases in mock fixtures [%s]",
+			svc.Url, svc.Mock)
+	}
+
+	dir := filepath.Dir(svc.Mock)
+
+	for i := range svc.Mock_cases {
+
+		c := &svc.Mock_cases[i]
+
+		if 0 == c.Status {
+			c.Status = http.StatusOK
+		}
+
+		if c.Status < 100 || c.Status > 599 || c.Delay < 0 {
+			return fmt.Errorf("Route [%s]: mock case %d: invalid status %d "+
+				"or delay %d", svc.Url, i, c.Status, c.Delay)
+		}
+
+		if len(c.Params) > 0 && svc.Format != "regexp" && svc.Format != "r" {
+			return fmt.Errorf("Route [%s]: mock case %d: 'params' require "+
+				"regexp route", svc.Url, i)
+		}
+
+		var s string
+
+		switch {
+		case "" != c.ResponseFile:
+
+			file := c.ResponseFile
+
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(dir, file)
+			}
+
+			if c.body, err = ioutil.ReadFile(file); nil != err {
+				return fmt.Errorf("Route [%s]: mock case %d: %s",
+					svc.Url, i, err.Error())
+			}
+
+			c.ctype = mime.TypeByExtension(filepath.Ext(file))
+		case len(c.Response) > 0 && nil == json.Unmarshal(c.Response, &s):
+			//String is sent as is
+			c.body = []byte(s)
+			c.ctype = "text/plain"
+		case len(c.Response) > 0:
+			c.body = c.Response
+			c.ctype = "application/json"
+		}
+	}
+
+	if svc.Format == "regexp" || svc.Format == "r" {
+		if svc.Mock_re, err = regexp.Compile(svc.Url); nil != err {
+			return fmt.Errorf("Route [%s]: failed to compile regexp: %s",
+				svc.Url, err.Error())
+		}
+	}
+
+	//Back-end may not exist
+	if "" == svc.Svc {
+		svc.Svc = MOCK_SVC
+	}
+
+	ac.TpLogInfo("Route [%s]: %d mock cases from [%s]", svc.Url,
+		len(svc.Mock_cases), svc.Mock)
+
+	return nil
+}
+
+//Is the route served from fixtures
+//@param svc route
+//@return true if mocked
+func mockRoute(svc *ServiceMap) bool {
+
+	return len(svc.Mock_cases) > 0 || (m_mockall && nil == svc.LocalHandler)
+}
+
+//Check the case conditions
+//@param c fixture case
+//@param req request
+//@param params path parameters
+//@param body parsed JSON body, nil if not JSON
+//@return true if matches
+func mockMatch(c *MockCase, req *http.Request, params map[string]string,
+	body map[string]interface{}) bool {
+
+	if "" != c.Method && !strings.EqualFold(c.Method, req.Method) {
+		return false
+	}
+
+	for k, v := range c.Params {
+		if pv, ok := params[k]; !ok || pv != v {
+			return false
+		}
+	}
+
+	query := req.URL.Query()
+
+	for k, v := range c.Query {
+		if qv, ok := query[k]; !ok || 0 == len(qv) || qv[0] != v {
+			return false
+		}
+	}
+
+	for k, v := range c.Match {
+		if bv, ok := body[k]; !ok || !reflect.DeepEqual(bv, v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+//Serve the request from fixtures, without worker pool
+//@param w response writer
+//@param req request
+//@param svc route
+func mockServe(w http.ResponseWriter, req *http.Request, svc *ServiceMap) {
+
+	if 0 == len(svc.Mock_cases) {
+		m_ac.TpLogWarn("Route [%s]: no mock fixtures", svc.Url)
+		http.Error(w, "No mock fixtures for the route", http.StatusServiceUnavailable)
+		return
+	}
+
+	params := make(map[string]string)
+
+	if nil != svc.Mock_re {
+		if m := svc.Mock_re.FindStringSubmatch(req.URL.Path); nil != m {
+			for i, name := range svc.Mock_re.SubexpNames() {
+				if "" != name {
+					params[name] = m[i]
+				}
+			}
+		}
+	}
+
+	var body map[string]interface{}
+
+	if data, err := ioutil.ReadAll(req.Body); nil == err && len(data) > 0 {
+		//Not a JSON object - match conditions do not apply
+		json.Unmarshal(data, &body)
+	}
+
+	for i := range svc.Mock_cases {
+
+		c := &svc.Mock_cases[i]
+
+		if !mockMatch(c, req, params, body) {
+			continue
+		}
+
+		m_ac.TpLogInfo("Route [%s]: serving mock case %d, status %d",
+			svc.Url, i, c.Status)
+
+		if c.Delay > 0 {
+			select {
+			case <-time.After(time.Duration(c.Delay) * time.Millisecond):
+			case <-req.Context().Done():
+				return
+			}
+		}
+
+		if "" != c.ctype {
+			w.Header().Set("Content-Type", c.ctype)
+		}
+
+		for k, v := range c.Headers {
+			w.Header().Set(k, v)
+		}
+
+		w.WriteHeader(c.Status)
+		w.Write(c.body)
+
+		return
+	}
+
+	m_ac.TpLogWarn("Route [%s]: no mock case matches %s %s", svc.Url,
+		req.Method, req.URL)
+	http.NotFound(w, req)
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,369 @@
+/**
+ * @brief Content negotiation - JSON, XML, MessagePack and CBOR formats of the routes
+ *
+ * @file negotiate.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"bytes"
+	"encoding/json"
+	"exutil"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+/*
+
+Routes with JSON based conversion (json2ubf, json2view, xml2ubf, xml2view) may
+enable additional formats. The request is converted to JSON by Content-Type,
+the response (including error envelopes) is produced in the native format of
+the route and then transcoded to the format selected by Accept header.
+
+*/
+
+//Message formats
+const (
+	FMT_JSON    = 1
+	FMT_XML     = 2
+	FMT_MSGPACK = 3
+	FMT_CBOR    = 4
+)
+
+//Format names used in 'formats' setting
+var m_fmts = map[string]int{
+	"json":    FMT_JSON,
+	"xml":     FMT_XML,
+	"msgpack": FMT_MSGPACK,
+	"cbor":    FMT_CBOR,
+}
+
+//Formats by MIME type
+var m_fmtmimes = map[string]int{
+	"application/json":        FMT_JSON,
+	"application/xml":         FMT_XML,
+	"text/xml":                FMT_XML,
+	"application/msgpack":     FMT_MSGPACK,
+	"application/x-msgpack":   FMT_MSGPACK,
+	"application/vnd.msgpack": FMT_MSGPACK,
+	"application/cbor":        FMT_CBOR,
+}
+
+//Response MIME types
+var m_fmtrsp = map[int]string{
+	FMT_JSON:    "application/json",
+	FMT_XML:     "application/xml",
+	FMT_MSGPACK: "application/msgpack",
+	FMT_CBOR:    "application/cbor",
+}
+
+//Native format of the route
+//@param svc service map
+//@return format
+func fmtNative(svc *ServiceMap) int {
+
+	if CONV_XML2UBF == svc.Conv_int || CONV_XML2VIEW == svc.Conv_int {
+		return FMT_XML
+	}
+
+	return FMT_JSON
+}
+
+//Validate formats of the route
+//@param ac ATMI context
+//@param svc service map
+//@return error or nil
+func validateFormatsService(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if "" == svc.Formats {
+		return nil
+	}
+
+	base := convBase(svc.Conv_int)
+
+	if CONV_JSON2UBF != base && CONV_JSON2VIEW != base {
+		return fmt.Errorf("Route [%s]: 'formats' valid only for json2ubf, "+
+			"json2view, xml2ubf or xml2view conv (cur %s)", svc.Url, svc.Conv)
+	}
+
+	svc.Formats_map = map[int]bool{fmtNative(svc): true}
+
+	for _, f := range strings.Split(svc.Formats, ",") {
+
+		f = strings.TrimSpace(f)
+
+		id, ok := m_fmts[f]
+
+		if !ok {
+			return fmt.Errorf("Route [%s]: invalid format [%s] in 'formats'",
+				svc.Url, f)
+		}
+
+		svc.Formats_map[id] = true
+	}
+
+	if svc.Formats_map[FMT_XML] && "" == svc.XmlRoot {
+
+		if CONV_JSON2UBF == base {
+			svc.XmlRoot = XML_ROOT_DEFAULT
+		} else if ERRORS_JSON == svc.Errors_int {
+			//Error fields are next to the VIEW object
+			return fmt.Errorf("Route [%s]: 'xml_root' is mandatory for json2view "+
+				"with 'xml' format and 'json' errors", svc.Url)
+		}
+	}
+
+	//Cached responses differ by format
+	if svc.Cache {
+		svc.CacheHdrs_arr = append(svc.CacheHdrs_arr, "Accept")
+	}
+
+	ac.TpLogInfo("Route [%s] formats: [%s]", svc.Url, svc.Formats)
+
+	return nil
+}
+
+//Select response format by Accept header
+//@param svc service map
+//@param accept Accept header value
+//@return format, 0 if none of the formats is acceptable
+func fmtAccept(svc *ServiceMap, accept string) int {
+
+	best := 0
+	bestq := 0.0
+
+	for _, part := range strings.Split(accept, ",") {
+
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+
+		if nil != err {
+			continue
+		}
+
+		q := 1.0
+
+		if qs, ok := params["q"]; ok {
+			if v, err := strconv.ParseFloat(qs, 64); nil == err {
+				q = v
+			}
+		}
+
+		if q <= bestq {
+			continue
+		}
+
+		f := 0
+
+		if "*/*" == mt || "application/*" == mt {
+			f = fmtNative(svc)
+		} else if id, ok := m_fmtmimes[mt]; ok && svc.Formats_map[id] {
+			f = id
+		}
+
+		if 0 != f {
+			best = f
+			bestq = q
+		}
+	}
+
+	return best
+}
+
+//Negotiate request and response formats
+//@param ac ATMI context
+//@param svc service map
+//@param req request
+//@return request format, response format, HTTP status if failed (0 - ok).
+//	If failed, response format is still valid for the error response.
+func fmtNegotiate(ac *atmi.ATMICtx, svc *ServiceMap, req *http.Request) (int, int, int) {
+
+	native := fmtNative(svc)
+
+	if nil == svc.Formats_map {
+		return native, native, 0
+	}
+
+	reqFmt := native
+	rspFmt := native
+
+	if accept := req.Header.Get("Accept"); "" != accept {
+
+		if rspFmt = fmtAccept(svc, accept); 0 == rspFmt {
+			ac.TpLogError("No acceptable format for [%s] in route [%s]",
+				accept, svc.Url)
+			return native, native, http.StatusNotAcceptable
+		}
+	}
+
+	//Unknown content types are processed as native (not checked before)
+	if ct := req.Header.Get("Content-Type"); "" != ct {
+
+		if mt, _, err := mime.ParseMediaType(ct); nil == err {
+
+			if id, ok := m_fmtmimes[mt]; ok {
+
+				if !svc.Formats_map[id] {
+					ac.TpLogError("Content-Type [%s] not enabled for route [%s]",
+						ct, svc.Url)
+					return native, rspFmt, http.StatusUnsupportedMediaType
+				}
+
+				reqFmt = id
+			}
+		}
+	}
+
+	ac.TpLogDebug("Negotiated formats: request %d response %d", reqFmt, rspFmt)
+
+	return reqFmt, rspFmt, 0
+}
+
+//Convert MessagePack or CBOR request to JSON
+//@param f request format
+//@param body request body
+//@return JSON message, error
+func fmtToJSON(f int, body []byte) ([]byte, error) {
+
+	var v interface{}
+	var err error
+
+	if FMT_MSGPACK == f {
+		v, err = exutil.MsgpackUnmarshal(body)
+	} else {
+		v, err = exutil.CborUnmarshal(body)
+	}
+
+	if nil != err {
+		return nil, err
+	}
+
+	return json.Marshal(v)
+}
+
+//Transcode response of the native format to given format
+//@param svc service map
+//@param body response body
+//@param ct response Content-Type
+//@param f target format
+//@return transcoded body (nil if not JSON or XML response), error
+func fmtTranscode(svc *ServiceMap, body []byte, ct string, f int) ([]byte, error) {
+
+	var js []byte
+	var err error
+
+	mt, _, _ := mime.ParseMediaType(ct)
+
+	switch {
+	case "application/json" == mt || strings.HasSuffix(mt, "+json"):
+		js = body
+	case "application/xml" == mt || "text/xml" == mt || strings.HasSuffix(mt, "+xml"):
+
+		keepRoot := CONV_JSON2VIEW == convBase(svc.Conv_int) && "" == svc.XmlRoot
+
+		if js, err = xmlToJSON(body, keepRoot); nil != err {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+
+	switch f {
+	case FMT_JSON:
+		return js, nil
+	case FMT_XML:
+		return jsonToXML(js, svc.XmlRoot)
+	}
+
+	var v interface{}
+
+	d := json.NewDecoder(bytes.NewReader(js))
+	d.UseNumber()
+
+	if err = d.Decode(&v); nil != err {
+		return nil, err
+	}
+
+	if FMT_MSGPACK == f {
+		return exutil.MsgpackMarshal(v)
+	}
+
+	return exutil.CborMarshal(v)
+}
+
+//Send buffered response in negotiated format
+//@param ac ATMI context
+//@param svc service map
+//@param w response writer
+//@param rsp response in native format
+//@param f response format
+func fmtSend(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
+	rsp *RspBuffer, f int) {
+
+	body := rsp.Body()
+	status := rsp.Status()
+
+	if 0 == status {
+		status = http.StatusOK
+	}
+
+	for k, v := range rsp.Header() {
+		w.Header()[k] = v
+	}
+
+	if len(body) > 0 {
+
+		out, err := fmtTranscode(svc, body, rsp.Header().Get("Content-Type"), f)
+
+		if nil != err {
+			ac.TpLogError("Failed to convert response to [%s]: %s",
+				m_fmtrsp[f], err.Error())
+			w.Header().Del("Content-Length")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		//Length of native body is set by genRsp()
+		if nil != out {
+			body = out
+			w.Header().Set("Content-Type", m_fmtrsp[f])
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		}
+	}
+
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,289 @@
+/**
+ * @brief Content negotiation tests
+ *
+ * @file negotiate_test.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"encoding/json"
+	"exutil"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//ATMI context for logging, test is skipped if Enduro/X is not available
+//@param t test
+//@return ATMI context
+func testAtmiCtx(t *testing.T) *atmi.ATMICtx {
+
+	ac, err := atmi.NewATMICtx()
+
+	if nil != err {
+		t.Skipf("No ATMI context: %s", err.Error())
+	}
+
+	return ac
+}
+
+//Route with formats enabled
+//@param t test
+//@param ac ATMI context
+//@param formats additional formats
+//@return service map
+func testFmtService(t *testing.T, ac *atmi.ATMICtx, formats string) *ServiceMap {
+
+	svc := &ServiceMap{Url: "/fmt", Svc: "FMTSV", Conv: "json2ubf",
+		Conv_int: CONV_JSON2UBF, Errors_int: ERRORS_JSON, Formats: formats}
+
+	if err := validateFormatsService(ac, svc); nil != err {
+		t.Fatalf("validateFormatsService: %s", err.Error())
+	}
+
+	return svc
+}
+
+func TestFmtAccept(t *testing.T) {
+
+	ac := testAtmiCtx(t)
+	defer ac.FreeATMICtx()
+
+	svc := testFmtService(t, ac, "xml,msgpack")
+
+	tests := []struct {
+		accept string
+		exp    int
+	}{
+		{"application/json", FMT_JSON},
+		{"application/xml", FMT_XML},
+		{"text/xml", FMT_XML},
+		{"application/x-msgpack", FMT_MSGPACK},
+		{"*/*", FMT_JSON},
+		{"application/*", FMT_JSON},
+		{"text/html", 0},
+		{"application/cbor", 0},
+		{"application/xml;q=0", 0},
+		{"application/xml;q=0.5, application/msgpack", FMT_MSGPACK},
+		{"application/xml;q=0.9, application/json;q=0.1", FMT_XML},
+		{"text/html, application/msgpack;q=0.2", FMT_MSGPACK},
+		{"application/cbor, */*;q=0.1", FMT_JSON},
+		{"application/xml, */*;q=0.1", FMT_XML},
+		{"text/html;q=1, application/xml;q=bad", FMT_XML},
+		{";;;, application/xml", FMT_XML},
+	}
+
+	for _, tc := range tests {
+		if got := fmtAccept(svc, tc.accept); got != tc.exp {
+			t.Errorf("Accept [%s]: got %d, expected %d", tc.accept, got, tc.exp)
+		}
+	}
+}
+
+func TestFmtNegotiate(t *testing.T) {
+
+	ac := testAtmiCtx(t)
+	defer ac.FreeATMICtx()
+
+	svc := testFmtService(t, ac, "xml,msgpack")
+	plain := testFmtService(t, ac, "")
+
+	tests := []struct {
+		svc    *ServiceMap
+		accept string
+		ct     string
+		reqFmt int
+		rspFmt int
+		status int
+	}{
+		{svc, "", "", FMT_JSON, FMT_JSON, 0},
+		{svc, "", "application/json; charset=utf-8", FMT_JSON, FMT_JSON, 0},
+		{svc, "application/xml", "application/msgpack", FMT_MSGPACK, FMT_XML, 0},
+		{svc, "", "text/plain", FMT_JSON, FMT_JSON, 0},
+		{svc, "text/html", "", FMT_JSON, FMT_JSON, http.StatusNotAcceptable},
+		{svc, "application/xml", "application/cbor", FMT_JSON, FMT_XML,
+			http.StatusUnsupportedMediaType},
+		{plain, "text/html", "application/cbor", FMT_JSON, FMT_JSON, 0},
+	}
+
+	for _, tc := range tests {
+
+		req := httptest.NewRequest("POST", "/fmt", nil)
+
+		if "" != tc.accept {
+			req.Header.Set("Accept", tc.accept)
+		}
+
+		if "" != tc.ct {
+			req.Header.Set("Content-Type", tc.ct)
+		}
+
+		reqFmt, rspFmt, status := fmtNegotiate(ac, tc.svc, req)
+
+		if reqFmt != tc.reqFmt || rspFmt != tc.rspFmt || status != tc.status {
+			t.Errorf("Accept [%s] Content-Type [%s]: got %d/%d/%d, expected %d/%d/%d",
+				tc.accept, tc.ct, reqFmt, rspFmt, status,
+				tc.reqFmt, tc.rspFmt, tc.status)
+		}
+	}
+}
+
+//Decode response of given format to JSON
+//@param t test
+//@param f format
+//@param body response body
+//@return JSON message
+func testFmtDecode(t *testing.T, f int, body []byte) []byte {
+
+	var v interface{}
+	var err error
+
+	switch f {
+	case FMT_JSON:
+		return body
+	case FMT_XML:
+		js, err := xmlToJSON(body, false)
+
+		if nil != err {
+			t.Fatalf("xmlToJSON: %s", err.Error())
+		}
+
+		return js
+	case FMT_MSGPACK:
+		v, err = exutil.MsgpackUnmarshal(body)
+	default:
+		v, err = exutil.CborUnmarshal(body)
+	}
+
+	if nil != err {
+		t.Fatalf("Failed to decode format %d: %s", f, err.Error())
+	}
+
+	js, _ := json.Marshal(v)
+
+	return js
+}
+
+func TestFmtSend(t *testing.T) {
+
+	ac := testAtmiCtx(t)
+	defer ac.FreeATMICtx()
+
+	svc := testFmtService(t, ac, "xml,msgpack,cbor")
+
+	//XML carries strings only
+	native := []byte(`{"T_STRING_FLD":["A","B & <C>"],"error_code":"0","error_message":"SUCCEED"}`)
+
+	var f int
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+
+		rsp := NewRspBuffer()
+		rsp.Header().Set("Content-Type", "application/json")
+		rsp.Header().Set("Content-Length", strconv.Itoa(len(native)))
+		rsp.WriteHeader(http.StatusOK)
+		rsp.Write(native)
+
+		fmtSend(ac, svc, w, rsp, f)
+	}))
+
+	defer srv.Close()
+
+	for _, f = range []int{FMT_JSON, FMT_XML, FMT_MSGPACK, FMT_CBOR} {
+
+		rsp, err := http.Get(srv.URL)
+
+		if nil != err {
+			t.Fatalf("Format %d: %s", f, err.Error())
+		}
+
+		body, err := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+
+		if nil != err {
+			t.Fatalf("Format %d: failed to read body: %s", f, err.Error())
+		}
+
+		if http.StatusOK != rsp.StatusCode {
+			t.Errorf("Format %d: status %d", f, rsp.StatusCode)
+		}
+
+		if ct := rsp.Header.Get("Content-Type"); m_fmtrsp[f] != ct {
+			t.Errorf("Format %d: Content-Type [%s]", f, ct)
+		}
+
+		if cl := rsp.Header.Get("Content-Length"); strconv.Itoa(len(body)) != cl {
+			t.Errorf("Format %d: Content-Length [%s], body %d bytes",
+				f, cl, len(body))
+		}
+
+		js := testFmtDecode(t, f, body)
+
+		var exp, got interface{}
+		json.Unmarshal(native, &exp)
+
+		if err = json.Unmarshal(js, &got); nil != err ||
+			!reflect.DeepEqual(exp, got) {
+			t.Errorf("Format %d: got [%s] expected [%s]", f, js, native)
+		}
+	}
+}
+
+//Not convertible response is sent as is
+func TestFmtSendRaw(t *testing.T) {
+
+	ac := testAtmiCtx(t)
+	defer ac.FreeATMICtx()
+
+	svc := testFmtService(t, ac, "cbor")
+
+	rsp := NewRspBuffer()
+	rsp.Header().Set("Content-Type", "text/plain")
+	rsp.WriteHeader(http.StatusBadGateway)
+	rsp.Write([]byte("Gateway failure"))
+
+	w := httptest.NewRecorder()
+
+	fmtSend(ac, svc, w, rsp, FMT_CBOR)
+
+	if http.StatusBadGateway != w.Code || "Gateway failure" != w.Body.String() ||
+		"text/plain" != w.Header().Get("Content-Type") {
+		t.Errorf("Unexpected response %d [%s] [%s]", w.Code,
+			w.Header().Get("Content-Type"), w.Body.String())
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
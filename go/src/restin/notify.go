@@ -0,0 +1,683 @@
+/**
+ * @brief Unsolicited notification push channel over WebSocket
+ *
+ * @file notify.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"encoding/json"
+	"errors"
+	"exutil"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+	"github.com/gorilla/websocket"
+)
+
+/*
+
+Pooled contexts in m_ctxs are used for short request/reply calls only, thus they
+never see tpnotify(3)/tpbroadcast(3) messages. For the websocket routes each
+XATMI context is owned by a "notification context" (wsCtx) which:
+
+- is tpinit'ed with its own reply queue (so it has its own CLIENTID)
+- has tpsetunsol(3) handler installed
+- is polled by tpchkunsol(3) from dedicated goroutine
+
+In default mode each websocket connection gets its own context. In shared
+mode ('ws_shared') all the connections with the same client identity share
+single context, and messages are fanned out to all of them.
+
+On connect/disconnect the 'ws_regsvc' service is called from the notification
+context, thus the service can record the caller's CLIENTID for tpnotify(3)
+or reject the connection by failing.
+
+*/
+
+const (
+	WS_METHOD_OPEN  = "OPEN"  //Connection open, passed in EX_IF_METHOD to regsvc
+	WS_METHOD_CLOSE = "CLOSE" //Connection closed, passed in EX_IF_METHOD to regsvc
+	WS_OUTQ         = 64      //Number of messages queued per connection
+)
+
+//Single websocket connection
+type wsClient struct {
+	id   string          //Client identity
+	conn *websocket.Conn //Websocket connection
+	out  chan []byte     //Outgoing messages
+	wctx *wsCtx          //Notification context serving the client
+}
+
+//Notification context - XATMI session receiving unsolicited messages
+type wsCtx struct {
+	ac      *atmi.ATMICtx      //XATMI context
+	id      string             //Client identity
+	key     string             //Key in shared contexts map
+	url     string             //Route serving the context
+	clients map[*wsClient]bool //Connections receiving the messages
+	closed  bool               //Closed by shutdown, guarded by m_wsmutex
+	mutex   sync.Mutex         //Protects ATMI context, as shared by poller & reg
+	stop    chan bool          //Stop the poller
+	done    chan bool          //Poller finished
+}
+
+var m_wsmutex sync.Mutex                      //Protects websocket maps bellow
+var m_wsctxs = make(map[*atmi.ATMICtx]*wsCtx) //Lookup by ATMI context
+var m_wsshared = make(map[string]*wsCtx)      //Shared contexts by route+id
+var m_wscount = make(map[string]int)          //Contexts open per route
+var m_wsdown bool                             //Shutdown is done, no new contexts
+
+//Allowed client identities
+var m_wsclid = regexp.MustCompile("^[-_.@:A-Za-z0-9]+$")
+
+//Validate websocket route settings
+//@param ac ATMI context
+//@param svc service map
+//@return error or nil
+func validateWsService(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if svc.Conv_int != CONV_WEBSOCKET {
+		return nil
+	}
+
+	if svc.WsIdQuery == "" && svc.WsIdHdr == "" {
+		return fmt.Errorf("Route [%s]: 'ws_idquery' or 'ws_idhdr' must be set",
+			svc.Url)
+	}
+
+	if svc.WsPoll <= 0 {
+		return fmt.Errorf("Route [%s]: invalid 'ws_poll' %d", svc.Url, svc.WsPoll)
+	}
+
+	if svc.WsMax <= 0 {
+		return fmt.Errorf("Route [%s]: invalid 'ws_max' %d", svc.Url, svc.WsMax)
+	}
+
+	ac.TpLogInfo("Websocket route [%s]: idquery [%s] idhdr [%s] regsvc [%s] "+
+		"shared %t poll %d ms max %d", svc.Url, svc.WsIdQuery, svc.WsIdHdr,
+		svc.WsRegsvc, svc.WsShared, svc.WsPoll, svc.WsMax)
+
+	return nil
+}
+
+//Convert unsolicited message to JSON, suitable for websocket text frame
+//@param ac ATMI context
+//@param tb typed buffer received
+//@return JSON bytes, UBF buffer (if message was UBF) or error
+func wsUnsolToJSON(ac *atmi.ATMICtx, tb atmi.TypedBuffer) ([]byte, *atmi.TypedUBF, error) {
+
+	itype := ""
+	subtype := ""
+
+	if _, errA := ac.TpTypes(tb.GetBuf(), &itype, &subtype); nil != errA {
+		return nil, nil, errA
+	}
+
+	ac.TpLogDebug("Unsolicited message type %s/%s", itype, subtype)
+
+	switch itype {
+	case "UBF", "UBF32", "FML", "FML32":
+		bufu, errA := ac.CastToUBF(tb.GetBuf())
+		if nil != errA {
+			return nil, nil, errA
+		}
+
+		ret, errA := exutil.UBFToJSON(ac, bufu, 0)
+		if nil != errA {
+			return nil, nil, errA
+		}
+
+		return []byte(ret), bufu, nil
+	case "VIEW", "VIEW32":
+		bufv, errA := ac.CastToVIEW(tb.GetBuf())
+		if nil != errA {
+			return nil, nil, errA
+		}
+
+		ret, errA := bufv.TpVIEWToJSON(0)
+		if nil != errA {
+			return nil, nil, errA
+		}
+
+		return []byte(ret), nil, nil
+	case "JSON":
+		bufj, errA := ac.CastToJSON(tb.GetBuf())
+		if nil != errA {
+			return nil, nil, errA
+		}
+
+		return bufj.GetJSON(), nil, nil
+	case "STRING":
+		bufs, errA := ac.CastToString(tb.GetBuf())
+		if nil != errA {
+			return nil, nil, errA
+		}
+
+		ret, err := json.Marshal(map[string]string{"message": bufs.GetString()})
+		return ret, nil, err
+	case "CARRAY":
+		bufc, errA := ac.CastToCarray(tb.GetBuf())
+		if nil != errA {
+			return nil, nil, errA
+		}
+
+		//[]byte goes as base64
+		ret, err := json.Marshal(map[string][]byte{"data": bufc.GetBytes()})
+		return ret, nil, err
+	}
+
+	return nil, nil, fmt.Errorf("Unsupported unsolicited buffer type [%s]", itype)
+}
+
+//Check the broadcast target against client identity
+//@param target exact identity, or prefix ending with '*'
+//@param id client identity
+//@return true if message is for the client
+func wsTargetMatch(target string, id string) bool {
+
+	if strings.HasSuffix(target, "*") {
+		return strings.HasPrefix(id, target[:len(target)-1])
+	}
+
+	return target == id
+}
+
+//Unsolicited message callback, invoked from tpchkunsol() of the poller
+//@param ac ATMI context which received the message
+//@param tb message buffer
+func wsUnsolHandler(ac *atmi.ATMICtx, tb atmi.TypedBuffer) {
+
+	m_wsmutex.Lock()
+	wctx, ok := m_wsctxs[ac]
+	m_wsmutex.Unlock()
+
+	if !ok {
+		ac.TpLogWarn("Unsolicited message for unknown context - dropping")
+		return
+	}
+
+	msg, bufu, err := wsUnsolToJSON(ac, tb)
+
+	if nil != err {
+		ac.TpLogError("Failed to convert unsolicited message for [%s] "+
+			"- dropping: %s", wctx.id, err.Error())
+		return
+	}
+
+	//Broadcasts reach all the contexts, thus filter by target identity
+	if nil != bufu && bufu.BPres(ubftab.EX_CLTID, 0) {
+		target, _ := bufu.BGetString(ubftab.EX_CLTID, 0)
+
+		if !wsTargetMatch(target, wctx.id) {
+			ac.TpLogDebug("Message for [%s], we are [%s] - skip", target, wctx.id)
+			return
+		}
+	}
+
+	ac.TpLogInfo("Delivering unsolicited message to [%s]", wctx.id)
+
+	m_wsmutex.Lock()
+	for cl := range wctx.clients {
+		select {
+		case cl.out <- msg:
+		default:
+			ac.TpLogWarn("Client [%s] queue full - dropping message", cl.id)
+		}
+	}
+	m_wsmutex.Unlock()
+}
+
+//Call the registration service for the connection
+//@param wctx notification context (locked by caller)
+//@param svc service map
+//@param req http request
+//@param method WS_METHOD_OPEN or WS_METHOD_CLOSE
+//@return ATMI error or nil
+func wsCallReg(wctx *wsCtx, svc *ServiceMap, req *http.Request, method string) atmi.ATMIError {
+
+	if "" == svc.WsRegsvc {
+		return nil
+	}
+
+	ac := wctx.ac
+	bufu, errA := ac.NewUBF(1024)
+
+	if nil != errA {
+		ac.TpLogError("Failed to alloc UBF: %s", errA.Error())
+		return errA
+	}
+
+	defer ac.TpFree(bufu.GetBuf())
+
+	if errU := bufu.BChg(ubftab.EX_CLTID, 0, wctx.id); nil != errU {
+		return atmi.NewCustomATMIError(atmi.TPESYSTEM, errU.Error())
+	}
+
+	if errU := bufu.BChg(ubftab.EX_IF_METHOD, 0, method); nil != errU {
+		return atmi.NewCustomATMIError(atmi.TPESYSTEM, errU.Error())
+	}
+
+	if errU := bufu.BChg(ubftab.EX_IF_URL, 0, req.URL.Path); nil != errU {
+		return atmi.NewCustomATMIError(atmi.TPESYSTEM, errU.Error())
+	}
+
+	if errU := parseHeaders(ac, svc, req, bufu); nil != errU {
+		return atmi.NewCustomATMIError(atmi.TPESYSTEM, errU.Error())
+	}
+
+	ac.TpLogInfo("Calling [%s] for [%s] %s", svc.WsRegsvc, wctx.id, method)
+
+	_, errA = ac.TpCall(svc.WsRegsvc, bufu, 0)
+
+	return errA
+}
+
+//Poll for unsolicited messages until stopped
+//@param wctx notification context
+//@param svc service map
+func wsPoller(wctx *wsCtx, svc *ServiceMap) {
+
+	ticker := time.NewTicker(time.Duration(svc.WsPoll) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-wctx.stop:
+			close(wctx.done)
+			return
+		case <-ticker.C:
+			wctx.mutex.Lock()
+			if _, errA := wctx.ac.TpChkUnsol(); nil != errA {
+				wctx.ac.TpLogError("tpchkunsol failed for [%s]: %s",
+					wctx.id, errA.Error())
+			}
+			wctx.mutex.Unlock()
+		}
+	}
+}
+
+//Open new notification context
+//@param svc service map
+//@param id client identity
+//@param key shared key
+//@return notification context or error
+func wsCtxOpen(svc *ServiceMap, id string, key string) (*wsCtx, error) {
+
+	ac, errA := atmi.NewATMICtx()
+
+	if nil != errA {
+		return nil, errA
+	}
+
+	if errA = ac.TpInit(); nil != errA {
+		ac.FreeATMICtx()
+		return nil, errA
+	}
+
+	if errA = ac.TpSetUnsol(wsUnsolHandler); nil != errA {
+		ac.TpTerm()
+		ac.FreeATMICtx()
+		return nil, errA
+	}
+
+	wctx := &wsCtx{ac: ac, id: id, key: key, url: svc.Url,
+		clients: make(map[*wsClient]bool),
+		stop:    make(chan bool), done: make(chan bool)}
+
+	return wctx, nil
+}
+
+//Close the notification context, poller must be stopped
+//@param wctx notification context
+func wsCtxClose(wctx *wsCtx) {
+	wctx.ac.TpTerm()
+	wctx.ac.FreeATMICtx()
+}
+
+//Attach the connection to notification context. Context is created if needed
+//@param svc service map
+//@param cl client connection
+//@param req http request
+//@return error or nil
+func wsAttach(svc *ServiceMap, cl *wsClient, req *http.Request) error {
+
+	key := svc.Url + "\x00" + cl.id
+
+	m_wsmutex.Lock()
+
+	if m_wsdown {
+		m_wsmutex.Unlock()
+		return errors.New("Bridge is shutting down")
+	}
+
+	if svc.WsShared {
+		if wctx, ok := m_wsshared[key]; ok {
+			wctx.clients[cl] = true
+			cl.wctx = wctx
+			m_wsmutex.Unlock()
+
+			//Let the service know that there is one more connection
+			wctx.mutex.Lock()
+			errA := wsCallReg(wctx, svc, req, WS_METHOD_OPEN)
+			wctx.mutex.Unlock()
+
+			if nil != errA {
+				wsDetach(svc, cl, req, false)
+				return errA
+			}
+
+			return nil
+		}
+	}
+
+	if m_wscount[svc.Url] >= svc.WsMax {
+		m_wsmutex.Unlock()
+		return fmt.Errorf("Max number of websocket contexts (%d) reached for [%s]",
+			svc.WsMax, svc.Url)
+	}
+
+	m_wscount[svc.Url]++
+	m_wsmutex.Unlock()
+
+	wctx, err := wsCtxOpen(svc, cl.id, key)
+
+	if nil != err {
+		m_wsmutex.Lock()
+		m_wscount[svc.Url]--
+		m_wsmutex.Unlock()
+		return err
+	}
+
+	//Service may reject the client
+	if errA := wsCallReg(wctx, svc, req, WS_METHOD_OPEN); nil != errA {
+		m_wsmutex.Lock()
+		m_wscount[svc.Url]--
+		m_wsmutex.Unlock()
+		wsCtxClose(wctx)
+		return errA
+	}
+
+	m_wsmutex.Lock()
+
+	//Shutdown was done while the context was opening
+	if m_wsdown {
+		m_wscount[svc.Url]--
+		m_wsmutex.Unlock()
+		wsCallReg(wctx, svc, req, WS_METHOD_CLOSE)
+		wsCtxClose(wctx)
+		return errors.New("Bridge is shutting down")
+	}
+
+	//Somebody was faster in shared mode, use their context
+	if other, ok := m_wsshared[key]; ok && svc.WsShared {
+		m_wscount[svc.Url]--
+		other.clients[cl] = true
+		cl.wctx = other
+		m_wsmutex.Unlock()
+
+		//Registration moves to the context which stays
+		wsCallReg(wctx, svc, req, WS_METHOD_CLOSE)
+		wsCtxClose(wctx)
+
+		other.mutex.Lock()
+		errA := wsCallReg(other, svc, req, WS_METHOD_OPEN)
+		other.mutex.Unlock()
+
+		if nil != errA {
+			wsDetach(svc, cl, req, false)
+			return errA
+		}
+
+		return nil
+	}
+
+	wctx.clients[cl] = true
+	cl.wctx = wctx
+	m_wsctxs[wctx.ac] = wctx
+
+	if svc.WsShared {
+		m_wsshared[key] = wctx
+	}
+
+	m_wsmutex.Unlock()
+
+	go wsPoller(wctx, svc)
+
+	return nil
+}
+
+//Detach the connection from notification context. Context is closed
+//if there are no more connections.
+//@param svc service map
+//@param cl client connection
+//@param req http request
+//@param callreg call registration service
+func wsDetach(svc *ServiceMap, cl *wsClient, req *http.Request, callreg bool) {
+
+	wctx := cl.wctx
+
+	m_wsmutex.Lock()
+	delete(wctx.clients, cl)
+
+	//Context is already terminated by shutdown
+	if wctx.closed {
+		m_wsmutex.Unlock()
+		return
+	}
+
+	last := len(wctx.clients) == 0
+
+	if last {
+		delete(m_wsctxs, wctx.ac)
+
+		if svc.WsShared {
+			delete(m_wsshared, wctx.key)
+		}
+
+		m_wscount[svc.Url]--
+	}
+	m_wsmutex.Unlock()
+
+	if last {
+		close(wctx.stop)
+		<-wctx.done
+	}
+
+	if callreg {
+		wctx.mutex.Lock()
+		if errA := wsCallReg(wctx, svc, req, WS_METHOD_CLOSE); nil != errA {
+			wctx.ac.TpLogWarn("Close notification for [%s] failed: %s",
+				cl.id, errA.Error())
+		}
+		wctx.mutex.Unlock()
+	}
+
+	if last {
+		wsCtxClose(wctx)
+	}
+}
+
+//Resolve the client identity from the request
+//@param svc service map
+//@param req http request
+//@return identity or empty string
+func wsGetClientId(svc *ServiceMap, req *http.Request) string {
+
+	if "" != svc.WsIdHdr {
+		if id := req.Header.Get(svc.WsIdHdr); "" != id {
+			return id
+		}
+	}
+
+	if "" != svc.WsIdQuery {
+		return req.URL.Query().Get(svc.WsIdQuery)
+	}
+
+	return ""
+}
+
+//Serve the websocket route. Request does not use worker pool.
+//@param w response writer
+//@param req http request
+//@param svc service map
+func wsHandler(w http.ResponseWriter, req *http.Request, svc *ServiceMap) {
+
+	id := wsGetClientId(svc, req)
+
+	if "" == id || !m_wsclid.MatchString(id) {
+		m_ac.TpLogError("Websocket [%s]: missing or invalid client id [%s] from %s",
+			req.URL.Path, id, req.RemoteAddr)
+		http.Error(w, "Invalid client identity", http.StatusBadRequest)
+		return
+	}
+
+	upgrader := websocket.Upgrader{}
+
+	if "*" == svc.WsOrigins {
+		upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+	} else if "" != svc.WsOrigins {
+		origins := strings.Split(svc.WsOrigins, ",")
+		upgrader.CheckOrigin = func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			for _, o := range origins {
+				if strings.TrimSpace(o) == origin {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	conn, err := upgrader.Upgrade(w, req, nil)
+
+	if nil != err {
+		//Upgrader has already replied with error
+		m_ac.TpLogError("Websocket [%s]: upgrade failed for %s: %s",
+			req.URL.Path, req.RemoteAddr, err.Error())
+		return
+	}
+
+	cl := &wsClient{id: id, conn: conn, out: make(chan []byte, WS_OUTQ)}
+
+	if err := wsAttach(svc, cl, req); nil != err {
+		m_ac.TpLogError("Websocket [%s]: client [%s] rejected: %s",
+			req.URL.Path, id, err.Error())
+
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rejected"),
+			time.Now().Add(time.Second))
+		conn.Close()
+		return
+	}
+
+	m_ac.TpLogInfo("Websocket [%s]: client [%s] connected from %s",
+		req.URL.Path, id, req.RemoteAddr)
+
+	//Reader, we do not expect any data, but need to process control frames
+	closed := make(chan bool)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); nil != err {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	//Writer
+	for run := true; run; {
+		select {
+		case msg := <-cl.out:
+			if err := conn.WriteMessage(websocket.TextMessage, msg); nil != err {
+				m_ac.TpLogError("Websocket [%s]: write to [%s] failed: %s",
+					req.URL.Path, id, err.Error())
+				run = false
+			}
+		case <-closed:
+			run = false
+		}
+	}
+
+	wsDetach(svc, cl, req, true)
+	conn.Close()
+
+	m_ac.TpLogInfo("Websocket [%s]: client [%s] disconnected", req.URL.Path, id)
+}
+
+//Close all websocket connections and notification contexts
+//Used at shutdown
+func wsShutdown(ac *atmi.ATMICtx) {
+
+	var wctxs []*wsCtx
+	var conns []*websocket.Conn
+
+	m_wsmutex.Lock()
+
+	for _, wctx := range m_wsctxs {
+		wctx.closed = true
+		wctxs = append(wctxs, wctx)
+
+		for cl := range wctx.clients {
+			conns = append(conns, cl.conn)
+		}
+	}
+
+	m_wsctxs = make(map[*atmi.ATMICtx]*wsCtx)
+	m_wsshared = make(map[string]*wsCtx)
+	m_wscount = make(map[string]int)
+	m_wsdown = true
+
+	m_wsmutex.Unlock()
+
+	for _, wctx := range wctxs {
+		ac.TpLogWarn("Closing websocket context for [%s]", wctx.id)
+
+		close(wctx.stop)
+		<-wctx.done
+
+		//Registration call may be in progress
+		wctx.mutex.Lock()
+		wsCtxClose(wctx)
+		wctx.mutex.Unlock()
+	}
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,168 @@
+/**
+ * @brief RFC 7807 problem details error responses
+ *
+ * @file problem.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+const (
+	PROBLEM_MIME         = "application/problem+json"
+	PROBLEM_TYPE_DEFAULT = "about:blank"
+)
+
+/**
+ * Problem details response (RFC 7807) with XATMI extension members
+ */
+type ProblemRsp struct {
+	Type        string `json:"type"`
+	Title       string `json:"title"`
+	Status      int    `json:"status"`
+	Detail      string `json:"detail"`
+	Instance    string `json:"instance,omitempty"`
+	ErrorCode   int    `json:"error_code"`
+	ErrorSource string `json:"error_source"`
+	Tpurcode    *int64 `json:"tpurcode,omitempty"`
+}
+
+//Validate problem details settings of the route
+//@param ac ATMI context
+//@param svc service map
+//@return error or nil
+func validateProblemService(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	svc.ProblemTypes_map = nil
+
+	if ERRORS_PROBLEM != svc.Errors_int {
+
+		if "" != svc.ProblemTypes {
+			return fmt.Errorf("Route [%s]: 'problem_types' valid only for "+
+				"errors 'problem'", svc.Url)
+		}
+
+		return nil
+	}
+
+	switch svc.Conv_int {
+	case CONV_EXT, CONV_STATIC, CONV_WEBSOCKET:
+		return fmt.Errorf("Route [%s]: errors 'problem' not valid for conv %s",
+			svc.Url, svc.Conv)
+	}
+
+	svc.ProblemTypes_map = make(map[string]string)
+
+	for _, element := range strings.Split(svc.ProblemTypes, ",") {
+
+		if element = strings.TrimSpace(element); "" == element {
+			continue
+		}
+
+		//URI itself contains ':', thus split on first only
+		pair := strings.SplitN(element, ":", 2)
+
+		if len(pair) < 2 || "" == strings.TrimSpace(pair[1]) {
+			return fmt.Errorf("Route [%s]: invalid problem type pair [%s]",
+				svc.Url, element)
+		}
+
+		code := strings.TrimSpace(pair[0])
+
+		if "*" != code {
+			if _, err := strconv.Atoi(code); nil != err {
+				return fmt.Errorf("Route [%s]: invalid error code [%s] in "+
+					"problem type pair [%s]", svc.Url, code, element)
+			}
+		}
+
+		svc.ProblemTypes_map[code] = strings.TrimSpace(pair[1])
+	}
+
+	ac.TpLogInfo("Route [%s] problem details: types [%s]",
+		svc.Url, svc.ProblemTypes)
+
+	return nil
+}
+
+//Build problem details response for the error
+//@param ac ATMI context
+//@param svc service map
+//@param err ATMI error
+//@param status HTTP status
+//@param rctx request context
+//@return JSON response
+func problemRsp(ac *atmi.ATMICtx, svc *ServiceMap, err atmi.ATMIError,
+	status int, rctx *RequestContext) []byte {
+
+	var rsp ProblemRsp
+
+	rsp.Type = PROBLEM_TYPE_DEFAULT
+
+	if uri, ok := svc.ProblemTypes_map[strconv.Itoa(err.Code())]; ok {
+		rsp.Type = uri
+	} else if uri, ok := svc.ProblemTypes_map["*"]; ok {
+		rsp.Type = uri
+	}
+
+	rsp.Title = http.StatusText(status)
+	rsp.Status = status
+	rsp.Detail = err.Message()
+	rsp.Instance = rctx.instance
+	rsp.ErrorCode = err.Code()
+	rsp.ErrorSource = rctx.errSrc
+
+	//User return code is meaningful only if service did reply, on success
+	//problem is reported only due to urcode_http_map
+	if atmi.TPESVCFAIL == err.Code() || atmi.TPEOTYPE == err.Code() ||
+		atmi.TPMINVAL == err.Code() {
+		urcode, _ := ac.TpURCode()
+		rsp.Tpurcode = &urcode
+	}
+
+	js, errJ := json.Marshal(&rsp)
+
+	if nil != errJ {
+		ac.TpLogError("Failed to marshal problem details: %s", errJ.Error())
+		return []byte(fmt.Sprintf("{\"type\":\"%s\",\"status\":%d}",
+			PROBLEM_TYPE_DEFAULT, status))
+	}
+
+	return js
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,155 @@
+/**
+ * @brief HTTP response recorder - captures the response while it is sent
+ *
+ * @file recorder.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"bytes"
+	"net/http"
+)
+
+//Response writer which passes the data to the real writer and keeps
+//the copy of status and body
+type RspRecorder struct {
+	w      http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+//Create new recorder
+//@param w real response writer
+//@return recorder
+func NewRspRecorder(w http.ResponseWriter) *RspRecorder {
+	return &RspRecorder{w: w}
+}
+
+//Response headers (of the real writer)
+func (r *RspRecorder) Header() http.Header {
+	return r.w.Header()
+}
+
+//Record and send the status code
+//@param status http status
+func (r *RspRecorder) WriteHeader(status int) {
+
+	if 0 == r.status {
+		r.status = status
+	}
+
+	r.w.WriteHeader(status)
+}
+
+//Record and send the body data
+//@param b data to write
+func (r *RspRecorder) Write(b []byte) (int, error) {
+
+	if 0 == r.status {
+		r.status = http.StatusOK
+	}
+
+	r.body.Write(b)
+
+	return r.w.Write(b)
+}
+
+//Recorded status, 0 if nothing was sent
+func (r *RspRecorder) Status() int {
+	return r.status
+}
+
+//Recorded body
+func (r *RspRecorder) Body() []byte {
+	return r.body.Bytes()
+}
+
+//Copy of response headers
+func (r *RspRecorder) HeaderCopy() http.Header {
+
+	ret := make(http.Header)
+
+	for k, v := range r.w.Header() {
+		ret[k] = append([]string(nil), v...)
+	}
+
+	return ret
+}
+
+//Response writer which keeps the response in memory, caller sends it later
+//(possibly to several clients)
+type RspBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+//Create new response buffer
+//@return response buffer
+func NewRspBuffer() *RspBuffer {
+	return &RspBuffer{header: make(http.Header)}
+}
+
+//Buffered response headers
+func (r *RspBuffer) Header() http.Header {
+	return r.header
+}
+
+//Record the status code
+//@param status http status
+func (r *RspBuffer) WriteHeader(status int) {
+
+	if 0 == r.status {
+		r.status = status
+	}
+}
+
+//Record the body data
+//@param b data to write
+func (r *RspBuffer) Write(b []byte) (int, error) {
+
+	if 0 == r.status {
+		r.status = http.StatusOK
+	}
+
+	return r.body.Write(b)
+}
+
+//Recorded status, 0 if nothing was written
+func (r *RspBuffer) Status() int {
+	return r.status
+}
+
+//Recorded body
+func (r *RspBuffer) Body() []byte {
+	return r.body.Bytes()
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,287 @@
+/**
+ * @brief Reload of the routes without restarting the process
+ *
+ * @file reload.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+/*
+
+Routes are re-read from common-config and validated the same way as at startup.
+New route table is swapped in only if whole configuration is valid. Requests in
+progress complete with the routes they were started with.
+
+Process level settings (ip, port, workers, tls_*, debug) are not reloaded.
+
+*/
+
+//Metric names
+const (
+	METRIC_RELOAD_OK   = "restincl_reload_total"
+	METRIC_RELOAD_FAIL = "restincl_reload_failed_total"
+)
+
+var m_routesmutex sync.Mutex //Route table changes are done one at the time
+
+var m_cfgroutes *RegexpHandler //Routes loaded from configuration, guarded by m_routesmutex
+
+var m_runmutex sync.RWMutex //Requests in progress hold the read lock
+var m_closed bool           //Bridge is stopped, guarded by m_runmutex
+
+//Reload route response
+type ReloadRsp struct {
+	Status  string `json:"status"`            //ok or error
+	Routes  int    `json:"routes"`            //Number of routes loaded
+	Message string `json:"message,omitempty"` //Reason of failure
+}
+
+//Serves the requests by current route table
+type currentRoutes struct{}
+
+//ServeHTTP function to satisfy http.Handler interface
+func (currentRoutes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	m_runmutex.RLock()
+	defer m_runmutex.RUnlock()
+
+	//Worker contexts are already taken back by bridgeStop()
+	if m_closed {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable),
+			http.StatusServiceUnavailable)
+		return
+	}
+
+	m_handler.Load().(*RegexpHandler).ServeHTTP(w, r)
+}
+
+//Reload the routes
+//@param ac ATMI context
+//@return number of routes, error (current routes are kept)
+func configReload(ac *atmi.ATMICtx) (int, error) {
+
+	m_routesmutex.Lock()
+	defer m_routesmutex.Unlock()
+
+	ac.TpLogWarn("Reloading routes")
+
+	buf, err := configGet(ac)
+
+	if nil != err {
+		metricsAdd(METRIC_RELOAD_FAIL, 1)
+		return 0, err
+	}
+
+	defer ac.TpFree(buf.GetBuf())
+
+	var defaults ServiceMap
+	initDefaults(&defaults)
+
+	tpopen := m_do_tpopen
+	h := newRegexpHandler()
+
+	err = configLoad(ac, buf, &defaults, h, true)
+
+	//Worker contexts are already open, XA cannot be enabled
+	if nil == err && !tpopen && m_do_tpopen {
+		err = errors.New("Transactional routes require restart " +
+			"of restincl (workers are not open with tpopen)")
+	}
+
+	m_do_tpopen = tpopen
+
+	if nil != err {
+		ac.TpLogError("Reload failed, keeping current routes: %s", err.Error())
+		metricsAdd(METRIC_RELOAD_FAIL, 1)
+		return 0, err
+	}
+
+	cacheCarryOver(ac, h)
+
+	m_cfgroutes = h
+	routesPublish(ac)
+	metricsAdd(METRIC_RELOAD_OK, 1)
+
+	routes := len(h.urlMap) + len(h.regexpRoutes)
+	ac.TpLogWarn("Routes reloaded: %d", routes)
+
+	return routes, nil
+}
+
+//Keep the memory idempotency store of the current route with the same URL,
+//if store settings are unchanged. m_routesmutex must be locked.
+//@param ac ATMI context
+//@param svc new route
+func routeCarryOver(ac *atmi.ATMICtx, svc *ServiceMap) {
+
+	if nil == m_cfgroutes || IDEM_MEM != svc.Idem_int {
+		return
+	}
+
+	old, ok := m_cfgroutes.getRoute(svc.Url)
+
+	if ok && IDEM_MEM == old.Idem_int && old.IdemMax == svc.IdemMax {
+		ac.TpLogInfo("Route [%s] keeps idempotency store", svc.Url)
+		svc.IdemStore = old.IdemStore
+	}
+}
+
+//Drop cached responses of the routes which are removed or which cache
+//settings are changed by the reload. m_routesmutex must be locked.
+//@param ac ATMI context
+//@param h new route table
+func cacheCarryOver(ac *atmi.ATMICtx, h *RegexpHandler) {
+
+	var olds []*ServiceMap
+
+	for _, svc := range m_cfgroutes.urlMap {
+		svc := svc
+		olds = append(olds, &svc)
+	}
+
+	for _, r := range m_cfgroutes.regexpRoutes {
+		olds = append(olds, &r.svc)
+	}
+
+	for _, old := range olds {
+
+		if !old.Cache {
+			continue
+		}
+
+		svc, ok := h.getRoute(old.Url)
+
+		if !ok || !svc.Cache || svc.Svc != old.Svc || svc.Conv != old.Conv ||
+			svc.CacheTtl != old.CacheTtl || svc.CacheTtlField != old.CacheTtlField ||
+			svc.CacheTtlHdr != old.CacheTtlHdr || svc.CacheHdrs != old.CacheHdrs {
+			cacheDrop(ac, old.Url)
+		}
+	}
+}
+
+//Reload the routes with free worker context
+//@return number of routes, error
+func configReloadWorker() (int, error) {
+
+	nr := <-m_freechan
+
+	defer func() {
+		workerFree(nr)
+		m_freechan <- nr
+	}()
+
+	workerBusy(nr, "@RINRELOAD", "")
+
+	return configReload(m_ctxs[nr])
+}
+
+//Reload on SIGHUP
+//@param ac ATMI context, for logging
+func handleReload(ac *atmi.ATMICtx) {
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, syscall.SIGHUP)
+	go func() {
+		for range signalChannel {
+			ac.TpLogWarn("Got SIGHUP - reloading routes")
+
+			if _, err := configReloadWorker(); nil != err {
+				ac.UserLog("restincl: route reload failed: %s", err.Error())
+			}
+		}
+	}()
+}
+
+//Reload route is on public listener, thus admin token is mandatory
+//@param ac ATMI context
+//@param svc service map
+//@return error or nil
+func validateReloadService(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if !svc.Reload {
+		return nil
+	}
+
+	if "" == m_admintoken {
+		return fmt.Errorf("Route [%s]: 'reload' requires 'admin_token'", svc.Url)
+	}
+
+	return nil
+}
+
+//Serve reload route, POST triggers the reload
+//@param w response writer
+//@param req request
+//@param svc route, nil if called from admin listener (already authenticated)
+func reloadHandler(w http.ResponseWriter, req *http.Request, svc *ServiceMap) {
+
+	var rsp ReloadRsp
+
+	if nil != svc && !adminTokenOk(w, req) {
+		return
+	}
+
+	if http.MethodPost != req.Method {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := http.StatusOK
+	routes, err := configReloadWorker()
+
+	if nil != err {
+		rsp.Status = "error"
+		rsp.Message = err.Error()
+		status = http.StatusUnprocessableEntity
+	} else {
+		rsp.Status = "ok"
+		rsp.Routes = routes
+	}
+
+	body, _ := json.Marshal(&rsp)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
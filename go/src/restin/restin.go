@@ -0,0 +1,1544 @@
+/**
+ * @brief HTTP to XATMI bridge - routes, configuration and the listener
+ *
+ * @file restin.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+// Request types supported:
+// - json (TypedJSON, TypedUBF)
+// - plain text (TypedString)
+// - binary (TypedCarray)
+
+//Hmm we might need to put in channels a free ATMI contexts..
+import (
+	"encoding/json"
+	"errors"
+	"exutil"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	u "ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+/*
+#include <signal.h>
+*/
+import "C"
+
+const (
+	progsection = "@restin"
+)
+
+const (
+	UNSET = -1
+	FALSE = 0
+	TRUE  = 1
+)
+
+//Error handling type
+const (
+	ERRORS_HTTP = 1 //Return error code in http
+	ERRORS_TEXT = 2 //Return error as formatted text (from config)
+	ERRORS_RAW  = 3 //Use the raw formatting (just another kind for text)
+	ERRORS_JSON = 4 //Contact the json fields to main respons block.
+	//Return the error code as UBF response (usable only in case if CONV_JSON2UBF used)
+	ERRORS_JSON2UBF  = 5
+	ERRORS_JSON2VIEW = 6
+	ERRORS_EXT       = 7 //External mode errors, direct UBF error codes, services
+	ERRORS_XML       = 8 //Error code/message elements in XML response
+	ERRORS_PROBLEM   = 9 //RFC 7807 problem details
+)
+
+const (
+	ERRSRC_FINMAN  = "F" //Input mandatory filter failed
+	ERRSRC_SERVICE = "S" //Error source is target service
+	ERRSRC_RESTIN  = "R" //Error source is rest-in internal error
+)
+
+//Conversion types resolved
+const (
+	CONV_JSON2UBF  = 1
+	CONV_TEXT      = 2
+	CONV_JSON      = 3
+	CONV_RAW       = 4
+	CONV_JSON2VIEW = 5
+	CONV_STATIC    = 6  //Serving static content
+	CONV_EXT       = 7  //External services, raw FML buffers
+	CONV_WEBSOCKET = 8  //Websocket, unsolicited notifications push
+	CONV_XML2UBF   = 9  //XML converted to UBF
+	CONV_XML2VIEW  = 10 //XML converted to VIEW
+	CONV_STREAM    = 11 //Request body streamed to conversational service
+)
+
+//Defaults
+const (
+	ERRORS_DEFAULT             = ERRORS_JSON
+	NOTIMEOUT_DEFAULT          = false /* we will use default timeout */
+	CONV_DEFAULT               = "json2ubf"
+	CONV_INT_DEFAULT           = CONV_JSON2UBF
+	ERRFMT_JSON_MSG_DEFAULT    = "\"error_message\":\"%s\""
+	ERRFMT_JSON_CODE_DEFAULT   = "\"error_code\":%d"
+	ERRFMT_JSON_ONSUCC_DEFAULT = true /* generate success message in JSON */
+	ERRFMT_VIEW_ONSUCC_DEFAULT = true /* generate success message in VIEW */
+	ERRFMT_XML_CODE_DEFAULT    = "error_code"
+	ERRFMT_XML_MSG_DEFAULT     = "error_message"
+	ERRFMT_XML_ONSUCC_DEFAULT  = true    /* generate success message in XML */
+	XML_ROOT_DEFAULT           = "ubf"   /* Root element for xml2ubf */
+	XML_ERROR_ROOT             = "error" /* Root of error only XML response */
+	ERRFMT_TEXT_DEFAULT        = "%d: %s"
+	ASYNCCALL_DEFAULT          = false
+	WORKERS                    = 10 /* Number of worker processes */
+	WS_IDQUERY_DEFAULT         = "clientid"
+	WS_POLL_DEFAULT            = 100 /* Unsolicited msg poll interval, ms */
+	WS_MAX_DEFAULT             = 100 /* Max XATMI contexts per websocket route */
+	BATCH_MAX_DEFAULT          = 20  /* Max items in batch request */
+	IDEM_HDR_DEFAULT           = "Idempotency-Key"
+	IDEM_TTL_DEFAULT           = 86400    /* Stored response lifetime, sec */
+	IDEM_MAX_DEFAULT           = 10000    /* Max keys in memory store */
+	IDEM_LOCKTTL_DEFAULT       = 0        /* Pending lock lease, sec, 0 - by timeout */
+	IDEM_LOCK_MARGIN           = 30       /* Added to service timeout for lease, sec */
+	IDEM_TOUT_DEFAULT          = 60       /* Service timeout if NDRX_TOUT not set */
+	CACHE_TTL_DEFAULT          = 60       /* Cached response lifetime, sec */
+	CACHE_MEM_DEFAULT          = 67108864 /* Response cache memory, bytes */
+)
+
+//We will have most of the settings as defaults
+//And then these settings we can override with
+type ServiceMap struct {
+	Svc    string `json:"svc"`
+	Url    string
+	Errors string `json:"errors"`
+	//Above converted to consntant
+	Errors_int       int
+	Notime           bool   `json:"notime"`
+	Errfmt_text      string `json:"errfmt_text"`
+	Errfmt_json_msg  string `json:"errfmt_json_msg"`
+	Errfmt_json_code string `json:"errfmt_json_code"`
+	//If set, then generate code/message for success too
+	Errfmt_json_onsucc bool `json:"errfmt_json_onsucc"`
+
+	//In case of json2view errors, we install the return
+	//code direclty in the given fields
+	Errfmt_view_msg    string `json:"errfmt_view_msg"`
+	Errfmt_view_code   string `json:"errfmt_view_code"`
+	Errfmt_view_onsucc bool   `json:"errfmt_view_onsucc"`
+
+	//XML errors, element names of code and message
+	Errfmt_xml_code   string `json:"errfmt_xml_code"`
+	Errfmt_xml_msg    string `json:"errfmt_xml_msg"`
+	Errfmt_xml_onsucc bool   `json:"errfmt_xml_onsucc"`
+	XmlRoot           string `json:"xml_root"` //Root element name of XML messages
+
+	//JSON key mapping profile file
+	JsonMap      string                 `json:"json_map"`
+	JsonMap_prof *exutil.JSONMapProfile `json:"-"`
+
+	//UBF JSON normalization
+	JsonArrays    string           `json:"json_arrays"`    // Fields always arrays
+	JsonScalars   string           `json:"json_scalars"`   // Fields always scalars
+	JsonOmitEmpty bool             `json:"json_omitempty"` // Omit empty/zero values
+	JsonNulls     string           `json:"json_nulls"`     // Fields null if absent
+	JsonNorm      *exutil.JSONNorm `json:"-"`
+
+	//Problem details (errors 'problem') type URIs by ATMI error code
+	//Format: <atmi_err>:<uri>,*:<uri>
+	ProblemTypes     string `json:"problem_types"`
+	ProblemTypes_map map[string]string
+
+	//Service user return code (tpurcode) mapping to HTTP status/message
+	//Format: <urcode>|<from>..<to>:<http_status>[:<message>],...
+	UrcodeHttpMap     string `json:"urcode_http_map"`
+	UrcodeHttpMap_arr []UrcodeMap
+
+	//Response template
+	Template       string      `json:"template"`        //Template file
+	TemplateEngine string      `json:"template_engine"` //text or html
+	TemplateCtype  string      `json:"template_ctype"`  //Content-Type of output
+	Template_tpl   RspTemplate `json:"-"`
+
+	//CSV/TSV export of the UBF response
+	CsvFields     string `json:"csv_fields"`   //Column fields
+	CsvDelim      string `json:"csv_delim"`    //CSV delimiter
+	CsvEncoding   string `json:"csv_encoding"` //utf-8, utf-8-bom, iso-8859-1
+	CsvQuery      string `json:"csv_query"`    //Query parameter selecting export
+	CsvFilename   string `json:"csv_filename"` //File name without extension
+	CsvFields_arr []string
+	CsvFields_ids []int
+
+	//Responses from fixture file, no service call
+	Mock       string `json:"mock"`
+	Mock_cases []MockCase
+	Mock_re    *regexp.Regexp
+
+	//Send Server-Timing header with request phases
+	ServerTiming bool `json:"server_timing"`
+
+	//Target services, selected by condition or weight
+	Targets      []RouteTarget `json:"targets"`
+	TargetSticky string        `json:"target_sticky"` //Client key: header|cookie|query:NAME
+	TargetWeight int           //Total weight of targets
+
+	//Shadow calls to mirror service
+	MirrorSvc     string  `json:"mirror_svc"`
+	MirrorRate    float64 `json:"mirror_rate"`    //Share of requests mirrored, 0..1
+	MirrorCompare bool    `json:"mirror_compare"` //Compare responses
+
+	//Content negotiation, additional formats: json, xml, msgpack, cbor
+	Formats     string `json:"formats"`
+	Formats_map map[int]bool
+
+	//Install in response non null fields only
+	View_notnull bool `json:"view_notnull"`
+
+	View_flags int64 //Flags used for VIEW2JSON
+
+	//Response view, if in original buffer fields defined in
+	//errfmt_view_msg and errfmt_view_code are not found.
+	//Must be set in case of 'async' if 'asyncecho' not set. In all other
+	//cases for example if json2view errors are used, system will try
+	//to install the error code in original buffer (either from service
+	//response or parsed incomming msg)
+	//In case if errfmt_view_rsp_first then errfmt_view_rsp is mandatory too
+	//and errors are always returned within the 'errfmt_view_rsp' view struct
+	Errfmt_view_rsp string `json:"errfmt_view_rsp"`
+	//In case of normal calls, this will be set only if 'errfmt_view_onsucc' is
+	//set, otherwise if there is no error, then normal response object is returned
+	Errfmt_view_rsp_first bool `json:"errfmt_view_rsp_first"`
+
+	Asynccall bool   `json:"async"`     //use tpacall()
+	Asyncecho bool   `json:"asyncecho"` //echo message in async mode
+	Conv      string `json:"conv"`      //Conv mode
+	Conv_int  int    //Resolve conversion type
+	//Request logging classify service
+	Reqlogsvc string `json:"reqlogsvc"`
+	//Error mapping Enduro/X error code (including * for all):http error code
+	Errors_fmt_http_map_str string `json:"errors_fmt_http_map"`
+	Errors_fmt_http_map     map[string]int
+	Noreqfilersp            bool `json:"noreqfilersp"` //Do not sent request file in respones
+	Echo                    bool `json:"echo"`         //Echo request buffer back
+	//URL format
+	Format   string `json:"format"`   // "r" or "regexp" for regexp format
+	UrlField string `json:"urlfield"` //Field for URL in case of CONV_JSON2UBF and CONV_JSON
+
+	// Parsing request headers/Cookies
+	Parseheaders bool   `json:"parseheaders"` // Default false
+	Parsecookies bool   `json:"parsecookies"` // Default false
+	Parseform    bool   `json:"parseform"`    // Parse form data and load into UBF
+	Fileupload   bool   `json:"fileupload"`   // This url end-point is used for file upload
+	Tempdir      string `json:"tempdir"`      // Temporary folder where to store uploaded files
+
+	//Maintenance response (admin API)
+	MaintBody  string `json:"maint_body"`  //Response body
+	MaintCtype string `json:"maint_ctype"` //Response content type
+
+	//Upload policy
+	UploadMaxFiles  int    `json:"upload_max_files"` //Max number of files
+	UploadMaxSize   int64  `json:"upload_max_size"`  //Max size of file, bytes
+	UploadMaxTotal  int64  `json:"upload_max_total"` //Max total size, bytes
+	UploadMimes     string `json:"upload_mimes"`     //Allowed content types
+	UploadExts      string `json:"upload_exts"`      //Allowed file extensions
+	UploadScanSvc   string `json:"upload_scansvc"`   //Service checking the files
+	UploadMimes_arr []string
+	UploadExts_arr  []string
+
+	//Directories of files which ext services may send back (EX_IF_RSPFILEDISK)
+	DownloadDirs     string `json:"download_dirs"`
+	DownloadDirs_arr []string
+
+	//Streaming to conversational service
+	StreamChunk int    `json:"stream_chunk"` //Chunk size, bytes
+	StreamBuf   string `json:"stream_buf"`   //Chunk buffer: carray or ubf
+
+	//For ext mode:
+	Finman     string `json:"finman"` // Mandatory incoming services
+	Finman_arr []string
+	Finopt     string `json:"finopt"` // Optional incoming services
+	Finopt_arr []string
+	Finerr     string `json:"finerr"` // Incoming error handling services
+	Finerr_arr []string
+
+	Foutman     string `json:"foutman"` // Mandatory outgoing services
+	Foutman_arr []string
+	Foutopt     string `json:"foutopt"` // Optional outgoing services
+	Foutopt_arr []string
+	Fouterr     string `json:"fouterr"` // Outgoing error handling services
+	Fouterr_arr []string
+
+	StaticDir  string       `json:"staticdir"` //Static files directory
+	FileServer http.Handler //File server handler for static content
+
+	TransactionHandler bool `json:"transaction_handler"` // Is this transaction handler route?
+	NoAbort            bool `json:"txnoabort"`           // Do not abort global transaction if service failed
+	TxNoOptim          bool `json:"txnooptim"`           // Do not optimize known resource managers
+	TransactionList    bool `json:"transaction_list"`    // List transactions started by clients
+	Metrics            bool `json:"metrics"`             // Is this metrics route?
+	Reload             bool `json:"reload"`              // Is this route reload trigger?
+
+	//Handler of process internal routes (served without XATMI worker)
+	LocalHandler func(w http.ResponseWriter, req *http.Request, svc *ServiceMap) `json:"-"`
+
+	//For websocket mode:
+	WsIdQuery string `json:"ws_idquery"` // Query parameter with client identity
+	WsIdHdr   string `json:"ws_idhdr"`   // Header with client identity (e.g. from auth proxy)
+	WsRegsvc  string `json:"ws_regsvc"`  // Service called on connection open/close
+	WsShared  bool   `json:"ws_shared"`  // One XATMI context per client identity
+	WsPoll    int    `json:"ws_poll"`    // Unsolicited message poll interval, ms
+	WsMax     int    `json:"ws_max"`     // Max XATMI contexts opened by route
+	WsOrigins string `json:"ws_origins"` // Allowed origins, comma separated or *
+
+	//For batch mode:
+	Batch         bool   `json:"batch"`          // Is this batch route?
+	BatchSvcs     string `json:"batch_svcs"`     // Permitted services, comma separated or *
+	BatchParallel bool   `json:"batch_parallel"` // Run items in parallel
+	BatchTran     bool   `json:"batch_tran"`     // Run batch in global transaction
+	BatchTrantout uint64 `json:"batch_trantout"` // Batch transaction timeout
+	BatchMax      int    `json:"batch_max"`      // Max number of items in batch
+	BatchSvcs_map map[string]bool
+
+	//Idempotency-Key support:
+	Idempotency string `json:"idempotency"` // Store: mem, svc or queue
+	Idem_int    int
+	IdemHdr     string    `json:"idem_hdr"`     // Header carrying the key
+	IdemTtl     int       `json:"idem_ttl"`     // Stored response lifetime, sec
+	IdemMax     int       `json:"idem_max"`     // Max keys for memory store
+	IdemLockTtl int       `json:"idem_lockttl"` // Pending lock lease, sec
+	IdemSvc     string    `json:"idem_svc"`     // Store service
+	IdemQspace  string    `json:"idem_qspace"`  // Store queue space
+	IdemQname   string    `json:"idem_qname"`   // Store queue name
+	IdemStore   IdemStore `json:"-"`
+
+	//Response caching for GET requests:
+	Cache         bool   `json:"cache"`           // Cache the responses
+	CacheTtl      int    `json:"cache_ttl"`       // Default lifetime, sec
+	CacheTtlField string `json:"cache_ttl_field"` // JSON response field with TTL
+	CacheTtlHdr   string `json:"cache_ttl_hdr"`   // Response header with TTL
+	CacheHdrs     string `json:"cache_hdrs"`      // Request headers in cache key
+	CacheHdrs_arr []string
+}
+
+//Route information structure for Handles with Regexp path
+type route struct {
+	pattern *regexp.Regexp
+	handler http.Handler
+	svc     ServiceMap
+}
+
+//Custom handler to handle regexp and simple URLs
+//Simple URLs are stored in urlMap and http handler for them are stored in defaultHandler[]
+//If URL contains regexp, then regexpRoutes array is used which contains compiled pattern and handler
+type RegexpHandler struct {
+	regexpRoutes   []*route
+	urlMap         map[string]ServiceMap
+	defaultHandler map[string]http.Handler
+	defaults       ServiceMap //Defaults the routes were loaded with
+}
+
+var m_port int = atmi.FAIL
+var m_ip string
+
+//map the atmi error code (numbers + *) to some http error
+//We shall provide default mappings.
+
+var m_defaults ServiceMap
+
+/* TLS Settings: */
+var m_tls_enable int16 = FALSE
+var m_tls_cert_file string
+var m_tls_key_file string
+var m_do_tpopen bool = false //Shall we open TP for threads
+
+//Conversion types
+var m_convs = map[string]int{
+
+	"json2ubf":  CONV_JSON2UBF,
+	"text":      CONV_TEXT,
+	"json":      CONV_JSON,
+	"raw":       CONV_RAW,
+	"json2view": CONV_JSON2VIEW,
+	"static":    CONV_STATIC,
+	"ext":       CONV_EXT,
+	"websocket": CONV_WEBSOCKET,
+	"xml2ubf":   CONV_XML2UBF,
+	"xml2view":  CONV_XML2VIEW,
+	"stream":    CONV_STREAM,
+}
+
+var m_workers int
+var m_ac *atmi.ATMICtx //Mainly shared for logging....
+
+/*
+ * Handler object, provides:
+ * - ServeHTTP() for request handling (real time):
+ * - HandleFunc() config time register routes to service with regexp masks.
+ *   registers handler funcs/callbacks into RegexpHandler.defaultHandler or
+ *   RegexpHandler.regexpRoutes + regexp
+ *   which later are used by real time ServeHTTP()  to resolve services/urls...
+ */
+var m_handler atomic.Value //Global HTTP call handler (*RegexpHandler) which contains regexp and simple handlers, replaced on reload
+
+var m_cctag string //CCTAG from env
+
+//HandleFunc Can be used to add regexp or exact match URLs which uses dispathRequest()
+// to handle request
+//if regexp patters is nil, then add exact match URL, otherwise add compiled regexp
+//and handler to global handler struct
+func (h *RegexpHandler) HandleFunc(pattern *regexp.Regexp, svc ServiceMap) {
+	if svc.Format == "regexp" || svc.Format == "r" {
+		h.regexpRoutes = append(h.regexpRoutes, &route{pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			routeServe(w, r, &svc)
+		}), svc})
+	} else {
+		h.urlMap[svc.Url] = svc
+		h.defaultHandler[svc.Url] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			routeServe(w, r, &svc)
+		})
+	}
+}
+
+//Serve the request by the route, counting the route statistics
+//@param w response writer
+//@param r request
+//@param svc route
+func routeServe(w http.ResponseWriter, r *http.Request, svc *ServiceMap) {
+
+	//Route is under maintenance
+	if maintServe(w, svc) {
+		return
+	}
+
+	start := time.Now()
+
+	//Websocket needs original writer for connection hijack
+	if CONV_WEBSOCKET == svc.Conv_int {
+		wsHandler(w, r, svc)
+		statsAdd(svc.Url, http.StatusSwitchingProtocols, start)
+		return
+	}
+
+	sw := &statusWriter{ResponseWriter: w}
+
+	if CONV_STATIC == svc.Conv_int {
+		result := strings.Split(r.URL.Path, "/")
+		//m_ac.TpLogInfo("Got Static request... [%s] base: [%s]", r.URL.Path, result[1])
+		http.StripPrefix("/"+result[1], svc.FileServer).ServeHTTP(sw, r)
+	} else if nil != svc.LocalHandler {
+		svc.LocalHandler(sw, r, svc)
+	} else if mockRoute(svc) {
+		mockServe(sw, r, svc)
+	} else {
+		//m_ac.TpLogInfo("Got XATMI request...")
+		dispatchRequest(sw, r, *svc)
+	}
+
+	statsAdd(svc.Url, sw.Status(), start)
+}
+
+//ServeHTTP function to satisfy http.Handler interface
+//This function is called when incomming request is received
+//It checks if urlMap contains exact match URL and if it does, calls corresponding
+// handler which calls dispatchRequest()
+//If URL is not in urlMap (exact match) ServeHTTP checks all compiled regexps
+//and calls dispatchRequest() on match.
+func (h *RegexpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	//m_ac.TpLogInfo("ServeHTTP: [%s]", r.URL.Path)
+
+	svc := h.urlMap[r.URL.Path]
+	if svc.Svc != "" || svc.Echo {
+		//m_ac.TpLogInfo("Default ServeHTTP: [%s]", r.URL.Path)
+
+		h.defaultHandler[r.URL.Path].ServeHTTP(w, r)
+		return
+	}
+
+	for _, route := range h.regexpRoutes {
+		//m_ac.TpLogInfo("REX ServeHTTP: [%s]", r.URL.Path)
+		if route.pattern.MatchString(r.URL.Path) {
+			route.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+	//m_ac.TpLogInfo("404 ServeHTTP: [%s]", r.URL.Path)
+
+	// no pattern matched; send 404 response
+	http.NotFound(w, r)
+}
+
+//Basic setup of the route
+//Such as Syntactic sugar setups
+func routeSetup(svc *ServiceMap) error {
+
+	if svc.TransactionHandler {
+		svc.Errors = "ext"
+		svc.Conv = "ext"
+		//special value, really not used
+		svc.Svc = "@RINTX"
+
+		//Mark that workers require tpopen / close
+
+		m_do_tpopen = true
+	}
+
+	if svc.TransactionList {
+		svc.Svc = "@RINTXLIST"
+		svc.LocalHandler = txListHandler
+	}
+
+	if svc.Metrics {
+		svc.Svc = "@RINMETRICS"
+		svc.LocalHandler = metricsHandler
+	}
+
+	if svc.Reload {
+		svc.Svc = "@RINRELOAD"
+		svc.LocalHandler = reloadHandler
+	}
+
+	if svc.Batch {
+		//special value, services are given in request
+		svc.Svc = "@RINBATCH"
+
+		if svc.BatchTran {
+			m_do_tpopen = true
+		}
+	}
+
+	if svc.Conv == "websocket" && svc.Svc == "" {
+		//special value, notifications are not bound to service
+		svc.Svc = "@RINWS"
+	}
+
+	return nil
+}
+
+//Remap the error from string to int constant
+//for better performance...
+func remapErrors(svc *ServiceMap) error {
+
+	switch svc.Errors {
+	case "http":
+		svc.Errors_int = ERRORS_HTTP
+		break
+	case "json":
+		svc.Errors_int = ERRORS_JSON
+		break
+	case "json2ubf":
+		svc.Errors_int = ERRORS_JSON2UBF
+		break
+	case "json2view":
+		svc.Errors_int = ERRORS_JSON2VIEW
+		break
+	case "text":
+		svc.Errors_int = ERRORS_TEXT
+		break
+	case "ext":
+		svc.Errors_int = ERRORS_EXT
+		break
+	case "xml":
+		svc.Errors_int = ERRORS_XML
+		break
+	case "problem":
+		svc.Errors_int = ERRORS_PROBLEM
+		break
+	default:
+		return fmt.Errorf("Unsupported error type [%s]", svc.Errors)
+	}
+
+	return nil
+}
+
+//Run the listener
+//Listener uses custom handler to support Regexp and simple URLs separatly
+func apprun(ac *atmi.ATMICtx) error {
+
+	var err error
+	//TODO: Some works needed for TLS...
+	listenOn := fmt.Sprintf("%s:%d", m_ip, m_port)
+	ac.TpLog(atmi.LOG_INFO, "About to listen on: (ip: %s, port: %d) %s",
+		m_ip, m_port, listenOn)
+
+	/*
+		l, err := net.Listen("tcp", listenOn)
+
+		if err != nil {
+			ac.TpLog(atmi.LOG_ERROR, "Listen failed on %s: %v", listenOn, err)
+			return err
+		}
+
+		defer l.Close()
+
+		l = netutil.LimitListener(l, m_workers)
+	*/
+
+	if TRUE == m_tls_enable {
+
+		/* To prepare cert (self-signed) do following steps:
+		 * - TODO
+		 */
+		err = http.ListenAndServeTLS(listenOn, m_tls_cert_file, m_tls_key_file, currentRoutes{})
+
+		/*	err = http.ServeTLS(l, currentRoutes{}, m_tls_cert_file, m_tls_key_file) */
+
+		ac.TpLog(atmi.LOG_ERROR, "ListenAndServeTLS() failed: %s", err)
+	} else {
+		/*err = http.Serve(l, currentRoutes{})*/
+		err = http.ListenAndServe(listenOn, currentRoutes{})
+		ac.TpLog(atmi.LOG_ERROR, "ListenAndServe() failed: %s", err)
+	}
+
+	return err
+}
+
+//Init function, read config (with CCTAG)
+func dispatchRequest(w http.ResponseWriter, req *http.Request, svc ServiceMap) {
+
+	//Version/canary selection, route is per request copy
+	if len(svc.Targets) > 0 {
+		svc.Svc = targetSelect(&svc, req)
+		m_ac.TpLogInfo("URL [%s] target service [%s]", req.URL, svc.Svc)
+	}
+
+	if svc.Cache && http.MethodGet == req.Method && !cachePrivate(&svc, req) {
+		cacheDispatch(w, req, &svc)
+		return
+	}
+
+	m_ac.TpLog(atmi.LOG_DEBUG, "URL [%s] getting free goroutine caller: %s",
+		req.URL, req.RemoteAddr)
+
+	t := timingStart(&svc, req)
+
+	nr := <-m_freechan
+
+	t.Mark("wait")
+
+	m_ac.TpLogInfo("Got free goroutine, nr %d", nr)
+	workerBusy(nr, req.URL.Path, req.Method)
+
+	handleMessage(m_ctxs[nr], &svc, &timingWriter{ResponseWriter: w, t: t}, req, t)
+
+	timingDone(m_ctxs[nr], &svc, t)
+
+	m_ac.TpLogInfo("Request processing done %d... releasing the context", nr)
+
+	workerFree(nr)
+	m_freechan <- nr
+
+}
+
+//Resolve HTTP status of the ATMI error by route (or default) mapping
+//@param svc service map
+//@param code ATMI error code
+//@return HTTP status
+func mapHttpStatus(svc *ServiceMap, code int) int {
+
+	var lookup map[string]int
+
+	if len(svc.Errors_fmt_http_map) > 0 {
+		lookup = svc.Errors_fmt_http_map
+	} else {
+		lookup = m_defaults.Errors_fmt_http_map
+	}
+
+	if httpCode := lookup[strconv.Itoa(code)]; 0 != httpCode {
+		return httpCode
+	}
+
+	return lookup["*"]
+}
+
+//Map the ATMI Errors to Http errors
+//Format: <atmi_err>:<http_err>,<*>:<http_err>
+//* - means any other unmapped ATMI error
+//@param svc	Service map
+func parseHTTPErrorMap(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	svc.Errors_fmt_http_map = make(map[string]int)
+	ac.TpLogDebug("Splitting error mapping string [%s]",
+		svc.Errors_fmt_http_map_str)
+
+	parsed := regexp.MustCompile(", *").Split(svc.Errors_fmt_http_map_str, -1)
+
+	for index, element := range parsed {
+		ac.TpLogDebug("Got pair [%s] at %d", element, index)
+
+		pair := regexp.MustCompile(": *").Split(element, -1)
+
+		pairLen := len(pair)
+
+		if pairLen < 2 || pairLen > 2 {
+			ac.TpLogError("Invalid http error pair: [%s] "+
+				"parsed into %d elms", element, pairLen)
+
+			return fmt.Errorf("Invalid http error pair: [%s] "+
+				"parsed into %d elms", element, pairLen)
+		}
+
+		number, err := strconv.ParseInt(pair[1], 10, 0)
+
+		if err != nil {
+			ac.TpLogError("Failed to parse http error code %s (%s)",
+				pair[1], err)
+			return fmt.Errorf("Failed to parse http error code %s (%s)",
+				pair[1], err)
+		}
+
+		//Add to hash
+		svc.Errors_fmt_http_map[pair[0]] = int(number)
+	}
+
+	return nil
+}
+
+//Print the summary of the service after init
+func printSvcSummary(ac *atmi.ATMICtx, svc *ServiceMap) {
+	ac.TpLogWarn("Service: %s, Url: %s, Async mode: %t, Log request svc: [%s], "+
+		"Errors:%d (%s), Async echo %t, "+
+		"Filters: inman:%s/inopt:%s/inerr:%s/outman:%s/outopt:%s/outerr:%s, noabort: %t",
+		svc.Svc,
+		svc.Url,
+		svc.Asynccall,
+		svc.Reqlogsvc,
+		svc.Errors_int,
+		svc.Errors,
+		svc.Asyncecho,
+		svc.Finman, svc.Finopt, svc.Finerr, svc.Foutman, svc.Foutopt, svc.Fouterr,
+		svc.NoAbort)
+
+	ac.TpLogWarn("fileupload:%t tempdir:[%s]", svc.Fileupload, svc.Tempdir)
+}
+
+//Validate external service definitions
+//Also perform any needed parsings before we open the service
+func validateExtService(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	//check that errors are correct
+	if svc.Conv_int == CONV_EXT {
+
+		if svc.Errors_int != ERRORS_EXT {
+			ac.TpLogError("Service [%s] conv is 'ext', but errors not 'ext' [%s]!",
+				svc.Svc, svc.Errors)
+
+			return errors.New(fmt.Sprintf("Service [%s] conv is 'ext', but errors not ext '%s'!",
+				svc.Svc, svc.Errors))
+		}
+	} else {
+		//Others shall not use ext error mode
+		if svc.Errors_int == ERRORS_EXT {
+			ac.TpLogError("Service [%s] conv is not '%s', but errors is 'ext'!",
+				svc.Svc, svc.Conv)
+
+			return errors.New(fmt.Sprintf("Service [%s] conv is not '%s', but errors is 'ext'!",
+				svc.Svc, svc.Conv))
+		}
+	}
+
+	//Trim off whitespace
+	svc.Finman = strings.TrimSpace(svc.Finman)
+	svc.Finopt = strings.TrimSpace(svc.Finopt)
+
+	if svc.Conv_int == CONV_EXT {
+
+		svc.Finerr = strings.TrimSpace(svc.Finerr)
+
+		svc.Foutman = strings.TrimSpace(svc.Foutman)
+		svc.Foutopt = strings.TrimSpace(svc.Foutopt)
+		svc.Fouterr = strings.TrimSpace(svc.Fouterr)
+
+		//Split by comma
+
+		if "" != svc.Finman {
+			svc.Finman_arr = strings.Split(svc.Finman, ",")
+		}
+		if "" != svc.Finopt {
+			svc.Finopt_arr = strings.Split(svc.Finopt, ",")
+		}
+		if "" != svc.Finerr {
+			svc.Finerr_arr = strings.Split(svc.Finerr, ",")
+		}
+
+		if "" != svc.Foutman {
+			svc.Foutman_arr = strings.Split(svc.Foutman, ",")
+		}
+		if "" != svc.Foutopt {
+			svc.Foutopt_arr = strings.Split(svc.Foutopt, ",")
+		}
+		if "" != svc.Fouterr {
+			svc.Fouterr_arr = strings.Split(svc.Fouterr, ",")
+		}
+	} else {
+
+		if "" != svc.Finerr {
+			return errors.New(fmt.Sprintf("`finerr' not suitable for conv %s",
+				svc.Conv))
+		}
+
+		if "" != svc.Foutman {
+			return errors.New(fmt.Sprintf("`foutman' not suitable for conv %s",
+				svc.Conv))
+		}
+		if "" != svc.Foutopt {
+			return errors.New(fmt.Sprintf("`foutopt' not suitable for conv %s",
+				svc.Conv))
+		}
+		if "" != svc.Fouterr {
+			return errors.New(fmt.Sprintf("`fouterr' not suitable for conv %s",
+				svc.Conv))
+		}
+
+		if svc.Fileupload {
+			return errors.New(fmt.Sprintf("`fileupload' is valid only for ext conv (cur %s)",
+				svc.Conv))
+		}
+
+		if svc.Parseform {
+			return errors.New(fmt.Sprintf("`parseform' is valid only for ext conv (cur %s",
+				svc.Conv))
+		}
+
+	}
+
+	if svc.Fileupload && svc.Parseform {
+		return errors.New(fmt.Sprintf("`fileupload' or `parseform' must be used exclusively"))
+	}
+
+	return nil
+}
+
+//Setup default route configuration
+//@param defs defaults to fill
+func initDefaults(defs *ServiceMap) {
+
+	defs.Errors_int = ERRORS_DEFAULT
+	defs.Notime = NOTIMEOUT_DEFAULT
+	defs.Conv = CONV_DEFAULT
+	defs.Conv_int = CONV_INT_DEFAULT
+	defs.Errfmt_json_msg = ERRFMT_JSON_MSG_DEFAULT
+	defs.Errfmt_json_code = ERRFMT_JSON_CODE_DEFAULT
+	defs.Errfmt_json_onsucc = ERRFMT_JSON_ONSUCC_DEFAULT
+	defs.Errfmt_text = ERRFMT_TEXT_DEFAULT
+	defs.Asynccall = ASYNCCALL_DEFAULT
+	defs.Errfmt_view_onsucc = ERRFMT_VIEW_ONSUCC_DEFAULT
+	defs.Errfmt_xml_code = ERRFMT_XML_CODE_DEFAULT
+	defs.Errfmt_xml_msg = ERRFMT_XML_MSG_DEFAULT
+	defs.Errfmt_xml_onsucc = ERRFMT_XML_ONSUCC_DEFAULT
+	defs.WsIdQuery = WS_IDQUERY_DEFAULT
+	defs.WsPoll = WS_POLL_DEFAULT
+	defs.WsMax = WS_MAX_DEFAULT
+	defs.BatchMax = BATCH_MAX_DEFAULT
+	defs.IdemHdr = IDEM_HDR_DEFAULT
+	defs.IdemTtl = IDEM_TTL_DEFAULT
+	defs.IdemMax = IDEM_MAX_DEFAULT
+	defs.IdemLockTtl = IDEM_LOCKTTL_DEFAULT
+	defs.CacheTtl = CACHE_TTL_DEFAULT
+
+	//Do not use known rm optimization, so that each time
+	//transaction life is validated.
+	defs.TxNoOptim = true
+}
+
+//Read the configuration from common-config server
+//@param ac ATMI context
+//@return configuration buffer, error
+func configGet(ac *atmi.ATMICtx) (*atmi.TypedUBF, error) {
+
+	buf, err := ac.NewUBF(16 * 1024)
+	if nil != err {
+		ac.TpLog(atmi.LOG_ERROR, "Failed to allocate buffer: [%s]", err.Error())
+		return nil, errors.New(err.Error())
+	}
+
+	buf.BChg(u.EX_CC_CMD, 0, "g")
+	buf.BChg(u.EX_CC_LOOKUPSECTION, 0, fmt.Sprintf("%s/%s", progsection, m_cctag))
+
+	if _, err := ac.TpCall("@CCONF", buf, 0); nil != err {
+		ac.TpLog(atmi.LOG_ERROR, "ATMI Error %d:[%s]\n", err.Code(), err.Message())
+		return nil, errors.New(err.Error())
+	}
+
+	buf.TpLogPrintUBF(atmi.LOG_DEBUG, "Got configuration.")
+
+	return buf, nil
+}
+
+//Load the route from configuration, validate and prepare it for serving
+//@param ac ATMI context
+//@param defaults default route settings
+//@param url route URL (or regexp)
+//@param cfg route configuration (JSON)
+//@return route, error
+func routeLoad(ac *atmi.ATMICtx, defaults *ServiceMap, url string,
+	cfg string) (*ServiceMap, error) {
+
+	tmp := *defaults
+
+	//Override the stuff from current config
+
+	//err := json.Unmarshal(cfg, &tmp)
+	decoder := json.NewDecoder(strings.NewReader(cfg))
+	//conf := Config{}
+	err := decoder.Decode(&tmp)
+
+	if err != nil {
+		ac.TpLog(atmi.LOG_ERROR,
+			fmt.Sprintf("Failed to parse config key %s: %s",
+				url, err))
+		return nil, err
+	}
+
+	if err := routeSetup(&tmp); nil != err {
+		return nil, err
+	}
+
+	ac.TpLogDebug("Got route: URL [%s] -> Service [%s]",
+		url, tmp.Svc)
+	tmp.Url = url
+
+	//Parse http errors for
+	if tmp.Errors_fmt_http_map_str != "" {
+		if jerr := parseHTTPErrorMap(ac, &tmp); err != nil {
+			return nil, jerr
+		}
+	}
+
+	remapErrors(&tmp)
+	//Map the conv
+	tmp.Conv_int = m_convs[tmp.Conv]
+
+	if tmp.Conv_int == 0 {
+		return nil, fmt.Errorf("Invalid conv: %s", tmp.Conv)
+
+	} else if CONV_STATIC == tmp.Conv_int {
+
+		//Check that it is directory and we can read it
+		info, err := os.Stat(tmp.StaticDir)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to stat [%s] directoy - does it exists?",
+				tmp.StaticDir)
+		}
+
+		if !info.IsDir() {
+			return nil, fmt.Errorf("Path [%s] is NOT a directoy! Cannot server files",
+				tmp.StaticDir)
+		}
+
+		tmp.FileServer = http.FileServer(http.Dir(tmp.StaticDir))
+
+		if nil == tmp.FileServer {
+			return nil, fmt.Errorf("Failed to create static file server "+
+				"for [%s] directory",
+				tmp.StaticDir)
+		} else {
+			ac.TpLogInfo("Static file server [%s] OK", tmp.StaticDir)
+		}
+
+	}
+
+	//Default temporary folder
+	if "" == tmp.Tempdir {
+		tmp.Tempdir = os.TempDir()
+	}
+
+	//Validate mock fixtures
+	if err = validateMockService(ac, &tmp); err != nil {
+		return nil, err
+	}
+
+	if err = validateReloadService(ac, &tmp); err != nil {
+		return nil, err
+	}
+
+	//Validate target services
+	if err = validateTargetService(ac, &tmp); err != nil {
+		return nil, err
+	}
+
+	//Validate mirror settings
+	if err = validateMirrorService(ac, &tmp); err != nil {
+		return nil, err
+	}
+
+	//Validate view settings (if any)
+	if err = VIEWSvcValidateSettings(ac, &tmp); err != nil {
+		return nil, err
+	}
+
+	//Validate ext
+	if err = validateExtService(ac, &tmp); err != nil {
+		return nil, err
+	}
+
+	//Validate upload policy
+	if err = validateUploadService(ac, &tmp); err != nil {
+		return nil, err
+	}
+
+	//Validate file downloads
+	if err = validateDownloadService(ac, &tmp); err != nil {
+		return nil, err
+	}
+
+	//Validate websocket
+	if err = validateWsService(ac, &tmp); err != nil {
+		return nil, err
+	}
+
+	//Validate XML
+	if err = validateXMLService(ac, &tmp); err != nil {
+		return nil, err
+	}
+
+	//Validate batch
+	if err = validateBatchService(ac, &tmp); err != nil {
+		return nil, err
+	}
+
+	//Validate idempotency
+	if err = validateIdemService(ac, &tmp); err != nil {
+		return nil, err
+	}
+
+	//Validate cache
+	if err = validateCacheService(ac, &tmp); err != nil {
+		return nil, err
+	}
+
+	//Load JSON mapping profile
+	if err = validateJsonMapService(ac, &tmp); err != nil {
+		return nil, err
+	}
+
+	//Setup JSON normalization
+	if err = validateJsonNormService(ac, &tmp); err != nil {
+		return nil, err
+	}
+
+	//Validate problem details
+	if err = validateProblemService(ac, &tmp); err != nil {
+		return nil, err
+	}
+
+	//Parse user return code mapping
+	if err = validateUrcodeService(ac, &tmp); err != nil {
+		return nil, err
+	}
+
+	//Compile response template
+	if err = validateTemplateService(ac, &tmp); err != nil {
+		return nil, err
+	}
+
+	//Validate CSV export
+	if err = validateCsvService(ac, &tmp); err != nil {
+		return nil, err
+	}
+
+	//Validate content negotiation
+	if err = validateFormatsService(ac, &tmp); err != nil {
+		return nil, err
+	}
+
+	//Validate streaming settings
+	if err = validateStreamService(ac, &tmp); err != nil {
+		return nil, err
+	}
+
+	printSvcSummary(ac, &tmp)
+
+	return &tmp, nil
+}
+
+//Create empty route table
+//@return handler
+func newRegexpHandler() *RegexpHandler {
+
+	return &RegexpHandler{urlMap: make(map[string]ServiceMap),
+		defaultHandler: make(map[string]http.Handler)}
+}
+
+//Add the route to the HTTP listener
+//@param ac ATMI context
+//@param svc route
+//@param strict fail on invalid regexp, otherwise route is skipped
+//@return error
+func (h *RegexpHandler) routeAdd(ac *atmi.ATMICtx, svc *ServiceMap, strict bool) error {
+
+	ac.TpLogInfo("Checking if service uses regexp")
+	//Add to HTTP listener
+	if svc.Format == "regexp" || svc.Format == "r" {
+		if r, err := regexp.Compile(svc.Url); err == nil {
+			ac.TpLogInfo("Regexp compiled")
+			h.HandleFunc(r, *svc)
+		} else {
+			ac.TpLogError("Failed to compile regexp [%s]",
+				err.Error())
+
+			if strict {
+				return fmt.Errorf("Route [%s]: failed to compile regexp: %s",
+					svc.Url, err.Error())
+			}
+		}
+	} else {
+		h.HandleFunc(nil, *svc)
+	}
+
+	return nil
+}
+
+//Apply "defaults" JSON over the default route settings
+//@param ac ATMI context
+//@param defaults default settings to update
+//@param jsonDefault defaults JSON
+//@return error
+func defaultsLoad(ac *atmi.ATMICtx, defaults *ServiceMap, jsonDefault []byte) error {
+
+	jerr := json.Unmarshal(jsonDefault, defaults)
+	if jerr != nil {
+		ac.TpLog(atmi.LOG_ERROR,
+			fmt.Sprintf("Failed to parse defaults: %s", jerr))
+		return jerr
+	}
+
+	if defaults.Errors_fmt_http_map_str != "" {
+		if jerr := parseHTTPErrorMap(ac, defaults); jerr != nil {
+			return jerr
+		}
+	}
+
+	if err := routeSetup(defaults); nil != err {
+		return err
+	}
+
+	remapErrors(defaults)
+
+	defaults.Conv_int = m_convs[defaults.Conv]
+	if defaults.Conv_int == 0 {
+		return fmt.Errorf("Invalid conv: %s", defaults.Conv)
+	}
+
+	//Validate view settings (if any)
+	if errS := VIEWSvcValidateSettings(ac, defaults); errS != nil {
+		return errS
+	}
+
+	//Validate ext
+	if errS := validateExtService(ac, defaults); errS != nil {
+		return errS
+	}
+
+	printSvcSummary(ac, defaults)
+
+	return nil
+}
+
+//Validate the defaults and add the default error mappings
+//@param defaults default settings
+//@return error
+func defaultsFinish(defaults *ServiceMap) error {
+
+	if defaults.Parsecookies && !defaults.Parseheaders {
+		return errors.New("Invalid config: parsecookies works only in parseheader mode")
+	}
+
+	//Add the default erorr mappings
+	if defaults.Errors_fmt_http_map_str == "" {
+
+		//https://golang.org/src/net/http/status.go
+		defaults.Errors_fmt_http_map = make(map[string]int)
+		//Accepted
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPMINVAL)] =
+			http.StatusOK
+		//Errors:
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEABORT)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEBADDESC)] =
+			http.StatusBadRequest
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEBLOCK)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEINVAL)] =
+			http.StatusBadRequest
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPELIMIT)] =
+			http.StatusRequestEntityTooLarge
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPENOENT)] =
+			http.StatusNotFound
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEOS)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEPERM)] =
+			http.StatusUnauthorized
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEPROTO)] =
+			http.StatusBadRequest
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPESVCERR)] =
+			http.StatusBadGateway
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPESVCFAIL)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPESYSTEM)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPETIME)] =
+			http.StatusGatewayTimeout
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPETRAN)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPERMERR)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEITYPE)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEOTYPE)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPERELEASE)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEHAZARD)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEHEURISTIC)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEEVENT)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEMATCH)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEDIAGNOSTIC)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEMIB)] =
+			http.StatusInternalServerError
+		//Anything other goes to server error.
+		defaults.Errors_fmt_http_map["*"] = http.StatusInternalServerError
+
+	}
+
+	return nil
+}
+
+//Load default settings and the routes from configuration
+//@param ac ATMI context
+//@param buf configuration buffer
+//@param defaults default settings, loaded from "defaults" key
+//@param h route table to fill
+//@param strict route with invalid regexp is error
+//@return error
+func configLoad(ac *atmi.ATMICtx, buf *atmi.TypedUBF, defaults *ServiceMap,
+	h *RegexpHandler, strict bool) error {
+
+	occs, _ := buf.BOccur(u.EX_CC_KEY)
+
+	for occ := 0; occ < occs; occ++ {
+		fldName, err := buf.BGetString(u.EX_CC_KEY, occ)
+
+		if nil != err {
+			ac.TpLog(atmi.LOG_ERROR, "Failed to get field "+
+				"%d occ %d", u.EX_CC_KEY, occ)
+			return errors.New(err.Error())
+		}
+
+		if "defaults" == fldName {
+			//Override the defaults
+			jsonDefault, _ := buf.BGetByteArr(u.EX_CC_VALUE, occ)
+
+			if err := defaultsLoad(ac, defaults, jsonDefault); nil != err {
+				return err
+			}
+		}
+	}
+
+	if err := defaultsFinish(defaults); nil != err {
+		return err
+	}
+
+	//Bug #461 Load the services in second pass..
+	ac.TpLogInfo("Second pass config process - service load")
+	for occ := 0; occ < occs; occ++ {
+		ac.TpLog(atmi.LOG_DEBUG, "occ %d", occ)
+		fldName, err := buf.BGetString(u.EX_CC_KEY, occ)
+
+		if nil != err {
+			ac.TpLog(atmi.LOG_ERROR, "Failed to get field "+
+				"%d occ %d", u.EX_CC_KEY, occ)
+			return errors.New(err.Error())
+		}
+
+		ac.TpLog(atmi.LOG_DEBUG, "Got config field [%s]", fldName)
+
+		//Load routes...
+		if strings.HasPrefix(fldName, "/") {
+			cfgVal, _ := buf.BGetString(u.EX_CC_VALUE, occ)
+
+			ac.TpLogInfo("Got route config [%s]", cfgVal)
+
+			svc, err := routeLoad(ac, defaults, fldName, cfgVal)
+
+			if nil != err {
+				return err
+			}
+
+			routeCarryOver(ac, svc)
+
+			if err := h.routeAdd(ac, svc, strict); nil != err {
+				return err
+			}
+		}
+	}
+
+	h.defaults = *defaults
+
+	return nil
+}
+
+//Un-init function
+func appinit(ac *atmi.ATMICtx) error {
+	//runtime.LockOSThread()
+
+	//Setup default configuration
+	initDefaults(&m_defaults)
+
+	m_workers = WORKERS
+
+	if err := ac.TpInit(); err != nil {
+		return errors.New(err.Error())
+	}
+
+	//Get the configuration
+	m_cctag = os.Getenv("NDRX_CCTAG")
+
+	buf, err := configGet(ac)
+
+	if nil != err {
+		return err
+	}
+
+	//Set the parameters (ip/port/services)
+
+	occs, _ := buf.BOccur(u.EX_CC_KEY)
+	// Load in the config...
+	for occ := 0; occ < occs; occ++ {
+		ac.TpLog(atmi.LOG_DEBUG, "occ %d", occ)
+		fldName, err := buf.BGetString(u.EX_CC_KEY, occ)
+
+		if nil != err {
+			ac.TpLog(atmi.LOG_ERROR, "Failed to get field "+
+				"%d occ %d", u.EX_CC_KEY, occ)
+			return errors.New(err.Error())
+		}
+
+		ac.TpLog(atmi.LOG_DEBUG, "Got config field [%s]", fldName)
+
+		switch fldName {
+		case "debug":
+			//Set debug configuration string
+			debug, _ := buf.BGetString(u.EX_CC_VALUE, occ)
+			ac.TpLogDebug("Got [%s] = [%s] ", fldName, debug)
+			if err := ac.TpLogConfig((atmi.LOG_FACILITY_NDRX | atmi.LOG_FACILITY_UBF | atmi.LOG_FACILITY_TP),
+				-1, debug, "ROUT", ""); nil != err {
+				ac.TpLogError("Invalid debug config [%s] %d:[%s]",
+					debug, err.Code(), err.Message())
+				return fmt.Errorf("Invalid debug config [%s] %d:[%s]",
+					debug, err.Code(), err.Message())
+			}
+
+			break
+		case "workers":
+			m_workers, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "gencore":
+			gencore, _ := buf.BGetInt(u.EX_CC_VALUE, occ)
+
+			if TRUE == gencore {
+				//Process signals by default handlers
+				ac.TpLogInfo("gencore=1 - SIGSEG signal will be " +
+					"processed by default OS handler")
+				// Have some core dumps...
+				C.signal(11, nil)
+			}
+			break
+		case "port":
+			m_port, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "ip":
+			m_ip, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "tls_enable":
+			m_tls_enable, _ = buf.BGetInt16(u.EX_CC_VALUE, occ)
+			break
+		case "tls_cert_file":
+			m_tls_cert_file, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "tls_key_file":
+			m_tls_key_file, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "tpopen":
+			m_do_tpopen = true
+			break
+		case "tx_idle_max":
+			m_tx_idle_max, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "cache_mem":
+			m_cachemem, _ = buf.BGetInt64(u.EX_CC_VALUE, occ)
+			break
+		case "admin_ip":
+			m_adminip, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "admin_port":
+			m_adminport, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "admin_token":
+			m_admintoken, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "route_event":
+			m_routeevent, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "route_poll":
+			m_routepoll, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "route_ttl":
+			m_routettl, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "timing_header":
+			m_timingheader, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "timing_ips":
+			m_timingips, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "mock":
+			mock, _ := buf.BGetInt(u.EX_CC_VALUE, occ)
+			m_mockall = (TRUE == mock)
+			break
+		case "mirror_workers":
+			m_mirrorworkers, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "mirror_queue":
+			m_mirrorqueue, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		}
+	}
+
+	h := newRegexpHandler()
+
+	if err := configLoad(ac, buf, &m_defaults, h, false); nil != err {
+		return err
+	}
+
+	m_cfgroutes = h
+	m_handler.Store(h)
+
+	if atmi.FAIL == m_port || "" == m_ip {
+		ac.TpLog(atmi.LOG_ERROR, "Invalid config: missing ip (%s) or port (%d)",
+			m_ip, m_port)
+		return errors.New("Invalid config: missing ip or port")
+	}
+
+	//Check the TLS settings
+	if TRUE == m_tls_enable && (m_tls_cert_file == "" || m_tls_key_file == "") {
+
+		ac.TpLog(atmi.LOG_ERROR, "Invalid TLS settigns missing cert "+
+			"(%s) or keyfile (%s) ", m_tls_cert_file, m_tls_key_file)
+
+		return errors.New("Invalid config: missing ip or port")
+	}
+
+	ac.TpLogInfo("About to init woker pool, number of workers: %d", m_workers)
+
+	if err := initPool(ac); nil != err {
+		return err
+	}
+
+	//Reaper needs XA session, which is configured for transactional processes
+	if !m_do_tpopen {
+		m_tx_idle_max = 0
+	}
+
+	if err := txReaperStart(ac); nil != err {
+		return err
+	}
+
+	if err := timingInit(ac); nil != err {
+		ac.TpLogError("%s", err.Error())
+		return err
+	}
+
+	if m_mirrorworkers <= 0 || m_mirrorqueue <= 0 {
+		ac.TpLogError("Invalid mirror_workers %d or mirror_queue %d",
+			m_mirrorworkers, m_mirrorqueue)
+		return errors.New("Invalid config: mirror_workers or mirror_queue")
+	}
+
+	//Routes published by services
+	if "" != m_routeevent {
+		if err := routeSubStart(ac); nil != err {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Stop background processing: notifications, tx reaper, route events, mirror.
+//New requests are refused, requests in progress are waited for
+//@param ac ATMI context
+func bridgeStop(ac *atmi.ATMICtx) {
+
+	//Websocket requests are served until the connection is closed
+	wsShutdown(ac)
+
+	m_runmutex.Lock()
+	m_closed = true
+	m_runmutex.Unlock()
+
+	txReaperStop(ac)
+	routeSubStop(ac)
+	mirrorStop(ac)
+}
+
+//Un-init the application, the process exit is up to the caller
+func unInit(ac *atmi.ATMICtx) {
+
+	bridgeStop(ac)
+
+	for i := 0; i < m_workers; i++ {
+		nr := <-m_freechan
+
+		ac.TpLogWarn("Terminating %d context", nr)
+
+		//Close transactions
+		if m_do_tpopen {
+			m_ctxs[nr].TpClose()
+		}
+
+		m_ctxs[nr].TpTerm()
+		m_ctxs[nr].FreeATMICtx()
+	}
+
+	ac.TpTerm()
+	ac.FreeATMICtx()
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
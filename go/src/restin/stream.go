@@ -0,0 +1,375 @@
+/**
+ * @brief Streaming of request bodies into conversational services
+ *
+ * @file stream.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+/*
+
+Request body is sent to the service in chunks over conversation:
+
+- tpconnect() with the first chunk (TPSENDONLY, restincl keeps the control)
+- tpsend() for next chunks
+- last chunk (may be empty) is sent with TPRECVONLY, passing the control
+- tprecv() until the service finishes with tpreturn(), reply is the response
+
+Body is read from the client only as fast as the service receives the chunks.
+
+*/
+
+//Chunk buffer types
+const (
+	STREAM_BUF_CARRAY = "carray"
+	STREAM_BUF_UBF    = "ubf"
+)
+
+const (
+	STREAM_CHUNK_DEFAULT = 32768 //Default chunk size, bytes
+	STREAM_UBF_RESERVE   = 1024  //Space for other fields in UBF chunk
+)
+
+//Validate streaming settings of the route
+//@param ac ATMI context
+//@param svc service map
+//@return error or nil
+func validateStreamService(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if CONV_STREAM != svc.Conv_int {
+		return nil
+	}
+
+	switch svc.Errors_int {
+	case ERRORS_HTTP, ERRORS_TEXT, ERRORS_PROBLEM:
+	default:
+		return fmt.Errorf("Route [%s]: conv 'stream' supports errors http, "+
+			"text or problem only (cur %s)", svc.Url, svc.Errors)
+	}
+
+	if svc.Asynccall || svc.Echo || "" == svc.Svc {
+		return fmt.Errorf("Route [%s]: conv 'stream' requires service and "+
+			"does not support async or echo", svc.Url)
+	}
+
+	switch svc.StreamBuf {
+	case "":
+		svc.StreamBuf = STREAM_BUF_CARRAY
+	case STREAM_BUF_CARRAY, STREAM_BUF_UBF:
+	default:
+		return fmt.Errorf("Route [%s]: invalid 'stream_buf' [%s]",
+			svc.Url, svc.StreamBuf)
+	}
+
+	if 0 == svc.StreamChunk {
+		svc.StreamChunk = STREAM_CHUNK_DEFAULT
+	}
+
+	max := int(atmi.ATMIMsgSizeMax()) - STREAM_UBF_RESERVE
+
+	if svc.StreamChunk < 0 || svc.StreamChunk > max {
+		return fmt.Errorf("Route [%s]: invalid 'stream_chunk' %d, max %d",
+			svc.Url, svc.StreamChunk, max)
+	}
+
+	ac.TpLogInfo("Route [%s] stream: chunk %d buffer [%s]",
+		svc.Url, svc.StreamChunk, svc.StreamBuf)
+
+	return nil
+}
+
+//Map conversation event to error
+//@param revent event
+//@return ATMI error
+func streamEventErr(revent int64) atmi.ATMIError {
+
+	switch {
+	case 0 != revent&atmi.TPEV_SVCFAIL:
+		return atmi.NewCustomATMIError(atmi.TPESVCFAIL, "Service failed")
+	case 0 != revent&atmi.TPEV_SVCERR:
+		return atmi.NewCustomATMIError(atmi.TPESVCERR, "Service error")
+	case 0 != revent&atmi.TPEV_DISCONIMM:
+		return atmi.NewCustomATMIError(atmi.TPESYSTEM,
+			"Service disconnected the conversation")
+	}
+
+	return atmi.NewCustomATMIError(atmi.TPESYSTEM,
+		fmt.Sprintf("Unexpected conversation event %d", revent))
+}
+
+//Allocate the chunk buffer
+//@param ac ATMI context
+//@param svc service map
+//@param req request
+//@return buffer, ATMI error
+func streamNewBuf(ac *atmi.ATMICtx, svc *ServiceMap,
+	req *http.Request) (atmi.TypedBuffer, atmi.ATMIError) {
+
+	if STREAM_BUF_CARRAY == svc.StreamBuf {
+		return ac.NewCarray([]byte{})
+	}
+
+	bufu, errA := ac.NewUBF(int64(svc.StreamChunk + STREAM_UBF_RESERVE))
+
+	if nil != errA {
+		return nil, errA
+	}
+
+	//Request attributes, for the first chunk
+	if errU := parseHeaders(ac, svc, req, bufu); nil != errU {
+		return nil, atmi.NewCustomATMIError(atmi.TPESYSTEM,
+			fmt.Sprintf("Failed to parse headers %d:[%s]",
+				errU.Code(), errU.Message()))
+	}
+
+	if errU := parseQuery(ac, svc, req, bufu); nil != errU {
+		return nil, atmi.NewCustomATMIError(atmi.TPESYSTEM,
+			fmt.Sprintf("Failed to parse query %d:[%s]",
+				errU.Code(), errU.Message()))
+	}
+
+	if errU := bufu.BChg(ubftab.EX_IF_URL, 0, req.URL.Path); nil != errU {
+		return nil, atmi.NewCustomATMIError(atmi.TPESYSTEM,
+			fmt.Sprintf("Failed to set EX_IF_URL %d:[%s]",
+				errU.Code(), errU.Message()))
+	}
+
+	if errU := bufu.BChg(ubftab.EX_IF_METHOD, 0, req.Method); nil != errU {
+		return nil, atmi.NewCustomATMIError(atmi.TPESYSTEM,
+			fmt.Sprintf("Failed to set EX_IF_METHOD %d:[%s]",
+				errU.Code(), errU.Message()))
+	}
+
+	return bufu, nil
+}
+
+//Load chunk data to buffer
+//@param svc service map
+//@param buf chunk buffer
+//@param data chunk data
+//@return ATMI error
+func streamSetChunk(svc *ServiceMap, buf atmi.TypedBuffer, data []byte) atmi.ATMIError {
+
+	if bufc, ok := buf.(*atmi.TypedCarray); ok {
+		return bufc.SetBytes(data)
+	}
+
+	bufu := buf.(*atmi.TypedUBF)
+
+	if errU := bufu.BChg(ubftab.EX_IF_REQDATA, 0, data); nil != errU {
+		return atmi.NewCustomATMIError(atmi.TPESYSTEM,
+			fmt.Sprintf("Failed to set EX_IF_REQDATA %d:[%s]",
+				errU.Code(), errU.Message()))
+	}
+
+	return nil
+}
+
+//Stream the request body to the service
+//@param ac ATMI context
+//@param svc service map
+//@param w response writer
+//@param req request
+//@param rctx request context
+//@return SUCCEED/FAIL
+func streamHandler(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
+	req *http.Request, rctx *RequestContext) int {
+
+	var flags int64
+	var revent int64
+	var rsp atmi.TypedBuffer
+	var errA atmi.ATMIError
+
+	cd := -1
+	chunks := 0
+	total := 0
+
+	if svc.Notime {
+		flags |= atmi.TPNOTIME
+	}
+
+	buf, errA := streamNewBuf(ac, svc, req)
+
+	if nil != errA {
+		ac.TpLogError("Failed to prepare chunk buffer: %s", errA.Message())
+		genRsp(ac, nil, svc, w, errA, false, false, false, rctx)
+		return atmi.FAIL
+	}
+
+	data := make([]byte, svc.StreamChunk)
+
+	defer func() {
+		//Conversation not completed
+		if cd >= 0 {
+			ac.TpLogWarn("Aborting conversation %d", cd)
+			ac.TpDiscon(cd)
+		}
+
+		ac.TpFree(buf.GetBuf())
+	}()
+
+	rctx.errSrc = ERRSRC_SERVICE
+
+	for last := false; !last; {
+
+		n, err := io.ReadFull(req.Body, data)
+
+		if io.EOF == err || io.ErrUnexpectedEOF == err {
+			last = true
+		} else if nil != err {
+			ac.TpLogError("Failed to read request body: %s", err.Error())
+			errA = atmi.NewCustomATMIError(atmi.TPEINVAL,
+				fmt.Sprintf("Failed to read request body: %s", err.Error()))
+			break
+		}
+
+		if errA = streamSetChunk(svc, buf, data[:n]); nil != errA {
+			break
+		}
+
+		chunks++
+		total += n
+
+		ac.TpLogDebug("Sending chunk %d, %d bytes (last: %t)", chunks, n, last)
+
+		if cd < 0 {
+
+			if cd, errA = ac.TpConnect(svc.Svc, buf, flags|atmi.TPSENDONLY); nil != errA {
+				cd = -1
+				break
+			}
+
+			//Request attributes are sent in the first chunk only
+			if bufu, ok := buf.(*atmi.TypedUBF); ok {
+				bufu.BProj([]int{ubftab.EX_IF_REQDATA})
+			}
+
+			if !last {
+				continue
+			}
+
+			//Pass the control, no more data
+			if errA = streamSetChunk(svc, buf, []byte{}); nil != errA {
+				break
+			}
+		}
+
+		sendFlags := flags
+
+		if last {
+			sendFlags |= atmi.TPRECVONLY
+		}
+
+		if errA = ac.TpSend(cd, buf, sendFlags, &revent); nil != errA {
+
+			if atmi.TPEEVENT == errA.Code() {
+				//Service has finished the conversation
+				errA = streamEventErr(revent)
+				cd = -1
+			}
+
+			break
+		}
+	}
+
+	if nil == errA {
+
+		ac.TpLogInfo("Sent %d bytes in %d chunks, waiting for reply", total, chunks)
+
+		if STREAM_BUF_CARRAY == svc.StreamBuf {
+			var bufc *atmi.TypedCarray
+
+			if bufc, errA = ac.NewCarray([]byte{}); nil == errA {
+				rsp = bufc
+			}
+		} else {
+			var bufu *atmi.TypedUBF
+
+			if bufu, errA = ac.NewUBF(atmi.ATMIMsgSizeMax()); nil == errA {
+				rsp = bufu
+			}
+		}
+	}
+
+	for nil == errA {
+
+		errA = ac.TpRecv(&cd, rsp, flags, &revent)
+
+		if nil == errA {
+			//Intermediate data, final reply comes with tpreturn()
+			continue
+		}
+
+		if atmi.TPEEVENT == errA.Code() {
+
+			cd = -1
+
+			if 0 != revent&atmi.TPEV_SVCSUCC {
+				errA = nil
+			} else {
+				errA = streamEventErr(revent)
+			}
+		}
+
+		break
+	}
+
+	if nil != errA {
+		ac.TpLogError("Stream to [%s] failed: %d:%s", svc.Svc,
+			errA.Code(), errA.Message())
+	}
+
+	//Failed service may return data too
+	if nil == errA || atmi.TPESVCFAIL == errA.Code() {
+		genRsp(ac, rsp, svc, w, errA, false, true, true, rctx)
+	} else {
+		genRsp(ac, nil, svc, w, errA, false, true, false, rctx)
+
+		if nil != rsp {
+			ac.TpFree(rsp.GetBuf())
+		}
+	}
+
+	if nil != errA {
+		return atmi.FAIL
+	}
+
+	return atmi.SUCCEED
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
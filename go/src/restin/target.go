@@ -0,0 +1,244 @@
+/**
+ * @brief Weighted and conditional selection of route target services
+ *
+ * @file target.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+/*
+
+Route may list several target services, e.g. versions of the same API:
+
+"targets":[{"svc":"ACCTGET2", "header":"X-Api-Version", "value":"2"},
+	{"svc":"ACCTGET2", "weight":10}, {"svc":"ACCTGET", "weight":90}]
+
+Targets with condition (header, cookie or query) are checked first, in given
+order. If none matches, target is chosen by weight from targets without
+condition. If 'target_sticky' is set, the choice is made by hash of the client
+key, thus the same client gets the same target while weights are not changed.
+
+*/
+
+const (
+	METRIC_TARGET_REQUESTS = "restincl_target_requests_total"
+)
+
+//Route target service
+type RouteTarget struct {
+	Svc    string `json:"svc"`    //Target service
+	Weight int    `json:"weight"` //Share of requests without condition
+	Header string `json:"header"` //Condition: request header...
+	Cookie string `json:"cookie"` //... or cookie ...
+	Query  string `json:"query"`  //... or query parameter
+	Value  string `json:"value"`  //... equals to
+}
+
+//Get the request attribute
+//@param req request
+//@param kind header, cookie or query
+//@param name attribute name
+//@return value, present
+func targetAttr(req *http.Request, kind string, name string) (string, bool) {
+
+	switch kind {
+	case "header":
+		if v := req.Header.Get(name); "" != v {
+			return v, true
+		}
+	case "cookie":
+		if c, err := req.Cookie(name); nil == err {
+			return c.Value, true
+		}
+	case "query":
+		if v, ok := req.URL.Query()[name]; ok && len(v) > 0 {
+			return v[0], true
+		}
+	}
+
+	return "", false
+}
+
+//Validate route targets
+//@param ac ATMI context
+//@param svc service map
+//@return error or nil
+func validateTargetService(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if 0 == len(svc.Targets) {
+
+		if "" != svc.TargetSticky {
+			return fmt.Errorf("Route [%s]: 'target_sticky' requires 'targets'",
+				svc.Url)
+		}
+
+		return nil
+	}
+
+	if CONV_STATIC == svc.Conv_int || CONV_WEBSOCKET == svc.Conv_int ||
+		svc.Batch || svc.Echo || nil != svc.LocalHandler {
+		return fmt.Errorf("Route [%s]: 'targets' are not supported by this route",
+			svc.Url)
+	}
+
+	svc.TargetWeight = 0
+
+	for i, t := range svc.Targets {
+
+		conds := 0
+
+		for _, c := range []string{t.Header, t.Cookie, t.Query} {
+			if "" != c {
+				conds++
+			}
+		}
+
+		if "" == t.Svc || t.Weight < 0 || conds > 1 || (conds > 0 && t.Weight > 0) {
+			return fmt.Errorf("Route [%s]: invalid target %d [%s], either one "+
+				"condition or weight may be set", svc.Url, i, t.Svc)
+		}
+
+		svc.TargetWeight += t.Weight
+	}
+
+	if "" != svc.TargetSticky {
+
+		pair := strings.SplitN(svc.TargetSticky, ":", 2)
+
+		if 2 != len(pair) || "" == pair[1] ||
+			("header" != pair[0] && "cookie" != pair[0] && "query" != pair[0]) {
+			return fmt.Errorf("Route [%s]: invalid 'target_sticky' [%s], "+
+				"expected header|cookie|query:NAME", svc.Url, svc.TargetSticky)
+		}
+	}
+
+	//Service used when no target is selected
+	if "" == svc.Svc {
+
+		for _, t := range svc.Targets {
+			if t.Weight > 0 {
+				svc.Svc = t.Svc
+				break
+			}
+		}
+
+		if "" == svc.Svc {
+			return fmt.Errorf("Route [%s]: 'svc' or weighted target is required",
+				svc.Url)
+		}
+	}
+
+	ac.TpLogInfo("Route [%s]: %d targets, total weight %d, sticky [%s]",
+		svc.Url, len(svc.Targets), svc.TargetWeight, svc.TargetSticky)
+
+	return nil
+}
+
+//Select the target service for the request
+//@param svc route
+//@param req request
+//@return service name
+func targetSelect(svc *ServiceMap, req *http.Request) string {
+
+	ret := ""
+
+	for _, t := range svc.Targets {
+
+		var v string
+		var ok bool
+
+		switch {
+		case "" != t.Header:
+			v, ok = targetAttr(req, "header", t.Header)
+		case "" != t.Cookie:
+			v, ok = targetAttr(req, "cookie", t.Cookie)
+		case "" != t.Query:
+			v, ok = targetAttr(req, "query", t.Query)
+		default:
+			continue
+		}
+
+		if ok && v == t.Value {
+			ret = t.Svc
+			break
+		}
+	}
+
+	if "" == ret && svc.TargetWeight > 0 {
+
+		var pick int
+		sticky := false
+
+		if "" != svc.TargetSticky {
+			pair := strings.SplitN(svc.TargetSticky, ":", 2)
+
+			if key, ok := targetAttr(req, pair[0], pair[1]); ok {
+				h := fnv.New32a()
+				h.Write([]byte(key))
+				pick = int(h.Sum32() % uint32(svc.TargetWeight))
+				sticky = true
+			}
+		}
+
+		if !sticky {
+			pick = rand.Intn(svc.TargetWeight)
+		}
+
+		for _, t := range svc.Targets {
+
+			if pick < t.Weight {
+				ret = t.Svc
+				break
+			}
+
+			pick -= t.Weight
+		}
+	}
+
+	if "" == ret {
+		ret = svc.Svc
+	}
+
+	metricsAdd(fmt.Sprintf("%s{route=%q,svc=%q}", METRIC_TARGET_REQUESTS,
+		svc.Url, ret), 1)
+
+	return ret
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,383 @@
+/**
+ * @brief Template based response rendering (text/template or html/template)
+ *
+ * @file template.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"exutil"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Template engines
+const (
+	TEMPLATE_TEXT = "text"
+	TEMPLATE_HTML = "html"
+)
+
+//Compiled template (text or html)
+type RspTemplate interface {
+	Execute(wr io.Writer, data interface{}) error
+}
+
+/**
+ * Data passed to the template
+ */
+type TemplateData struct {
+	Data         map[string]interface{} //Response fields, occurrences as arrays
+	View         string                 //VIEW name, for VIEW responses
+	Text         string                 //STRING response of text route
+	ErrorCode    int                    //XATMI error code, 0 on success
+	ErrorMessage string                 //XATMI error message
+	Url          string                 //Route URL
+}
+
+//Helper functions available in templates
+var m_tplfuncs = map[string]interface{}{
+	"occs":    tplOccs,
+	"occ":     tplOcc,
+	"count":   tplCount,
+	"join":    tplJoin,
+	"num":     tplNum,
+	"default": tplDefault,
+	"upper":   strings.ToUpper,
+	"lower":   strings.ToLower,
+	"trim":    strings.TrimSpace,
+	"csv":     tplCsv,
+	"xml":     tplXml,
+	"json":    tplJson,
+}
+
+//Return field occurrences as list
+//@param v field value (scalar or array)
+//@return list of occurrences
+func tplOccs(v interface{}) []interface{} {
+
+	switch t := v.(type) {
+	case nil:
+		return []interface{}{}
+	case []interface{}:
+		return t
+	}
+
+	return []interface{}{v}
+}
+
+//Return field occurrence
+//@param v field value
+//@param occ occurrence
+//@return value or nil if occurrence not present
+func tplOcc(v interface{}, occ int) interface{} {
+
+	occs := tplOccs(v)
+
+	if occ < 0 || occ >= len(occs) {
+		return nil
+	}
+
+	return occs[occ]
+}
+
+//Number of field occurrences
+//@param v field value
+//@return count
+func tplCount(v interface{}) int {
+	return len(tplOccs(v))
+}
+
+//Join field occurrences
+//@param sep separator
+//@param v field value
+//@return joined string
+func tplJoin(sep string, v interface{}) string {
+
+	var strs []string
+
+	for _, o := range tplOccs(v) {
+		strs = append(strs, fmt.Sprint(o))
+	}
+
+	return strings.Join(strs, sep)
+}
+
+//Convert value to number, for formatting with printf
+//@param v value
+//@return float value, 0 if not a number
+func tplNum(v interface{}) float64 {
+
+	var f float64
+
+	fmt.Sscan(fmt.Sprint(tplOcc(v, 0)), &f)
+
+	return f
+}
+
+//Use default if value is missing or empty
+//@param def default value
+//@param v value
+//@return value or default
+func tplDefault(def interface{}, v interface{}) interface{} {
+
+	if nil == v || "" == v {
+		return def
+	}
+
+	return v
+}
+
+//Escape value as CSV field
+//@param v value
+//@return CSV field
+func tplCsv(v interface{}) string {
+
+	var b bytes.Buffer
+
+	w := csv.NewWriter(&b)
+	w.Write([]string{fmt.Sprint(tplDefault("", v))})
+	w.Flush()
+
+	return strings.TrimRight(b.String(), "\r\n")
+}
+
+//Escape value as XML text
+//@param v value
+//@return escaped text
+func tplXml(v interface{}) string {
+
+	var b bytes.Buffer
+
+	xml.EscapeText(&b, []byte(fmt.Sprint(tplDefault("", v))))
+
+	return b.String()
+}
+
+//Encode value as JSON
+//@param v value
+//@return JSON text
+func tplJson(v interface{}) string {
+
+	js, _ := json.Marshal(v)
+
+	return string(js)
+}
+
+//Validate and compile the response template of the route
+//@param ac ATMI context
+//@param svc service map
+//@return error or nil
+func validateTemplateService(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	svc.Template_tpl = nil
+
+	if "" == svc.Template {
+		return nil
+	}
+
+	switch svc.Conv_int {
+	case CONV_JSON2UBF, CONV_JSON2VIEW, CONV_TEXT:
+	default:
+		return fmt.Errorf("Route [%s]: 'template' valid only for json2ubf, "+
+			"json2view or text conv (cur %s)", svc.Url, svc.Conv)
+	}
+
+	switch svc.Errors_int {
+	case ERRORS_JSON, ERRORS_XML:
+		return fmt.Errorf("Route [%s]: 'template' not valid for errors %s",
+			svc.Url, svc.Errors)
+	}
+
+	if "" != svc.Formats {
+		return fmt.Errorf("Route [%s]: 'template' not valid together "+
+			"with 'formats'", svc.Url)
+	}
+
+	src, err := ioutil.ReadFile(svc.Template)
+
+	if nil != err {
+		return fmt.Errorf("Route [%s]: failed to read template: %s",
+			svc.Url, err.Error())
+	}
+
+	name := filepath.Base(svc.Template)
+
+	switch svc.TemplateEngine {
+	case "", TEMPLATE_TEXT:
+		svc.TemplateEngine = TEMPLATE_TEXT
+		svc.Template_tpl, err = texttemplate.New(name).
+			Funcs(texttemplate.FuncMap(m_tplfuncs)).Parse(string(src))
+
+		if "" == svc.TemplateCtype {
+			svc.TemplateCtype = "text/plain"
+		}
+	case TEMPLATE_HTML:
+		svc.Template_tpl, err = htmltemplate.New(name).
+			Funcs(htmltemplate.FuncMap(m_tplfuncs)).Parse(string(src))
+
+		if "" == svc.TemplateCtype {
+			svc.TemplateCtype = "text/html; charset=utf-8"
+		}
+	default:
+		return fmt.Errorf("Route [%s]: invalid 'template_engine' [%s]",
+			svc.Url, svc.TemplateEngine)
+	}
+
+	if nil != err {
+		return fmt.Errorf("Route [%s]: failed to compile template: %s",
+			svc.Url, err.Error())
+	}
+
+	ac.TpLogInfo("Route [%s] template [%s] engine [%s] content type [%s]",
+		svc.Url, svc.Template, svc.TemplateEngine, svc.TemplateCtype)
+
+	return nil
+}
+
+//Convert UBF or VIEW response of text route to JSON (service has changed
+//the buffer type on return)
+//@param ac ATMI context
+//@param svc service map
+//@param buf response buffer
+//@return JSON or nil if buffer is not UBF or VIEW, true if VIEW
+func templateBufJSON(ac *atmi.ATMICtx, svc *ServiceMap,
+	buf atmi.TypedBuffer) ([]byte, bool) {
+
+	itype := ""
+	subtype := ""
+
+	if _, err := ac.TpTypes(buf.GetBuf(), &itype, &subtype); nil != err {
+		ac.TpLogError("Failed to get buffer infos: %s", err.Error())
+		return nil, false
+	}
+
+	switch itype {
+	case "UBF", "UBF32", "FML", "FML32":
+
+		bufu, err := ac.CastToUBF(buf.GetBuf())
+
+		if nil != err {
+			ac.TpLogError("Failed to cast to UBF: %s", err.Error())
+			return nil, false
+		}
+
+		ret, err := exutil.UBFToJSON(ac, bufu, svc.View_flags)
+
+		if nil != err {
+			ac.TpLogError("Failed to convert UBF to JSON: %s", err.Error())
+			return nil, false
+		}
+
+		return []byte(ret), false
+	case "VIEW", "VIEW32":
+
+		bufv, err := ac.CastToVIEW(buf.GetBuf())
+
+		if nil != err {
+			ac.TpLogError("Failed to cast to VIEW: %s", err.Error())
+			return nil, false
+		}
+
+		ret, err := bufv.TpVIEWToJSON(svc.View_flags)
+
+		if nil != err {
+			ac.TpLogError("Failed to convert VIEW to JSON: %s", err.Error())
+			return nil, false
+		}
+
+		return []byte(ret), true
+	}
+
+	return nil, false
+}
+
+//Render the response with route template
+//@param ac ATMI context
+//@param svc service map
+//@param js response in JSON (UBF or VIEW), may be empty
+//@param text STRING response (text route)
+//@param view JSON is VIEW, i.e. {"VIEW_NAME":{fields...}}
+//@param err call result
+//@return rendered response, ATMI error if rendering failed
+func templateRender(ac *atmi.ATMICtx, svc *ServiceMap, js []byte, text string,
+	view bool, err atmi.ATMIError) ([]byte, atmi.ATMIError) {
+
+	var b bytes.Buffer
+
+	data := TemplateData{Data: make(map[string]interface{}), ErrorCode: err.Code(),
+		ErrorMessage: err.Message(), Text: text, Url: svc.Url}
+
+	if atmi.TPMINVAL == err.Code() {
+		data.ErrorCode = 0
+	}
+
+	if len(js) > 0 {
+
+		d := json.NewDecoder(bytes.NewReader(js))
+		d.UseNumber()
+
+		if errJ := d.Decode(&data.Data); nil != errJ {
+			ac.TpLogError("Failed to decode response for template: %s", errJ.Error())
+			return nil, atmi.NewCustomATMIError(atmi.TPESYSTEM,
+				"Failed to decode response for template")
+		}
+
+		if view {
+			for k, v := range data.Data {
+				if inner, ok := v.(map[string]interface{}); ok {
+					data.View = k
+					data.Data = inner
+				}
+			}
+		}
+	}
+
+	if errT := svc.Template_tpl.Execute(&b, &data); nil != errT {
+		ac.TpLogError("Failed to execute template [%s]: %s",
+			svc.Template, errT.Error())
+		return nil, atmi.NewCustomATMIError(atmi.TPESYSTEM,
+			"Failed to render response")
+	}
+
+	return b.Bytes(), nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
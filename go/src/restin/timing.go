@@ -0,0 +1,282 @@
+/**
+ * @brief Request phase timing and Server-Timing header
+ *
+ * @file timing.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"exutil"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+/*
+
+Each request served by the worker pool is split in phases:
+
+wait - waiting for free worker;
+conv - reading and converting request to XATMI buffer;
+finman, finopt - incoming filters;
+upload - receiving uploaded files;
+call - service call;
+foutman, foutopt - outgoing filters;
+rsp - building the response, until the headers are sent.
+
+Phases are logged and counted in metrics. 'Server-Timing' header is sent, if
+route has 'server_timing' set, or request has debug header ('timing_header')
+and comes from the allowed address ('timing_ips').
+
+*/
+
+const (
+	TIMING_HEADER_DEFAULT = "X-Server-Timing" //Default debug header
+	TIMING_IPS_DEFAULT    = "127.0.0.1,::1"   //Default addresses allowed
+	METRIC_PHASE_MICROS   = "restincl_phase_microseconds_total"
+	METRIC_PHASE_COUNT    = "restincl_phase_count_total"
+)
+
+var m_timingheader string = TIMING_HEADER_DEFAULT //Debug header, empty - disabled
+var m_timingips string = TIMING_IPS_DEFAULT       //Allowed addresses (IP or CIDR)
+var m_timingnets []*net.IPNet                     //Parsed m_timingips
+
+//Time spent in the phase
+type timingPhase struct {
+	name   string //Phase name
+	micros int64  //Duration, microseconds
+}
+
+//Phase timing of the request
+type ServerTiming struct {
+	sw     exutil.StopWatch //Since last phase
+	phases []timingPhase    //Completed phases
+	emit   bool             //Send Server-Timing header
+	sent   bool             //Headers are sent
+}
+
+//Writer which adds Server-Timing header, when response is started
+type timingWriter struct {
+	http.ResponseWriter
+	t *ServerTiming
+}
+
+//Parse the allowed addresses
+//@param ac ATMI context
+//@return error
+func timingInit(ac *atmi.ATMICtx) error {
+
+	m_timingnets = nil
+
+	for _, addr := range strings.Split(m_timingips, ",") {
+
+		addr = strings.TrimSpace(addr)
+
+		if "" == addr {
+			continue
+		}
+
+		if !strings.Contains(addr, "/") {
+			if strings.Contains(addr, ":") {
+				addr += "/128"
+			} else {
+				addr += "/32"
+			}
+		}
+
+		_, ipnet, err := net.ParseCIDR(addr)
+
+		if nil != err {
+			return fmt.Errorf("Invalid timing_ips entry [%s]: %s",
+				addr, err.Error())
+		}
+
+		m_timingnets = append(m_timingnets, ipnet)
+	}
+
+	ac.TpLogInfo("Server-Timing debug header [%s] allowed from [%s]",
+		m_timingheader, m_timingips)
+
+	return nil
+}
+
+//Check if the timing header shall be sent
+//@param svc route
+//@param req request
+//@return true if header is sent
+func timingWanted(svc *ServiceMap, req *http.Request) bool {
+
+	if svc.ServerTiming {
+		return true
+	}
+
+	if "" == m_timingheader || "" == req.Header.Get(m_timingheader) {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+
+	if nil != err {
+		host = req.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+
+	if nil == ip {
+		return false
+	}
+
+	for _, ipnet := range m_timingnets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Start timing the request
+//@param svc route
+//@param req request
+//@return request timing
+func timingStart(svc *ServiceMap, req *http.Request) *ServerTiming {
+
+	t := &ServerTiming{emit: timingWanted(svc, req)}
+	t.sw.Reset()
+
+	return t
+}
+
+//Complete the phase, next phase starts. Timing may be nil.
+//@param name phase name
+func (t *ServerTiming) Mark(name string) {
+
+	if nil == t {
+		return
+	}
+
+	t.phases = append(t.phases, timingPhase{name, t.sw.GetDeltaMicros()})
+	t.sw.Reset()
+}
+
+//Total time of completed phases
+//@return microseconds
+func (t *ServerTiming) Total() int64 {
+
+	var ret int64
+
+	for _, p := range t.phases {
+		ret += p.micros
+	}
+
+	return ret
+}
+
+//Build Server-Timing header value
+//@return header value
+func (t *ServerTiming) Header() string {
+
+	var b strings.Builder
+
+	for _, p := range t.phases {
+		fmt.Fprintf(&b, "%s;dur=%.3f, ", p.name, float64(p.micros)/1000)
+	}
+
+	fmt.Fprintf(&b, "total;dur=%.3f", float64(t.Total())/1000)
+
+	return b.String()
+}
+
+//Log the phases and add them to metrics
+//@param ac ATMI context
+//@param svc route
+//@param t request timing
+func timingDone(ac *atmi.ATMICtx, svc *ServiceMap, t *ServerTiming) {
+
+	//Response not sent (e.g. client gone)
+	if !t.sent {
+		t.Mark("rsp")
+	}
+
+	var b strings.Builder
+
+	for _, p := range t.phases {
+
+		fmt.Fprintf(&b, "%s=%dus ", p.name, p.micros)
+
+		metricsAdd(fmt.Sprintf("%s{route=%q,phase=%q}", METRIC_PHASE_MICROS,
+			svc.Url, p.name), p.micros)
+		metricsAdd(fmt.Sprintf("%s{route=%q,phase=%q}", METRIC_PHASE_COUNT,
+			svc.Url, p.name), 1)
+	}
+
+	ac.TpLogInfo("Route [%s] timing: %stotal=%dus", svc.Url, b.String(),
+		t.Total())
+}
+
+//Response is started, complete the response phase and send the header
+//@param status http status
+func (s *timingWriter) WriteHeader(status int) {
+
+	if !s.t.sent {
+		s.t.sent = true
+		s.t.Mark("rsp")
+
+		if s.t.emit {
+			s.Header().Set("Server-Timing", s.t.Header())
+		}
+	}
+
+	s.ResponseWriter.WriteHeader(status)
+}
+
+//Send the body data
+//@param b data to write
+func (s *timingWriter) Write(b []byte) (int, error) {
+
+	if !s.t.sent {
+		s.WriteHeader(http.StatusOK)
+	}
+
+	return s.ResponseWriter.Write(b)
+}
+
+//Flush the data to the client, if supported
+func (s *timingWriter) Flush() {
+
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
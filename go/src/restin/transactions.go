@@ -30,7 +30,7 @@
  * contact@mavimax.com
  * -----------------------------------------------------------------------------
  */
-package main
+package restin
 
 import (
 	"encoding/json"
@@ -90,6 +90,7 @@ func txHandler(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap, req *htt
 	var reqData TxReqData
 	var rspData TxRspData
 	var err atmi.ATMIError
+	var ended bool //Transaction ended by commit/abort
 	bufu, ok := buf.(*atmi.TypedUBF)
 
 	if !ok {
@@ -174,57 +175,41 @@ func txHandler(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap, req *htt
 	ac.TpLogInfo("txHandler: operation:  [%s], timeout: %d, flags: %d tptranid: [%s]",
 		reqData.Operation, reqData.Timeout, reqData.Flags, reqData.Tptranid)
 
-	if reqData.Operation == OP_TPCOMMIT || reqData.Operation == OP_TPABORT {
-		//Resume transaction
-		err = ac.TpResumeString(reqData.Tptranid, 0)
-
-		if nil != err {
-			ac.TpLogError("%s: failed to resume transaction: %s",
-				reqData.Operation, err.Error())
-
-			return err
-		}
-	}
-
 	switch reqData.Operation {
 
 	case OP_TPBEGIN:
 
-		err = ac.TpBegin(reqData.Timeout, reqData.Flags)
+		tid, err := txBegin(ac, reqData.Timeout, reqData.Flags)
 
 		if nil != err {
-			ac.TpLogError("Failed to begin transaction: %s", err.Error())
-			return err
-		}
-
-		//Suspend transactions & get TID
-		tid, err := ac.TpSuspendString(0)
-
-		if nil != err {
-			ac.TpLogError("tpbegin: Failed to suspend transaction: %s", err.Error())
 			return err
 		}
 
 		rspData.Tptranid = tid
-
-		ac.TpLogInfo("Started transaction: [%s]", rspData.Tptranid)
+		txTrackBegin(tid, req.RemoteAddr)
 
 	case OP_TPCOMMIT:
-		err = ac.TpCommit(0)
+
+		ended, err = txEnd(ac, reqData.Tptranid, true)
+
+		//Transaction not resumed (e.g. in use) is still alive
+		if ended {
+			txTrackEnd(reqData.Tptranid, nil == err)
+		}
 
 		if nil != err {
-			ac.TpLogError("Failed to commit transaction: %s", err.Error())
-			//In any case, context now becomes disasociated from tran
 			return err
 		}
 
 	case OP_TPABORT:
 
-		err = ac.TpAbort(0)
+		ended, err = txEnd(ac, reqData.Tptranid, false)
+
+		if ended {
+			txTrackEnd(reqData.Tptranid, false)
+		}
 
 		if nil != err {
-			ac.TpLogError("Failed to abort transaction: %s", err.Error())
-			//In any case, context now becomes disasociated from tran
 			return err
 		}
 
@@ -252,10 +237,43 @@ func txHandler(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap, req *htt
 func txCall(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap, req *http.Request,
 	w http.ResponseWriter, rctx *RequestContext, flags int64) atmi.ATMIError {
 
-	var err atmi.ATMIError
-
 	tidreq := req.Header.Get(TX_REQ_HDR)
 
+	if "" != tidreq {
+		txTrackEnter(tidreq)
+	}
+
+	tidrsp, ended, err := txSvcCall(ac, svc.Svc, buf, svc, tidreq, flags)
+
+	if "" != tidreq {
+		txTrackLeave(tidreq, tidrsp, ended)
+	}
+
+	if "" != tidrsp {
+		w.Header().Set(TX_RSP_HDR, tidrsp)
+	}
+
+	return err
+}
+
+/**
+ * Call the service within given global transaction (if any). Transaction is
+ * resumed before the call and suspended after the call.
+ * @param ac ATMI Context
+ * @param svcnm service name to call
+ * @param buf ATMI buffer to call
+ * @param svc service mapping (transaction settings)
+ * @param tidreq transaction id to resume, if empty, no transaction is used
+ * @param flags call flags
+ * @return suspended transaction id (if transaction was active), true if
+ *  transaction was ended by the call (aborted on failure), call error
+ */
+func txSvcCall(ac *atmi.ATMICtx, svcnm string, buf atmi.TypedBuffer, svc *ServiceMap,
+	tidreq string, flags int64) (string, bool, atmi.ATMIError) {
+
+	var err atmi.ATMIError
+	tidrsp := ""
+
 	if tidreq != "" {
 
 		var resum_flags int64
@@ -268,10 +286,10 @@ func txCall(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap, req *http.R
 
 		if nil != err {
 			ac.TpLogError("Failed to resume transaction [%s] for svc call [%s]",
-				tidreq, svc.Svc)
+				tidreq, svcnm)
 			ac.UserLog("Failed to resume transaction [%s] for svc call [%s]",
-				tidreq, svc.Svc)
-			return err
+				tidreq, svcnm)
+			return "", false, err
 		}
 
 		ac.TpLogDebug("Resumed global transaction [%s]", tidreq)
@@ -281,25 +299,101 @@ func txCall(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap, req *http.R
 		flags |= atmi.TPNOABORT
 	}
 
-	_, err = ac.TpCall(svc.Svc, buf, flags|atmi.TPTRANSUSPEND)
+	_, err = ac.TpCall(svcnm, buf, flags|atmi.TPTRANSUSPEND)
 
 	if ac.TpGetLev() > 0 {
 
-		tidrsp, err_susp := ac.TpSuspendString(0)
+		tid, err_susp := ac.TpSuspendString(0)
 
 		if nil != err_susp {
-			ac.TpLogError("Failed to suspend transaction for %s call: %s", svc.Svc,
+			ac.TpLogError("Failed to suspend transaction for %s call: %s", svcnm,
 				err_susp.Message())
-			ac.UserLog("Failed to suspend transaction for %s call: %s", svc.Svc,
+			ac.UserLog("Failed to suspend transaction for %s call: %s", svcnm,
 				err_susp.Message())
 			//Ignore and continue... (do not return tran header)
 		} else {
-			ac.TpLogDebug("Transaction suspended [%s]", tidrsp)
-			w.Header().Set(TX_RSP_HDR, tidrsp)
+			ac.TpLogDebug("Transaction suspended [%s]", tid)
+			tidrsp = tid
 		}
+	} else if tidreq != "" {
+		ac.TpLogWarn("Transaction [%s] ended by %s call", tidreq, svcnm)
+		return "", true, err
 	}
 
-	return err
+	return tidrsp, false, err
+}
+
+/**
+ * Begin global transaction and suspend it
+ * @param ac ATMI Context
+ * @param timeout transaction timeout
+ * @param flags tpbegin flags
+ * @return transaction id, ATMI error
+ */
+func txBegin(ac *atmi.ATMICtx, timeout uint64, flags int64) (string, atmi.ATMIError) {
+
+	err := ac.TpBegin(timeout, flags)
+
+	if nil != err {
+		ac.TpLogError("Failed to begin transaction: %s", err.Error())
+		return "", err
+	}
+
+	//Suspend transactions & get TID
+	tid, err := ac.TpSuspendString(0)
+
+	if nil != err {
+		ac.TpLogError("tpbegin: Failed to suspend transaction: %s", err.Error())
+
+		//Not returned to the client, thus shall not stay open
+		if errA := ac.TpAbort(0); nil != errA {
+			ac.TpLogError("tpbegin: Failed to abort transaction: %s",
+				errA.Error())
+		}
+
+		return "", err
+	}
+
+	ac.TpLogInfo("Started transaction: [%s]", tid)
+
+	return tid, nil
+}
+
+/**
+ * Resume and complete global transaction
+ * @param ac ATMI Context
+ * @param tid transaction id
+ * @param commit true - commit, false - abort
+ * @return true if transaction was resumed and thus is ended (even if commit
+ *  failed), ATMI error
+ */
+func txEnd(ac *atmi.ATMICtx, tid string, commit bool) (bool, atmi.ATMIError) {
+
+	err := ac.TpResumeString(tid, 0)
+
+	if nil != err {
+		ac.TpLogError("Failed to resume transaction [%s]: %s",
+			tid, err.Error())
+
+		return false, err
+	}
+
+	if commit {
+		err = ac.TpCommit(0)
+	} else {
+		err = ac.TpAbort(0)
+	}
+
+	if nil != err {
+		ac.TpLogError("Failed to complete (commit: %t) transaction [%s]: %s",
+			commit, tid, err.Error())
+		//In any case, context now becomes disasociated from tran
+		return true, err
+	}
+
+	ac.TpLogInfo("Transaction [%s] completed (commit: %t)", tid, commit)
+
+	return true, nil
 }
 
 /* vim: set ts=4 sw=4 et smartindent: */
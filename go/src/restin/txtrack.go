@@ -0,0 +1,326 @@
+/**
+ * @brief Tracking and reaping of the global transactions started by HTTP clients
+ *
+ * @file txtrack.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+/**
+ * Transaction started by transaction_handler route
+ */
+type TxInfo struct {
+	Tptranid     string    `json:"tptranid"`
+	Client       string    `json:"client"`
+	Started      time.Time `json:"started"`
+	LastActivity time.Time `json:"last_activity"`
+	Calls        int       `json:"calls"`
+	IdleSec      int64     `json:"idle_sec"`
+	inflight     int       //Number of service calls in progress
+}
+
+/**
+ * Transaction listing response
+ */
+type TxListRsp struct {
+	Count        int      `json:"count"`
+	Transactions []TxInfo `json:"transactions"`
+}
+
+var m_txmutex sync.Mutex
+
+//Transactions by tptranid
+var m_txs = make(map[string]*TxInfo)
+
+//Abort transactions idle more than given seconds, 0 - disabled
+var m_tx_idle_max int
+
+var m_txreap_stop chan bool
+var m_txreap_done chan bool
+
+//Register transaction started by client
+//@param tid transaction id
+//@param client client address
+func txTrackBegin(tid string, client string) {
+
+	now := time.Now()
+
+	m_txmutex.Lock()
+	m_txs[tid] = &TxInfo{Tptranid: tid, Client: client, Started: now,
+		LastActivity: now}
+	m_txmutex.Unlock()
+
+	metricsAdd(METRIC_TX_STARTED, 1)
+}
+
+//Remove transaction from tracking, after commit or abort
+//@param tid transaction id
+//@param commit true if committed
+func txTrackEnd(tid string, commit bool) {
+
+	m_txmutex.Lock()
+	delete(m_txs, tid)
+	m_txmutex.Unlock()
+
+	if commit {
+		metricsAdd(METRIC_TX_COMMITTED, 1)
+	} else {
+		metricsAdd(METRIC_TX_ABORTED, 1)
+	}
+}
+
+//Mark the service call started in transaction
+//Reaper does not touch transactions with calls in progress
+//@param tid transaction id
+func txTrackEnter(tid string) {
+
+	m_txmutex.Lock()
+
+	if tx, ok := m_txs[tid]; ok {
+		tx.inflight++
+		tx.LastActivity = time.Now()
+	}
+
+	m_txmutex.Unlock()
+}
+
+//Mark the service call finished in transaction
+//Transaction ended by the call is removed from tracking. If transaction was
+//not resumed or suspended (e.g. used by concurrent request), it is still
+//alive, and is kept, so that it is ended by the client or by the reaper.
+//@param tid transaction id used for call
+//@param tidrsp transaction id after suspend (if any)
+//@param ended transaction was ended (aborted) by the call
+func txTrackLeave(tid string, tidrsp string, ended bool) {
+
+	aborted := false
+
+	m_txmutex.Lock()
+
+	if tx, ok := m_txs[tid]; ok {
+		tx.inflight--
+		tx.Calls++
+		tx.LastActivity = time.Now()
+
+		if ended {
+			delete(m_txs, tid)
+			aborted = true
+		} else if "" != tidrsp && tidrsp != tid {
+			delete(m_txs, tid)
+			tx.Tptranid = tidrsp
+			m_txs[tidrsp] = tx
+		}
+	}
+
+	m_txmutex.Unlock()
+
+	if aborted {
+		metricsAdd(METRIC_TX_ABORTED, 1)
+	}
+}
+
+//Return number of tracked transactions
+func txTrackCount() int64 {
+
+	m_txmutex.Lock()
+	defer m_txmutex.Unlock()
+
+	return int64(len(m_txs))
+}
+
+//Serve transaction listing route
+//@param w response writer
+//@param req request
+//@param svc route
+func txListHandler(w http.ResponseWriter, req *http.Request, svc *ServiceMap) {
+
+	var rsp TxListRsp
+
+	if !adminTokenOk(w, req) {
+		return
+	}
+
+	now := time.Now()
+	rsp.Transactions = []TxInfo{}
+
+	m_txmutex.Lock()
+
+	for _, tx := range m_txs {
+		item := *tx
+		item.IdleSec = int64(now.Sub(tx.LastActivity) / time.Second)
+		rsp.Transactions = append(rsp.Transactions, item)
+	}
+
+	m_txmutex.Unlock()
+
+	sort.Slice(rsp.Transactions, func(i, j int) bool {
+		return rsp.Transactions[i].Started.Before(rsp.Transactions[j].Started)
+	})
+
+	rsp.Count = len(rsp.Transactions)
+
+	body, err := json.Marshal(&rsp)
+
+	if nil != err {
+		m_ac.TpLogError("Failed to marshal transaction list: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+//Abort transactions which are idle for too long
+//@param ac ATMI context used for aborts
+func txReap(ac *atmi.ATMICtx) {
+
+	var reap []TxInfo
+
+	now := time.Now()
+	idle := time.Duration(m_tx_idle_max) * time.Second
+
+	m_txmutex.Lock()
+
+	for tid, tx := range m_txs {
+		if tx.inflight <= 0 && now.Sub(tx.LastActivity) > idle {
+			reap = append(reap, *tx)
+			delete(m_txs, tid)
+		}
+	}
+
+	m_txmutex.Unlock()
+
+	for _, tx := range reap {
+
+		ac.TpLogWarn("Reaping idle transaction [%s] client [%s] started %s "+
+			"idle %d sec", tx.Tptranid, tx.Client, tx.Started.String(),
+			int64(now.Sub(tx.LastActivity)/time.Second))
+
+		ac.UserLog("Reaping idle transaction [%s] client [%s] idle %d sec",
+			tx.Tptranid, tx.Client, int64(now.Sub(tx.LastActivity)/time.Second))
+
+		if _, err := txEnd(ac, tx.Tptranid, false); nil != err {
+			ac.TpLogError("Failed to abort idle transaction [%s]: %s",
+				tx.Tptranid, err.Error())
+		}
+
+		metricsAdd(METRIC_TX_REAPED, 1)
+	}
+}
+
+//Start the idle transaction reaper
+//@param ac main ATMI context
+//@return ATMI error
+func txReaperStart(ac *atmi.ATMICtx) atmi.ATMIError {
+
+	metricsGauge(METRIC_TX_ACTIVE, txTrackCount)
+
+	if m_tx_idle_max <= 0 {
+		ac.TpLogInfo("Idle transaction reaper disabled")
+		return nil
+	}
+
+	rac, err := atmi.NewATMICtx()
+
+	if nil != err {
+		ac.TpLogError("Failed to create reaper context: %s", err.Message())
+		return err
+	}
+
+	if err = rac.TpOpen(); nil != err {
+		ac.TpLogError("Reaper failed to tpopen(): %s", err.Error())
+		rac.FreeATMICtx()
+		return err
+	}
+
+	m_txreap_stop = make(chan bool)
+	m_txreap_done = make(chan bool)
+
+	//Check few times within the idle period
+	period := time.Duration(m_tx_idle_max) * time.Second / 4
+
+	if period < time.Second {
+		period = time.Second
+	}
+
+	ac.TpLogInfo("Idle transaction reaper started, idle max %d sec, period %s",
+		m_tx_idle_max, period.String())
+
+	go func() {
+		ticker := time.NewTicker(period)
+
+		defer func() {
+			ticker.Stop()
+			rac.TpClose()
+			rac.TpTerm()
+			rac.FreeATMICtx()
+			close(m_txreap_done)
+		}()
+
+		for {
+			select {
+			case <-ticker.C:
+				txReap(rac)
+			case <-m_txreap_stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+//Stop the reaper (if running)
+//@param ac main ATMI context
+func txReaperStop(ac *atmi.ATMICtx) {
+
+	if nil == m_txreap_stop {
+		return
+	}
+
+	ac.TpLogInfo("Stopping idle transaction reaper")
+
+	close(m_txreap_stop)
+	<-m_txreap_done
+	m_txreap_stop = nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,223 @@
+/**
+ * @brief File upload policy - limits, MIME/extension allow-lists and scan service
+ *
+ * @file uploadpolicy.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Validate upload policy of the route
+//@param ac ATMI context
+//@param svc service map
+//@return error or nil
+func validateUploadService(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	svc.UploadMimes_arr = nil
+	svc.UploadExts_arr = nil
+
+	hasPolicy := svc.UploadMaxFiles != 0 || svc.UploadMaxSize != 0 ||
+		svc.UploadMaxTotal != 0 || "" != svc.UploadMimes ||
+		"" != svc.UploadExts || "" != svc.UploadScanSvc
+
+	if !hasPolicy {
+		return nil
+	}
+
+	if !svc.Fileupload {
+		return fmt.Errorf("Route [%s]: upload policy settings valid only "+
+			"with 'fileupload'", svc.Url)
+	}
+
+	if svc.UploadMaxFiles < 0 || svc.UploadMaxSize < 0 || svc.UploadMaxTotal < 0 {
+		return fmt.Errorf("Route [%s]: upload limits must not be negative", svc.Url)
+	}
+
+	for _, m := range strings.Split(svc.UploadMimes, ",") {
+		if m = strings.ToLower(strings.TrimSpace(m)); "" != m {
+			svc.UploadMimes_arr = append(svc.UploadMimes_arr, m)
+		}
+	}
+
+	for _, e := range strings.Split(svc.UploadExts, ",") {
+
+		if e = strings.ToLower(strings.TrimSpace(e)); "" == e {
+			continue
+		}
+
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+
+		svc.UploadExts_arr = append(svc.UploadExts_arr, e)
+	}
+
+	ac.TpLogInfo("Route [%s] upload policy: max files %d max size %d "+
+		"max total %d mimes [%s] exts [%s] scan service [%s]", svc.Url,
+		svc.UploadMaxFiles, svc.UploadMaxSize, svc.UploadMaxTotal,
+		svc.UploadMimes, svc.UploadExts, svc.UploadScanSvc)
+
+	return nil
+}
+
+//Reject the upload, HTTP status is returned in EX_NETRCODE
+//@param ac ATMI context
+//@param bufu request buffer
+//@param status HTTP status
+//@param format message format
+//@param a message arguments
+//@return ATMI error
+func uploadReject(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, status int,
+	format string, a ...interface{}) atmi.ATMIError {
+
+	msg := fmt.Sprintf(format, a...)
+
+	ac.TpLogError("Upload rejected (http %d): %s", status, msg)
+
+	if errU := bufu.BChg(ubftab.EX_NETRCODE, 0, status); nil != errU {
+		ac.TpLogError("Failed to set EX_NETRCODE: %s", errU.Error())
+	}
+
+	return atmi.NewCustomATMIError(atmi.TPEINVAL, msg)
+}
+
+//Check file name extension against allow-list
+//@param svc service map
+//@param name file name
+//@return true if allowed
+func uploadExtAllowed(svc *ServiceMap, name string) bool {
+
+	if nil == svc.UploadExts_arr {
+		return true
+	}
+
+	ext := strings.ToLower(filepath.Ext(name))
+
+	for _, e := range svc.UploadExts_arr {
+		if e == ext {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Check the content type (sniffed from data) against allow-list
+//@param svc service map
+//@param head first bytes of the file (up to 512)
+//@return detected type, true if allowed
+func uploadMimeAllowed(svc *ServiceMap, head []byte) (string, bool) {
+
+	detected := http.DetectContentType(head)
+
+	if nil == svc.UploadMimes_arr {
+		return detected, true
+	}
+
+	mt, _, err := mime.ParseMediaType(detected)
+
+	if nil != err {
+		return detected, false
+	}
+
+	for _, m := range svc.UploadMimes_arr {
+
+		if m == mt {
+			return detected, true
+		}
+
+		if strings.HasSuffix(m, "/*") && strings.HasPrefix(mt, m[:len(m)-1]) {
+			return detected, true
+		}
+	}
+
+	return detected, false
+}
+
+//Call the scan service for uploaded file
+//@param ac ATMI context
+//@param bufu request buffer (for rejection)
+//@param svc service map
+//@param occ file occurrence
+//@param path file on disk
+//@param name file name
+//@param mtype detected content type
+//@param sum SHA-256 of the file
+//@return ATMI error if file is rejected or scan failed
+func uploadScan(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, svc *ServiceMap, occ int,
+	path string, name string, mtype string, sum string) atmi.ATMIError {
+
+	scanbuf, errA := ac.NewUBF(1024)
+
+	if nil != errA {
+		ac.TpLogError("Failed to allocate scan buffer: %s", errA.Message())
+		return errA
+	}
+
+	defer ac.TpFree(scanbuf.GetBuf())
+
+	scanbuf.BChg(ubftab.EX_IF_REQFILEDISK, 0, path)
+	scanbuf.BChg(ubftab.EX_IF_REQFILENAME, 0, name)
+	scanbuf.BChg(ubftab.EX_IF_REQFILEMIME, 0, mtype)
+	scanbuf.BChg(ubftab.EX_IF_REQFILESHA256, 0, sum)
+
+	ac.TpLogInfo("Scanning file occ %d [%s] with [%s]", occ, path, svc.UploadScanSvc)
+
+	if _, errA = ac.TpCall(svc.UploadScanSvc, scanbuf, 0); nil != errA {
+
+		if atmi.TPESVCFAIL == errA.Code() {
+
+			reason, _ := scanbuf.BGetString(ubftab.EX_IF_EMSG, 0)
+
+			return uploadReject(ac, bufu, http.StatusUnprocessableEntity,
+				"File [%s] rejected by scan: %s", name, reason)
+		}
+
+		//Fail closed, file is not checked
+		ac.TpLogError("Scan service [%s] failed: %s", svc.UploadScanSvc,
+			errA.Message())
+
+		return atmi.NewCustomATMIError(atmi.TPESYSTEM,
+			fmt.Sprintf("Scan service failed: %s", errA.Message()))
+	}
+
+	return nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
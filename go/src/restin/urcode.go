@@ -0,0 +1,181 @@
+/**
+ * @brief Mapping of service user return codes (tpurcode) to HTTP statuses
+ *
+ * @file urcode.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+/**
+ * User return code range mapped to HTTP status
+ */
+type UrcodeMap struct {
+	From   int64
+	To     int64
+	Status int
+	Msg    string //Error message, optional
+}
+
+//Parse user return code mapping of the route
+//Format: <urcode>|<from>..<to>:<http_status>[:<message>],...
+//@param ac ATMI context
+//@param svc service map
+//@return error or nil
+func validateUrcodeService(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	svc.UrcodeHttpMap_arr = nil
+
+	if "" == svc.UrcodeHttpMap {
+		return nil
+	}
+
+	switch svc.Conv_int {
+	case CONV_EXT, CONV_STATIC, CONV_WEBSOCKET:
+		return fmt.Errorf("Route [%s]: 'urcode_http_map' not valid for conv %s",
+			svc.Url, svc.Conv)
+	}
+
+	for _, element := range strings.Split(svc.UrcodeHttpMap, ",") {
+
+		if element = strings.TrimSpace(element); "" == element {
+			continue
+		}
+
+		var m UrcodeMap
+		var err error
+
+		//Message may contain ':'
+		pair := strings.SplitN(element, ":", 3)
+
+		if len(pair) < 2 {
+			return fmt.Errorf("Route [%s]: invalid urcode mapping [%s]",
+				svc.Url, element)
+		}
+
+		codes := strings.SplitN(pair[0], "..", 2)
+
+		if m.From, err = strconv.ParseInt(strings.TrimSpace(codes[0]), 10, 64); nil != err {
+			return fmt.Errorf("Route [%s]: invalid urcode in mapping [%s]: %s",
+				svc.Url, element, err.Error())
+		}
+
+		m.To = m.From
+
+		if 2 == len(codes) {
+			if m.To, err = strconv.ParseInt(strings.TrimSpace(codes[1]), 10, 64); nil != err {
+				return fmt.Errorf("Route [%s]: invalid urcode in mapping [%s]: %s",
+					svc.Url, element, err.Error())
+			}
+
+			if m.To < m.From {
+				return fmt.Errorf("Route [%s]: invalid urcode range in mapping [%s]",
+					svc.Url, element)
+			}
+		}
+
+		if m.Status, err = strconv.Atoi(strings.TrimSpace(pair[1])); nil != err ||
+			m.Status < 100 || m.Status > 599 {
+			return fmt.Errorf("Route [%s]: invalid http status in urcode mapping [%s]",
+				svc.Url, element)
+		}
+
+		if 3 == len(pair) {
+			m.Msg = pair[2]
+		}
+
+		svc.UrcodeHttpMap_arr = append(svc.UrcodeHttpMap_arr, m)
+	}
+
+	ac.TpLogInfo("Route [%s] urcode mapping: [%s] (%d entries)",
+		svc.Url, svc.UrcodeHttpMap, len(svc.UrcodeHttpMap_arr))
+
+	return nil
+}
+
+//Resolve HTTP status and message by service user return code
+//First matching entry is used
+//@param ac ATMI context
+//@param svc service map
+//@param err call result (success or TPESVCFAIL)
+//@return HTTP status (0 if not mapped), error to report (TPESVCFAIL for
+//	successful call mapped to error status)
+func urcodeApply(ac *atmi.ATMICtx, svc *ServiceMap,
+	err atmi.ATMIError) (int, atmi.ATMIError) {
+
+	if 0 == len(svc.UrcodeHttpMap_arr) {
+		return 0, err
+	}
+
+	urcode, errU := ac.TpURCode()
+
+	if nil != errU {
+		ac.TpLogError("Failed to get tpurcode: %s", errU.Message())
+		return 0, err
+	}
+
+	for _, m := range svc.UrcodeHttpMap_arr {
+
+		if urcode < m.From || urcode > m.To {
+			continue
+		}
+
+		ac.TpLogInfo("tpurcode %d mapped to http %d [%s]", urcode, m.Status, m.Msg)
+
+		code := err.Code()
+		msg := m.Msg
+
+		//Error status is not reported as success in the body
+		if atmi.TPMINVAL == code && m.Status >= http.StatusBadRequest {
+			code = atmi.TPESVCFAIL
+
+			if "" == msg {
+				msg = http.StatusText(m.Status)
+			}
+		}
+
+		if "" != msg {
+			err = atmi.NewCustomATMIError(code, msg)
+		}
+
+		return m.Status, err
+	}
+
+	return 0, err
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -30,7 +30,7 @@
  * contact@mavimax.com
  * -----------------------------------------------------------------------------
  */
-package main
+package restin
 
 import (
 	"fmt"
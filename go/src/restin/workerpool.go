@@ -30,10 +30,11 @@
  * contact@mavimax.com
  * -----------------------------------------------------------------------------
  */
-package main
+package restin
 
 import (
 	"encoding/json"
+	"exutil"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -53,19 +54,19 @@ for doing less works with ATMI initialization and uninit.
 
 Scheme will be following
 
-- there will be array of goroutines, number is set in M_workwers
-- there will be number same number of channels M_waitjobchan[M_workers]
-- there will be M_freechan which will identify the free channel number (
+- there will be array of goroutines, number is set in m_workwers
+- there will be number same number of channels m_waitjobchan[m_workers]
+- there will be m_freechan which will identify the free channel number (
 when worker will complete its work, it will submit it's number to this channel)
 
-So handler on new message will do <-M_freechan and then send message to -> M_waitjobchan[M_workers]
-Workes will wait on <-M_waitjobchan[M_workers], when complete they will do Nr -> M_freechan
+So handler on new message will do <-m_freechan and then send message to -> m_waitjobchan[m_workers]
+Workes will wait on <-m_waitjobchan[m_workers], when complete they will do Nr -> m_freechan
 
 */
 
-var M_freechan chan int //List of free channels submitted by wokers
+var m_freechan chan int //List of free channels submitted by wokers
 
-var M_ctxs []*atmi.ATMICtx //List of contexts
+var m_ctxs []*atmi.ATMICtx //List of contexts
 
 //Generate the headers for UBF mode and for EXT mode
 //Return content type if available
@@ -215,6 +216,9 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 	var rsp []byte
 	var err atmi.ATMIError
 	var netCode int = 200
+	var urStatus int //HTTP status mapped from tpurcode, 0 - not mapped
+	var tplJs []byte //UBF or VIEW response of text route, for template
+	var tplView bool //Response JSON is VIEW, for template
 	/*	application/json */
 	rspType := "text/plain"
 	// Header and Cookies fields to delete from buffer
@@ -248,10 +252,33 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 		err = atmiErr
 	}
 
+	//Business results of the service, mapped by tpurcode
+	if loadurcode && (atmi.TPMINVAL == err.Code() || atmi.TPESVCFAIL == err.Code()) {
+		urStatus, err = urcodeApply(ac, svc, err)
+	}
+
+	//Status set by the bridge overrides the error mapping
+	if 0 != rctx.status {
+		urStatus = rctx.status
+	}
+
+	//Successful response exported as CSV/TSV, errors are sent as usual.
+	//For ext routes export is done after the outgoing filters.
+	if "" != rctx.export && CONV_EXT != svc.Conv_int &&
+		atmi.TPMINVAL == err.Code() && 0 == urStatus {
+
+		if bufu, ok := buf.(*atmi.TypedUBF); ok {
+			csvExport(ac, svc, w, bufu, rctx.export)
+			ac.TpFree(buf.GetBuf())
+			return
+		}
+	}
+
 	//Generate response accordingly...
 	ac.TpLogDebug("Conv %d errors %d", svc.Conv_int, svc.Errors_int)
 
-	switch svc.Conv_int {
+	//XML modes are processed as JSON modes and converted at the end
+	switch convBase(svc.Conv_int) {
 	case CONV_EXT:
 
 		bufu, ok := buf.(*atmi.TypedUBF)
@@ -293,8 +320,14 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 			was_error = true
 		} else if nil == err || 0 == err.Code() {
 			//Execute the outgoing chains...
-			if errA := runChain(ac, svc, buf, true, svc.Foutman_arr,
-				"filter-outgoing-mandatory(foutman)"); nil != errA {
+			errA := runChain(ac, svc, buf, true, svc.Foutman_arr,
+				"filter-outgoing-mandatory(foutman)")
+
+			if len(svc.Foutman_arr) > 0 {
+				rctx.timing.Mark("foutman")
+			}
+
+			if nil != errA {
 				out_err = true
 				was_error = true
 			}
@@ -302,6 +335,10 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 			if !was_error {
 				runChain(ac, svc, buf, false, svc.Foutopt_arr,
 					"filter-outgoing-optional(foutopt)")
+
+				if len(svc.Foutopt_arr) > 0 {
+					rctx.timing.Mark("foutopt")
+				}
 			}
 		} else {
 			out_err = true
@@ -345,6 +382,22 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 			rspType = rspTypeHdr
 		}
 
+		//Service responds with file from disk
+		if !was_error && 200 == netCode && bufu.BPres(ubftab.EX_IF_RSPFILEDISK, 0) {
+
+			downloadSend(ac, svc, w, bufu, rctx)
+			ac.TpFree(buf.GetBuf())
+			return
+		}
+
+		//Successful response exported as CSV/TSV
+		if "" != rctx.export && !was_error && 200 == netCode && 0 == urStatus {
+
+			csvExport(ac, svc, w, bufu, rctx.export)
+			ac.TpFree(buf.GetBuf())
+			return
+		}
+
 		//Load the body (if any..)
 		if bufu.BPres(ubftab.EX_IF_RSPDATA, 0) {
 			var errU atmi.UBFError
@@ -418,7 +471,7 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 			// Delete Header and Cookie data from buffer (req&rsp)
 			bufu.BDelete(delFldList)
 
-			ret, err1 := bufu.TpUBFToJSON()
+			ret, err1 := exutil.UBFToJSON(ac, bufu, svc.View_flags)
 
 			if nil == err1 {
 				//Generate the resposne buffer...
@@ -577,6 +630,13 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 
 			bufs, ok := buf.(*atmi.TypedString)
 
+			if nil != svc.Template_tpl && nil != buf {
+				//Service may respond with UBF or VIEW for rendering
+				if tplJs, tplView = templateBufJSON(ac, svc, buf); nil != tplJs {
+					break
+				}
+			}
+
 			if !ok {
 				ac.TpLogError("Failed to cast buffer to TypedString")
 
@@ -615,6 +675,31 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 			}
 		}
 		break
+	case CONV_STREAM: //Reply of conversation, carray or UBF
+		rspType = "application/octet-stream"
+
+		if bufc, ok := buf.(*atmi.TypedCarray); ok {
+			rsp = bufc.GetBytes()
+		} else if bufu, ok := buf.(*atmi.TypedUBF); ok {
+
+			if rspTypeHdr := genRspHeaders(ac, bufu, w, svc); "" != rspTypeHdr {
+				rspType = rspTypeHdr
+			}
+
+			if bufu.BPres(ubftab.EX_IF_RSPDATA, 0) {
+				rsp, _ = bufu.BGetByteArr(ubftab.EX_IF_RSPDATA, 0)
+			}
+
+			//Service may set the status, if not mapped by tpurcode
+			if 0 == urStatus && bufu.BPres(ubftab.EX_NETRCODE, 0) {
+				netCode, _ = bufu.BGetInt(ubftab.EX_NETRCODE, 0)
+
+				if 200 != netCode {
+					urStatus = netCode
+				}
+			}
+		}
+		break
 	case CONV_JSON:
 		rspType = "application/json"
 		/*		if !svc.Asynccall && atmi.TPMINVAL == err.Code() { why?
@@ -635,27 +720,71 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 		break
 	}
 
+	if (nil != svc.JsonMap_prof || nil != svc.JsonNorm) && len(rsp) > 0 {
+
+		mapped, errA := jsonMapResponse(ac, svc, rsp)
+
+		if nil != errA && err.Code() == atmi.TPMINVAL {
+			err = errA
+		}
+
+		rsp = mapped
+	}
+
+	if nil != svc.Template_tpl {
+
+		js := rsp
+		text := ""
+
+		if CONV_JSON2VIEW == svc.Conv_int {
+			tplView = true
+		} else if CONV_TEXT == svc.Conv_int {
+			js = tplJs
+			text = string(rsp)
+		}
+
+		rspType = svc.TemplateCtype
+
+		rendered, errT := templateRender(ac, svc, js, text, tplView, err)
+
+		if nil != errT && err.Code() == atmi.TPMINVAL {
+			err = errT
+		}
+
+		rsp = rendered
+	}
+
+	if CONV_XML2UBF == svc.Conv_int || CONV_XML2VIEW == svc.Conv_int {
+
+		rspType = "application/xml"
+
+		if len(rsp) > 0 {
+			xmlrsp, errX := jsonToXML(rsp, svc.XmlRoot)
+
+			if nil != errX {
+				ac.TpLogError("Failed to convert response to XML: %s", errX.Error())
+
+				if err.Code() == atmi.TPMINVAL {
+					err = atmi.NewCustomATMIError(atmi.TPESYSTEM,
+						"Failed to convert response to XML")
+				}
+			}
+
+			rsp = xmlrsp
+		}
+	}
+
 	//OK Now if all ok, there is stuff in buffer (from JSONUBF) it will
 	//be there in any case, thus we do not handle that
 	w.Header().Set("Content-Type", rspType)
 	switch svc.Errors_int {
 	case ERRORS_HTTP:
-		var lookup map[string]int
 		//Map the resposne codes
-		if len(svc.Errors_fmt_http_map) > 0 {
-			lookup = svc.Errors_fmt_http_map
-		} else {
-			lookup = M_defaults.Errors_fmt_http_map
-		}
-
-		estr := strconv.Itoa(err.Code())
-
-		httpCode := 500
+		httpCode := mapHttpStatus(svc, err.Code())
 
-		if 0 != lookup[estr] {
-			httpCode = lookup[estr]
-		} else {
-			httpCode = lookup["*"]
+		if 0 != urStatus {
+			httpCode = urStatus
+			urStatus = 0
 		}
 
 		//Generate error response and pop out of the funcion
@@ -711,6 +840,39 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 		}
 
 		rsp = []byte(strrsp)
+		break
+	case ERRORS_XML:
+		//Install error elements in the end of the root element
+
+		if atmi.TPMINVAL == err.Code() && !svc.Errfmt_xml_onsucc && !svc.Asyncecho {
+			break //Do no generate on success.
+		}
+
+		rsp = xmlAddError(svc, rsp, err.Code(), err.Message())
+		ac.TpLogDebug("XML Response generated: [%s]", string(rsp))
+
+		break
+	case ERRORS_PROBLEM:
+		//Problem details replace the response on error
+
+		if atmi.TPMINVAL == err.Code() && urStatus < 400 {
+			break
+		}
+
+		httpCode := mapHttpStatus(svc, err.Code())
+
+		if 0 != urStatus {
+			httpCode = urStatus
+			urStatus = 0
+		}
+
+		rsp = problemRsp(ac, svc, err, httpCode, rctx)
+		ac.TpLogDebug("Problem response generated: [%s]", string(rsp))
+
+		w.Header().Set("Content-Type", PROBLEM_MIME)
+		w.Header().Set("Content-Length", strconv.Itoa(len(rsp)))
+		w.WriteHeader(httpCode)
+
 		break
 	case ERRORS_TEXT:
 		//Send plain text error if have one.
@@ -730,6 +892,11 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 	ac.TpLogDump(atmi.LOG_DEBUG, "Sending response back", rsp, len(rsp))
 	w.Header().Set("Content-Length", strconv.Itoa(len(rsp)))
 
+	if 0 != urStatus {
+		ac.TpLogWarn("Mapped response: tpurcode -> http %d", urStatus)
+		w.WriteHeader(urStatus)
+	}
+
 	w.Write(rsp)
 
 	//Avoid gc use...
@@ -846,8 +1013,9 @@ func runChain(ac *atmi.ATMICtx, svc *ServiceMap, buf atmi.TypedBuffer, mand bool
 //@param ac	ATMI Context
 //@param w	Response writer (as usual)
 //@param req	Request message (as usual)
+//@param t	Phase timing, may be nil
 func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
-	req *http.Request) int {
+	req *http.Request, t *ServerTiming) int {
 
 	var rctx RequestContext
 	var flags int64 = 0
@@ -856,11 +1024,60 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 	do_upload := false //perform file download?
 	reqlogOpen := false
 	rctx.errSrc = ERRSRC_RESTIN //Default error source rest-in process
+	rctx.instance = req.URL.RequestURI()
+	rctx.req = req
+	rctx.timing = t
 
 	ac.TpLog(atmi.LOG_DEBUG, "Got URL [%s], caller: %s", req.URL, req.RemoteAddr)
 
+	if IDEM_NONE != svc.Idem_int {
+
+		ictx, done := idemStart(ac, svc, w, req)
+
+		if done {
+			return atmi.SUCCEED
+		} else if nil != ictx {
+			//Capture the response for the replays
+			w = ictx.rec
+			defer idemFinish(ac, svc, ictx)
+		}
+	}
+
+	if svc.Batch {
+		return batchHandler(ac, svc, w, req)
+	}
+
+	//Body is read while sending to the service
+	if CONV_STREAM == svc.Conv_int {
+		return streamHandler(ac, svc, w, req, &rctx)
+	}
+
 	if "" != svc.Svc || svc.Echo {
 
+		rctx.export = csvSelect(svc, req)
+
+		reqFmt, rspFmt, status := fmtNegotiate(ac, svc, req)
+
+		if nil != svc.Formats_map {
+
+			w.Header().Add("Vary", "Accept")
+
+			//Response is transcoded from native format
+			if rspFmt != fmtNative(svc) {
+				fw := NewRspBuffer()
+				defer fmtSend(ac, svc, w, fw, rspFmt)
+				w = fw
+			}
+		}
+
+		//Error envelope of the route with 415/406 status
+		if 0 != status {
+			rctx.status = status
+			errA := atmi.NewCustomATMIError(atmi.TPEINVAL, http.StatusText(status))
+			genRsp(ac, nil, svc, w, errA, false, false, false, &rctx)
+			return atmi.FAIL
+		}
+
 		var body []byte
 		if !svc.Parseform && !svc.Fileupload {
 
@@ -869,8 +1086,56 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 				svc.Svc, string(body))
 		}
 
+		//XML is converted to JSON and processed as json2ubf/json2view
+		if FMT_XML == reqFmt {
+
+			jsbody, errX := xmlToJSON(body,
+				CONV_JSON2VIEW == convBase(svc.Conv_int) && "" == svc.XmlRoot)
+
+			if nil != errX {
+				ac.TpLogError("Failed to convert XML to JSON: %s", errX.Error())
+
+				errA := atmi.NewCustomATMIError(atmi.TPEINVAL,
+					fmt.Sprintf("Failed to parse XML: %s", errX.Error()))
+
+				genRsp(ac, nil, svc, w, errA, false, false, false, &rctx)
+				return atmi.FAIL
+			}
+
+			ac.TpLogDebug("XML converted to JSON: [%s]", string(jsbody))
+			body = jsbody
+		} else if FMT_MSGPACK == reqFmt || FMT_CBOR == reqFmt {
+
+			jsbody, errX := fmtToJSON(reqFmt, body)
+
+			if nil != errX {
+				ac.TpLogError("Failed to convert request to JSON: %s", errX.Error())
+
+				errA := atmi.NewCustomATMIError(atmi.TPEINVAL,
+					fmt.Sprintf("Failed to parse request: %s", errX.Error()))
+
+				genRsp(ac, nil, svc, w, errA, false, false, false, &rctx)
+				return atmi.FAIL
+			}
+
+			ac.TpLogDebug("Request converted to JSON: [%s]", string(jsbody))
+			body = jsbody
+		}
+
+		if nil != svc.JsonMap_prof || nil != svc.JsonNorm {
+
+			mapped, errA := jsonMapRequest(ac, svc, body)
+
+			if nil != errA {
+				genRsp(ac, nil, svc, w, errA, false, false, false, &rctx)
+				return atmi.FAIL
+			}
+
+			body = mapped
+		}
+
 		//Prepare outgoing buffer...
-		switch svc.Conv_int {
+		switch convBase(svc.Conv_int) {
 		case CONV_EXT:
 			//Convert JSON 2 UBF...
 			//Bug #200, use max buffer size
@@ -1024,7 +1289,7 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 				return atmi.FAIL
 			}
 
-			if err1 := bufu.TpJSONToUBF(string(body)); err1 != nil {
+			if err1 := exutil.JSONToUBF(ac, bufu, body); err1 != nil {
 				ac.TpLogError("Failed to conver from JSON to UBF %d:[%s]\n",
 					err1.Code(), err1.Message())
 
@@ -1163,6 +1428,8 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 			}
 		}
 
+		t.Mark("conv")
+
 		//Perform incoming filters...
 		//If input filters fails, then generate response immediately...
 		err = nil
@@ -1170,12 +1437,17 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 		if len(svc.Finman_arr) > 0 {
 			err = runChain(ac, svc, buf, true, svc.Finman_arr,
 				"filter-incoming-mandatory(finman)")
+			t.Mark("finman")
 
 			//Run optional chain, if any..
 			if nil == err {
 
 				runChain(ac, svc, buf, false, svc.Finopt_arr,
 					"filter-incoming-optional(finopt)")
+
+				if len(svc.Finopt_arr) > 0 {
+					t.Mark("finopt")
+				}
 			} else {
 				//Error source is mandatory filter
 				rctx.errSrc = ERRSRC_FINMAN
@@ -1193,6 +1465,8 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 				genRsp(ac, buf, svc, w, errA, false, false, false, &rctx)
 				return atmi.FAIL
 			}
+
+			t.Mark("upload")
 		}
 
 		if nil != err {
@@ -1202,6 +1476,7 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 			genRsp(ac, buf, svc, w, err, reqlogOpen, true, false, &rctx)
 		} else if svc.Asynccall {
 			_, err := ac.TpACall(svc.Svc, buf, flags|atmi.TPNOREPLY)
+			t.Mark("call")
 			//Now service is response for errors
 			rctx.errSrc = ERRSRC_SERVICE
 			genRsp(ac, buf, svc, w, err, reqlogOpen, true, false, &rctx)
@@ -1209,6 +1484,9 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 			//Now service is response for errors
 			rctx.errSrc = ERRSRC_SERVICE
 
+			//Request copy for the mirror service, before the reply overwrites it
+			mirror := mirrorSample(ac, svc, buf)
+
 			/*
 				_, err := ac.TpCall(svc.Svc, buf, flags)
 			*/
@@ -1218,7 +1496,19 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 				err = txCall(ac, buf, svc, req, w, &rctx, flags)
 			}
 
+			t.Mark("call")
+
+			var job *mirrorJob
+
+			if nil != mirror {
+				job = mirrorJobNew(ac, svc, mirror, buf, err, flags)
+			}
+
 			genRsp(ac, buf, svc, w, err, reqlogOpen, true, true, &rctx)
+
+			if nil != job {
+				mirrorSubmit(ac, w, job)
+			}
 		}
 	}
 
@@ -1232,9 +1522,9 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 //Initialise channels and work pools
 func initPool(ac *atmi.ATMICtx) error {
 
-	M_freechan = make(chan int, M_workers)
+	var ctxs []*atmi.ATMICtx
 
-	for i := 0; i < M_workers; i++ {
+	for i := 0; i < m_workers; i++ {
 
 		ctx, err := atmi.NewATMICtx()
 
@@ -1243,19 +1533,34 @@ func initPool(ac *atmi.ATMICtx) error {
 			return err
 		}
 
-		if M_do_tpopen {
+		if m_do_tpopen {
 			if err = ctx.TpOpen(); nil != err {
 				ac.TpLogError("Failed to tpopen(): %s", err.Error())
 				return err
 			}
 		}
 
-		M_ctxs = append(M_ctxs, ctx)
+		ctxs = append(ctxs, ctx)
+	}
+
+	poolStart(ctxs)
 
+	return nil
+}
+
+//Start serving by the worker contexts
+//@param ctxs ATMI contexts of the workers
+func poolStart(ctxs []*atmi.ATMICtx) {
+
+	m_ctxs = ctxs
+	m_workers = len(ctxs)
+	m_freechan = make(chan int, m_workers)
+	m_workstate = make([]WorkerState, m_workers)
+
+	for i := range ctxs {
 		//Submit the free ATMI context
-		M_freechan <- i
+		m_freechan <- i
 	}
-	return nil
 }
 
 /* vim: set ts=4 sw=4 et smartindent: */
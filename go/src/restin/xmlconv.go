@@ -0,0 +1,410 @@
+/**
+ * @brief XML conversion - XML messages mapped to UBF/VIEW via JSON representation
+ *
+ * @file xmlconv.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+/*
+
+XML messages are converted to the same JSON representation which is used by
+json2ubf/json2view modes, and then Enduro/X JSON<->UBF/VIEW conversion is
+used. Thus field types are resolved in the same way as for JSON.
+
+- child elements and attributes are fields
+- repeated elements are occurrences (JSON arrays)
+- element with child elements or attributes is sub-object (embedded buffer),
+  text of such element is ignored
+
+*/
+
+//Node of parsed XML, keeps the order of fields
+type xmlNode struct {
+	keys []string
+	vals map[string][]interface{} //string or *xmlNode
+}
+
+//Add value to node
+//@param name field name
+//@param val value (string or *xmlNode)
+func (n *xmlNode) add(name string, val interface{}) {
+
+	if _, ok := n.vals[name]; !ok {
+		n.keys = append(n.keys, name)
+	}
+
+	n.vals[name] = append(n.vals[name], val)
+}
+
+//Parse XML element (start token already read)
+//@param d decoder
+//@param start start element
+//@return string (text element) or *xmlNode, error
+func xmlParseElem(d *xml.Decoder, start *xml.StartElement) (interface{}, error) {
+
+	var text bytes.Buffer
+	var node *xmlNode
+
+	newNode := func() {
+		if nil == node {
+			node = &xmlNode{vals: make(map[string][]interface{})}
+		}
+	}
+
+	for _, a := range start.Attr {
+		//Namespace declarations are not fields
+		if "xmlns" == a.Name.Space || "xmlns" == a.Name.Local {
+			continue
+		}
+
+		newNode()
+		node.add(a.Name.Local, a.Value)
+	}
+
+	for {
+		tok, err := d.Token()
+
+		if nil != err {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+
+			val, err := xmlParseElem(d, &t)
+
+			if nil != err {
+				return nil, err
+			}
+
+			newNode()
+			node.add(t.Name.Local, val)
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+
+			if nil != node {
+				return node, nil
+			}
+
+			return text.String(), nil
+		}
+	}
+}
+
+//Write parsed value as JSON
+//@param b output buffer
+//@param val string or *xmlNode
+func xmlValJSON(b *bytes.Buffer, val interface{}) {
+
+	switch v := val.(type) {
+	case string:
+		js, _ := json.Marshal(v)
+		b.Write(js)
+	case *xmlNode:
+		b.WriteString("{")
+
+		for i, k := range v.keys {
+
+			if i > 0 {
+				b.WriteString(",")
+			}
+
+			js, _ := json.Marshal(k)
+			b.Write(js)
+			b.WriteString(":")
+
+			occs := v.vals[k]
+
+			if 1 == len(occs) {
+				xmlValJSON(b, occs[0])
+			} else {
+				b.WriteString("[")
+				for j, o := range occs {
+					if j > 0 {
+						b.WriteString(",")
+					}
+					xmlValJSON(b, o)
+				}
+				b.WriteString("]")
+			}
+		}
+
+		b.WriteString("}")
+	}
+}
+
+//Convert XML message to JSON
+//@param body XML message
+//@param keepRoot root element is part of data (VIEW name), otherwise only
+//	content of the root is converted
+//@return JSON message, error
+func xmlToJSON(body []byte, keepRoot bool) ([]byte, error) {
+
+	var b bytes.Buffer
+
+	d := xml.NewDecoder(bytes.NewReader(body))
+
+	for {
+		tok, err := d.Token()
+
+		if io.EOF == err {
+			return nil, errors.New("No root element in XML message")
+		} else if nil != err {
+			return nil, err
+		}
+
+		if start, ok := tok.(xml.StartElement); ok {
+
+			val, err := xmlParseElem(d, &start)
+
+			if nil != err {
+				return nil, err
+			}
+
+			if keepRoot {
+				root := &xmlNode{vals: make(map[string][]interface{})}
+				root.add(start.Name.Local, val)
+				val = root
+			} else if _, ok := val.(string); ok {
+				//Root without fields
+				val = &xmlNode{vals: make(map[string][]interface{})}
+			}
+
+			xmlValJSON(&b, val)
+
+			return b.Bytes(), nil
+		}
+	}
+}
+
+//Write JSON value as XML element(s)
+//@param d JSON decoder
+//@param b output buffer
+//@param name element name
+//@return error
+func xmlFromJSONVal(d *json.Decoder, b *bytes.Buffer, name string) error {
+
+	tok, err := d.Token()
+
+	if nil != err {
+		return err
+	}
+
+	switch t := tok.(type) {
+	case json.Delim:
+
+		if '[' == t {
+			for d.More() {
+				if err := xmlFromJSONVal(d, b, name); nil != err {
+					return err
+				}
+			}
+		} else {
+			b.WriteString("<" + name + ">")
+
+			if err := xmlFromJSONMembers(d, b); nil != err {
+				return err
+			}
+
+			b.WriteString("</" + name + ">")
+		}
+
+		//Closing delimiter
+		_, err = d.Token()
+
+		return err
+	case nil:
+		b.WriteString("<" + name + "/>")
+	case string:
+		b.WriteString("<" + name + ">")
+		xml.EscapeText(b, []byte(t))
+		b.WriteString("</" + name + ">")
+	default:
+		b.WriteString("<" + name + ">")
+		b.WriteString(fmt.Sprintf("%v", t))
+		b.WriteString("</" + name + ">")
+	}
+
+	return nil
+}
+
+//Write members of JSON object (opening delimiter already read) as XML elements
+//@param d JSON decoder
+//@param b output buffer
+//@return error
+func xmlFromJSONMembers(d *json.Decoder, b *bytes.Buffer) error {
+
+	for d.More() {
+
+		tok, err := d.Token()
+
+		if nil != err {
+			return err
+		}
+
+		if err = xmlFromJSONVal(d, b, tok.(string)); nil != err {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Convert JSON message to XML
+//@param js JSON message (object)
+//@param root root element name, if empty, members of the object are top level
+//	elements (VIEW name)
+//@return XML message, error
+func jsonToXML(js []byte, root string) ([]byte, error) {
+
+	var b bytes.Buffer
+
+	d := json.NewDecoder(bytes.NewReader(js))
+	d.UseNumber()
+
+	tok, err := d.Token()
+
+	if nil != err {
+		return nil, err
+	}
+
+	if delim, ok := tok.(json.Delim); !ok || '{' != delim {
+		return nil, errors.New("JSON message is not an object")
+	}
+
+	b.WriteString(xml.Header)
+
+	if "" != root {
+		b.WriteString("<" + root + ">")
+	}
+
+	if err = xmlFromJSONMembers(d, &b); nil != err {
+		return nil, err
+	}
+
+	if "" != root {
+		b.WriteString("</" + root + ">")
+	}
+
+	return b.Bytes(), nil
+}
+
+//Install error code and message in XML response
+//@param svc service map
+//@param rsp XML response (may be empty)
+//@param code error code
+//@param msg error message
+//@return XML response with error elements
+func xmlAddError(svc *ServiceMap, rsp []byte, code int, msg string) []byte {
+
+	var b bytes.Buffer
+
+	b.WriteString(fmt.Sprintf("<%s>%d</%s><%s>", svc.Errfmt_xml_code, code,
+		svc.Errfmt_xml_code, svc.Errfmt_xml_msg))
+	xml.EscapeText(&b, []byte(msg))
+	b.WriteString("</" + svc.Errfmt_xml_msg + ">")
+
+	strrsp := string(rsp)
+
+	if i := strings.LastIndex(strrsp, "</"); i > -1 {
+		return []byte(strrsp[0:i] + b.String() + strrsp[i:])
+	}
+
+	root := svc.XmlRoot
+
+	if "" == root {
+		root = XML_ERROR_ROOT
+	}
+
+	return []byte(xml.Header + "<" + root + ">" + b.String() + "</" + root + ">")
+}
+
+//Resolve JSON conversion mode used for the XML mode
+//@param conv conversion mode
+//@return JSON based conversion mode, or the same mode if not XML
+func convBase(conv int) int {
+
+	switch conv {
+	case CONV_XML2UBF:
+		return CONV_JSON2UBF
+	case CONV_XML2VIEW:
+		return CONV_JSON2VIEW
+	}
+
+	return conv
+}
+
+//Validate XML settings of the route
+//@param ac ATMI context
+//@param svc service map
+//@return error or nil
+func validateXMLService(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	isXML := CONV_XML2UBF == svc.Conv_int || CONV_XML2VIEW == svc.Conv_int
+
+	if !isXML {
+
+		if ERRORS_XML == svc.Errors_int {
+			return fmt.Errorf("Route [%s]: errors 'xml' valid only for "+
+				"xml2ubf or xml2view conv (cur %s)", svc.Url, svc.Conv)
+		}
+
+		return nil
+	}
+
+	if ERRORS_JSON == svc.Errors_int {
+		return fmt.Errorf("Route [%s]: errors 'json' not valid for conv %s",
+			svc.Url, svc.Conv)
+	}
+
+	if CONV_XML2UBF == svc.Conv_int && "" == svc.XmlRoot {
+		svc.XmlRoot = XML_ROOT_DEFAULT
+	}
+
+	ac.TpLogInfo("Route [%s] XML: root [%s] errfmt_xml_code [%s] errfmt_xml_msg [%s]",
+		svc.Url, svc.XmlRoot, svc.Errfmt_xml_code, svc.Errfmt_xml_msg)
+
+	return nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,216 @@
+/**
+ * @brief XML <-> JSON conversion tests
+ *
+ * @file xmlconv_test.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package restin
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"reflect"
+	"testing"
+)
+
+//Check that JSON messages are equal
+//@param t test
+//@param what tested conversion
+//@param exp expected message
+//@param got converted message
+func xmlTestSame(t *testing.T, what string, exp string, got []byte) {
+
+	var v1, v2 interface{}
+
+	if err := json.Unmarshal([]byte(exp), &v1); nil != err {
+		t.Fatalf("Invalid test JSON [%s]: %s", exp, err.Error())
+	}
+
+	if err := json.Unmarshal(got, &v2); nil != err || !reflect.DeepEqual(v1, v2) {
+		t.Errorf("%s: got [%s], expected [%s]", what, got, exp)
+	}
+}
+
+func TestXMLToJSON(t *testing.T) {
+
+	tests := []struct {
+		xml      string
+		keepRoot bool
+		exp      string
+	}{
+		//Attributes and child elements are fields
+		{`<req id="5"><name>A</name></req>`, false, `{"id":"5","name":"A"}`},
+		//Repeated elements are occurrences
+		{`<r><a>1</a><b>x</b><a>2</a></r>`, false, `{"a":["1","2"],"b":"x"}`},
+		{`<r><a k="1"/><a k="2"><v>3</v></a></r>`, false,
+			`{"a":[{"k":"1"},{"k":"2","v":"3"}]}`},
+		//Text of element with fields is ignored
+		{`<r><s x="1">text</s></r>`, false, `{"s":{"x":"1"}}`},
+		//Empty element is empty string
+		{`<r><a/><b></b></r>`, false, `{"a":"","b":""}`},
+		//Namespace declarations are not fields
+		{`<r xmlns="urn:x" xmlns:p="urn:p"><p:a>1</p:a></r>`, false, `{"a":"1"}`},
+		//Escaping
+		{`<r q="&quot;a&quot;"><a>&lt;x&gt; &amp; &#34;y&#34;</a><b><![CDATA[<c>]]></b></r>`,
+			false, `{"q":"\"a\"","a":"<x> & \"y\"","b":"<c>"}`},
+		{`<?xml version="1.0"?><!-- c --><r><a> sp </a></r>`, false, `{"a":" sp "}`},
+		//Root without fields
+		{`<r/>`, false, `{}`},
+		{`<r>text</r>`, false, `{}`},
+		//Root is VIEW name
+		{`<V1><a>1</a></V1>`, true, `{"V1":{"a":"1"}}`},
+	}
+
+	for _, tc := range tests {
+
+		js, err := xmlToJSON([]byte(tc.xml), tc.keepRoot)
+
+		if nil != err {
+			t.Errorf("xmlToJSON [%s] failed: %s", tc.xml, err.Error())
+			continue
+		}
+
+		xmlTestSame(t, "xmlToJSON "+tc.xml, tc.exp, js)
+	}
+
+	for _, in := range []string{``, `<!-- c -->`, `<r><a>`, `<r><a></b></r>`, `<r>&bad;</r>`} {
+		if js, err := xmlToJSON([]byte(in), false); nil == err {
+			t.Errorf("xmlToJSON [%s]: expected error, got [%s]", in, js)
+		}
+	}
+}
+
+func TestJSONToXML(t *testing.T) {
+
+	tests := []struct {
+		js   string
+		root string
+		exp  string
+	}{
+		{`{"a":"1","b":["x","y"],"c":{"d":2.50},"e":null,"f":true}`, "r",
+			`<r><a>1</a><b>x</b><b>y</b><c><d>2.50</d></c><e/><f>true</f></r>`},
+		{`{"a":[{"k":"1"},{"k":"2"}]}`, "r", `<r><a><k>1</k></a><a><k>2</k></a></r>`},
+		//Escaping
+		{`{"a":"<x> & \"y\""}`, "r", `<r><a>&lt;x&gt; &amp; &#34;y&#34;</a></r>`},
+		//Members are top level elements (VIEW)
+		{`{"V1":{"a":"1"}}`, "", `<V1><a>1</a></V1>`},
+		{`{}`, "r", `<r></r>`},
+	}
+
+	for _, tc := range tests {
+
+		out, err := jsonToXML([]byte(tc.js), tc.root)
+
+		if nil != err {
+			t.Errorf("jsonToXML [%s] failed: %s", tc.js, err.Error())
+		} else if xml.Header+tc.exp != string(out) {
+			t.Errorf("jsonToXML [%s]: got [%s], expected [%s]", tc.js, out, tc.exp)
+		}
+	}
+
+	for _, in := range []string{`[1]`, `"s"`, ``, `{"a":`} {
+		if out, err := jsonToXML([]byte(in), "r"); nil == err {
+			t.Errorf("jsonToXML [%s]: expected error, got [%s]", in, out)
+		}
+	}
+}
+
+//XML carries strings, thus string messages convert there and back unchanged
+func TestXMLRoundTrip(t *testing.T) {
+
+	tests := []struct {
+		js   string
+		root string
+	}{
+		{`{"T_STRING_FLD":["A","B & <C>","\"q\" 'a'"],"T_LONG_FLD":"5"}`, "ubf"},
+		{`{"a":{"b":{"c":["1","2"]},"d":""}}`, "r"},
+		{`{"V1":{"f":["x","y"]}}`, ""},
+	}
+
+	for _, tc := range tests {
+
+		out, err := jsonToXML([]byte(tc.js), tc.root)
+
+		if nil != err {
+			t.Errorf("jsonToXML [%s] failed: %s", tc.js, err.Error())
+			continue
+		}
+
+		js, err := xmlToJSON(out, "" == tc.root)
+
+		if nil != err {
+			t.Errorf("xmlToJSON [%s] failed: %s", out, err.Error())
+			continue
+		}
+
+		xmlTestSame(t, "round trip "+tc.js, tc.js, js)
+	}
+}
+
+func TestXMLAddError(t *testing.T) {
+
+	svc := &ServiceMap{Errfmt_xml_code: "error_code",
+		Errfmt_xml_msg: "error_message", XmlRoot: "ubf"}
+
+	out := xmlAddError(svc, []byte(xml.Header+`<ubf><a>1</a></ubf>`), 11, "Failed <svc> & co")
+
+	if exp := xml.Header + `<ubf><a>1</a><error_code>11</error_code>` +
+		`<error_message>Failed &lt;svc&gt; &amp; co</error_message></ubf>`; exp != string(out) {
+		t.Errorf("xmlAddError: got [%s], expected [%s]", out, exp)
+	}
+
+	js, err := xmlToJSON(out, false)
+
+	if nil != err {
+		t.Fatalf("xmlToJSON failed: %s", err.Error())
+	}
+
+	xmlTestSame(t, "xmlAddError", `{"a":"1","error_code":"11",`+
+		`"error_message":"Failed <svc> & co"}`, js)
+
+	//Empty response uses root of the route, or error root
+	for _, root := range []string{"ubf", ""} {
+
+		svc.XmlRoot = root
+		out = xmlAddError(svc, nil, 4, "Invalid")
+
+		exp := root
+
+		if "" == exp {
+			exp = XML_ERROR_ROOT
+		}
+
+		if exp = xml.Header + "<" + exp + "><error_code>4</error_code>" +
+			"<error_message>Invalid</error_message></" + exp + ">"; exp != string(out) {
+			t.Errorf("xmlAddError: got [%s], expected [%s]", out, exp)
+		}
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
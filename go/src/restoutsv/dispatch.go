@@ -193,7 +193,34 @@ func XATMIDispatchCall(pool *XATMIPool, nr int, ctxData *atmi.TPSRVCTXDATA,
 			ac.TpLogSetReqFile(buf, "", "")
 		}
 
-		json, errA := bufu.TpUBFToJSON()
+		json, errA := exutil.UBFToJSON(ac, bufu, svc.View_flags)
+
+		if nil == errA && nil != svc.JsonNorm {
+
+			norm, errN := svc.JsonNorm.FromXATMI([]byte(json))
+
+			if nil != errN {
+				ac.TpLogError("Failed to normalize request: %s", errN.Error())
+				ret = FAIL
+				return
+			}
+
+			json = string(norm)
+		}
+
+		if nil == errA && nil != svc.JsonMap_prof {
+
+			mapped, errM := svc.JsonMap_prof.FromXATMI([]byte(json), false)
+
+			if nil != errM {
+				ac.TpLogError("Failed to map request by [%s]: %s",
+					svc.JsonMap, errM.Error())
+				ret = FAIL
+				return
+			}
+
+			json = string(mapped)
+		}
 
 		if nil == errA {
 			ac.TpLogDebug("Got json to send: [%s]", json)
@@ -450,6 +477,39 @@ func XATMIDispatchCall(pool *XATMIPool, nr int, ctxData *atmi.TPSRVCTXDATA,
 
 	ac.TpLogDump(atmi.LOG_DEBUG, "Got response back", body, len(body))
 
+	//Map API names back to UBF fields
+	if nil != bufu && nil != svc.JsonMap_prof && len(body) > 0 {
+
+		mapped, errM := svc.JsonMap_prof.ToXATMI(body, false)
+
+		if nil != errM {
+			ac.TpLogError("Failed to map response by [%s]: %s - dropping",
+				svc.JsonMap, errM.Error())
+
+			retFlags |= atmi.TPSOFTTIMEOUT
+			ret = FAIL
+			return
+		}
+
+		body = mapped
+	}
+
+	if nil != bufu && nil != svc.JsonNorm && len(body) > 0 {
+
+		norm, errN := svc.JsonNorm.ToXATMI(body)
+
+		if nil != errN {
+			ac.TpLogError("Failed to normalize response: %s - dropping",
+				errN.Error())
+
+			retFlags |= atmi.TPSOFTTIMEOUT
+			ret = FAIL
+			return
+		}
+
+		body = norm
+	}
+
 	stringBody := string(body)
 
 	ac.TpLogDebug("Got string body [%s]", stringBody)
@@ -515,7 +575,7 @@ func XATMIDispatchCall(pool *XATMIPool, nr int, ctxData *atmi.TPSRVCTXDATA,
 			return
 		}
 
-		if errA = bufuRsp.TpJSONToUBF(stringBody); errA != nil {
+		if errA = exutil.JSONToUBF(ac, bufuRsp, body); errA != nil {
 			ac.TpLogError("Failed to conver JSON to UBF %d:[%s]",
 				errA.Code(), errA.Message())
 
@@ -696,7 +756,7 @@ func XATMIDispatchCall(pool *XATMIPool, nr int, ctxData *atmi.TPSRVCTXDATA,
 			if !bufu_rsp_parsed {
 				ac.TpLogDebug("Converting to UBF: [%s]", body)
 
-				if errA = bufu.TpJSONToUBF(stringBody); errA != nil {
+				if errA = exutil.JSONToUBF(ac, bufu, body); errA != nil {
 					ac.TpLogError("Failed to conver rsp "+
 						"buffer from JSON->UBF%d:[%s] - dropping",
 						errA.Code(), errA.Message())
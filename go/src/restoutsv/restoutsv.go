@@ -40,6 +40,7 @@ package main
 //Hmm we might need to put in channels a free ATMI contexts..
 import (
 	"encoding/json"
+	"exutil"
 	"fmt"
 	"net/http"
 	"os"
@@ -159,6 +160,17 @@ type ServiceMap struct {
 	View_notnull bool  `json:"view_notnull"`
 	View_flags   int64 //Flags used for VIEW2JSON
 
+	//JSON key mapping profile file, for UBF buffers
+	JsonMap      string `json:"json_map"`
+	JsonMap_prof *exutil.JSONMapProfile
+
+	//UBF JSON normalization
+	JsonArrays    string `json:"json_arrays"`
+	JsonScalars   string `json:"json_scalars"`
+	JsonOmitEmpty bool   `json:"json_omitempty"`
+	JsonNulls     string `json:"json_nulls"`
+	JsonNorm      *exutil.JSONNorm
+
 	//Counters:
 	echoFails      int  //Number failed echos
 	echoSchedUnAdv bool //Should we schedule advertise
@@ -555,6 +567,25 @@ func appinit(ctx *atmi.ATMICtx) int {
 				return FAIL
 			}
 
+			if "" != tmp.JsonMap {
+
+				if tmp.JsonMap_prof, err = exutil.JSONMapLoad(tmp.JsonMap); nil != err {
+					ctx.TpLogError("Failed to load 'json_map': %s",
+						err.Error())
+					return FAIL
+				}
+
+				ctx.TpLogInfo("Service [%s] JSON mapping profile [%s]",
+					tmp.Svc, tmp.JsonMap)
+			}
+
+			if tmp.JsonNorm, err = exutil.NewJSONNorm(tmp.JsonArrays,
+				tmp.JsonScalars, tmp.JsonOmitEmpty, tmp.JsonNulls); nil != err {
+				ctx.TpLogError("Invalid JSON normalization settings: %s",
+					err.Error())
+				return FAIL
+			}
+
 			Mservices[matchSvc[1]] = &tmp
 
 			printSvcSummary(ctx, &tmp)
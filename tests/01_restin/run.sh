@@ -26,6 +26,10 @@ mkdir -p runtime/tmlogs/rm2
 rm -rf runtime/qdata 2>/dev/null
 mkdir -p runtime/qdata
 
+# Download directory is validated at restincl startup
+rm -rf runtime/download 2>/dev/null
+mkdir -p runtime/download
+
 # Normally provided by provision, but probably those all build systems
 # has already old provision with out this extension env
 if [ "$(uname)" == "Darwin" ]; then
@@ -145,6 +149,91 @@ if [[ $? -ne 0 ]]; then
 	go_out 74
 fi
 
+###############################################################################
+echo "Check transaction tracking"
+###############################################################################
+{
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" http://localhost:8081/transactions/list`
+
+if [[ "$RSP" != "401" ]]; then
+	echo "Expected 401 for transaction list without token, got [$RSP]"
+	go_out 76
+fi
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" http://localhost:8081/metrics`
+
+if [[ "$RSP" != "401" ]]; then
+	echo "Expected 401 for metrics without token, got [$RSP]"
+	go_out 76
+fi
+
+RSP=`curl -s -H "Authorization: Bearer ADMSECRET" http://localhost:8081/transactions/list`
+echo "Response: [$RSP]"
+
+if [[ "$RSP" != "{\"count\":"* ]]; then
+	echo "Invalid transaction list received: [$RSP]"
+	go_out 76
+fi
+
+RSP=`curl -s -H "Authorization: Bearer ADMSECRET" http://localhost:8081/metrics`
+echo "Response: [$RSP]"
+
+if [[ "$RSP" != *"restincl_tx_started_total "* ]]; then
+	echo "Expected restincl_tx_started_total in metrics: [$RSP]"
+	go_out 76
+fi
+
+if [[ "$RSP" != *"restincl_tx_active "* ]]; then
+	echo "Expected restincl_tx_active in metrics: [$RSP]"
+	go_out 76
+fi
+
+# Idle transaction is aborted by the reaper (tx_idle_max=4)
+RSP=`curl -s -X POST -d '{"operation":"tpbegin","timeout":60}' http://localhost:8081/transactions`
+echo "Response: [$RSP]"
+
+TID=`echo "$RSP" | sed -n 's/.*"tptranid":"\([^"]*\)".*/\1/p'`
+
+if [[ "X$TID" == "X" ]]; then
+	echo "Expected tptranid from tpbegin, got [$RSP]"
+	go_out 76
+fi
+
+RSP=`curl -s -H "Authorization: Bearer ADMSECRET" http://localhost:8081/transactions/list`
+
+if [[ "$RSP" != *"$TID"* ]]; then
+	echo "Expected [$TID] in transaction list, got [$RSP]"
+	go_out 76
+fi
+
+sleep 7
+
+RSP=`curl -s -H "Authorization: Bearer ADMSECRET" http://localhost:8081/transactions/list`
+echo "Response: [$RSP]"
+
+if [[ "$RSP" == *"$TID"* ]]; then
+	echo "Idle transaction [$TID] not reaped: [$RSP]"
+	go_out 76
+fi
+
+RSP=`curl -s -H "Authorization: Bearer ADMSECRET" http://localhost:8081/metrics`
+
+if [[ "$RSP" != *"restincl_tx_reaped_total "[1-9]* ]]; then
+	echo "Expected restincl_tx_reaped_total in metrics: [$RSP]"
+	go_out 76
+fi
+
+RSP=`curl -s -X POST -d "{\"operation\":\"tpcommit\",\"tptranid\":\"$TID\"}" http://localhost:8081/transactions`
+echo "Response: [$RSP]"
+
+if [[ "$RSP" == *"\"error_code\":0"* ]]; then
+	echo "Commit of reaped transaction must fail: [$RSP]"
+	go_out 76
+fi
+
+} >> $LOGFILE 2>&1
+
 ###############################################################################
 echo "Check EXT error filter service fail (tpurcode 3)"
 ###############################################################################
@@ -1925,6 +2014,1298 @@ http://localhost:8080/header/cookies`
 		go_out 4
 	fi
 done
+
+###############################################################################
+echo "Batch calls"
+###############################################################################
+{
+for url in batch batch/parallel
+do
+for i in {1..100}
+do
+
+	RSP=`curl -s -H "Content-Type: application/json" -X POST -d \
+"[{\"service\":\"JSONSV\",\"conv\":\"json\",\"payload\":{\"StringField\":\"Hello\"}},\
+{\"service\":\"TEXTSV\",\"conv\":\"text\",\"payload\":\"Hello from curl\"},\
+{\"service\":\"FAILSV1\",\"conv\":\"text\",\"payload\":\"Hello\"}]" \
+http://localhost:8080/$url`
+
+	RSP_EXPECTED="{\"error_code\":0,\"error_message\":\"SUCCEED\",\"results\":[\
+{\"service\":\"JSONSV\",\"error_code\":0,\"error_message\":\"SUCCEED\",\"tpurcode\":0,\
+\"payload\":{\"StringField\":\"Hello\",\"StringField2\":\"Hello\",\
+\"NumField\":0,\"NumField2\":0,\"BoolField\":false,\"BoolField2\":false}},\
+{\"service\":\"TEXTSV\",\"error_code\":0,\"error_message\":\"SUCCEED\",\"tpurcode\":0,\
+\"payload\":\"Hello from EnduroX\"},\
+{\"service\":\"FAILSV1\",\"error_code\":11,"
+
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != "X$RSP_EXPECTED"* ]]; then
+		echo "Invalid response received, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 75
+	fi
+done
+done
+
+# Too many items
+RSP=`curl -s -o /dev/null -w "%{http_code}" -H "Content-Type: application/json" -X POST -d \
+"[{\"service\":\"TEXTSV\"},{\"service\":\"TEXTSV\"},{\"service\":\"TEXTSV\"},\
+{\"service\":\"TEXTSV\"}]" http://localhost:8080/batch`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != "X400" ]]; then
+	echo "Expected HTTP 400 for too many batch items, got: [$RSP]"
+	go_out 75
+fi
+
+# Failed item rolls back the transaction
+RSP=`curl -s -w " %{http_code}" -H "Content-Type: application/json" -X POST -d \
+"[{\"service\":\"QADD\",\"conv\":\"json2ubf\",\"payload\":{\"T_STRING_FLD\":\"BATCHROLLBACK\"}},\
+{\"service\":\"TXFAIL\",\"conv\":\"json2ubf\",\"payload\":{}}]" http://localhost:8081/batch/tran`
+
+echo "Response: [$RSP]"
+
+if [[ "$RSP" != "{\"error_code\":1,"*" 500" ]]; then
+	echo "Expected transactional batch to abort, got: [$RSP]"
+	go_out 75
+fi
+
+RSP=`curl -s -H "Content-Type: application/json" -X POST -d "{}" http://localhost:8081/dequeue`
+
+echo "Response: [$RSP]"
+
+if [[ "$RSP" == *"BATCHROLLBACK"* || "$RSP" == *"\"EX_IF_ECODE\":0"* ]]; then
+	echo "Enqueued message must be rolled back, got: [$RSP]"
+	go_out 75
+fi
+
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Idempotency-Key"
+###############################################################################
+{
+for i in {1..100}
+do
+	RSP=`(curl -s -i -H "Content-Type: text/plain" -H "Idempotency-Key: KEY$i" \
+		-X POST -d "Hello from curl" http://localhost:8080/idem/text 2>&1 )`
+
+	echo "Response: [$RSP]"
+
+	if [[ "$RSP" != *"Hello from EnduroX"* || "$RSP" == *"Idempotent-Replayed"* ]]; then
+		echo "Invalid first response received, got: [$RSP]"
+		go_out 77
+	fi
+
+	RSP=`(curl -s -i -H "Content-Type: text/plain" -H "Idempotency-Key: KEY$i" \
+		-X POST -d "Hello from curl" http://localhost:8080/idem/text 2>&1 )`
+
+	echo "Response: [$RSP]"
+
+	if [[ "$RSP" != *"Hello from EnduroX"* || "$RSP" != *"Idempotent-Replayed: true"* ]]; then
+		echo "Invalid replayed response received, got: [$RSP]"
+		go_out 77
+	fi
+
+	RSP=`curl -s -o /dev/null -w "%{http_code}" -H "Content-Type: text/plain" \
+		-H "Idempotency-Key: KEY$i" -X POST -d "Other" http://localhost:8080/idem/text`
+
+	if [[ "X$RSP" != "X422" ]]; then
+		echo "Expected HTTP 422 for fingerprint mismatch, got: [$RSP]"
+		go_out 77
+	fi
+done
+
+# Safe methods ignore the key
+for i in 1 2
+do
+	RSP=`(curl -s -i -H "Idempotency-Key: GET1" http://localhost:8080/idem/text 2>&1 )`
+
+	echo "Response: [$RSP]"
+
+	if [[ "$RSP" == *"Idempotent-Replayed"* ]]; then
+		echo "GET request must not be replayed, got: [$RSP]"
+		go_out 77
+	fi
+done
+
+# Service and queue stores
+for s in svc queue; do
+	for i in {1..10}
+	do
+		RSP=`(curl -s -i -H "Content-Type: text/plain" -H "Idempotency-Key: $s$i" \
+			-X POST -d "Hello from curl" http://localhost:8080/idem/$s 2>&1 )`
+
+		if [[ "$RSP" != *"Hello from EnduroX"* || "$RSP" == *"Idempotent-Replayed"* ]]; then
+			echo "Invalid first response of [$s] store, got: [$RSP]"
+			go_out 77
+		fi
+
+		RSP=`(curl -s -i -H "Content-Type: text/plain" -H "Idempotency-Key: $s$i" \
+			-X POST -d "Hello from curl" http://localhost:8080/idem/$s 2>&1 )`
+
+		if [[ "$RSP" != *"Hello from EnduroX"* || "$RSP" != *"Idempotent-Replayed: true"* ]]; then
+			echo "Invalid replayed response of [$s] store, got: [$RSP]"
+			go_out 77
+		fi
+
+		RSP=`curl -s -o /dev/null -w "%{http_code}" -H "Content-Type: text/plain" \
+			-H "Idempotency-Key: $s$i" -X POST -d "Other" http://localhost:8080/idem/$s`
+
+		if [[ "X$RSP" != "X422" ]]; then
+			echo "Expected HTTP 422 for [$s] store fingerprint mismatch, got: [$RSP]"
+			go_out 77
+		fi
+	done
+done
+
+# Same key in progress (service sleeps 4 sec)
+curl -s -o /dev/null -H "Content-Type: text/plain" -H "Idempotency-Key: SLOW1" \
+	-X POST -d "Hello" http://localhost:8080/idem/slow &
+SLOW=$!
+sleep 1
+
+RSP=`curl -s -w " %{http_code}" -H "Content-Type: text/plain" \
+	-H "Idempotency-Key: SLOW1" -X POST -d "Hello" http://localhost:8080/idem/slow`
+
+if [[ "$RSP" != *'"error_code":'*" 409" ]]; then
+	echo "Expected HTTP 409 for key in progress, got: [$RSP]"
+	go_out 77
+fi
+
+wait $SLOW
+
+# Pending record of queue store is seen by other instance
+curl -s -o /dev/null -H "Content-Type: text/plain" -H "Idempotency-Key: SLOW2" \
+	-X POST -d "Hello" http://localhost:8080/idem/slowq &
+SLOW=$!
+sleep 1
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" -H "Content-Type: text/plain" \
+	-H "Idempotency-Key: SLOW2" -X POST -d "Hello" http://localhost:8081/idem/slowq`
+
+if [[ "X$RSP" != "X409" ]]; then
+	echo "Expected HTTP 409 from other instance for key in progress, got: [$RSP]"
+	go_out 77
+fi
+
+wait $SLOW
+
+# Final response replaces the pending record
+RSP=`curl -s -i -H "Content-Type: text/plain" -H "Idempotency-Key: SLOW2" \
+	-X POST -d "Hello" http://localhost:8081/idem/slowq`
+
+if [[ "$RSP" != *"Idempotent-Replayed: true"* ]]; then
+	echo "Expected replay from other instance, got: [$RSP]"
+	go_out 77
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Response cache"
+###############################################################################
+{
+RSP=`(curl -s -i http://localhost:8080/cache/text 2>&1 )`
+echo "Response: [$RSP]"
+
+if [[ "$RSP" != *"Hello from EnduroX"* || "$RSP" != *"Cache-Control: max-age="* ]]; then
+	echo "Invalid cached response received, got: [$RSP]"
+	go_out 78
+fi
+
+ETAG=`echo "$RSP" | grep -i "^ETag:" | cut -d ' ' -f2 | tr -d '\r'`
+
+for i in {1..100}
+do
+	RSP=`curl -s -o /dev/null -w "%{http_code}" -H "If-None-Match: $ETAG" \
+		http://localhost:8080/cache/text`
+
+	if [[ "X$RSP" != "X304" ]]; then
+		echo "Expected HTTP 304 for ETag [$ETAG], got: [$RSP]"
+		go_out 78
+	fi
+
+	RSP=`curl -s http://localhost:8080/cache/text`
+
+	if [[ "X$RSP" != "XHello from EnduroX" ]]; then
+		echo "Invalid cached response received, got: [$RSP]"
+		go_out 78
+	fi
+done
+
+# Requests with credentials are not served from cache
+for HDR in "Authorization: Bearer USER1" "Cookie: session=USER1"
+do
+	RSP=`curl -s -i -H "$HDR" http://localhost:8080/cache/text`
+	echo "Response: [$RSP]"
+
+	if [[ "$RSP" != *"Hello from EnduroX"* ]] || echo "$RSP" | grep -qi "^ETag:"; then
+		echo "Expected uncached response for [$HDR], got: [$RSP]"
+		go_out 78
+	fi
+done
+
+# Responses setting cookies are not cached
+for i in {1..2}
+do
+	RSP=`curl -s -i -X GET -H "Content-Type: application/json" -d "{}" \
+		http://localhost:8080/cache/cookies`
+	echo "Response: [$RSP]"
+
+	if [[ "$RSP" != *"Set-Cookie: RspCookie="* ]] || echo "$RSP" | grep -qi "^ETag:"; then
+		echo "Expected uncached response with cookie, got: [$RSP]"
+		go_out 78
+	fi
+done
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "XML conversion"
+###############################################################################
+{
+for i in {1..100}
+do
+	RSP=`curl -s -H "Content-Type: application/xml" -X POST -d \
+"<req T_STRING_FLD=\"A\"><T_STRING_FLD>B</T_STRING_FLD></req>" \
+http://localhost:8080/xml/echo`
+
+	RSP_EXPECTED="<rsp><T_STRING_FLD>A</T_STRING_FLD><T_STRING_FLD>B</T_STRING_FLD>\
+<error_code>0</error_code><error_message>SUCCEED</error_message></rsp>"
+
+	echo "Response: [$RSP]"
+
+	if [[ "$RSP" != *"$RSP_EXPECTED" ]]; then
+		echo "Invalid response received, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 79
+	fi
+
+	RSP=`curl -s -H "Content-Type: application/xml" -X POST -d "<req>" \
+http://localhost:8080/xml/echo`
+
+	echo "Response: [$RSP]"
+
+	if [[ "$RSP" != *"<error_code>4</error_code>"* ]]; then
+		echo "Expected TPEINVAL in XML response, got: [$RSP]"
+		go_out 79
+	fi
+done
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Nested JSON to embedded UBF/VIEW"
+###############################################################################
+{
+for i in {1..100}
+do
+	RSP=`curl -s -H "Content-Type: application/json" -X POST -d \
+"{\"T_STRING_FLD\":\"ORDER1\",\"T_UBF_FLD\":[{\"T_STRING_FLD\":\"ITEM1\",\"T_LONG_FLD\":2},\
+{\"T_STRING_FLD\":\"ITEM2\",\"T_LONG_FLD\":1}],\
+\"T_VIEW_FLD\":{\"REQUEST2\":{\"tshort2\":100,\"tlong2\":200,\"tstring2\":\"X\"}}}" \
+http://localhost:8080/echo`
+
+	echo "Response: [$RSP]"
+
+	RSP_EXPECTED="\"T_UBF_FLD\":[{\"T_LONG_FLD\":2,\"T_STRING_FLD\":\"ITEM1\"},\
+{\"T_LONG_FLD\":1,\"T_STRING_FLD\":\"ITEM2\"}]"
+
+	if [[ "$RSP" != *"$RSP_EXPECTED"* || "$RSP" != *"\"T_STRING_FLD\":\"ORDER1\""* ||
+		"$RSP" != *"\"tlong2\":200"* || "$RSP" != *"\"error_code\":0"* ]]; then
+		echo "Invalid nested response received, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 80
+	fi
+
+	RSP=`curl -s -H "Content-Type: application/json" -X POST -d \
+"{\"T_STRING_FLD\":{\"T_LONG_FLD\":1}}" http://localhost:8080/echo`
+
+	echo "Response: [$RSP]"
+
+	if [[ "$RSP" != *"\"error_code\":4"* ]]; then
+		echo "Expected TPEINVAL for object in non embedded field, got: [$RSP]"
+		go_out 80
+	fi
+done
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "JSON key mapping"
+###############################################################################
+{
+for i in {1..100}
+do
+	RSP=`curl -s -H "Content-Type: application/json" -X POST -d \
+"{\"accountId\":\"ACC1\",\"amount\":\"15\",\"customer\":{\"name\":\"JOHN\"},\"other\":1}" \
+http://localhost:8080/map/echo`
+
+	RSP_EXPECTED="{\"accountId\":\"ACC1\",\"amount\":15,\"customer\":{\"name\":\"JOHN\"},\
+\"error_code\":0,\"error_message\":\"SUCCEED\"}"
+
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != "X$RSP_EXPECTED" ]]; then
+		echo "Invalid mapped response received, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 81
+	fi
+done
+
+# Error fields are passed with "unknown":"drop" profile
+RSP=`curl -s -H "Content-Type: application/json" -X POST -d \
+"{\"accountId\":\"ACC1\",\"other\":1}" http://localhost:8080/map/ubferr`
+
+echo "Response: [$RSP]"
+
+if [[ "$RSP" != *'"errorCode":0'* || "$RSP" != *'"EX_IF_EMSG":"SUCCEED"'* ||
+	"$RSP" == *'"other"'* ]]; then
+	echo "Expected error fields in mapped response, got: [$RSP]"
+	go_out 81
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "UBF JSON normalization"
+###############################################################################
+{
+for i in {1..100}
+do
+	RSP=`curl -s -H "Content-Type: application/json" -X POST -d \
+"{\"T_STRING_FLD\":\"A\",\"T_LONG_FLD\":[5,6],\"T_SHORT_FLD\":0}" \
+http://localhost:8080/norm/echo`
+
+	RSP_EXPECTED="{\"T_DOUBLE_FLD\":null,\"T_LONG_FLD\":5,\"T_STRING_FLD\":[\"A\"],\
+\"error_code\":0,\"error_message\":\"SUCCEED\"}"
+
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != "X$RSP_EXPECTED" ]]; then
+		echo "Invalid normalized response received, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 82
+	fi
+done
+
+# Zero error code is not omitted
+RSP=`curl -s -H "Content-Type: application/json" -X POST -d \
+"{\"T_STRING_FLD\":\"A\",\"T_LONG_FLD\":0}" http://localhost:8080/norm/ubferr`
+
+echo "Response: [$RSP]"
+
+if [[ "$RSP" != *'"EX_IF_ECODE":0'* || "$RSP" != *'"EX_IF_EMSG":"SUCCEED"'* ||
+	"$RSP" == *'"T_LONG_FLD"'* ]]; then
+	echo "Expected error fields kept and empty fields omitted, got: [$RSP]"
+	go_out 82
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Content negotiation"
+###############################################################################
+{
+printf '\x81\xacT_STRING_FLD\xa1A' > msgpack.test.request
+
+for i in {1..100}
+do
+	RSP=`curl -s -H "Content-Type: application/json" -H "Accept: application/xml" \
+-X POST -d "{\"T_STRING_FLD\":\"A\"}" http://localhost:8080/fmt/echo`
+
+	RSP_EXPECTED="<ubf><T_STRING_FLD>A</T_STRING_FLD><error_code>0</error_code>\
+<error_message>SUCCEED</error_message></ubf>"
+
+	echo "Response: [$RSP]"
+
+	if [[ "$RSP" != *"$RSP_EXPECTED" ]]; then
+		echo "Invalid XML response received, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 83
+	fi
+
+	RSP=`curl -s -H "Content-Type: application/msgpack" -H "Accept: application/json" \
+-X POST --data-binary @msgpack.test.request http://localhost:8080/fmt/echo`
+
+	RSP_EXPECTED="{\"T_STRING_FLD\":\"A\",\"error_code\":0,\"error_message\":\"SUCCEED\"}"
+
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != "X$RSP_EXPECTED" ]]; then
+		echo "Invalid JSON response for MessagePack request, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 83
+	fi
+
+	RSP=`curl -s -o /dev/null -w "%{content_type}" -H "Accept: application/cbor" \
+-X POST -d "{\"T_STRING_FLD\":\"A\"}" http://localhost:8080/fmt/echo`
+
+	if [[ "X$RSP" != "Xapplication/cbor" ]]; then
+		echo "Expected CBOR response, got content type: [$RSP]"
+		go_out 83
+	fi
+
+	RSP=`curl -s -H "Accept: application/cbor" -X POST -d "{\"T_STRING_FLD\":\"A\"}" \
+http://localhost:8080/fmt/echo | od -An -tx1 | tr -d ' \n'`
+
+	# {"T_STRING_FLD":"A","error_code":0,"error_message":"SUCCEED"}
+	RSP_EXPECTED="a36c545f535452494e475f464c4461416a6572726f725f636f6465006d\
+6572726f725f6d6573736167656753554343454544"
+
+	if [[ "X$RSP" != "X$RSP_EXPECTED" ]]; then
+		echo "Invalid CBOR response received, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 83
+	fi
+
+	RSP=`curl -s -o /dev/null -w "%{http_code}" -H "Accept: text/html" \
+-X POST -d "{\"T_STRING_FLD\":\"A\"}" http://localhost:8080/fmt/echo`
+
+	if [[ "X$RSP" != "X406" ]]; then
+		echo "Expected HTTP 406 for not acceptable format, got: [$RSP]"
+		go_out 83
+	fi
+done
+
+RSP=`curl -s -w " %{http_code} %{content_type}" -H "Accept: text/html" \
+-X POST -d "{\"T_STRING_FLD\":\"A\"}" http://localhost:8080/fmt/echo`
+
+if [[ "X$RSP" != 'X{"error_code":4,'*" 406 application/json" ]]; then
+	echo "Expected JSON error envelope with 406, got: [$RSP]"
+	go_out 83
+fi
+
+RSP=`curl -s -w " %{http_code} %{content_type}" -H "Content-Type: application/cbor" \
+-X POST --data-binary @msgpack.test.request http://localhost:8080/fmt/mp`
+
+if [[ "X$RSP" != 'X{"error_code":4,'*" 415 application/json" ]]; then
+	echo "Expected JSON error envelope with 415, got: [$RSP]"
+	go_out 83
+fi
+
+rm msgpack.test.request
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Problem details errors"
+###############################################################################
+{
+for i in {1..100}
+do
+	RSP=`curl -s -D problem.test.headers -H "Content-Type: application/json" \
+-X POST -d "{\"T_STRING_FLD\":\"A\"}" http://localhost:8080/problem/fail`
+
+	RSP_EXPECTED="{\"type\":\"https://example.com/probs/svcfail\",\
+\"title\":\"Internal Server Error\",\"status\":500,\"detail\":"
+
+	echo "Response: [$RSP]"
+
+	if [[ "$RSP" != "$RSP_EXPECTED"* ]]; then
+		echo "Invalid problem response received, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 84
+	fi
+
+	RSP_EXPECTED="\"instance\":\"/problem/fail\",\"error_code\":11,\
+\"error_source\":\"S\",\"tpurcode\":0}"
+
+	if [[ "$RSP" != *"$RSP_EXPECTED" ]]; then
+		echo "Invalid problem extensions received, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 84
+	fi
+
+	if ! grep -qi "^Content-Type: application/problem+json" problem.test.headers; then
+		echo "Expected application/problem+json content type"
+		go_out 84
+	fi
+done
+
+rm problem.test.headers
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "tpurcode mapping"
+###############################################################################
+{
+for i in {1..100}
+do
+	RSP=`curl -s -w " %{http_code}" -H "Content-Type: application/json" \
+-X POST -d "{\"T_LONG_FLD\":404}" http://localhost:8080/urcode/json`
+
+	RSP_EXPECTED="{\"T_LONG_FLD\":404,\"error_code\":11,\"error_message\":\"Not found\"} 404"
+
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != "X$RSP_EXPECTED" ]]; then
+		echo "Invalid urcode response received, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 85
+	fi
+
+	RSP=`curl -s -w " %{http_code}" -H "Content-Type: application/json" \
+-X POST -d "{\"T_LONG_FLD\":1500,\"T_STRING_FLD\":\"FAIL\"}" http://localhost:8080/urcode/json`
+
+	RSP_EXPECTED="\"error_code\":11,\"error_message\":\"Business rule\"} 422"
+
+	echo "Response: [$RSP]"
+
+	if [[ "$RSP" != *"$RSP_EXPECTED" ]]; then
+		echo "Invalid urcode range response received, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 85
+	fi
+
+	RSP=`curl -s -w " %{http_code}" -H "Content-Type: application/json" \
+-X POST -d "{\"T_LONG_FLD\":1}" http://localhost:8080/urcode/json`
+
+	RSP_EXPECTED="{\"T_LONG_FLD\":1,\"error_code\":0,\"error_message\":\"SUCCEED\"} 200"
+
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != "X$RSP_EXPECTED" ]]; then
+		echo "Invalid unmapped urcode response received, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 85
+	fi
+
+	RSP=`curl -s -w " %{http_code}" -H "Content-Type: application/json" \
+-X POST -d "{\"T_LONG_FLD\":409}" http://localhost:8080/urcode/problem`
+
+	RSP_EXPECTED="\"error_code\":11,\"error_source\":\"S\",\"tpurcode\":409} 409"
+
+	echo "Response: [$RSP]"
+
+	if [[ "$RSP" != *"$RSP_EXPECTED" ]]; then
+		echo "Invalid urcode problem response received, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 85
+	fi
+done
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Response templates"
+###############################################################################
+{
+for i in {1..100}
+do
+	RSP=`curl -s -w " %{content_type}" -H "Content-Type: application/json" \
+-X POST -d "{\"T_STRING_FLD\":[\"A,B\",\"C\"],\"T_DOUBLE_FLD\":1.5}" \
+http://localhost:8080/tpl/echo`
+
+	RSP_EXPECTED="\"A,B\";C;1.50;0
+ text/csv"
+
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != "X$RSP_EXPECTED" ]]; then
+		echo "Invalid template response received, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 86
+	fi
+done
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "CSV export"
+###############################################################################
+{
+for i in {1..100}
+do
+	RSP=`curl -s -D csv.test.headers -H "Content-Type: application/json" \
+-X POST -d "{\"T_STRING_FLD\":[\"A;B\",\"C\"],\"T_LONG_FLD\":[1]}" \
+"http://localhost:8080/csv/echo?format=csv"`
+
+	RSP_EXPECTED="T_STRING_FLD;T_LONG_FLD
+\"A;B\";1
+C;"
+
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != "X$RSP_EXPECTED" ]]; then
+		echo "Invalid CSV response received, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 87
+	fi
+
+	if ! grep -qi "^Content-Disposition: attachment; filename=report.csv" csv.test.headers; then
+		echo "Expected Content-Disposition with report.csv"
+		go_out 87
+	fi
+
+	RSP=`curl -s -H "Content-Type: application/json" -H "Accept: text/tab-separated-values" \
+-X POST -d "{\"T_STRING_FLD\":\"A\",\"T_LONG_FLD\":1}" http://localhost:8080/csv/echo`
+
+	RSP_EXPECTED=`printf "T_STRING_FLD\tT_LONG_FLD\nA\t1"`
+
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != "X$RSP_EXPECTED" ]]; then
+		echo "Invalid TSV response received, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 87
+	fi
+
+	RSP=`curl -s -H "Content-Type: application/json" \
+-X POST -d "{\"T_STRING_FLD\":\"A\"}" http://localhost:8080/csv/echo`
+
+	RSP_EXPECTED="{\"T_STRING_FLD\":\"A\",\"error_code\":0,\"error_message\":\"SUCCEED\"}"
+
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != "X$RSP_EXPECTED" ]]; then
+		echo "Invalid JSON response received, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 87
+	fi
+done
+
+rm csv.test.headers
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "File download"
+###############################################################################
+{
+printf "0123456789" > secret.test.txt
+
+for i in {1..100}
+do
+	printf "0123456789" > download/report.txt
+
+	RSP=`curl -s -D download.test.headers "http://localhost:8080/download?file=report.txt"`
+
+	if [[ "X$RSP" != "X0123456789" ]]; then
+		echo "Invalid file received, got: [$RSP], expected: [0123456789]"
+		go_out 88
+	fi
+
+	if ! grep -qi "^Content-Disposition: attachment; filename=report-report.txt" \
+		download.test.headers; then
+		echo "Expected Content-Disposition with report-report.txt"
+		go_out 88
+	fi
+
+	RSP=`curl -s -w " %{http_code}" -H "Range: bytes=2-4" \
+"http://localhost:8080/download?file=report.txt"`
+
+	if [[ "X$RSP" != "X234 206" ]]; then
+		echo "Invalid range received, got: [$RSP], expected: [234 206]"
+		go_out 88
+	fi
+
+	RSP=`curl -s -o /dev/null -w "%{http_code}" \
+"http://localhost:8080/download?file=../secret.test.txt"`
+
+	if [[ "X$RSP" != "X403" ]]; then
+		echo "File out of download directory must be refused, got: [$RSP]"
+		go_out 88
+	fi
+
+	RSP=`curl -s "http://localhost:8080/download?file=report.txt&del=1"`
+
+	if [[ "X$RSP" != "X0123456789" || -f download/report.txt ]]; then
+		echo "File must be sent and removed, got: [$RSP]"
+		go_out 88
+	fi
+done
+
+rm -f secret.test.txt download.test.headers
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "File upload policy"
+###############################################################################
+{
+printf "hello" > upl.test.txt
+printf "hello" > upl.test.exe
+printf "hello" > virus.test.txt
+printf "\x00\x01\x02\x03" > bin.test.txt
+head -c 1200 /dev/zero | tr '\0' 'a' > big.test.txt
+head -c 800 /dev/zero | tr '\0' 'a' > mid.test.txt
+
+SUM=`openssl dgst -sha256 upl.test.txt | awk '{print $NF}'`
+
+for i in {1..10}
+do
+	RSP=`curl -s -w " %{http_code}" -F "files[]=@upl.test.txt" \
+http://localhost:8080/ext_fileupload_policy`
+
+	if [[ "X$RSP" != "X$SUM"*" 200" ]]; then
+		echo "Expected checksum [$SUM] with 200, got [$RSP]"
+		go_out 89
+	fi
+
+	for f in upl.test.exe bin.test.txt; do
+		RSP=`curl -s -o /dev/null -w "%{http_code}" -F "files[]=@$f" \
+http://localhost:8080/ext_fileupload_policy`
+
+		if [[ "X$RSP" != "X415" ]]; then
+			echo "Expected 415 for [$f], got [$RSP]"
+			go_out 89
+		fi
+	done
+
+	RSP=`curl -s -o /dev/null -w "%{http_code}" -F "files[]=@upl.test.txt" \
+-F "files[]=@upl.test.txt" -F "files[]=@upl.test.txt" \
+http://localhost:8080/ext_fileupload_policy`
+
+	if [[ "X$RSP" != "X413" ]]; then
+		echo "Expected 413 for too many files, got [$RSP]"
+		go_out 89
+	fi
+
+	RSP=`curl -s -o /dev/null -w "%{http_code}" -F "files[]=@big.test.txt" \
+http://localhost:8080/ext_fileupload_policy`
+
+	if [[ "X$RSP" != "X413" ]]; then
+		echo "Expected 413 for file size, got [$RSP]"
+		go_out 89
+	fi
+
+	RSP=`curl -s -o /dev/null -w "%{http_code}" -F "files[]=@mid.test.txt" \
+-F "files[]=@mid.test.txt" http://localhost:8080/ext_fileupload_policy`
+
+	if [[ "X$RSP" != "X413" ]]; then
+		echo "Expected 413 for total size, got [$RSP]"
+		go_out 89
+	fi
+
+	RSP=`curl -s -o /dev/null -w "%{http_code}" -F "files[]=@virus.test.txt" \
+http://localhost:8080/ext_fileupload_policy`
+
+	if [[ "X$RSP" != "X422" ]]; then
+		echo "Expected 422 for rejected by scan, got [$RSP]"
+		go_out 89
+	fi
+done
+
+rm -f upl.test.txt upl.test.exe virus.test.txt bin.test.txt big.test.txt mid.test.txt
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Streaming to conversational service"
+###############################################################################
+{
+head -c 1000000 /dev/urandom > stream.test.bin
+SUM=`openssl dgst -sha256 stream.test.bin | awk '{print $NF}'`
+
+for i in {1..10}
+do
+	for r in raw ubf; do
+		RSP=`curl -s -w " %{http_code}" --data-binary @stream.test.bin \
+http://localhost:8080/stream/$r`
+
+		if [[ "X$r" == "Xraw" ]]; then
+			EXP="1000000 $SUM 200"
+		else
+			EXP="1000000 $SUM 201"
+		fi
+
+		if [[ "X$RSP" != "X$EXP" ]]; then
+			echo "Expected [$EXP] for [$r], got [$RSP]"
+			go_out 90
+		fi
+	done
+
+	#Empty body
+	RSP=`curl -s -X POST http://localhost:8080/stream/raw`
+
+	if [[ "X$RSP" != "X0 "* ]]; then
+		echo "Expected zero bytes streamed, got [$RSP]"
+		go_out 90
+	fi
+
+	RSP=`curl -s -o /dev/null -w "%{http_code}" --data-binary @stream.test.bin \
+"http://localhost:8080/stream/ubf?fail=1"`
+
+	if [[ "X$RSP" != "X500" ]]; then
+		echo "Expected 500 for failed service, got [$RSP]"
+		go_out 90
+	fi
+done
+
+rm -f stream.test.bin
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Route reload"
+###############################################################################
+{
+RSP=`curl -s -o /dev/null -w "%{http_code}" -X POST http://localhost:8080/admin/reload`
+
+if [[ "X$RSP" != "X401" ]]; then
+	echo "Expected 401 for reload without token, got [$RSP]"
+	go_out 91
+fi
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer ADMSECRET" \
+http://localhost:8080/admin/reload`
+
+if [[ "X$RSP" != "X405" ]]; then
+	echo "Expected 405 for GET of reload, got [$RSP]"
+	go_out 91
+fi
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" http://localhost:8080/reload/echo`
+
+if [[ "X$RSP" != "X404" ]]; then
+	echo "Route must not exist before reload, got [$RSP]"
+	go_out 91
+fi
+
+cat << EOF > conf/reload.test.ini
+[@restin]
+/reload/echo={"conv":"text", "errors":"text", "echo":true}
+EOF
+
+RSP=`curl -s -H "Authorization: Bearer ADMSECRET" -X POST http://localhost:8080/admin/reload`
+
+if [[ "X$RSP" != "X{\"status\":\"ok\""* ]]; then
+	echo "Reload failed: [$RSP]"
+	go_out 91
+fi
+
+RSP=`curl -s -H "Content-Type: text/plain" -d "HELLO" http://localhost:8080/reload/echo`
+
+if [[ "X$RSP" != "XHELLO" ]]; then
+	echo "Expected reloaded route to echo [HELLO], got [$RSP]"
+	go_out 91
+fi
+
+# Idempotency memory store is kept over the reload
+RSP=`(curl -s -i -H "Content-Type: text/plain" -H "Idempotency-Key: KEY1" \
+	-X POST -d "Hello from curl" http://localhost:8080/idem/text 2>&1 )`
+
+if [[ "$RSP" != *"Idempotent-Replayed: true"* ]]; then
+	echo "Expected idempotency key kept over reload, got: [$RSP]"
+	go_out 91
+fi
+
+# Invalid config keeps the current routes
+cat << EOF >> conf/reload.test.ini
+/reload/bad={"conv":"json3"}
+EOF
+
+RSP=`curl -s -w " %{http_code}" -H "Authorization: Bearer ADMSECRET" -X POST \
+http://localhost:8080/admin/reload`
+
+if [[ "X$RSP" != *"Invalid conv"*" 422" ]]; then
+	echo "Expected reload to fail with 422, got [$RSP]"
+	go_out 91
+fi
+
+RSP=`curl -s -H "Content-Type: text/plain" -d "HELLO" http://localhost:8080/reload/echo`
+
+if [[ "X$RSP" != "XHELLO" ]]; then
+	echo "Routes must be kept after failed reload, got [$RSP]"
+	go_out 91
+fi
+
+# Reload by signal
+rm -f conf/reload.test.ini
+pkill -HUP restincl
+sleep 1
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" http://localhost:8080/reload/echo`
+
+if [[ "X$RSP" != "X404" ]]; then
+	echo "Route must be removed after SIGHUP reload, got [$RSP]"
+	go_out 91
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Routes published by services"
+###############################################################################
+{
+RSP=`curl -s -o /dev/null -w "%{http_code}" -H "Content-Type: application/json" \
+-d '{"url":"/dyn/echo","owner":"TEST","ttl":30,"route":{"conv":"text","errors":"text","echo":true}}' \
+http://localhost:8080/route/publish`
+
+if [[ "X$RSP" != "X200" ]]; then
+	echo "Failed to publish route: [$RSP]"
+	go_out 92
+fi
+
+sleep 1
+
+RSP=`curl -s -H "Content-Type: text/plain" -d "HELLO" http://localhost:8080/dyn/echo`
+
+if [[ "X$RSP" != "XHELLO" ]]; then
+	echo "Expected published route to echo [HELLO], got [$RSP]"
+	go_out 92
+fi
+
+# Other owner cannot remove it
+curl -s -H "Content-Type: application/json" \
+-d '{"op":"del","url":"/dyn/echo","owner":"OTHER"}' \
+http://localhost:8080/route/publish
+sleep 1
+
+RSP=`curl -s -H "Content-Type: text/plain" -d "HELLO" http://localhost:8080/dyn/echo`
+
+if [[ "X$RSP" != "XHELLO" ]]; then
+	echo "Route must be kept, got [$RSP]"
+	go_out 92
+fi
+
+curl -s -H "Content-Type: application/json" \
+-d '{"op":"del","url":"/dyn/echo","owner":"TEST"}' \
+http://localhost:8080/route/publish
+sleep 1
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" http://localhost:8080/dyn/echo`
+
+if [[ "X$RSP" != "X404" ]]; then
+	echo "Route must be removed, got [$RSP]"
+	go_out 92
+fi
+
+# Expiry
+curl -s -H "Content-Type: application/json" \
+-d '{"url":"/dyn/echo","owner":"TEST","ttl":1,"route":{"conv":"text","errors":"text","echo":true}}' \
+http://localhost:8080/route/publish
+sleep 3
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" http://localhost:8080/dyn/echo`
+
+if [[ "X$RSP" != "X404" ]]; then
+	echo "Route must expire, got [$RSP]"
+	go_out 92
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Admin API"
+###############################################################################
+{
+RSP=`curl -s -o /dev/null -w "%{http_code}" http://127.0.0.1:8090/routes`
+
+if [[ "X$RSP" != "X401" ]]; then
+	echo "Expected 401 without token, got [$RSP]"
+	go_out 93
+fi
+
+RSP=`curl -s -H "Authorization: Bearer ADMSECRET" http://127.0.0.1:8090/routes`
+
+if [[ "X$RSP" != *'"url":"/map/echo"'* || "X$RSP" != *'"json_map":'* ]]; then
+	echo "Routes must be listed with settings, got [$RSP]"
+	go_out 93
+fi
+
+RSP=`curl -s -H "Authorization: Bearer ADMSECRET" http://127.0.0.1:8090/workers`
+
+if [[ "X$RSP" != *'"workers":'* ]]; then
+	echo "Expected worker state, got [$RSP]"
+	go_out 93
+fi
+
+RSP=`curl -s -H "Authorization: Bearer ADMSECRET" -X PUT \
+-d '{"url":"/xml/echo","enabled":true,"body":"DOWN","retry_after":60}' \
+http://127.0.0.1:8090/maintenance`
+
+RSP=`curl -s -w " %{http_code}" -d "<rsp><T_STRING_FLD>HELLO</T_STRING_FLD></rsp>" \
+-H "Content-Type: application/xml" http://localhost:8080/xml/echo`
+
+if [[ "X$RSP" != "XDOWN 503" ]]; then
+	echo "Expected route in maintenance, got [$RSP]"
+	go_out 93
+fi
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer ADMSECRET" -X PUT \
+-d '{"url":"/xml/echoo","enabled":true}' http://127.0.0.1:8090/maintenance`
+
+if [[ "X$RSP" != "X404" ]]; then
+	echo "Expected 404 for maintenance of unknown route, got [$RSP]"
+	go_out 93
+fi
+
+# Maintenance survives reload
+curl -s -H "Authorization: Bearer ADMSECRET" -X POST http://127.0.0.1:8090/reload
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" -d "<rsp><T_STRING_FLD>HELLO</T_STRING_FLD></rsp>" \
+-H "Content-Type: application/xml" http://localhost:8080/xml/echo`
+
+if [[ "X$RSP" != "X503" ]]; then
+	echo "Expected maintenance after reload, got [$RSP]"
+	go_out 93
+fi
+
+curl -s -H "Authorization: Bearer ADMSECRET" -X PUT \
+-d '{"url":"/xml/echo","enabled":false}' http://127.0.0.1:8090/maintenance
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" -d "<rsp><T_STRING_FLD>HELLO</T_STRING_FLD></rsp>" \
+-H "Content-Type: application/xml" http://localhost:8080/xml/echo`
+
+if [[ "X$RSP" != "X200" ]]; then
+	echo "Expected route back in service, got [$RSP]"
+	go_out 93
+fi
+
+RSP=`curl -s -H "Authorization: Bearer ADMSECRET" http://127.0.0.1:8090/stats`
+
+if [[ "X$RSP" != *'"/xml/echo":{"requests":'*'"maintenance":2'* ]]; then
+	echo "Expected route statistics, got [$RSP]"
+	go_out 93
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Target service selection"
+###############################################################################
+{
+
+RSP=`curl -s -H "X-Api-Version: 2" -d "Hello" http://localhost:8080/target/text`
+
+if [[ "X$RSP" != "XHello from EnduroX v2" ]]; then
+	echo "Expected v2 by header condition, got [$RSP]"
+	go_out 94
+fi
+
+# Same client key gets the same version
+FIRST=`curl -s -H "X-Client-Id: client-1" -d "Hello" http://localhost:8080/target/text`
+
+for i in 1 2 3 4 5; do
+
+	RSP=`curl -s -H "X-Client-Id: client-1" -d "Hello" http://localhost:8080/target/text`
+
+	if [[ "X$RSP" != "X$FIRST" ]]; then
+		echo "Expected sticky target [$FIRST], got [$RSP]"
+		go_out 94
+	fi
+done
+
+# Both versions are reached by different clients
+V1=0
+V2=0
+
+for i in `seq 1 40`; do
+
+	RSP=`curl -s -H "X-Client-Id: client-$i" -d "Hello" http://localhost:8080/target/text`
+
+	case "$RSP" in
+	"Hello from EnduroX")
+		V1=$((V1+1))
+		;;
+	"Hello from EnduroX v2")
+		V2=$((V2+1))
+		;;
+	*)
+		echo "Unexpected target response [$RSP]"
+		go_out 94
+		;;
+	esac
+done
+
+if [[ $V1 -eq 0 || $V2 -eq 0 ]]; then
+	echo "Expected both targets used, got v1=$V1 v2=$V2"
+	go_out 94
+fi
+
+RSP=`curl -s -H "Authorization: Bearer ADMSECRET" http://localhost:8080/target/metrics`
+
+if [[ "$RSP" != *'restincl_target_requests_total{route="/target/text",svc="TEXTSV2"} '* ]]; then
+	echo "Expected target metrics, got [$RSP]"
+	go_out 94
+fi
+
+# Cached response of one target must not be served for the other
+RSP=`curl -s -H "X-Api-Version: 2" http://localhost:8080/target/cache`
+
+if [[ "X$RSP" != "XHello from EnduroX v2" ]]; then
+	echo "Expected cached v2 response, got [$RSP]"
+	go_out 94
+fi
+
+RSP=`curl -s http://localhost:8080/target/cache`
+
+if [[ "X$RSP" != "XHello from EnduroX" ]]; then
+	echo "Expected default target not from v2 cache, got [$RSP]"
+	go_out 94
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Shadow mirroring"
+###############################################################################
+{
+
+for i in 1 2 3; do
+
+	RSP=`curl -s -d "Hello" http://localhost:8080/mirror/text`
+
+	if [[ "X$RSP" != "XHello from EnduroX" ]]; then
+		echo "Expected main service response, got [$RSP]"
+		go_out 95
+	fi
+done
+
+for i in `seq 1 20`; do
+
+	RSP=`curl -s -d "Hello" http://localhost:8080/mirror/noreply`
+
+	if [[ "X$RSP" != "XHello from EnduroX" ]]; then
+		echo "Expected main service response, got [$RSP]"
+		go_out 95
+	fi
+done
+
+# Let the mirror workers complete
+sleep 1
+
+RSP=`curl -s -H "Authorization: Bearer ADMSECRET" http://localhost:8080/target/metrics`
+
+if [[ "$RSP" != *"restincl_mirror_diff_total 3"* ]]; then
+	echo "Expected 3 mirror differences, got [$RSP]"
+	go_out 95
+fi
+
+SENT=`echo "$RSP" | grep "^restincl_mirror_sent_total " | cut -d " " -f 2`
+
+if [[ "X$SENT" == "X" || $SENT -le 3 || $SENT -ge 23 ]]; then
+	echo "Expected sampled mirror calls, got [$SENT]"
+	go_out 95
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Mock mode"
+###############################################################################
+{
+
+RSP=`curl -s http://localhost:8080/mock/acct/1`
+
+if [[ "X$RSP" != 'X{"id":1, "name":"Demo"}' ]]; then
+	echo "Expected mock by path param, got [$RSP]"
+	go_out 96
+fi
+
+RSP=`curl -s "http://localhost:8080/mock/acct/1?full=y"`
+
+if [[ "X$RSP" != 'X{"id":1, "name":"Demo", "balance":100}' ]]; then
+	echo "Expected mock by query, got [$RSP]"
+	go_out 96
+fi
+
+RSP=`curl -s -i -d '{"type":"card","limit":5}' http://localhost:8080/mock/acct/9`
+
+if [[ "$RSP" != *"201 Created"* || "$RSP" != *"Location: /mock/acct/2"* ||
+	"$RSP" != *'{"id":2,"type":"card"}'* ]]; then
+	echo "Expected mock by body match, got [$RSP]"
+	go_out 96
+fi
+
+START=`date +%s%N`
+RSP=`curl -s -X DELETE http://localhost:8080/mock/acct/3`
+END=`date +%s%N`
+
+if [[ "X$RSP" != "Xdeleted" || $(( (END-START)/1000000 )) -lt 500 ]]; then
+	echo "Expected delayed text mock, got [$RSP]"
+	go_out 96
+fi
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" http://localhost:8080/mock/acct/3`
+
+if [[ "X$RSP" != "X404" ]]; then
+	echo "Expected mock default case 404, got [$RSP]"
+	go_out 96
+fi
+
+# Global mock mode instance (mock=1)
+RSP=`curl -s http://localhost:8082/mock/acct/1`
+
+if [[ "X$RSP" != 'X{"id":1, "name":"Demo"}' ]]; then
+	echo "Expected mock by global mode, got [$RSP]"
+	go_out 96
+fi
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" -d "Hello" http://localhost:8082/mock/text`
+
+if [[ "X$RSP" != "X503" ]]; then
+	echo "Expected 503 for route without fixtures in global mock mode, got [$RSP]"
+	go_out 96
+fi
+
+RSP=`curl -s -H "Authorization: Bearer ADMSECRET" http://localhost:8082/metrics`
+
+if [[ "$RSP" != *"restincl_"* ]]; then
+	echo "Expected built-in route served in global mock mode, got [$RSP]"
+	go_out 96
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Server-Timing"
+###############################################################################
+{
+
+RSP=`curl -s -i -d "Hello" http://localhost:8080/timing/text`
+
+if [[ "$RSP" != *"Server-Timing: wait;dur="*"conv;dur="*"call;dur="*"rsp;dur="*"total;dur="* ]]; then
+	echo "Expected Server-Timing header, got [$RSP]"
+	go_out 97
+fi
+
+RSP=`curl -s -i -d "Hello" http://localhost:8080/text/ok`
+
+if [[ "$RSP" == *"Server-Timing:"* ]]; then
+	echo "Unexpected Server-Timing header, got [$RSP]"
+	go_out 97
+fi
+
+RSP=`curl -s -i -H "X-Server-Timing: 1" -d "Hello" http://127.0.0.1:8080/text/ok`
+
+if [[ "$RSP" != *"Server-Timing: wait;dur="*"call;dur="* ]]; then
+	echo "Expected Server-Timing by debug header, got [$RSP]"
+	go_out 97
+fi
+
+RSP=`curl -s -H "Authorization: Bearer ADMSECRET" http://localhost:8080/target/metrics`
+
+if [[ "$RSP" != *'restincl_phase_count_total{route="/timing/text",phase="call"} 1'* ]]; then
+	echo "Expected phase metrics, got [$RSP]"
+	go_out 97
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Websocket notifications"
+###############################################################################
+{
+wscl "ws://localhost:8080/ws/notify?id=client1" 3 10 > ws1.test.out 2>&1 &
+WS1=$!
+wscl "ws://localhost:8080/ws/notify?id=client2" 1 10 > ws2.test.out 2>&1 &
+WS2=$!
+
+sleep 2
+
+RSP=`curl -s -d '{"EX_CLTID":"client1","T_STRING_FLD":"notify"}' \
+http://localhost:8080/ws/push`
+
+if [[ "$RSP" != *'"EX_IF_ECODE":0'* ]]; then
+	echo "Expected tpnotify ok, got [$RSP]"
+	go_out 98
+fi
+
+# filtered broadcast - for client1 only
+RSP=`curl -s -d '{"EX_CLTID":"client1","T_LONG_FLD":1,"T_STRING_FLD":"bfilter"}' \
+http://localhost:8080/ws/push`
+
+if [[ "$RSP" != *'"EX_IF_ECODE":0'* ]]; then
+	echo "Expected filtered broadcast ok, got [$RSP]"
+	go_out 98
+fi
+
+# prefix broadcast - for all
+RSP=`curl -s -d '{"EX_CLTID":"client*","T_LONG_FLD":1,"T_STRING_FLD":"ball"}' \
+http://localhost:8080/ws/push`
+
+if [[ "$RSP" != *'"EX_IF_ECODE":0'* ]]; then
+	echo "Expected broadcast ok, got [$RSP]"
+	go_out 98
+fi
+
+wait $WS1 $WS2
+
+RSP=`cat ws1.test.out`
+
+if [[ "$RSP" != *'"notify"'*'"bfilter"'*'"ball"'* ]]; then
+	echo "Expected notify and broadcasts for client1, got [$RSP]"
+	go_out 98
+fi
+
+RSP=`cat ws2.test.out`
+
+if [[ "$RSP" == *'"bfilter"'* || "$RSP" != *'"ball"'* ]]; then
+	echo "Expected only prefix broadcast for client2, got [$RSP]"
+	go_out 98
+fi
+
+rm -f ws1.test.out ws2.test.out
+} >> $LOGFILE 2>&1
+
 # go_out alreay doing stop
 #xadmin stop -c -y
 
@@ -0,0 +1,2 @@
+{{- range occs .Data.T_STRING_FLD}}{{csv .}};{{end -}}
+{{printf "%.2f" (num .Data.T_DOUBLE_FLD)}};{{.ErrorCode}}
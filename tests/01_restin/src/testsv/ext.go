@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"strconv"
 	"ubftab"
 
@@ -362,6 +363,36 @@ func INOK(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
 
 }
 
+// DOWNLOADSV service - responds with file ${NDRX_APPHOME}/download/<file>,
+// where file and del (delete after send) are query parameters
+func DOWNLOADSV(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	defer func() {
+		ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+	}()
+
+	occs, _ := ub.BOccur(ubftab.EX_IF_REQQUERYN)
+
+	for i := 0; i < occs; i++ {
+
+		name, _ := ub.BGetString(ubftab.EX_IF_REQQUERYN, i)
+		val, _ := ub.BGetString(ubftab.EX_IF_REQQUERYV, i)
+
+		switch name {
+		case "file":
+			ub.BChg(ubftab.EX_IF_RSPFILEDISK, 0,
+				os.Getenv("NDRX_APPHOME")+"/download/"+val)
+			ub.BChg(ubftab.EX_IF_RSPFILENAME, 0, "report-"+val)
+			ub.BChg(ubftab.EX_IF_RSPFILEMIME, 0, "text/plain")
+		case "del":
+			ub.BChg(ubftab.EX_IF_RSPFILEDEL, 0, val)
+		}
+	}
+}
+
 // IN Fail service
 func INFAIL(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
 	ret := SUCCEED
@@ -195,3 +195,42 @@ func FILEUPLOAD(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
 
 	return
 }
+
+//Reply with SHA-256 checksums of the uploaded files, one per line
+func UPLDSHA(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	var reply string
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	defer func() {
+		ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+	}()
+
+	occs, _ := ub.BOccur(u.EX_IF_REQFILESHA256)
+
+	for i := 0; i < occs; i++ {
+		sum, _ := ub.BGetString(u.EX_IF_REQFILESHA256, i)
+		reply += (sum + "\n")
+	}
+
+	ub.BChg(u.EX_IF_RSPDATA, 0, reply)
+}
+
+//Scan service stand-in, rejects files having "virus" in the name
+func UPLDSCAN(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	fname, _ := ub.BGetString(u.EX_IF_REQFILENAME, 0)
+
+	if strings.Contains(fname, "virus") {
+		ub.BChg(u.EX_IF_EMSG, 0, "infected")
+		ac.TpReturn(atmi.TPFAIL, 0, ub, 0)
+		return
+	}
+
+	ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+}
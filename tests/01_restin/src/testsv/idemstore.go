@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Idempotency store request, record is kept as is
+type IdemStoreReq struct {
+	Operation string          `json:"operation"`
+	Key       string          `json:"key"`
+	Record    json.RawMessage `json:"record,omitempty"`
+}
+
+//Stored record
+type IdemStoreRec struct {
+	Expires int64 `json:"expires"`
+	data    json.RawMessage
+}
+
+var idemRecs = make(map[string]*IdemStoreRec)
+var idemMutex sync.Mutex
+
+//Idempotency store service for restincl 'svc' store, keeps the records in
+//memory
+//@param ac ATMI Context
+//@param svc Service call information
+func IDEMSTORE(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	var req IdemStoreReq
+	var rec IdemStoreRec
+
+	jb, _ := ac.CastToJSON(&svc.Data)
+
+	if jerr := json.Unmarshal(jb.GetJSON(), &req); nil != jerr {
+		ac.TpLogError("Unmarshal: %s", jerr)
+		ac.TpReturn(atmi.TPFAIL, 0, jb, 0)
+		return
+	}
+
+	if len(req.Record) > 0 {
+		if jerr := json.Unmarshal(req.Record, &rec); nil != jerr {
+			ac.TpLogError("Unmarshal record: %s", jerr)
+			ac.TpReturn(atmi.TPFAIL, 0, jb, 0)
+			return
+		}
+		rec.data = req.Record
+	}
+
+	ac.TpLogInfo("Idempotency store %s [%s]", req.Operation, req.Key)
+
+	rsp := []byte("{}")
+
+	idemMutex.Lock()
+
+	switch req.Operation {
+	case "lock":
+		if old, ok := idemRecs[req.Key]; ok && old.Expires > time.Now().Unix() {
+			rsp, _ = json.Marshal(map[string]interface{}{"found": true,
+				"record": old.data})
+		} else {
+			idemRecs[req.Key] = &rec
+		}
+	case "save":
+		idemRecs[req.Key] = &rec
+	case "unlock":
+		delete(idemRecs, req.Key)
+	}
+
+	idemMutex.Unlock()
+
+	if err := jb.SetJSON(rsp); nil != err {
+		ac.TpLogError("Failed to set response: %s", err.Message())
+		ac.TpReturn(atmi.TPFAIL, 0, jb, 0)
+		return
+	}
+
+	ac.TpReturn(atmi.TPSUCCESS, 0, jb, 0)
+}
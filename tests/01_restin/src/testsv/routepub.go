@@ -0,0 +1,23 @@
+package main
+
+import (
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Publish the route to restincl, request is route message
+//@param ac ATMI Context
+//@param svc Service call information
+func ROUTEPUB(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	jb, _ := ac.CastToJSON(&svc.Data)
+
+	ac.TpLogInfo("Publishing route [%s]", jb.GetJSONText())
+
+	if _, err := ac.TpPost("@RESTIN_ROUTE", jb, 0, 0); nil != err {
+		ac.TpLogError("Failed to post route: %s", err.Message())
+		ac.TpReturn(atmi.TPFAIL, 0, jb, 0)
+		return
+	}
+
+	ac.TpReturn(atmi.TPSUCCESS, 0, jb, 0)
+}
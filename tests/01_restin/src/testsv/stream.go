@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	u "ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Add chunk to the checksum
+//@param ac ATMI Context
+//@param buf chunk buffer (CARRAY or UBF with EX_IF_REQDATA)
+//@param h checksum
+//@return number of bytes
+func streamChunk(ac *atmi.ATMICtx, buf atmi.TypedBuffer, h hash.Hash) int {
+
+	var data []byte
+
+	if bb, ok := buf.(*atmi.TypedCarray); ok {
+		data = bb.GetBytes()
+	} else if ub, ok := buf.(*atmi.TypedUBF); ok {
+		data, _ = ub.BGetByteArr(u.EX_IF_REQDATA, 0)
+	}
+
+	h.Write(data)
+	ac.TpLogInfo("Got chunk of %d bytes", len(data))
+
+	return len(data)
+}
+
+//Conversational service receiving the streamed body
+//Responds with "<bytes> <sha256>". UBF mode fails if query "fail" is given.
+//@param ac ATMI Context
+//@param svc Service call information
+func STREAMSV(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	var buf atmi.TypedBuffer
+	var revent int64
+	var itype, subtype string
+
+	h := sha256.New()
+	total := 0
+	fail := false
+
+	if _, err := ac.TpTypes(&svc.Data, &itype, &subtype); nil != err {
+		ac.TpLogError("Failed to get buffer type: %s", err.Message())
+		ac.TpReturn(atmi.TPFAIL, 0, nil, 0)
+		return
+	}
+
+	if "CARRAY" == itype {
+		buf, _ = ac.CastToCarray(&svc.Data)
+	} else {
+		ub, _ := ac.CastToUBF(&svc.Data)
+		ub.TpLogPrintUBF(atmi.LOG_DEBUG, "First chunk")
+
+		if qn, err := ub.BGetString(u.EX_IF_REQQUERYN, 0); nil == err && "fail" == qn {
+			fail = true
+		}
+
+		buf = ub
+	}
+
+	total += streamChunk(ac, buf, h)
+
+	//Receive until restincl passes the control
+	for {
+		err := ac.TpRecv(&svc.Cd, buf, 0, &revent)
+
+		if nil != err {
+
+			if atmi.TPEEVENT == err.Code() && 0 != revent&atmi.TPEV_SENDONLY {
+				total += streamChunk(ac, buf, h)
+				break
+			}
+
+			ac.TpLogError("TpRecv failed: %s (event %d)", err.Message(), revent)
+			ac.TpReturn(atmi.TPFAIL, 0, nil, 0)
+			return
+		}
+
+		total += streamChunk(ac, buf, h)
+	}
+
+	rsp := fmt.Sprintf("%d %x", total, h.Sum(nil))
+
+	ac.TpLogInfo("Stream completed: %s", rsp)
+
+	if bb, ok := buf.(*atmi.TypedCarray); ok {
+		bb.SetBytes([]byte(rsp))
+		ac.TpReturn(atmi.TPSUCCESS, 0, bb, 0)
+		return
+	}
+
+	ub := buf.(*atmi.TypedUBF)
+	ub.BProj([]int{})
+	ub.BChg(u.EX_IF_RSPDATA, 0, rsp)
+
+	if fail {
+		ac.TpReturn(atmi.TPFAIL, 0, ub, 0)
+	} else {
+		ub.BChg(u.EX_NETRCODE, 0, 201)
+		ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+	}
+}
@@ -297,6 +297,26 @@ func LONGOP2(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
 	return
 }
 
+// URCODESV service - returns T_LONG_FLD as user return code, fails if
+// T_STRING_FLD is "FAIL"
+// @param ac ATMI Context
+// @param svc Service call information
+func URCODESV(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	urcode, _ := ub.BGetInt64(u.T_LONG_FLD, 0)
+	string_val, _ := ub.BGetString(u.T_STRING_FLD, 0)
+
+	if "FAIL" == string_val {
+		ac.TpReturn(atmi.TPFAIL, urcode, ub, 0)
+	} else {
+		ac.TpReturn(atmi.TPSUCCESS, urcode, ub, 0)
+	}
+
+	return
+}
+
 // Server init, called when process is booted
 // @param ac ATMI Context
 func Init(ac *atmi.ATMICtx) int {
@@ -433,6 +453,16 @@ func Init(ac *atmi.ATMICtx) int {
 		return atmi.FAIL
 	}
 
+	if err := ac.TpAdvertise("UPLDSHA", "UPLDSHA", UPLDSHA); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("UPLDSCAN", "UPLDSCAN", UPLDSCAN); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
 	if err := ac.TpAdvertise("UPLDERR", "UPLDERR", UPLDERR); err != nil {
 		fmt.Println(err)
 		return atmi.FAIL
@@ -448,6 +478,46 @@ func Init(ac *atmi.ATMICtx) int {
 		return atmi.FAIL
 	}
 
+	if err := ac.TpAdvertise("DOWNLOADSV", "DOWNLOADSV", DOWNLOADSV); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("URCODESV", "URCODESV", URCODESV); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("STREAMSV", "STREAMSV", STREAMSV); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("ROUTEPUB", "ROUTEPUB", ROUTEPUB); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("TEXTSV2", "TEXTSV2", TEXTSV2); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("WSREG", "WSREG", WSREG); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("WSPUSH", "WSPUSH", WSPUSH); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("IDEMSTORE", "IDEMSTORE", IDEMSTORE); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
 	return atmi.SUCCEED
 }
 
@@ -29,3 +29,18 @@ func TEXTSV(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
 
 	return
 }
+
+//Text service, second version for target routing tests
+//@param ac ATMI Context
+//@param svc Service call information
+func TEXTSV2(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	//Get UBF Handler
+	sb, _ := ac.CastToString(&svc.Data)
+
+	ac.TpLogInfo("Got text v2: [%s]", sb.GetString())
+
+	sb.SetString("Hello from EnduroX v2")
+
+	ac.TpReturn(atmi.TPSUCCESS, 0, sb, 0)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	u "ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Websocket client ids (XATMI client ids of notification contexts)
+var wsClients = make(map[string]atmi.TPCLTID)
+var wsMutex sync.Mutex
+
+//Websocket connection registration, remember the caller for tpnotify
+//@param ac ATMI Context
+//@param svc Service call information
+func WSREG(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	id, _ := ub.BGetString(u.EX_CLTID, 0)
+	method, _ := ub.BGetString(u.EX_IF_METHOD, 0)
+
+	ac.TpLogInfo("Websocket client [%s] %s", id, method)
+
+	wsMutex.Lock()
+	if "OPEN" == method {
+		wsClients[id] = svc.Cltid
+	} else {
+		delete(wsClients, id)
+	}
+	wsMutex.Unlock()
+
+	ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+}
+
+//Push message to websocket clients. T_LONG_FLD=1 - broadcast (filtered by
+//EX_CLTID if present), otherwise tpnotify to EX_CLTID client
+//@param ac ATMI Context
+//@param svc Service call information
+func WSPUSH(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	id, _ := ub.BGetString(u.EX_CLTID, 0)
+	bcast, _ := ub.BGetInt(u.T_LONG_FLD, 0)
+
+	var err atmi.ATMIError
+
+	if 1 == bcast {
+		ac.TpLogInfo("Broadcasting to [%s]", id)
+		err = ac.TpBroadcast("", "", "", ub, 0)
+	} else {
+		wsMutex.Lock()
+		cltid, ok := wsClients[id]
+		wsMutex.Unlock()
+
+		if !ok {
+			ac.TpLogError("Websocket client [%s] not registered", id)
+			ac.TpReturn(atmi.TPFAIL, 0, ub, 0)
+			return
+		}
+
+		ac.TpLogInfo("Notifying [%s]", id)
+		err = ac.TpNotify(&cltid, ub, 0)
+	}
+
+	if nil != err {
+		ac.TpLogError("Failed to push: %s", err.Message())
+		ac.TpReturn(atmi.TPFAIL, 0, ub, 0)
+		return
+	}
+
+	ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+}
@@ -0,0 +1,51 @@
+/**
+ * @brief Websocket notification test client - prints received messages
+ *
+ * @file wscl.go
+ */
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//Connect to websocket URL and print messages received, one per line
+//Usage: wscl <url> <number of messages> <timeout seconds>
+func main() {
+
+	if len(os.Args) < 4 {
+		fmt.Fprintf(os.Stderr, "Usage: %s <url> <messages> <timeout>\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	count, _ := strconv.Atoi(os.Args[2])
+	timeout, _ := strconv.Atoi(os.Args[3])
+
+	conn, _, err := websocket.DefaultDialer.Dial(os.Args[1], nil)
+
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Failed to connect: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+
+	for i := 0; i < count; i++ {
+
+		_, msg, err := conn.ReadMessage()
+
+		if nil != err {
+			fmt.Fprintf(os.Stderr, "Failed to read: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		fmt.Println(string(msg))
+	}
+}